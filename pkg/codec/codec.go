@@ -0,0 +1,201 @@
+// Package codec compresses and encrypts the values of samlonfs and the
+// blobs of store before they reach the disk. An encoded value is
+// self-described:
+//
+//	| flags(1) | key id(4) | nonce(12) | payload |
+//
+// The low 4 bits of flags is the compression, the key id and the nonce
+// only exist if the encrypted bit set. The payload is compressed first,
+// then sealed by AES-GCM with the key of the id.
+package codec
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrCorrupted      error = errors.New("codec: value corrupted")
+	ErrUnknownKey     error = errors.New("codec: encryption key not found")
+	ErrNoEncryption   error = errors.New("codec: value encrypted but no key registry")
+	ErrKeyUnavailable error = errors.New("codec: no current encryption key")
+)
+
+type Compression byte
+
+const (
+	NoCompression Compression = iota
+	Snappy
+	Zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Snappy:
+		return "snappy"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+const (
+	compressionMask byte = 0x0f
+	flagEncrypted   byte = 1 << 4
+
+	keyIdSize   int = 4
+	nonceSize   int = 12
+	sealedExtra int = keyIdSize + nonceSize
+)
+
+// Codec is safe for concurrent use.
+type Codec struct {
+	compression Compression
+	keys        *KeyRegistry
+
+	zenc *zstd.Encoder
+	zdec *zstd.Decoder
+}
+
+// New returns a codec compressing the values by compression, and
+// encrypting them by the current key of keys if not nil.
+func New(compression Compression, keys *KeyRegistry) (*Codec, error) {
+	if compression > Zstd {
+		return nil, errors.Errorf("codec: unknown compression %d", compression)
+	}
+	c := &Codec{compression: compression, keys: keys}
+	// the decoders are always ready, the values written by other
+	// compressions before are still readable.
+	var err error
+	if c.zenc, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1)); err != nil {
+		return nil, errors.Wrap(err, "Unable to create zstd encoder")
+	}
+	if c.zdec, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0)); err != nil {
+		return nil, errors.Wrap(err, "Unable to create zstd decoder")
+	}
+	return c, nil
+}
+
+// Enabled tells whether the values written are encoded.
+func (c *Codec) Enabled() bool {
+	return c.compression != NoCompression || c.keys != nil
+}
+
+// Encode encodes value, ad is authenticated with the value but not
+// stored, so the value can't be moved to another one.
+func (c *Codec) Encode(value, ad []byte) ([]byte, error) {
+	compression := c.compression
+	payload := value
+	switch compression {
+	case Snappy:
+		payload = snappy.Encode(nil, value)
+	case Zstd:
+		payload = c.zenc.EncodeAll(value, nil)
+	}
+	if len(payload) >= len(value) {
+		// not worth it
+		compression, payload = NoCompression, value
+	}
+
+	flags := byte(compression)
+	if c.keys == nil {
+		out := make([]byte, 1+len(payload))
+		out[0] = flags
+		copy(out[1:], payload)
+		return out, nil
+	}
+
+	id, aead, err := c.keys.current()
+	if err != nil {
+		return nil, err
+	}
+	flags |= flagEncrypted
+	out := make([]byte, 1+sealedExtra, 1+sealedExtra+len(payload)+aead.Overhead())
+	out[0] = flags
+	binary.BigEndian.PutUint32(out[1:5], id)
+	nonce := out[1+keyIdSize : 1+sealedExtra]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "Unable to generate nonce")
+	}
+	return aead.Seal(out, nonce, payload, additional(out[:1+keyIdSize], ad)), nil
+}
+
+// additional binds the flags and key id to the sealed payload besides ad.
+func additional(head, ad []byte) []byte {
+	return append(append(make([]byte, 0, len(head)+len(ad)), head...), ad...)
+}
+
+// Decode returns the original value, ad must be the one encoded with.
+func (c *Codec) Decode(value, ad []byte) ([]byte, error) {
+	if len(value) < 1 {
+		return nil, ErrCorrupted
+	}
+	flags := value[0]
+	payload := value[1:]
+	if flags&flagEncrypted > 0 {
+		if len(payload) < sealedExtra {
+			return nil, ErrCorrupted
+		}
+		if c.keys == nil {
+			return nil, ErrNoEncryption
+		}
+		id := binary.BigEndian.Uint32(payload[:keyIdSize])
+		aead, err := c.keys.get(id)
+		if err != nil {
+			return nil, err
+		}
+		nonce := payload[keyIdSize:sealedExtra]
+		payload, err = aead.Open(nil, nonce, payload[sealedExtra:], additional(value[:1+keyIdSize], ad))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to open value sealed by key %d", id)
+		}
+	}
+
+	switch Compression(flags & compressionMask) {
+	case NoCompression:
+		return payload, nil
+	case Snappy:
+		out, err := snappy.Decode(nil, payload)
+		if err != nil {
+			return nil, errors.Wrap(ErrCorrupted, err.Error())
+		}
+		return out, nil
+	case Zstd:
+		out, err := c.zdec.DecodeAll(payload, nil)
+		if err != nil {
+			return nil, errors.Wrap(ErrCorrupted, err.Error())
+		}
+		return out, nil
+	}
+	return nil, errors.Wrapf(ErrCorrupted, "unknown compression %d", flags&compressionMask)
+}
+
+// Stale tells whether the encoded value should be encoded again to
+// follow the current key, it's not encrypted while the encryption is
+// enabled, or encrypted by an old key.
+func (c *Codec) Stale(value []byte) bool {
+	if c.keys == nil {
+		return false
+	}
+	if len(value) < 1+keyIdSize || value[0]&flagEncrypted == 0 {
+		return true
+	}
+	id, _, err := c.keys.current()
+	if err != nil {
+		return false
+	}
+	return binary.BigEndian.Uint32(value[1:5]) != id
+}
+
+// Close releases the resources of zstd.
+func (c *Codec) Close() {
+	c.zenc.Close()
+	c.zdec.Close()
+}
@@ -0,0 +1,126 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestCodecCompression(t *testing.T) {
+	value := bytes.Repeat([]byte("2021-06-01 12:00:00 INFO request served "), 100)
+	for _, compression := range []Compression{NoCompression, Snappy, Zstd} {
+		c, err := New(compression, nil)
+		if !assert.Nil(t, err) {
+			return
+		}
+		encoded, err := c.Encode(value, []byte("key"))
+		if !assert.Nil(t, err, compression.String()) {
+			return
+		}
+		if compression != NoCompression {
+			assert.True(t, len(encoded) < len(value)/4, compression.String())
+		}
+		decoded, err := c.Decode(encoded, []byte("key"))
+		if assert.Nil(t, err, compression.String()) {
+			assert.Equal(t, value, decoded)
+		}
+
+		// incompressible values are stored as they are
+		encoded, err = c.Encode([]byte("v"), nil)
+		if assert.Nil(t, err) {
+			assert.Equal(t, []byte{byte(NoCompression), 'v'}, encoded)
+		}
+		c.Close()
+	}
+
+	_, err := New(Compression(9), nil)
+	assert.NotNil(t, err)
+}
+
+func TestCodecEncryption(t *testing.T) {
+	keys := NewKeyRegistry()
+	c, err := New(Zstd, keys)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer c.Close()
+	value := bytes.Repeat([]byte("secret"), 10)
+
+	_, err = c.Encode(value, nil)
+	assert.Equal(t, ErrKeyUnavailable, err)
+	assert.NotNil(t, keys.AddKey(1, []byte("short")))
+
+	assert.Nil(t, keys.Rotate(1, testKey(1)))
+	sealed1, err := c.Encode(value, []byte("key"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.False(t, bytes.Contains(sealed1, []byte("secret")))
+	assert.False(t, c.Stale(sealed1))
+
+	decoded, err := c.Decode(sealed1, []byte("key"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, value, decoded)
+	}
+	// moved to another key
+	_, err = c.Decode(sealed1, []byte("other"))
+	assert.NotNil(t, err)
+	// tampered
+	tampered := append([]byte{}, sealed1...)
+	tampered[len(tampered)-1] ^= 0xff
+	_, err = c.Decode(tampered, []byte("key"))
+	assert.NotNil(t, err)
+
+	// the values sealed by the old key are still readable
+	assert.Nil(t, keys.Rotate(2, testKey(2)))
+	id, ok := keys.Current()
+	assert.True(t, ok)
+	assert.Equal(t, uint32(2), id)
+	assert.True(t, c.Stale(sealed1))
+	sealed2, err := c.Encode(value, []byte("key"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.False(t, c.Stale(sealed2))
+	for _, sealed := range [][]byte{sealed1, sealed2} {
+		decoded, err := c.Decode(sealed, []byte("key"))
+		if assert.Nil(t, err) {
+			assert.Equal(t, value, decoded)
+		}
+	}
+
+	// without the old key
+	others := NewKeyRegistry()
+	assert.Nil(t, others.Rotate(2, testKey(2)))
+	oc, err := New(NoCompression, others)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer oc.Close()
+	_, err = oc.Decode(sealed1, []byte("key"))
+	assert.Equal(t, ErrUnknownKey, errors.Cause(err))
+	decoded, err = oc.Decode(sealed2, []byte("key"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, value, decoded)
+	}
+
+	plain, err := New(Zstd, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer plain.Close()
+	_, err = plain.Decode(sealed2, []byte("key"))
+	assert.Equal(t, ErrNoEncryption, err)
+	// the plain values are encrypted again once the encryption enabled
+	compressed, err := plain.Encode(value, nil)
+	if assert.Nil(t, err) {
+		assert.True(t, c.Stale(compressed))
+		assert.False(t, plain.Stale(compressed))
+	}
+}
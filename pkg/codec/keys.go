@@ -0,0 +1,88 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// KeyRegistry holds the AES keys by id. The values are always sealed by
+// the current key, and opened by the key of the id they were sealed by,
+// so an old key must be kept until no value refers to it any more. The
+// keys are never persisted, they come from the caller every time.
+type KeyRegistry struct {
+	lock       sync.RWMutex
+	keys       map[uint32]cipher.AEAD
+	currentId  uint32
+	hasCurrent bool
+}
+
+func NewKeyRegistry() *KeyRegistry {
+	return &KeyRegistry{keys: make(map[uint32]cipher.AEAD)}
+}
+
+// AddKey registers a key for opening the values sealed by it. The length
+// of key selects AES-128, AES-192 or AES-256.
+func (r *KeyRegistry) AddKey(id uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create cipher of key %d", id)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create gcm of key %d", id)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.keys[id]; ok {
+		return errors.Errorf("codec: key %d registered already", id)
+	}
+	r.keys[id] = aead
+	return nil
+}
+
+// Rotate registers the key if not yet, and seals the values written
+// later by it.
+func (r *KeyRegistry) Rotate(id uint32, key []byte) error {
+	r.lock.RLock()
+	_, ok := r.keys[id]
+	r.lock.RUnlock()
+	if !ok {
+		if err := r.AddKey(id, key); err != nil {
+			return err
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.currentId = id
+	r.hasCurrent = true
+	return nil
+}
+
+// Current returns the id of the key sealing the values.
+func (r *KeyRegistry) Current() (uint32, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.currentId, r.hasCurrent
+}
+
+func (r *KeyRegistry) current() (uint32, cipher.AEAD, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if !r.hasCurrent {
+		return 0, nil, ErrKeyUnavailable
+	}
+	return r.currentId, r.keys[r.currentId], nil
+}
+
+func (r *KeyRegistry) get(id uint32) (cipher.AEAD, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	aead, ok := r.keys[id]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownKey, "key %d", id)
+	}
+	return aead, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+// iotune benchmarks the directory and saves the mountpoint profile of it,
+// loaded by ioqueue.NewIOQueueFromProfile.
+//
+//	iotune -dir /data1 -out /etc/ioqueue/data1.yaml
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/EricYT/go-examples/queue/ioqueue"
+)
+
+func main() {
+	opts := ioqueue.DefaultCalibrateOpts
+	var (
+		dir           string
+		out           string
+		concurrencies string
+	)
+	flag.StringVar(&dir, "dir", "", "the directory on the disk to calibrate")
+	flag.StringVar(&out, "out", "mountpoint.yaml", "the profile saved, in json unless ends with .yaml or .yml")
+	flag.Int64Var(&opts.FileSize, "file-size", opts.FileSize, "the bytes of the file benchmarked")
+	flag.DurationVar(&opts.Duration, "duration", opts.Duration, "the duration of a workload at a concurrency")
+	flag.StringVar(&concurrencies, "concurrencies", "1,4,16,64", "the concurrencies of the workloads")
+	flag.IntVar(&opts.SeqBlockSize, "seq-block-size", opts.SeqBlockSize, "the block size of the sequential workloads")
+	flag.IntVar(&opts.RandBlockSize, "rand-block-size", opts.RandBlockSize, "the block size of the random workloads")
+	flag.Uint64Var(&opts.NumIOQueues, "num-io-queues", opts.NumIOQueues, "the io queues of the mountpoint")
+	flag.BoolVar(&opts.Direct, "direct", opts.Direct, "bypass the page cache by O_DIRECT")
+	flag.Parse()
+
+	if dir == "" {
+		fmt.Fprintln(os.Stderr, "iotune: -dir not specified")
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts.Concurrencies = nil
+	for _, c := range strings.Split(concurrencies, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(c))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "iotune: invalid concurrency %q\n", c)
+			os.Exit(2)
+		}
+		opts.Concurrencies = append(opts.Concurrencies, n)
+	}
+
+	report, err := ioqueue.Calibrate(dir, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "iotune: calibrate %s failed. %v\n", dir, err)
+		os.Exit(1)
+	}
+	if !report.Direct && opts.Direct {
+		fmt.Fprintln(os.Stderr, "iotune: O_DIRECT not supported, the reads may be of the page cache")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "workload\tconcurrency\tbandwidth(B/s)\tiops")
+	for _, res := range report.Results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", res.Workload, res.Concurrency, res.BytesRate, res.ReqRate)
+	}
+	w.Flush()
+
+	if err := report.Mountpoint.Save(out); err != nil {
+		fmt.Fprintf(os.Stderr, "iotune: save profile %s failed. %v\n", out, err)
+		os.Exit(1)
+	}
+	fmt.Printf("mountpoint profile saved to %s\n", out)
+}
@@ -2,6 +2,7 @@ package ioqueue
 
 import (
 	"container/heap"
+	"context"
 	"errors"
 	"math"
 	"sync"
@@ -28,14 +29,33 @@ import (
  When the classes that lag behind start seeing requests, the fair queue will serve
  them first, until balance is restored. This balancing is expected to happen within
  a certain time window that obeys an exponential decay.
+
+ The requests dispatched are executing until their descriptors done, no more
+ dispatched while the weights or the sizes of them executing reach maxReqCount
+ or maxBytesCount.
+
+ The priority classes may be nested, e.g. tenant/workload/operation, only the
+ leaves queue requests. The children of a class share what the class gets
+ by their own shares, a request charges every class on the path from the
+ top to the leaf of it.
+
+ A request queued may be cancelled by Cancel, and the one with its context
+ done is failed instead of dispatched.
 */
 
 var (
 	ErrFairQueueClosed                error = errors.New("fair queue closed")
 	ErrFairQueueEmpty                 error = errors.New("fair queue empty")
 	ErrFairQueuePriorityClassNotFound error = errors.New("fair queue priority class not found")
+	ErrFairQueuePriorityClassNotLeaf  error = errors.New("fair queue priority class has children")
+	ErrFairQueuePriorityClassBusy     error = errors.New("fair queue priority class has requests queued")
+	ErrFairQueuePriorityClassRemoved  error = errors.New("fair queue priority class unregistered")
 )
 
+// the full name of a child class is the one of the parent and its own
+// joined by it.
+const PriorityClassSeparator = "/"
+
 type FairQueueConfig struct {
 	maxReqCount   uint64
 	maxBytesCount uint64
@@ -49,6 +69,13 @@ type FairQueue struct {
 	base       time.Time
 	handles    queue.PriorityQueue
 	allClasses map[string]*PriorityClass
+
+	// the requests dispatched not finished yet
+	requestsExecuting   uint64
+	reqCountExecuting   uint64
+	bytesCountExecuting uint64
+	// signaled once the capacity freed with requests queued
+	readyC chan struct{}
 }
 
 func NewFairQueue(cfg FairQueueConfig, cap int) *FairQueue {
@@ -57,17 +84,23 @@ func NewFairQueue(cfg FairQueueConfig, cap int) *FairQueue {
 		base:       time.Now(),
 		handles:    queue.NewPqueue(cap),
 		allClasses: make(map[string]*PriorityClass),
+		readyC:     make(chan struct{}, 1),
 	}
 }
 
 func (fq *FairQueue) Close() {
+	fq.close(ErrFairQueueClosed)
+}
+
+// close fails the requests queued by err.
+func (fq *FairQueue) close(err error) {
 	fq.mu.Lock()
 	defer fq.mu.Unlock()
 
 	for _, pc := range fq.allClasses {
-		for !pc.Empty() {
+		for !pc.queue.Empty() {
 			req := pc.Dequeue()
-			req.desc.Done(ErrFairQueueClosed)
+			req.desc.Done(err)
 		}
 	}
 	fq.allClasses = nil
@@ -86,13 +119,111 @@ func (fq *FairQueue) RegisterPriorityClass(name string, shares uint32) *Priority
 	return pc
 }
 
+// RegisterChildPriorityClass registers the class under the parent, named
+// parent/name. The parent should have no request queued.
+func (fq *FairQueue) RegisterChildPriorityClass(parent, name string, shares uint32) (*PriorityClass, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	ppc, ok := fq.allClasses[parent]
+	if !ok {
+		return nil, ErrFairQueuePriorityClassNotFound
+	}
+	fullName := parent + PriorityClassSeparator + name
+	if pc, ok := fq.allClasses[fullName]; ok {
+		return pc, nil
+	}
+	if !ppc.Empty() {
+		return nil, ErrFairQueuePriorityClassBusy
+	}
+	pc := NewPriorityClass(fullName, shares)
+	pc.parent = ppc
+	if ppc.children == nil {
+		ppc.children = make(map[string]*PriorityClass)
+		ppc.handles = queue.NewPqueue(4)
+	}
+	ppc.children[fullName] = pc
+	fq.allClasses[fullName] = pc
+
+	return pc, nil
+}
+
+// UnregisterPriorityClass unregisters the class with its children, the
+// requests queued of them failed by ErrFairQueuePriorityClassRemoved.
 func (fq *FairQueue) UnregisterPriorityClass(name string) {
 	fq.mu.Lock()
 	defer fq.mu.Unlock()
-	if _, ok := fq.allClasses[name]; !ok {
+	pc, ok := fq.allClasses[name]
+	if !ok {
 		return
 	}
-	delete(fq.allClasses, name)
+	if pc.Queued() {
+		fq.parentHandles(pc).Remove(pc.Item())
+		pc.SetQueued(false)
+	}
+	failed := fq.unregister(pc)
+	for p := pc.parent; p != nil; p = p.parent {
+		p.stats.Queued -= failed
+		p.stats.Cancelled += uint64(failed)
+		if p.Empty() && p.Queued() {
+			fq.parentHandles(p).Remove(p.Item())
+			p.SetQueued(false)
+		}
+	}
+	if pc.parent != nil {
+		delete(pc.parent.children, name)
+	}
+}
+
+// unregister returns the requests failed of the class and its children.
+func (fq *FairQueue) unregister(pc *PriorityClass) int {
+	var failed int
+	for _, child := range pc.children {
+		failed += fq.unregister(child)
+	}
+	for !pc.queue.Empty() {
+		req := pc.Dequeue()
+		FairQueuePriorityClassCancelledRequestsMetric(pc.name, ErrFairQueuePriorityClassRemoved)
+		req.desc.Done(ErrFairQueuePriorityClassRemoved)
+		failed++
+	}
+	pc.handles = queue.NewPqueue(4)
+	delete(fq.allClasses, pc.name)
+	return failed
+}
+
+// parentHandles returns the heap the class queued in.
+func (fq *FairQueue) parentHandles(pc *PriorityClass) *queue.PriorityQueue {
+	if pc.parent != nil {
+		return &pc.parent.handles
+	}
+	return &fq.handles
+}
+
+// UpdatePriorityClassShares takes effect on the requests dispatched later.
+func (fq *FairQueue) UpdatePriorityClassShares(name string, shares uint32) error {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	pc, ok := fq.allClasses[name]
+	if !ok {
+		return ErrFairQueuePriorityClassNotFound
+	}
+	pc.UpdateShares(shares)
+	return nil
+}
+
+// PriorityClassStats returns the stats of the class, including the ones
+// of its children.
+func (fq *FairQueue) PriorityClassStats(name string) (PriorityClassStats, error) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	pc, ok := fq.allClasses[name]
+	if !ok {
+		return PriorityClassStats{}, ErrFairQueuePriorityClassNotFound
+	}
+	stats := pc.stats
+	stats.Shares = pc.Shares()
+	return stats, nil
 }
 
 func (fq *FairQueue) Size() int {
@@ -119,29 +250,163 @@ func (fq *FairQueue) Enqueue(name string, desc *FairQueueRequestDescriptor) (int
 	if !ok {
 		return -1, ErrFairQueuePriorityClassNotFound
 	}
-	pc.Enqueue(&request{desc: desc})
+	if len(pc.children) > 0 {
+		return -1, ErrFairQueuePriorityClassNotLeaf
+	}
+	desc.pc = pc
+	desc.enqueued = _nowFn()
+	desc.req = &request{desc: desc}
+	pc.Enqueue(desc.req)
+	for p := pc; p != nil; p = p.parent {
+		p.stats.Queued++
+	}
 	fq.pushPriorityClass(pc)
 	return fq.size(), nil
 }
 
+// Dequeue pops the request to dispatch, nil if the capacity exhausted or
+// empty. The request is executing until the descriptor done. The ones of
+// the contexts done are failed on the way.
 func (fq *FairQueue) Dequeue() (*FairQueueRequestDescriptor, bool) {
 	fq.mu.Lock()
 	defer fq.mu.Unlock()
 
-	pc := fq.popPriorityClass()
-	if pc == nil {
-		return nil, true
+	for {
+		if fq.handles.Len() == 0 {
+			return nil, true
+		}
+		if !fq.canDispatch() {
+			// wait Ready
+			return nil, false
+		}
+		if desc := fq.dequeue(); desc != nil {
+			return desc, fq.handles.Len() == 0 // no pc in priority queue
+		}
 	}
+}
 
+// dequeue returns nil if the request popped failed by its context.
+func (fq *FairQueue) dequeue() *FairQueueRequestDescriptor {
+	// the least accumulated at every level down to the leaf
+	var path []*PriorityClass
+	handles := &fq.handles
+	for {
+		pc := fq.popPriorityClass(handles)
+		path = append(path, pc)
+		if pc.handles.Len() == 0 {
+			break
+		}
+		handles = &pc.handles
+	}
+
+	pc := path[len(path)-1]
 	req := pc.Dequeue()
-	nextAccumulated := fq.nextAccumulated(pc, req)
-	pc.SetAccumulated(nextAccumulated)
+	if err := req.desc.contextErr(); err != nil {
+		// not charged
+		for i := len(path) - 1; i >= 0; i-- {
+			pc := path[i]
+			pc.stats.Queued--
+			pc.stats.Cancelled++
+			if !pc.Empty() {
+				fq.pushPriorityClass(pc)
+			}
+		}
+		FairQueuePriorityClassCancelledRequestsMetric(pc.name, err)
+		req.desc.Done(err)
+		return nil
+	}
+
+	req.desc.dispatched = _nowFn()
+	cost := float64(req.desc.Weight)/float64(fq.config.maxReqCount) + float64(req.desc.Size)/float64(fq.config.maxBytesCount)
+	// every class on the path charged before any queued again, the parent
+	// queued by its child pushed with the key of it changed otherwise.
+	for _, pc := range path {
+		pc.SetAccumulated(fq.nextAccumulated(pc, req))
+
+		pc.stats.Queued--
+		pc.stats.Executing++
+		pc.stats.Dispatched++
+		pc.stats.Consumed += cost
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		if pc := path[i]; !pc.Empty() {
+			fq.pushPriorityClass(pc)
+		}
+	}
+
+	fq.requestsExecuting++
+	fq.reqCountExecuting += uint64(req.desc.Weight)
+	fq.bytesCountExecuting += uint64(req.desc.Size)
+	req.desc.fq = fq
+
+	return req.desc
+}
+
+// Cancel removes the request queued and fails it by err, false if it's
+// dispatched or failed already.
+func (fq *FairQueue) Cancel(desc *FairQueueRequestDescriptor, err error) bool {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	if desc.req == nil || !desc.pc.Remove(desc.req) {
+		return false
+	}
+	for pc := desc.pc; pc != nil; pc = pc.parent {
+		pc.stats.Queued--
+		pc.stats.Cancelled++
+		if pc.Empty() && pc.Queued() {
+			fq.parentHandles(pc).Remove(pc.Item())
+			pc.SetQueued(false)
+		}
+	}
+	FairQueuePriorityClassCancelledRequestsMetric(desc.pc.name, err)
+	desc.Done(err)
+	return true
+}
+
+func (fq *FairQueue) canDispatch() bool {
+	return fq.reqCountExecuting < fq.config.maxReqCount &&
+		fq.bytesCountExecuting < fq.config.maxBytesCount
+}
+
+// NotifyRequestFinished releases the capacity taken by the request
+// dispatched, called by the descriptor done.
+func (fq *FairQueue) NotifyRequestFinished(desc *FairQueueRequestDescriptor) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+
+	fq.requestsExecuting--
+	fq.reqCountExecuting -= uint64(desc.Weight)
+	fq.bytesCountExecuting -= uint64(desc.Size)
+
+	now := _nowFn()
+	for pc := desc.pc; pc != nil; pc = pc.parent {
+		pc.stats.Executing--
+		pc.stats.Finished++
+		pc.stats.QueueLatency += desc.dispatched.Sub(desc.enqueued)
+		pc.stats.Latency += now.Sub(desc.enqueued)
+	}
 
-	if !pc.Empty() {
-		fq.pushPriorityClass(pc)
+	if fq.handles.Len() > 0 && fq.canDispatch() {
+		select {
+		case fq.readyC <- struct{}{}:
+		default:
+		}
 	}
+}
 
-	return req.desc, fq.handles.Len() == 0 // no pc in priority queue
+// Ready is signaled once the requests queued can be dispatched again,
+// after Dequeue returns nil with the queue not empty.
+func (fq *FairQueue) Ready() <-chan struct{} {
+	return fq.readyC
+}
+
+// Executing returns the requests dispatched not finished yet, with their
+// weights and sizes.
+func (fq *FairQueue) Executing() (requests, reqCount, bytesCount uint64) {
+	fq.mu.Lock()
+	defer fq.mu.Unlock()
+	return fq.requestsExecuting, fq.reqCountExecuting, fq.bytesCountExecuting
 }
 
 var _nowFn = time.Now
@@ -174,18 +439,17 @@ func (fq *FairQueue) normalizeStats() {
 	}
 }
 
+// pushPriorityClass queues the class into the parent, and the parent
+// into its parent up to the top if not queued yet.
 func (fq *FairQueue) pushPriorityClass(pc *PriorityClass) {
-	if !pc.Queued() {
-		heap.Push(&fq.handles, pc.Item())
+	for ; pc != nil && !pc.Queued(); pc = pc.parent {
+		heap.Push(fq.parentHandles(pc), pc.Item())
 		pc.SetQueued(true)
 	}
 }
 
-func (fq *FairQueue) popPriorityClass() *PriorityClass {
-	if fq.handles.Len() == 0 {
-		return nil
-	}
-	pc := heap.Pop(&fq.handles).(*queue.Item).Value.(*PriorityClass)
+func (fq *FairQueue) popPriorityClass(handles *queue.PriorityQueue) *PriorityClass {
+	pc := heap.Pop(handles).(*queue.Item).Value.(*PriorityClass)
 	pc.SetQueued(false)
 	return pc
 }
@@ -199,6 +463,19 @@ type FairQueueRequestDescriptor struct {
 
 	Weight int
 	Size   int
+
+	// the fair queue dispatched it
+	fq *FairQueue
+	pc *PriorityClass
+	// not nil while queued
+	req *request
+
+	// cancels the request queued, and closed once done
+	ctx   context.Context
+	doneC chan struct{}
+
+	enqueued   time.Time
+	dispatched time.Time
 }
 
 func (desc *FairQueueRequestDescriptor) Do() {
@@ -206,8 +483,22 @@ func (desc *FairQueueRequestDescriptor) Do() {
 }
 
 func (desc *FairQueueRequestDescriptor) Done(err error) {
+	if desc.fq != nil {
+		desc.fq.NotifyRequestFinished(desc)
+		desc.fq = nil
+	}
 	desc.ErrorC <- err
 	close(desc.ErrorC) // in case someone block after calling more than once
+	if desc.doneC != nil {
+		close(desc.doneC)
+	}
+}
+
+func (desc *FairQueueRequestDescriptor) contextErr() error {
+	if desc.ctx == nil {
+		return nil
+	}
+	return desc.ctx.Err()
 }
 
 func (desc *FairQueueRequestDescriptor) RequestSize() int {
@@ -222,6 +513,27 @@ type request struct {
 	desc *FairQueueRequestDescriptor
 }
 
+// PriorityClassStats is the stats of a priority class since registered,
+// the ones of a parent include the children.
+type PriorityClassStats struct {
+	Shares uint32
+	// the requests queued, and dispatched not finished yet
+	Queued    int
+	Executing int
+
+	Dispatched uint64
+	Finished   uint64
+	// the requests cancelled, or of the contexts done before dispatched
+	Cancelled uint64
+	// the cost of the requests dispatched, by the weights and the sizes of
+	// them, not decayed.
+	Consumed float64
+	// the totals of the requests finished, from enqueued to dispatched and
+	// to finished.
+	QueueLatency time.Duration
+	Latency      time.Duration
+}
+
 type PriorityClass struct {
 	mu sync.Mutex
 
@@ -231,6 +543,13 @@ type PriorityClass struct {
 	queued bool
 
 	item *queue.Item
+
+	// the hierarchy and the stats are guarded by the fair queue
+	parent   *PriorityClass
+	children map[string]*PriorityClass
+	// the children queued
+	handles queue.PriorityQueue
+	stats   PriorityClassStats
 }
 
 func NewPriorityClass(name string, shares uint32) *PriorityClass {
@@ -299,11 +618,23 @@ func (pc *PriorityClass) Enqueue(req *request) {
 
 func (pc *PriorityClass) Dequeue() *request {
 	defer FairQueuePriorityClassQueuedRequestsMetric(pc.name, pc.shares, pc.queue.Size())
-	return pc.queue.Dequeue().(*request)
+	req := pc.queue.Dequeue().(*request)
+	req.desc.req = nil
+	return req
+}
+
+func (pc *PriorityClass) Remove(req *request) bool {
+	defer FairQueuePriorityClassQueuedRequestsMetric(pc.name, pc.shares, pc.queue.Size())
+	if !pc.queue.Remove(req) {
+		return false
+	}
+	req.desc.req = nil
+	return true
 }
 
+// Empty returns true if no request queued, in the children neither.
 func (pc *PriorityClass) Empty() bool {
-	return pc.queue.Empty()
+	return pc.queue.Empty() && pc.handles.Len() == 0
 }
 
 func (pc *PriorityClass) Size() int {
@@ -1,6 +1,7 @@
 package ioqueue
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
@@ -49,6 +50,7 @@ func TestFairQueue_Enqueue(t *testing.T) {
 		desc, empty := fq.Dequeue()
 		if desc != nil {
 			desc.Fn()
+			fq.NotifyRequestFinished(desc)
 		}
 		if empty {
 			break
@@ -99,6 +101,69 @@ func TestFairQueue_Close(t *testing.T) {
 	}
 }
 
+func TestFairQueue_Capacity(t *testing.T) {
+	fq := NewFairQueue(FairQueueConfig{maxReqCount: 2, maxBytesCount: 8, tau: 100 * 1000}, 10)
+	fq.RegisterPriorityClass("a", 1)
+
+	var descs []*FairQueueRequestDescriptor
+	for i := 0; i < 4; i++ {
+		desc := &FairQueueRequestDescriptor{Weight: 1, Size: 4, ErrorC: make(chan error, 1)}
+		_, err := fq.Enqueue("a", desc)
+		if !assert.Nil(t, err) {
+			return
+		}
+		descs = append(descs, desc)
+	}
+
+	// held back by the weights executing
+	desc1, _ := fq.Dequeue()
+	desc2, _ := fq.Dequeue()
+	if !assert.Equal(t, descs[:2], []*FairQueueRequestDescriptor{desc1, desc2}) {
+		return
+	}
+	desc, empty := fq.Dequeue()
+	if !assert.Nil(t, desc) || !assert.False(t, empty) {
+		return
+	}
+	requests, reqCount, bytesCount := fq.Executing()
+	if !assert.Equal(t, []uint64{2, 2, 8}, []uint64{requests, reqCount, bytesCount}) {
+		return
+	}
+
+	desc1.Done(nil)
+	select {
+	case <-fq.Ready():
+	default:
+		t.Fatalf("fair queue not ready after request finished")
+	}
+	desc3, _ := fq.Dequeue()
+	if !assert.Equal(t, descs[2], desc3) {
+		return
+	}
+
+	// held back by the sizes executing
+	fq.config.maxReqCount = 10
+	desc, empty = fq.Dequeue()
+	if !assert.Nil(t, desc) || !assert.False(t, empty) {
+		return
+	}
+	desc2.Done(nil)
+	desc3.Done(nil)
+	desc4, empty := fq.Dequeue()
+	if !assert.Equal(t, descs[3], desc4) || !assert.True(t, empty) {
+		return
+	}
+	desc4.Done(ErrFairQueueClosed)
+	if !assert.Equal(t, ErrFairQueueClosed, <-desc4.ErrorC) {
+		return
+	}
+
+	requests, reqCount, bytesCount = fq.Executing()
+	if !assert.Equal(t, []uint64{0, 0, 0}, []uint64{requests, reqCount, bytesCount}) {
+		return
+	}
+}
+
 func TestFairQueue_NormalizeStats(t *testing.T) {
 	start := time.Now()
 
@@ -152,3 +217,315 @@ func BenchmarkFairQueue_Dequeue(b *testing.B) {
 		_, empty = fq.Dequeue()
 	}
 }
+
+// dispatchAll dequeues n requests, each finished once dispatched, returns
+// the requests dispatched of every class.
+func dispatchAll(fq *FairQueue, n int) map[string]int {
+	dispatched := make(map[string]int)
+	for i := 0; i < n; i++ {
+		desc, _ := fq.Dequeue()
+		if desc == nil {
+			break
+		}
+		dispatched[desc.pc.name]++
+		fq.NotifyRequestFinished(desc)
+	}
+	return dispatched
+}
+
+func enqueueN(fq *FairQueue, name string, n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := fq.Enqueue(name, &FairQueueRequestDescriptor{Weight: 1, Size: 1, ErrorC: make(chan error, 1)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFairQueue_Hierarchy(t *testing.T) {
+	fq := NewFairQueue(FairQueueConfig{maxReqCount: 1000, maxBytesCount: 1000, tau: 100 * 1000}, 10)
+	fq.RegisterPriorityClass("a", 100)
+	fq.RegisterPriorityClass("b", 100)
+	_, err := fq.RegisterChildPriorityClass("a", "x", 300)
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = fq.RegisterChildPriorityClass("a", "y", 100)
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = fq.RegisterChildPriorityClass("b", "z", 1)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	for _, name := range []string{"a/x", "a/y", "b/z"} {
+		if !assert.Nil(t, enqueueN(fq, name, 1000)) {
+			return
+		}
+	}
+	if !assert.Equal(t, 3000, fq.Size()) {
+		return
+	}
+
+	// b/z gets the half of b, though of the least shares
+	dispatched := dispatchAll(fq, 800)
+	if !assert.InDelta(t, 400, dispatched["b/z"], 20) {
+		return
+	}
+	if !assert.InDelta(t, 300, dispatched["a/x"], 20) {
+		return
+	}
+	if !assert.InDelta(t, 100, dispatched["a/y"], 20) {
+		return
+	}
+
+	// only the leaves queue requests
+	_, err = fq.Enqueue("a", &FairQueueRequestDescriptor{Weight: 1, Size: 1})
+	if !assert.Equal(t, ErrFairQueuePriorityClassNotLeaf, err) {
+		return
+	}
+	_, err = fq.RegisterChildPriorityClass("a/x", "read", 1)
+	if !assert.Equal(t, ErrFairQueuePriorityClassBusy, err) {
+		return
+	}
+	_, err = fq.RegisterChildPriorityClass("c", "read", 1)
+	if !assert.Equal(t, ErrFairQueuePriorityClassNotFound, err) {
+		return
+	}
+
+	// with the children
+	fq.UnregisterPriorityClass("b")
+	_, err = fq.PriorityClassStats("b/z")
+	if !assert.Equal(t, ErrFairQueuePriorityClassNotFound, err) {
+		return
+	}
+}
+
+func TestFairQueue_UpdateShares(t *testing.T) {
+	fq := NewFairQueue(FairQueueConfig{maxReqCount: 1000, maxBytesCount: 1000, tau: 100 * 1000}, 10)
+	fq.RegisterPriorityClass("a", 100)
+	fq.RegisterPriorityClass("b", 100)
+	for _, name := range []string{"a", "b"} {
+		if !assert.Nil(t, enqueueN(fq, name, 1000)) {
+			return
+		}
+	}
+
+	dispatched := dispatchAll(fq, 200)
+	if !assert.InDelta(t, 100, dispatched["a"], 5) {
+		return
+	}
+
+	if !assert.Nil(t, fq.UpdatePriorityClassShares("a", 300)) {
+		return
+	}
+	dispatched = dispatchAll(fq, 400)
+	if !assert.InDelta(t, 300, dispatched["a"], 20) {
+		return
+	}
+	if !assert.Equal(t, ErrFairQueuePriorityClassNotFound, fq.UpdatePriorityClassShares("c", 1)) {
+		return
+	}
+}
+
+func TestFairQueue_PriorityClassStats(t *testing.T) {
+	fq := NewFairQueue(FairQueueConfig{maxReqCount: 1000, maxBytesCount: 1000, tau: 100 * 1000}, 10)
+	fq.RegisterPriorityClass("tenant", 100)
+	fq.RegisterChildPriorityClass("tenant", "read", 10)
+	fq.RegisterChildPriorityClass("tenant", "write", 10)
+
+	for _, name := range []string{"tenant/read", "tenant/write"} {
+		if !assert.Nil(t, enqueueN(fq, name, 2)) {
+			return
+		}
+	}
+	desc, _ := fq.Dequeue()
+	time.Sleep(time.Millisecond)
+	fq.NotifyRequestFinished(desc)
+	desc, _ = fq.Dequeue()
+
+	leaf, err := fq.PriorityClassStats(desc.pc.name)
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Equal(t, uint32(10), leaf.Shares) || !assert.Equal(t, 1, leaf.Queued) || !assert.Equal(t, 1, leaf.Executing) {
+		return
+	}
+
+	stats, err := fq.PriorityClassStats("tenant")
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Equal(t, uint32(100), stats.Shares) {
+		return
+	}
+	if !assert.Equal(t, 2, stats.Queued) || !assert.Equal(t, 1, stats.Executing) {
+		return
+	}
+	if !assert.Equal(t, uint64(2), stats.Dispatched) || !assert.Equal(t, uint64(1), stats.Finished) {
+		return
+	}
+	if !assert.InDelta(t, 2*(1.0/1000+1.0/1000), stats.Consumed, 1e-9) {
+		return
+	}
+	if !assert.True(t, stats.Latency >= time.Millisecond) || !assert.True(t, stats.QueueLatency <= stats.Latency) {
+		return
+	}
+}
+
+func TestFairQueue_Cancel(t *testing.T) {
+	fq := NewFairQueue(FairQueueConfig{maxReqCount: 1000, maxBytesCount: 1000, tau: 100 * 1000}, 10)
+	fq.RegisterPriorityClass("tenant", 100)
+	fq.RegisterChildPriorityClass("tenant", "read", 10)
+	fq.RegisterPriorityClass("other", 100)
+
+	desc1 := &FairQueueRequestDescriptor{Weight: 1, Size: 1, ErrorC: make(chan error, 1)}
+	desc2 := &FairQueueRequestDescriptor{Weight: 1, Size: 1, ErrorC: make(chan error, 1)}
+	fq.Enqueue("tenant/read", desc1)
+	fq.Enqueue("other", desc2)
+
+	if !assert.True(t, fq.Cancel(desc1, context.Canceled)) {
+		return
+	}
+	if !assert.Equal(t, context.Canceled, <-desc1.ErrorC) {
+		return
+	}
+	if !assert.False(t, fq.Cancel(desc1, context.Canceled)) {
+		return
+	}
+	// the classes emptied are not queued any more
+	if !assert.Equal(t, 1, len(fq.handles)) || !assert.Equal(t, 1, fq.Size()) {
+		return
+	}
+	stats, _ := fq.PriorityClassStats("tenant")
+	if !assert.Equal(t, 0, stats.Queued) || !assert.Equal(t, uint64(1), stats.Cancelled) {
+		return
+	}
+
+	desc, empty := fq.Dequeue()
+	if !assert.Equal(t, desc2, desc) || !assert.True(t, empty) {
+		return
+	}
+	if !assert.False(t, fq.Cancel(desc2, context.Canceled)) {
+		return
+	}
+	desc2.Done(nil)
+	if !assert.Nil(t, <-desc2.ErrorC) {
+		return
+	}
+}
+
+func TestFairQueue_ContextDone(t *testing.T) {
+	fq := NewFairQueue(FairQueueConfig{maxReqCount: 1000, maxBytesCount: 1000, tau: 100 * 1000}, 10)
+	fq.RegisterPriorityClass("a", 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	expired := &FairQueueRequestDescriptor{Weight: 1, Size: 1, ErrorC: make(chan error, 1), ctx: ctx}
+	live := &FairQueueRequestDescriptor{Weight: 1, Size: 1, ErrorC: make(chan error, 1), ctx: context.Background()}
+	fq.Enqueue("a", expired)
+	fq.Enqueue("a", live)
+	<-ctx.Done()
+
+	// failed instead of dispatched
+	desc, empty := fq.Dequeue()
+	if !assert.Equal(t, live, desc) || !assert.True(t, empty) {
+		return
+	}
+	if !assert.Equal(t, context.DeadlineExceeded, <-expired.ErrorC) {
+		return
+	}
+	stats, _ := fq.PriorityClassStats("a")
+	if !assert.Equal(t, uint64(1), stats.Cancelled) || !assert.Equal(t, uint64(1), stats.Dispatched) {
+		return
+	}
+}
+
+func TestFairQueue_HierarchyOrder(t *testing.T) {
+	fq := NewFairQueue(FairQueueConfig{maxReqCount: 1000, maxBytesCount: 1000, tau: 100 * 1000}, 10)
+	for _, name := range []string{"a", "b", "c"} {
+		fq.RegisterPriorityClass(name, 100)
+		if _, err := fq.RegisterChildPriorityClass(name, "x", 100); !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Nil(t, enqueueN(fq, name+"/x", 100)) {
+			return
+		}
+	}
+
+	// the tenants of the same shares served in turn
+	var order []string
+	for i := 0; i < 30; i++ {
+		desc, _ := fq.Dequeue()
+		if !assert.NotNil(t, desc) {
+			return
+		}
+		order = append(order, desc.pc.name)
+		fq.NotifyRequestFinished(desc)
+	}
+	counts := make(map[string]int)
+	for i, name := range order {
+		counts[name]++
+		if i > 0 && !assert.NotEqual(t, order[i-1], name, "dispatched %v", order) {
+			return
+		}
+	}
+	for _, name := range []string{"a/x", "b/x", "c/x"} {
+		if !assert.Equal(t, 10, counts[name], "dispatched %v", order) {
+			return
+		}
+	}
+}
+
+func TestFairQueue_UnregisterQueued(t *testing.T) {
+	fq := NewFairQueue(FairQueueConfig{maxReqCount: 1000, maxBytesCount: 1000, tau: 100 * 1000}, 10)
+	fq.RegisterPriorityClass("a", 100)
+	fq.RegisterPriorityClass("b", 100)
+	for _, name := range []string{"x", "y"} {
+		if _, err := fq.RegisterChildPriorityClass("a", name, 100); !assert.Nil(t, err) {
+			return
+		}
+	}
+
+	var descs []*FairQueueRequestDescriptor
+	for i := 0; i < 3; i++ {
+		desc := &FairQueueRequestDescriptor{Weight: 1, Size: 1, ErrorC: make(chan error, 1)}
+		if _, err := fq.Enqueue("a/x", desc); !assert.Nil(t, err) {
+			return
+		}
+		descs = append(descs, desc)
+	}
+	if !assert.Nil(t, enqueueN(fq, "a/y", 2)) || !assert.Nil(t, enqueueN(fq, "b", 2)) {
+		return
+	}
+
+	// the requests queued failed, not left in the queue forever
+	fq.UnregisterPriorityClass("a/x")
+	for _, desc := range descs {
+		if !assert.Equal(t, ErrFairQueuePriorityClassRemoved, <-desc.ErrorC) {
+			return
+		}
+	}
+	stats, err := fq.PriorityClassStats("a")
+	if !assert.Nil(t, err) || !assert.Equal(t, 2, stats.Queued) || !assert.Equal(t, uint64(3), stats.Cancelled) {
+		return
+	}
+	dispatched := dispatchAll(fq, 10)
+	if !assert.Equal(t, map[string]int{"a/y": 2, "b": 2}, dispatched) {
+		return
+	}
+
+	// the parent dequeued with the last child of it
+	if !assert.Nil(t, enqueueN(fq, "a/y", 2)) {
+		return
+	}
+	fq.UnregisterPriorityClass("a/y")
+	if !assert.Equal(t, 0, fq.handles.Len()) || !assert.False(t, fq.allClasses["a"].Queued()) {
+		return
+	}
+	desc, empty := fq.Dequeue()
+	if !assert.Nil(t, desc) || !assert.True(t, empty) {
+		return
+	}
+}
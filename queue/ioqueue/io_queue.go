@@ -1,6 +1,7 @@
 package ioqueue
 
 import (
+	"context"
 	"errors"
 	"math"
 	"sync"
@@ -18,6 +19,10 @@ type RequestType int
 const (
 	RequestTypeWrite RequestType = iota + 1
 	RequestTypeRead
+	// the ones not moving the data of their sizes
+	RequestTypeSync
+	RequestTypeTruncate
+	RequestTypeFallocate
 
 	/*
 	   // We want to represent the fact that write requests are (maybe) more expensive
@@ -32,6 +37,17 @@ const (
 	ReadRequestBaseCount int = 128
 )
 
+// The costs of the requests not moving data, in write requests. A sync
+// flushes the data written of the file and the journal, a truncate or a
+// fallocate updates the metadata mostly, the bytes allocated by fallocate
+// are counted by FallocateBytesDivisor.
+const (
+	SyncRequestCost       int = 4
+	TruncateRequestCost   int = 1
+	FallocateRequestCost  int = 1
+	FallocateBytesDivisor int = 64
+)
+
 type ioQueueConfig struct {
 	mountpoint                     string
 	diskBytesWriteToReadMultiplier uint64
@@ -51,14 +67,20 @@ func newIOQueueConfig(p Mountpoint) ioQueueConfig {
 
 	maxBandwidth := max(p.ReadBytesRate, p.WriteBytesRate)
 	maxIOPS := max(p.ReadReqRate, p.WriteReqRate)
+	numIOQueues := max(p.NumIOQueues, 1)
 
-	cfg.diskBytesWriteToReadMultiplier = (uint64(ReadRequestBaseCount) * p.ReadBytesRate) / p.WriteBytesRate
-	cfg.diskReqWriteToReadMultiplier = (uint64(ReadRequestBaseCount) * p.ReadReqRate) / p.WriteReqRate
-	if maxBandwidth != math.MaxUint64 {
-		cfg.maxBytesCount = uint64(ReadRequestBaseCount) * (maxBandwidth / p.NumIOQueues)
+	// the rates not known left zero, see Mountpoint.Validate
+	if p.WriteBytesRate != 0 {
+		cfg.diskBytesWriteToReadMultiplier = (uint64(ReadRequestBaseCount) * p.ReadBytesRate) / p.WriteBytesRate
+	}
+	if p.WriteReqRate != 0 {
+		cfg.diskReqWriteToReadMultiplier = (uint64(ReadRequestBaseCount) * p.ReadReqRate) / p.WriteReqRate
+	}
+	if maxBandwidth != math.MaxUint64 && maxBandwidth != 0 {
+		cfg.maxBytesCount = uint64(ReadRequestBaseCount) * (maxBandwidth / numIOQueues)
 	}
-	if maxIOPS != math.MaxUint64 {
-		cfg.maxReqCount = uint64(ReadRequestBaseCount) * (maxIOPS / p.NumIOQueues)
+	if maxIOPS != math.MaxUint64 && maxIOPS != 0 {
+		cfg.maxReqCount = uint64(ReadRequestBaseCount) * (maxIOPS / numIOQueues)
 	}
 	cfg.mountpoint = p.MP
 
@@ -86,14 +108,14 @@ type IOQueue struct {
 	wg      sync.WaitGroup
 	closing bool
 	closeC  chan struct{}
-	signalC chan struct{}
+	signalC chan struct{} // buffered, the signals pending coalesced
 }
 
 func NewIOQueue(mp Mountpoint) *IOQueue {
 	q := &IOQueue{
 		cfg:     newIOQueueConfig(mp),
 		closeC:  make(chan struct{}),
-		signalC: make(chan struct{}),
+		signalC: make(chan struct{}, 1),
 	}
 	q.fq = NewFairQueue(newFairQueueConfig(q.cfg), 128)
 
@@ -109,6 +131,16 @@ func NewIOQueue(mp Mountpoint) *IOQueue {
 	return q
 }
 
+// NewIOQueueFromProfile creates the io queue of the mountpoint profile
+// saved by the iotune command.
+func NewIOQueueFromProfile(path string) (*IOQueue, error) {
+	mp, err := LoadMountpoint(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewIOQueue(mp), nil
+}
+
 func (q *IOQueue) Close() {
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -121,44 +153,103 @@ func (q *IOQueue) Close() {
 		i.done()
 	}
 	q.wg.Wait()
-	q.fq.Close()
+	// the requests not dispatched yet fail as the ones dispatching
+	q.fq.close(ErrIOQueueClosed)
 }
 
 func (q *IOQueue) QueueRequest(pc string, size int, reqType RequestType, fn func()) (IOFuture, error) {
+	return q.QueueRequestContext(context.Background(), pc, size, reqType, fn)
+}
+
+// QueueRequestContext queues the request cancelled by the context, the
+// future of it gets the error of the context if done before dispatched.
+func (q *IOQueue) QueueRequestContext(ctx context.Context, pc string, size int, reqType RequestType, fn func()) (IOFuture, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	des := &FairQueueRequestDescriptor{
 		Fn:      fn,
 		ReqSize: size,
 		ErrorC:  make(chan error, 1),
 	}
-	if reqType == RequestTypeWrite {
-		des.Weight = int(q.cfg.diskReqWriteToReadMultiplier)
-		des.Size = int(q.cfg.diskBytesWriteToReadMultiplier) * size
-	} else {
-		des.Weight = ReadRequestBaseCount
-		des.Size = ReadRequestBaseCount * size
+	if ctx.Done() != nil {
+		des.ctx = ctx
+		des.doneC = make(chan struct{})
 	}
+	des.Typ = reqType
+	des.Weight, des.Size = q.requestCost(reqType, size)
 
 	queueSize, err := q.fq.Enqueue(pc, des) // it's unsafe to request size by another .Size() api
 	if err != nil {
 		return nil, err
 	}
 	QueueRequestMetric(reqType, size)
-	// wake up main loop to consume io request
+	if des.ctx != nil {
+		go q.watchRequest(des)
+	}
+	// wake up main loop to consume io request, never blocked by it
+	// dispatching or stopped
 	if queueSize == 1 {
-		q.signalC <- struct{}{}
+		select {
+		case q.signalC <- struct{}{}:
+		default:
+		}
 	}
 
 	return &ioFuture{errC: des.ErrorC}, nil
 }
 
+// requestCost returns the weight and the size of the request in the unit
+// of the read request.
+func (q *IOQueue) requestCost(reqType RequestType, size int) (weight, bytes int) {
+	writeWeight := int(q.cfg.diskReqWriteToReadMultiplier)
+	switch reqType {
+	case RequestTypeWrite:
+		return writeWeight, int(q.cfg.diskBytesWriteToReadMultiplier) * size
+	case RequestTypeSync:
+		return SyncRequestCost * writeWeight, 0
+	case RequestTypeTruncate:
+		return TruncateRequestCost * writeWeight, 0
+	case RequestTypeFallocate:
+		return FallocateRequestCost * writeWeight, int(q.cfg.diskBytesWriteToReadMultiplier) * size / FallocateBytesDivisor
+	default:
+		return ReadRequestBaseCount, ReadRequestBaseCount * size
+	}
+}
+
+// watchRequest cancels the request queued once the context done, it
+// makes no difference after dispatched.
+func (q *IOQueue) watchRequest(des *FairQueueRequestDescriptor) {
+	select {
+	case <-des.ctx.Done():
+		q.fq.Cancel(des, des.ctx.Err())
+	case <-des.doneC:
+	}
+}
+
 func (q *IOQueue) RegisterPriorityClass(name string, shares uint32) {
 	q.fq.RegisterPriorityClass(name, shares)
 }
 
+// RegisterChildPriorityClass registers the class parent/name, sharing
+// what the parent gets with its siblings.
+func (q *IOQueue) RegisterChildPriorityClass(parent, name string, shares uint32) error {
+	_, err := q.fq.RegisterChildPriorityClass(parent, name, shares)
+	return err
+}
+
 func (q *IOQueue) UnregisterPriorityClass(name string) {
 	q.fq.UnregisterPriorityClass(name)
 }
 
+func (q *IOQueue) UpdatePriorityClassShares(name string, shares uint32) error {
+	return q.fq.UpdatePriorityClassShares(name, shares)
+}
+
+func (q *IOQueue) PriorityClassStats(name string) (PriorityClassStats, error) {
+	return q.fq.PriorityClassStats(name)
+}
+
 func (q *IOQueue) dispatchRequest(req *FairQueueRequestDescriptor) {
 	var err error
 	defer func() {
@@ -197,20 +288,21 @@ func (q *IOQueue) run() {
 	for {
 		select {
 		case <-next:
-
-			req, empty := q.popOneRequest()
-			if req != nil {
-				q.dispatchRequest(req)
-			}
-			if empty {
-				next = q.signalC
-			} else {
-				next = closedC
-			}
-
+		case <-q.fq.Ready():
 		case <-q.closeC:
 			return
 		}
+
+		req, empty := q.popOneRequest()
+		if req != nil {
+			q.dispatchRequest(req)
+		}
+		if empty || req == nil {
+			// nothing queued, or wait the capacity freed
+			next = q.signalC
+		} else {
+			next = closedC
+		}
 	}
 }
 
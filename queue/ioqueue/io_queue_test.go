@@ -1,9 +1,12 @@
 package ioqueue
 
 import (
+	"context"
 	"math"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -66,3 +69,225 @@ func TestIOQueue_DispathchClosed(t *testing.T) {
 		return
 	}
 }
+
+func TestIOQueue_QueueWhileDispatching(t *testing.T) {
+	// no worker, the main loop waits in dispatching
+	q := NewIOQueue(Mountpoint{
+		MP:             "/disk1",
+		ReadBytesRate:  math.MaxUint64,
+		WriteBytesRate: math.MaxUint64,
+		WriteReqRate:   math.MaxUint64,
+		ReadReqRate:    math.MaxUint64,
+		NumIOQueues:    0,
+	})
+	q.RegisterPriorityClass("a", 100)
+
+	first, err := q.QueueRequest("a", 1, RequestTypeRead, func() { t.Fatalf("not reach here") })
+	if !assert.Nil(t, err) {
+		return
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	queuedC := make(chan IOFuture, 1)
+	go func() {
+		fut, err := q.QueueRequest("a", 1, RequestTypeRead, func() { t.Errorf("not reach here") })
+		assert.Nil(t, err)
+		queuedC <- fut
+	}()
+	var second IOFuture
+	select {
+	case second = <-queuedC:
+	case <-time.After(time.Second):
+		t.Fatalf("queueing blocked by dispatching")
+	}
+
+	q.Close()
+	assert.Equal(t, ErrIOQueueClosed, first.Done())
+	assert.Equal(t, ErrIOQueueClosed, second.Done())
+}
+
+func TestIOQueue_Capacity(t *testing.T) {
+	// one read request executing at a time
+	q := NewIOQueue(Mountpoint{
+		MP:             "/disk1",
+		ReadBytesRate:  math.MaxUint64,
+		WriteBytesRate: math.MaxUint64,
+		WriteReqRate:   1,
+		ReadReqRate:    1,
+		NumIOQueues:    4,
+	})
+	defer q.Close()
+	q.cfg.maxReqCount = uint64(ReadRequestBaseCount)
+	q.fq.config.maxReqCount = q.cfg.maxReqCount
+
+	q.RegisterPriorityClass("a", 100)
+
+	var (
+		executing, most int32
+		futs            []IOFuture
+	)
+	for i := 0; i < 20; i++ {
+		fut, err := q.QueueRequest("a", 1, RequestTypeRead, func() {
+			n := atomic.AddInt32(&executing, 1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&executing, -1)
+		})
+		if !assert.Nil(t, err) {
+			return
+		}
+		futs = append(futs, fut)
+	}
+	for _, fut := range futs {
+		if !assert.Nil(t, fut.Done()) {
+			return
+		}
+	}
+	if !assert.Equal(t, int32(1), atomic.LoadInt32(&most)) {
+		return
+	}
+}
+
+func TestIOQueue_PriorityClassHierarchy(t *testing.T) {
+	q := NewIOQueue(Mountpoint{
+		MP:             "/disk1",
+		ReadBytesRate:  1 << 30,
+		WriteBytesRate: 1 << 30,
+		WriteReqRate:   10000,
+		ReadReqRate:    10000,
+		NumIOQueues:    2,
+	})
+	defer q.Close()
+
+	q.RegisterPriorityClass("tenant", 100)
+	if !assert.Nil(t, q.RegisterChildPriorityClass("tenant", "compaction", 10)) {
+		return
+	}
+	if !assert.Equal(t, ErrFairQueuePriorityClassNotFound, q.RegisterChildPriorityClass("nop", "compaction", 10)) {
+		return
+	}
+	if !assert.Nil(t, q.UpdatePriorityClassShares("tenant/compaction", 20)) {
+		return
+	}
+
+	var futs []IOFuture
+	for i := 0; i < 10; i++ {
+		fut, err := q.QueueRequest("tenant/compaction", 4096, RequestTypeRead, func() {})
+		if !assert.Nil(t, err) {
+			return
+		}
+		futs = append(futs, fut)
+	}
+	for _, fut := range futs {
+		if !assert.Nil(t, fut.Done()) {
+			return
+		}
+	}
+
+	stats, err := q.PriorityClassStats("tenant")
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Equal(t, uint64(10), stats.Finished) || !assert.Equal(t, 0, stats.Queued+stats.Executing) {
+		return
+	}
+	stats, err = q.PriorityClassStats("tenant/compaction")
+	if !assert.Nil(t, err) || !assert.Equal(t, uint32(20), stats.Shares) {
+		return
+	}
+}
+
+func TestIOQueue_QueueRequestContext(t *testing.T) {
+	q := NewIOQueue(Mountpoint{
+		MP:             "/disk1",
+		ReadBytesRate:  math.MaxUint64,
+		WriteBytesRate: math.MaxUint64,
+		WriteReqRate:   1,
+		ReadReqRate:    1,
+		NumIOQueues:    1,
+	})
+	defer q.Close()
+	q.RegisterPriorityClass("a", 100)
+
+	// the only worker busy
+	blockC := make(chan struct{})
+	busy, err := q.QueueRequest("a", 1, RequestTypeRead, func() { <-blockC })
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelled, err := q.QueueRequestContext(ctx, "a", 1, RequestTypeRead, func() { t.Fatalf("not reach here") })
+	if !assert.Nil(t, err) {
+		return
+	}
+	tctx, tcancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer tcancel()
+	expired, err := q.QueueRequestContext(tctx, "a", 1, RequestTypeRead, func() { t.Fatalf("not reach here") })
+	if !assert.Nil(t, err) {
+		return
+	}
+	var ran int32
+	live, err := q.QueueRequestContext(context.Background(), "a", 1, RequestTypeRead, func() { atomic.StoreInt32(&ran, 1) })
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	cancel()
+	if !assert.Equal(t, context.Canceled, cancelled.Done()) {
+		return
+	}
+	if !assert.Equal(t, context.DeadlineExceeded, expired.Done()) {
+		return
+	}
+	close(blockC)
+	if !assert.Nil(t, busy.Done()) || !assert.Nil(t, live.Done()) || !assert.Equal(t, int32(1), atomic.LoadInt32(&ran)) {
+		return
+	}
+
+	stats, err := q.PriorityClassStats("a")
+	if !assert.Nil(t, err) || !assert.Equal(t, uint64(2), stats.Cancelled) || !assert.Equal(t, uint64(2), stats.Finished) {
+		return
+	}
+
+	_, err = q.QueueRequestContext(ctx, "a", 1, RequestTypeRead, func() { t.Fatalf("not reach here") })
+	if !assert.Equal(t, context.Canceled, err) {
+		return
+	}
+}
+
+func TestIOQueue_RequestCost(t *testing.T) {
+	q := NewIOQueue(Mountpoint{
+		MP:             "/disk1",
+		ReadBytesRate:  2,
+		WriteBytesRate: 1,
+		WriteReqRate:   1,
+		ReadReqRate:    2,
+		NumIOQueues:    1,
+	})
+	defer q.Close()
+
+	writeWeight := 2 * ReadRequestBaseCount
+	for _, c := range []struct {
+		typ    RequestType
+		weight int
+		size   int
+	}{
+		{RequestTypeRead, ReadRequestBaseCount, ReadRequestBaseCount * 4096},
+		{RequestTypeWrite, writeWeight, 2 * ReadRequestBaseCount * 4096},
+		{RequestTypeSync, SyncRequestCost * writeWeight, 0},
+		{RequestTypeTruncate, TruncateRequestCost * writeWeight, 0},
+		{RequestTypeFallocate, FallocateRequestCost * writeWeight, 2 * ReadRequestBaseCount * 4096 / FallocateBytesDivisor},
+	} {
+		weight, size := q.requestCost(c.typ, 4096)
+		if !assert.Equal(t, c.weight, weight) || !assert.Equal(t, c.size, size) {
+			return
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package ioqueue
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Calibrate measures the rates of the disk like the iotune of seastar, the
+// bandwidths by the sequential reads and writes of large blocks, the iops
+// by the random ones of small blocks, the best of the concurrencies taken.
+
+// the alignment of the buffers and offsets of O_DIRECT
+const directAlign = 4096
+
+type CalibrateOpts struct {
+	// the file benchmarked in the directory, it should be larger than the
+	// page cache if not direct.
+	FileSize int64
+	// of a workload at a concurrency
+	Duration      time.Duration
+	Concurrencies []int
+	SeqBlockSize  int
+	RandBlockSize int
+	NumIOQueues   uint64
+	// bypass the page cache by O_DIRECT, falls back to the page cache if
+	// not supported by the os or the file system.
+	Direct bool
+}
+
+var DefaultCalibrateOpts = CalibrateOpts{
+	FileSize:      1 << 30,
+	Duration:      5 * time.Second,
+	Concurrencies: []int{1, 4, 16, 64},
+	SeqBlockSize:  128 << 10,
+	RandBlockSize: 4 << 10,
+	NumIOQueues:   1,
+	Direct:        true,
+}
+
+type Workload int
+
+const (
+	WorkloadSeqWrite Workload = iota
+	WorkloadSeqRead
+	WorkloadRandWrite
+	WorkloadRandRead
+)
+
+func (w Workload) String() string {
+	switch w {
+	case WorkloadSeqWrite:
+		return "seq-write"
+	case WorkloadSeqRead:
+		return "seq-read"
+	case WorkloadRandWrite:
+		return "rand-write"
+	case WorkloadRandRead:
+		return "rand-read"
+	}
+	return "unknown"
+}
+
+func (w Workload) sequential() bool {
+	return w == WorkloadSeqWrite || w == WorkloadSeqRead
+}
+
+func (w Workload) write() bool {
+	return w == WorkloadSeqWrite || w == WorkloadRandWrite
+}
+
+type CalibrateResult struct {
+	Workload    Workload
+	Concurrency int
+	BytesRate   uint64
+	ReqRate     uint64
+}
+
+type CalibrateReport struct {
+	Mountpoint Mountpoint
+	// false if fell back to the page cache
+	Direct  bool
+	Results []CalibrateResult
+}
+
+func (opts CalibrateOpts) validate() error {
+	if opts.SeqBlockSize <= 0 || opts.RandBlockSize <= 0 {
+		return fmt.Errorf("block sizes %d %d not positive", opts.SeqBlockSize, opts.RandBlockSize)
+	}
+	if opts.Direct && (opts.SeqBlockSize%directAlign != 0 || opts.RandBlockSize%directAlign != 0) {
+		return fmt.Errorf("block sizes %d %d not aligned to %d", opts.SeqBlockSize, opts.RandBlockSize, directAlign)
+	}
+	if opts.FileSize < int64(opts.RandBlockSize) {
+		return fmt.Errorf("file of %d bytes too small for random block of %d", opts.FileSize, opts.RandBlockSize)
+	}
+	if opts.Duration <= 0 || len(opts.Concurrencies) == 0 || opts.NumIOQueues == 0 {
+		return fmt.Errorf("no duration, concurrency or io queue to calibrate")
+	}
+	for _, c := range opts.Concurrencies {
+		if c <= 0 || opts.FileSize/int64(c) < int64(opts.SeqBlockSize) {
+			return fmt.Errorf("file of %d bytes too small for %d sequential workers", opts.FileSize, c)
+		}
+	}
+	return nil
+}
+
+// Calibrate benchmarks the directory, returns the mountpoint of it with
+// the result of every run.
+func Calibrate(dir string, opts CalibrateOpts) (*CalibrateReport, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	fn := filepath.Join(dir, fmt.Sprintf("iotune-%d.tmp", os.Getpid()))
+	defer os.Remove(fn)
+	fd, direct, err := openCalibrateFile(fn, opts.Direct)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	if err := fillCalibrateFile(fd, opts.FileSize, opts.SeqBlockSize); err != nil {
+		return nil, err
+	}
+
+	report := &CalibrateReport{
+		Mountpoint: Mountpoint{MP: dir, NumIOQueues: opts.NumIOQueues},
+		Direct:     direct,
+	}
+	mp := &report.Mountpoint
+	for _, wl := range []Workload{WorkloadSeqWrite, WorkloadSeqRead, WorkloadRandWrite, WorkloadRandRead} {
+		for _, c := range opts.Concurrencies {
+			res, err := runWorkload(fd, wl, c, opts)
+			if err != nil {
+				return nil, fmt.Errorf("%s at concurrency %d: %v", wl, c, err)
+			}
+			report.Results = append(report.Results, res)
+			switch wl {
+			case WorkloadSeqWrite:
+				mp.WriteBytesRate = max(mp.WriteBytesRate, res.BytesRate)
+			case WorkloadSeqRead:
+				mp.ReadBytesRate = max(mp.ReadBytesRate, res.BytesRate)
+			case WorkloadRandWrite:
+				mp.WriteReqRate = max(mp.WriteReqRate, res.ReqRate)
+			case WorkloadRandRead:
+				mp.ReadReqRate = max(mp.ReadReqRate, res.ReqRate)
+			}
+		}
+	}
+	return report, mp.Validate()
+}
+
+// openCalibrateFile opens the file bypassing the page cache if direct, or
+// with the data synced on writing. No O_SYNC, the metadata flushed by it
+// on every write is not the cost of the data.
+func openCalibrateFile(fn string, direct bool) (*os.File, bool, error) {
+	flag := os.O_CREATE | os.O_RDWR
+	if direct && directFlag != 0 {
+		fd, err := os.OpenFile(fn, flag|directFlag, 0640)
+		if err == nil {
+			return fd, true, nil
+		}
+		// FIXME: tmpfs and the like refuse O_DIRECT, the reads measured are
+		// of the page cache then.
+	}
+	fd, err := os.OpenFile(fn, flag|dsyncFlag, 0640)
+	return fd, false, err
+}
+
+func fillCalibrateFile(fd *os.File, size int64, bs int) error {
+	buf := alignedBlock(bs)
+	rand.Read(buf)
+	for off := int64(0); off < size; off += int64(bs) {
+		if _, err := fd.WriteAt(buf, off); err != nil {
+			return err
+		}
+	}
+	return fd.Sync()
+}
+
+// alignedBlock returns the buffer aligned to directAlign.
+func alignedBlock(size int) []byte {
+	buf := make([]byte, size+directAlign)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & (directAlign - 1))
+	if off != 0 {
+		off = directAlign - off
+	}
+	return buf[off : off+size]
+}
+
+func runWorkload(fd *os.File, wl Workload, concurrency int, opts CalibrateOpts) (CalibrateResult, error) {
+	bs := opts.RandBlockSize
+	if wl.sequential() {
+		bs = opts.SeqBlockSize
+	}
+	blocks := opts.FileSize / int64(bs)
+	// the sequential workers walk their own regions
+	region := blocks / int64(concurrency)
+
+	var (
+		wg          sync.WaitGroup
+		bytes, reqs uint64
+		errOnce     sync.Once
+		workloadErr error
+		start       = time.Now()
+		deadline    = start.Add(opts.Duration)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := alignedBlock(bs)
+			rnd := rand.New(rand.NewSource(start.UnixNano() + int64(i)))
+			var block int64
+			for time.Now().Before(deadline) {
+				off := int64(i)*region + block
+				if wl.sequential() {
+					block = (block + 1) % region
+				} else {
+					off = rnd.Int63n(blocks)
+				}
+				var err error
+				if wl.write() {
+					_, err = fd.WriteAt(buf, off*int64(bs))
+				} else {
+					_, err = fd.ReadAt(buf, off*int64(bs))
+				}
+				if err != nil {
+					errOnce.Do(func() { workloadErr = err })
+					return
+				}
+				atomic.AddUint64(&bytes, uint64(bs))
+				atomic.AddUint64(&reqs, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if workloadErr != nil {
+		return CalibrateResult{}, workloadErr
+	}
+
+	elapsed := time.Since(start).Seconds()
+	return CalibrateResult{
+		Workload:    wl,
+		Concurrency: concurrency,
+		BytesRate:   uint64(float64(bytes) / elapsed),
+		ReqRate:     uint64(float64(reqs) / elapsed),
+	}, nil
+}
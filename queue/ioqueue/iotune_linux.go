@@ -0,0 +1,8 @@
+package ioqueue
+
+import "syscall"
+
+const (
+	directFlag = syscall.O_DIRECT
+	dsyncFlag  = syscall.O_DSYNC
+)
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package ioqueue
+
+import "os"
+
+// no O_DIRECT, the page cache measured
+const directFlag = 0
+
+// FIXME: O_DSYNC not portable, the metadata synced on writing too
+const dsyncFlag = os.O_SYNC
@@ -0,0 +1,136 @@
+package ioqueue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalibrate(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_iotune_")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	opts := DefaultCalibrateOpts
+	opts.FileSize = 4 << 20
+	opts.Duration = 20 * time.Millisecond
+	opts.Concurrencies = []int{1, 4}
+	report, err := Calibrate(tmpdir, opts)
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Equal(t, 4*len(opts.Concurrencies), len(report.Results)) {
+		return
+	}
+	if !assert.Nil(t, report.Mountpoint.Validate()) {
+		return
+	}
+	if !assert.Equal(t, tmpdir, report.Mountpoint.MP) {
+		return
+	}
+
+	// the file benchmarked removed
+	files, err := ioutil.ReadDir(tmpdir)
+	if !assert.Nil(t, err) || !assert.Equal(t, 0, len(files)) {
+		return
+	}
+
+	opts.Concurrencies = []int{64}
+	_, err = Calibrate(tmpdir, opts)
+	if !assert.NotNil(t, err) {
+		return
+	}
+}
+
+func TestCalibrate_FileTooSmall(t *testing.T) {
+	opts := DefaultCalibrateOpts
+	opts.Direct = false
+	opts.SeqBlockSize = 1 << 10
+	opts.FileSize = int64(opts.RandBlockSize) - 1
+	opts.Concurrencies = []int{1}
+	err := opts.validate()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "random block")
+	}
+}
+
+func TestMountpoint_SaveLoad(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_iotune_")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	mp := Mountpoint{
+		MP:             "/disk1",
+		ReadBytesRate:  500 << 20,
+		WriteBytesRate: 300 << 20,
+		ReadReqRate:    80000,
+		WriteReqRate:   40000,
+		NumIOQueues:    2,
+	}
+	for _, name := range []string{"disk1.json", "disk1.yaml"} {
+		path := filepath.Join(tmpdir, name)
+		if !assert.Nil(t, mp.Save(path)) {
+			return
+		}
+		loaded, err := LoadMountpoint(path)
+		if !assert.Nil(t, err) || !assert.Equal(t, mp, loaded) {
+			return
+		}
+		q, err := NewIOQueueFromProfile(path)
+		if !assert.Nil(t, err) {
+			return
+		}
+		q.Close()
+	}
+
+	// a zero rate refused
+	invalid := mp
+	invalid.WriteReqRate = 0
+	path := filepath.Join(tmpdir, "invalid.yaml")
+	if !assert.Nil(t, invalid.Save(path)) {
+		return
+	}
+	_, err = LoadMountpoint(path)
+	if !assert.NotNil(t, err) {
+		return
+	}
+	_, err = NewIOQueueFromProfile(path)
+	if !assert.NotNil(t, err) {
+		return
+	}
+
+	// unknown field
+	if !assert.Nil(t, ioutil.WriteFile(path, []byte("mountpoint: /disk1\nread_bandwith: 1\n"), 0644)) {
+		return
+	}
+	_, err = LoadMountpoint(path)
+	if !assert.NotNil(t, err) {
+		return
+	}
+	path = filepath.Join(tmpdir, "invalid.json")
+	if !assert.Nil(t, ioutil.WriteFile(path, []byte(`{"mountpoint": "/disk1", "read_bandwith": 1}`), 0644)) {
+		return
+	}
+	_, err = LoadMountpoint(path)
+	if !assert.NotNil(t, err) {
+		return
+	}
+}
+
+func TestIOQueue_ZeroRates(t *testing.T) {
+	cfg := newIOQueueConfig(Mountpoint{MP: "/disk1", ReadBytesRate: 100, ReadReqRate: 10})
+	if !assert.Equal(t, uint64(ReadRequestBaseCount), cfg.diskBytesWriteToReadMultiplier) {
+		return
+	}
+	if !assert.Equal(t, uint64(ReadRequestBaseCount)*10, cfg.maxReqCount) {
+		return
+	}
+}
@@ -1,6 +1,7 @@
 package ioqueue
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -13,6 +14,7 @@ func init() {
 	prometheus.Register(handlerRequestsDuration)
 	prometheus.Register(fairQueuePriorityClassRequestsTotal)
 	prometheus.Register(fairQueuePriorityClassQueuedRequestsTotal)
+	prometheus.Register(fairQueuePriorityClassCancelledRequestsTotal)
 }
 
 var (
@@ -50,11 +52,21 @@ var (
 		Name:      "priority_class_queued_requests_total",
 		Help:      "The counter of queued requests total of priority class.",
 	}, []string{"class", "shares"})
+
+	fairQueuePriorityClassCancelledRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ioqueue",
+		Subsystem: "fair_queue",
+		Name:      "priority_class_cancelled_requests_total",
+		Help:      "The counter of requests cancelled or expired before dispatched of priority class.",
+	}, []string{"class", "reason"})
 )
 
 const (
-	MethodRead  string = "READ"
-	MethodWrite string = "WRITE"
+	MethodRead      string = "READ"
+	MethodWrite     string = "WRITE"
+	MethodSync      string = "SYNC"
+	MethodTruncate  string = "TRUNCATE"
+	MethodFallocate string = "FALLOCATE"
 )
 
 func convertMethod(typ RequestType) string {
@@ -63,6 +75,12 @@ func convertMethod(typ RequestType) string {
 		return MethodWrite
 	case RequestTypeRead:
 		return MethodRead
+	case RequestTypeSync:
+		return MethodSync
+	case RequestTypeTruncate:
+		return MethodTruncate
+	case RequestTypeFallocate:
+		return MethodFallocate
 	default:
 	}
 	return "UNKNOW"
@@ -118,3 +136,11 @@ func FairQueuePriorityClassRequestsMetric(class string, shares uint32) {
 func FairQueuePriorityClassQueuedRequestsMetric(class string, shares uint32, size int) {
 	fairQueuePriorityClassQueuedRequestsTotal.WithLabelValues(class, fmt.Sprintf("%d", shares)).Set(float64(size))
 }
+
+func FairQueuePriorityClassCancelledRequestsMetric(class string, err error) {
+	reason := "cancelled"
+	if err == context.DeadlineExceeded {
+		reason = "deadline"
+	}
+	fairQueuePriorityClassCancelledRequestsTotal.WithLabelValues(class, reason).Inc()
+}
@@ -1,10 +1,91 @@
 package ioqueue
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Mountpoint is the profile of a disk, the rates are measured by Calibrate
+// or the iotune command.
 type Mountpoint struct {
-	MP             string
-	ReadBytesRate  uint64
-	WriteBytesRate uint64
-	WriteReqRate   uint64
-	ReadReqRate    uint64
-	NumIOQueues    uint64
+	MP             string `json:"mountpoint" yaml:"mountpoint"`
+	ReadBytesRate  uint64 `json:"read_bandwidth" yaml:"read_bandwidth"`
+	WriteBytesRate uint64 `json:"write_bandwidth" yaml:"write_bandwidth"`
+	WriteReqRate   uint64 `json:"write_iops" yaml:"write_iops"`
+	ReadReqRate    uint64 `json:"read_iops" yaml:"read_iops"`
+	NumIOQueues    uint64 `json:"num_io_queues" yaml:"num_io_queues"`
+}
+
+func (p Mountpoint) Validate() error {
+	if p.MP == "" {
+		return fmt.Errorf("mountpoint not specified")
+	}
+	rates := []struct {
+		name string
+		rate uint64
+	}{
+		{"read_bandwidth", p.ReadBytesRate},
+		{"write_bandwidth", p.WriteBytesRate},
+		{"read_iops", p.ReadReqRate},
+		{"write_iops", p.WriteReqRate},
+		{"num_io_queues", p.NumIOQueues},
+	}
+	for _, r := range rates {
+		if r.rate == 0 {
+			return fmt.Errorf("mountpoint %s %s not positive", p.MP, r.name)
+		}
+	}
+	return nil
+}
+
+func isYAML(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// LoadMountpoint loads the profile in yaml if the path ends with .yaml or
+// .yml, otherwise json.
+func LoadMountpoint(path string) (Mountpoint, error) {
+	var p Mountpoint
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if isYAML(path) {
+		err = yaml.UnmarshalStrict(data, &p)
+	} else {
+		// as strict as the yaml
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&p)
+	}
+	if err != nil {
+		return p, fmt.Errorf("unable to decode mountpoint profile %s: %v", path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return p, fmt.Errorf("invalid mountpoint profile %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// Save saves the profile, in yaml or json by the path as LoadMountpoint.
+func (p Mountpoint) Save(path string) error {
+	var (
+		data []byte
+		err  error
+	)
+	if isYAML(path) {
+		data, err = yaml.Marshal(&p)
+	} else {
+		data, err = json.MarshalIndent(&p, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
 }
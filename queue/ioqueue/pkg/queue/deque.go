@@ -74,6 +74,22 @@ func (s *Deque) Pop() interface{} {
 	return item
 }
 
+// Remove removes the element equal to item in a O(n) time complexity,
+// returning false if not found.
+func (s *Deque) Remove(item interface{}) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for e := s.container.Front(); e != nil; e = e.Next() {
+		if e.Value == item {
+			s.container.Remove(e)
+			return true
+		}
+	}
+
+	return false
+}
+
 // Shift removes the first element of the deque in a O(1) time complexity
 func (s *Deque) Shift() interface{} {
 	s.Lock()
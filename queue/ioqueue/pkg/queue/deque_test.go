@@ -387,3 +387,32 @@ func TestDequeFull_non_full_deque(t *testing.T) {
 		"deque.Full() = %t; want %t", deque.Full(), false,
 	)
 }
+
+func TestDequeRemove(t *testing.T) {
+	deque := NewDeque()
+	dequeSize := 10
+
+	for i := 0; i < dequeSize; i++ {
+		deque.Append(strconv.Itoa(i))
+	}
+
+	assertFn(t, deque.Remove("5"), "deque.Remove(\"5\") = false; want true")
+	assertFn(t, !deque.Remove("5"), "deque.Remove(\"5\") = true; want false")
+	assertFn(
+		t,
+		deque.Size() == dequeSize-1,
+		"deque.Size() = %d; want %d", deque.Size(), dequeSize-1,
+	)
+
+	for i := 0; i < dequeSize; i++ {
+		if i == 5 {
+			continue
+		}
+		item := deque.Shift()
+		assertFn(
+			t,
+			item == strconv.Itoa(i),
+			"deque.Shift() = %s; want %s", item, strconv.Itoa(i),
+		)
+	}
+}
@@ -86,3 +86,12 @@ func (pq *PriorityQueue) PeekAndShift(max float64) (*Item, float64) {
 
 	return item, 0
 }
+
+// Remove the item from the queue, returning false if not in it.
+func (pq *PriorityQueue) Remove(item *Item) bool {
+	if item.index < 0 || item.index >= pq.Len() || (*pq)[item.index] != item {
+		return false
+	}
+	heap.Remove(pq, item.index)
+	return true
+}
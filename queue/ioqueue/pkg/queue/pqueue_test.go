@@ -72,3 +72,28 @@ func TestPriorityQueueWithZeroCapacity(t *testing.T) {
 	pq := NewPqueue(0)
 	assert.Equal(t, cap(pq), 1)
 }
+
+func TestRemoveItem(t *testing.T) {
+	c := 10
+	pq := NewPqueue(c)
+
+	items := make([]*Item, 0, c)
+	for i := 0; i < c; i++ {
+		item := &Item{Value: i, Priority: float64(i)}
+		heap.Push(&pq, item)
+		items = append(items, item)
+	}
+
+	assert.True(t, pq.Remove(items[5]))
+	assert.False(t, pq.Remove(items[5]))
+	assert.False(t, pq.Remove(&Item{Value: c}))
+	assert.Equal(t, pq.Len(), c-1)
+
+	for i := 0; i < c; i++ {
+		if i == 5 {
+			continue
+		}
+		item := heap.Pop(&pq)
+		assert.Equal(t, item.(*Item).Value.(int), i)
+	}
+}
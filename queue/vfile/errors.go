@@ -1,6 +1,14 @@
 package vfile
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrVirtualFileClosed error = errors.New("virtual file closed")
+	ErrUnaligned         error = errors.New("virtual file direct io unaligned")
+)
 
 type InvalidFilePath struct {
 	Mountpoint string
@@ -0,0 +1,92 @@
+package vfile
+
+import (
+	"os"
+	"unsafe"
+)
+
+// the alignment of the buffers, the offsets and the lengths of the io of
+// the files opened with O_DIRECT
+const DirectIOAlignment = 4096
+
+// File is the file opened by the virtual file, the io of it queued by the
+// priority class given.
+type File struct {
+	vf     *vFile
+	fh     *os.File
+	direct bool
+}
+
+func (f *File) Name() string {
+	return f.fh.Name()
+}
+
+// Direct reports whether the page cache bypassed.
+func (f *File) Direct() bool {
+	return f.direct
+}
+
+func (f *File) ReadAt(pc string, off int64, buf []byte) (n int, err error) {
+	if err := f.checkAligned(off, buf); err != nil {
+		return -1, err
+	}
+	return f.vf.ReadAt(pc, f.fh, off, buf)
+}
+
+func (f *File) WriteAt(pc string, off int64, buf []byte) (n int, err error) {
+	if err := f.checkAligned(off, buf); err != nil {
+		return -1, err
+	}
+	return f.vf.WriteAt(pc, f.fh, off, buf)
+}
+
+func (f *File) Sync(pc string) error {
+	return f.vf.Sync(pc, f.fh)
+}
+
+func (f *File) Truncate(pc string, size int64) error {
+	return f.vf.Truncate(pc, f.fh, size)
+}
+
+func (f *File) Fallocate(pc string, off, length int64) error {
+	return f.vf.Fallocate(pc, f.fh, off, length)
+}
+
+// Close closes the file, nothing done if closed with the virtual file.
+func (f *File) Close() error {
+	if !f.vf.release(f) {
+		return nil
+	}
+	return f.fh.Close()
+}
+
+func (f *File) checkAligned(off int64, buf []byte) error {
+	if !f.direct {
+		return nil
+	}
+	if !isAligned(off, buf) {
+		return ErrUnaligned
+	}
+	return nil
+}
+
+func isAligned(off int64, buf []byte) bool {
+	if off%DirectIOAlignment != 0 || len(buf)%DirectIOAlignment != 0 {
+		return false
+	}
+	if len(buf) == 0 {
+		return true
+	}
+	return uintptr(unsafe.Pointer(&buf[0]))%DirectIOAlignment == 0
+}
+
+// AlignedBuffer returns the buffer aligned to DirectIOAlignment, the size
+// should be a multiple of it for O_DIRECT.
+func AlignedBuffer(size int) []byte {
+	buf := make([]byte, size+DirectIOAlignment)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & (DirectIOAlignment - 1))
+	if off != 0 {
+		off = DirectIOAlignment - off
+	}
+	return buf[off : off+size]
+}
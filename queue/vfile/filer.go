@@ -0,0 +1,127 @@
+package vfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/EricYT/go-examples/queue/ioqueue"
+)
+
+// vFiler serves the files of several mountpoints, each of them has its own
+// io queue, the file routed to the mountpoint of the longest prefix.
+type vFiler struct {
+	// the longest mountpoint first
+	vfs []*vFile
+}
+
+func NewVirtualFiler(mps ...ioqueue.Mountpoint) (*vFiler, error) {
+	if len(mps) == 0 {
+		return nil, fmt.Errorf("no mountpoint specified")
+	}
+	seen := make(map[string]bool)
+	for _, mp := range mps {
+		info, err := os.Stat(mp.MP)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("mountpoint %s is not a directory", mp.MP)
+		}
+		root, err := filepath.Abs(mp.MP)
+		if err != nil {
+			return nil, err
+		}
+		if seen[root] {
+			return nil, fmt.Errorf("mountpoint %s duplicated", mp.MP)
+		}
+		seen[root] = true
+	}
+
+	fr := &vFiler{}
+	for _, mp := range mps {
+		fr.vfs = append(fr.vfs, NewVirtualFile(mp))
+	}
+	sort.SliceStable(fr.vfs, func(i, j int) bool {
+		return len(fr.vfs[i].root) > len(fr.vfs[j].root)
+	})
+	return fr, nil
+}
+
+func (fr *vFiler) Close() {
+	for _, vf := range fr.vfs {
+		vf.Close()
+	}
+}
+
+// RegisterPriorityClass registers the class on all the mountpoints.
+func (fr *vFiler) RegisterPriorityClass(pc string, shares uint32) {
+	for _, vf := range fr.vfs {
+		vf.RegisterPriorityClass(pc, shares)
+	}
+}
+
+func (fr *vFiler) UnregisterPriorityClass(pc string) {
+	for _, vf := range fr.vfs {
+		vf.UnregisterPriorityClass(pc)
+	}
+}
+
+func (fr *vFiler) Open(name string, flag int, perm os.FileMode) (*File, error) {
+	vf, err := fr.route(name)
+	if err != nil {
+		return nil, err
+	}
+	return vf.Open(name, flag, perm)
+}
+
+func (fr *vFiler) WriteAt(pc string, fh *os.File, off int64, buf []byte) (n int, err error) {
+	vf, err := fr.route(fh.Name())
+	if err != nil {
+		return -1, err
+	}
+	return vf.WriteAt(pc, fh, off, buf)
+}
+
+func (fr *vFiler) ReadAt(pc string, fh *os.File, off int64, buf []byte) (n int, err error) {
+	vf, err := fr.route(fh.Name())
+	if err != nil {
+		return -1, err
+	}
+	return vf.ReadAt(pc, fh, off, buf)
+}
+
+func (fr *vFiler) Sync(pc string, fh *os.File) error {
+	vf, err := fr.route(fh.Name())
+	if err != nil {
+		return err
+	}
+	return vf.Sync(pc, fh)
+}
+
+func (fr *vFiler) Truncate(pc string, fh *os.File, size int64) error {
+	vf, err := fr.route(fh.Name())
+	if err != nil {
+		return err
+	}
+	return vf.Truncate(pc, fh, size)
+}
+
+func (fr *vFiler) Fallocate(pc string, fh *os.File, off, length int64) error {
+	vf, err := fr.route(fh.Name())
+	if err != nil {
+		return err
+	}
+	return vf.Fallocate(pc, fh, off, length)
+}
+
+// route returns the virtual file of the mountpoint the name under.
+func (fr *vFiler) route(name string) (*vFile, error) {
+	for _, vf := range fr.vfs {
+		if vf.validateMountpoint(name) == nil {
+			return vf, nil
+		}
+	}
+	return nil, &InvalidFilePath{Path: name}
+}
@@ -0,0 +1,114 @@
+package vfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/EricYT/go-examples/queue/ioqueue"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMountpoint(dir string) ioqueue.Mountpoint {
+	return ioqueue.Mountpoint{
+		MP:             dir,
+		ReadBytesRate:  1,
+		WriteBytesRate: 1,
+		WriteReqRate:   1,
+		ReadReqRate:    1,
+		NumIOQueues:    1,
+	}
+}
+
+func TestVFiler_Route(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "vfilerdir-")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+	disk1 := filepath.Join(tmpdir, "disk1")
+	disk2 := filepath.Join(disk1, "disk2")
+	if !assert.Nil(t, os.MkdirAll(disk2, 0755)) {
+		return
+	}
+
+	_, err = NewVirtualFiler()
+	if !assert.NotNil(t, err) {
+		return
+	}
+	_, err = NewVirtualFiler(testMountpoint(filepath.Join(tmpdir, "nonexist")))
+	if !assert.NotNil(t, err) {
+		return
+	}
+	_, err = NewVirtualFiler(testMountpoint(disk1), testMountpoint(disk1))
+	if !assert.NotNil(t, err) {
+		return
+	}
+
+	fr, err := NewVirtualFiler(testMountpoint(disk1), testMountpoint(disk2))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer fr.Close()
+	fr.RegisterPriorityClass("class1", 1)
+
+	// not under disk1 though of its prefix
+	disk10 := filepath.Join(tmpdir, "disk10")
+	if !assert.Nil(t, os.MkdirAll(disk10, 0755)) {
+		return
+	}
+	for _, name := range []string{filepath.Join(tmpdir, "file0"), filepath.Join(disk10, "file0")} {
+		_, err = fr.Open(name, os.O_CREATE|os.O_RDWR, 0644)
+		if _, ok := err.(*InvalidFilePath); !assert.True(t, ok, name) {
+			return
+		}
+	}
+	_, err = NewVirtualFiler(testMountpoint(disk1), testMountpoint(disk1+string(os.PathSeparator)))
+	if !assert.NotNil(t, err) {
+		return
+	}
+
+	// the relative path of the working directory
+	wd, err := os.Getwd()
+	if !assert.Nil(t, err) {
+		return
+	}
+	rel, err := filepath.Rel(wd, filepath.Join(disk2, "file2"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	file, err := fr.Open(rel, os.O_CREATE|os.O_RDWR, 0644)
+	if !assert.Nil(t, err) || !assert.Equal(t, disk2, file.vf.root) {
+		return
+	}
+
+	// the longest mountpoint taken
+	for _, c := range []struct {
+		dir string
+		mp  string
+	}{
+		{disk1, disk1},
+		{disk2, disk2},
+	} {
+		file, err := fr.Open(filepath.Join(c.dir, "file1"), os.O_CREATE|os.O_RDWR, 0644)
+		if !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Equal(t, c.mp+string(os.PathSeparator), file.vf.mp.MP) {
+			return
+		}
+		data := []byte("hello,world")
+		n, err := fr.WriteAt("class1", file.fh, 0, data)
+		if !assert.Equal(t, len(data), n) || !assert.Nil(t, err) {
+			return
+		}
+		if !assert.Nil(t, fr.Sync("class1", file.fh)) {
+			return
+		}
+		stats, err := file.vf.queue.PriorityClassStats("class1")
+		if !assert.Nil(t, err) || !assert.Equal(t, uint64(2), stats.Finished) {
+			return
+		}
+	}
+}
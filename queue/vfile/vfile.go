@@ -3,6 +3,7 @@ package vfile
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
@@ -13,18 +14,36 @@ import (
 // userspace io queue.
 
 type VFiler interface {
-	RegisterPriorityClass(name string, shares int)
+	RegisterPriorityClass(name string, shares uint32)
 	UnregisterPriorityClass(name string)
 
+	// Open opens the file owned by the virtual file, closed with it.
+	Open(name string, flag int, perm os.FileMode) (*File, error)
+
 	WriteAt(pc string, fh *os.File, off int64, buf []byte) (n int, err error)
-	ReadAt(pc, fh *os.File, off int64, buf []byte) (n int, err error)
+	ReadAt(pc string, fh *os.File, off int64, buf []byte) (n int, err error)
+	Sync(pc string, fh *os.File) error
+	Truncate(pc string, fh *os.File, size int64) error
+	Fallocate(pc string, fh *os.File, off, length int64) error
+
+	Close()
 }
 
+var (
+	_ VFiler = (*vFile)(nil)
+	_ VFiler = (*vFiler)(nil)
+)
+
 type vFile struct {
 	sync.Mutex
 
-	mp    ioqueue.Mountpoint
+	mp ioqueue.Mountpoint
+	// the mountpoint absolute and cleaned, the paths matched against
+	root  string
 	queue *ioqueue.IOQueue
+
+	closed bool
+	files  map[*File]struct{}
 }
 
 func NewVirtualFile(mp ioqueue.Mountpoint) *vFile {
@@ -36,6 +55,10 @@ func NewVirtualFile(mp ioqueue.Mountpoint) *vFile {
 	if !info.IsDir() {
 		panic(fmt.Sprintf("mountpoint %s is not a directory.", mp.MP))
 	}
+	root, err := filepath.Abs(mp.MP)
+	if err != nil {
+		panic(err)
+	}
 
 	// add path separator in mountpoint
 	mountpoint := []byte(mp.MP)
@@ -44,7 +67,9 @@ func NewVirtualFile(mp ioqueue.Mountpoint) *vFile {
 	}
 	vf := &vFile{
 		mp:    mp,
+		root:  root,
 		queue: ioqueue.NewIOQueue(mp),
+		files: make(map[*File]struct{}),
 	}
 	return vf
 }
@@ -52,7 +77,54 @@ func NewVirtualFile(mp ioqueue.Mountpoint) *vFile {
 func (f *vFile) Close() {
 	f.Lock()
 	defer f.Unlock()
+	f.closed = true
+	// the files opened closed behind the io queued
 	f.queue.Close()
+	for file := range f.files {
+		file.fh.Close()
+	}
+	f.files = make(map[*File]struct{})
+}
+
+func (f *vFile) Open(name string, flag int, perm os.FileMode) (*File, error) {
+	if err := f.validateMountpoint(name); err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if f.closed {
+		return nil, ErrVirtualFileClosed
+	}
+	fh, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	file := &File{
+		vf:     f,
+		fh:     fh,
+		direct: O_DIRECT != 0 && flag&O_DIRECT != 0,
+	}
+	f.files[file] = struct{}{}
+	return file, nil
+}
+
+// release returns false if the file closed already, by the virtual file
+// closed maybe.
+func (f *vFile) release(file *File) bool {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.files[file]; !ok {
+		return false
+	}
+	delete(f.files, file)
+	return true
+}
+
+func (f *vFile) isClosed() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.closed
 }
 
 func (f *vFile) RegisterPriorityClass(pc string, shares uint32) {
@@ -71,13 +143,9 @@ func (f *vFile) WriteAt(pc string, fh *os.File, off int64, buf []byte) (n int, e
 	writeFn := func() {
 		n, err = fh.WriteAt(buf, off)
 	}
-	fut, errq := f.queue.QueueRequest(pc, len(buf), ioqueue.RequestTypeWrite, writeFn)
-	if errq != nil {
+	if errq := f.queueRequest(pc, len(buf), ioqueue.RequestTypeWrite, writeFn); errq != nil {
 		return -1, errq
 	}
-	if ferr := fut.Done(); ferr != nil {
-		return -1, ferr
-	}
 	return n, err
 }
 
@@ -89,19 +157,75 @@ func (f *vFile) ReadAt(pc string, fh *os.File, off int64, buf []byte) (n int, er
 	readFn := func() {
 		n, err = fh.ReadAt(buf, off)
 	}
-	fut, errq := f.queue.QueueRequest(pc, len(buf), ioqueue.RequestTypeRead, readFn)
-	if errq != nil {
+	if errq := f.queueRequest(pc, len(buf), ioqueue.RequestTypeRead, readFn); errq != nil {
 		return -1, errq
 	}
-	if ferr := fut.Done(); ferr != nil {
-		return -1, ferr
-	}
 	return n, err
 }
 
+func (f *vFile) Sync(pc string, fh *os.File) error {
+	return f.do(pc, fh, 0, ioqueue.RequestTypeSync, fh.Sync)
+}
+
+func (f *vFile) Truncate(pc string, fh *os.File, size int64) error {
+	return f.do(pc, fh, 0, ioqueue.RequestTypeTruncate, func() error {
+		return fh.Truncate(size)
+	})
+}
+
+// Fallocate allocates the blocks of the range, the file extended if the
+// range beyond the end of it.
+func (f *vFile) Fallocate(pc string, fh *os.File, off, length int64) error {
+	return f.do(pc, fh, int(length), ioqueue.RequestTypeFallocate, func() error {
+		return fallocate(fh, off, length)
+	})
+}
+
+// do queues the request moving no data.
+func (f *vFile) do(pc string, fh *os.File, size int, reqType ioqueue.RequestType, fn func() error) (err error) {
+	if err := f.validateMountpoint(fh.Name()); err != nil {
+		return err
+	}
+
+	if errq := f.queueRequest(pc, size, reqType, func() { err = fn() }); errq != nil {
+		return errq
+	}
+	return err
+}
+
+// queueRequest queues the request and waits it done, ErrVirtualFileClosed
+// if closed before or meanwhile.
+func (f *vFile) queueRequest(pc string, size int, reqType ioqueue.RequestType, fn func()) error {
+	if f.isClosed() {
+		return ErrVirtualFileClosed
+	}
+	fut, err := f.queue.QueueRequest(pc, size, reqType, fn)
+	if err == nil {
+		err = fut.Done()
+	}
+	if err != nil && f.isClosed() {
+		return ErrVirtualFileClosed
+	}
+	return err
+}
+
+// validateMountpoint checks the path is under the mountpoint by the path
+// components, the relative one is of the working directory.
 func (f *vFile) validateMountpoint(name string) error {
-	if strings.HasPrefix(name, f.mp.MP) {
+	if p, err := filepath.Abs(name); err == nil && underDir(f.root, p) {
 		return nil
 	}
 	return &InvalidFilePath{Mountpoint: f.mp.MP, Path: name}
 }
+
+// underDir reports whether the path is the dir or in it, both cleaned.
+func underDir(dir, p string) bool {
+	if p == dir {
+		return true
+	}
+	// the root ends with the separator already
+	if !os.IsPathSeparator(dir[len(dir)-1]) {
+		dir += string(os.PathSeparator)
+	}
+	return strings.HasPrefix(p, dir)
+}
@@ -0,0 +1,14 @@
+package vfile
+
+import (
+	"os"
+	"syscall"
+)
+
+// O_DIRECT opens the file bypassing the page cache, the buffers and the
+// offsets of the io must be aligned to DirectIOAlignment.
+const O_DIRECT = syscall.O_DIRECT
+
+func fallocate(fh *os.File, off, length int64) error {
+	return syscall.Fallocate(int(fh.Fd()), 0, off, length)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package vfile
+
+import "os"
+
+// no O_DIRECT, the io goes through the page cache
+const O_DIRECT = 0
+
+// FIXME: the blocks are not allocated, the file extended only.
+func fallocate(fh *os.File, off, length int64) error {
+	info, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	if off+length > info.Size() {
+		return fh.Truncate(off + length)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package vfile
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -116,3 +117,161 @@ func TestVFile_Read_Write_At(t *testing.T) {
 		return
 	}
 }
+
+func newTestVirtualFile(t *testing.T) (*vFile, string) {
+	tmpdir, err := ioutil.TempDir("", "vfiledir-")
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	vf := NewVirtualFile(ioqueue.Mountpoint{
+		MP:             tmpdir,
+		ReadBytesRate:  1,
+		WriteBytesRate: 1,
+		WriteReqRate:   1,
+		ReadReqRate:    1,
+		NumIOQueues:    1,
+	})
+	vf.RegisterPriorityClass("class1", 1)
+	return vf, tmpdir
+}
+
+func TestVFile_Open(t *testing.T) {
+	vf, tmpdir := newTestVirtualFile(t)
+	defer os.RemoveAll(tmpdir)
+
+	_, err := vf.Open("/tmp1/c", os.O_CREATE|os.O_RDWR, 0644)
+	if _, ok := err.(*InvalidFilePath); !assert.True(t, ok) {
+		return
+	}
+
+	file, err := vf.Open(filepath.Join(tmpdir, "file1"), os.O_CREATE|os.O_RDWR, 0644)
+	if !assert.Nil(t, err) {
+		return
+	}
+	data := []byte("hello,world")
+	n, err := file.WriteAt("class1", 0, data)
+	if !assert.Equal(t, len(data), n) || !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Nil(t, file.Sync("class1")) {
+		return
+	}
+	if !assert.Equal(t, ioqueue.ErrFairQueuePriorityClassNotFound, file.Sync("class2")) {
+		return
+	}
+	rdata := make([]byte, len(data))
+	n, err = file.ReadAt("class1", 0, rdata)
+	if !assert.Equal(t, len(data), n) || !assert.Equal(t, data, rdata) {
+		return
+	}
+	if !assert.Nil(t, file.Close()) || !assert.Equal(t, 0, len(vf.files)) {
+		return
+	}
+
+	// the files opened closed with the virtual file
+	file, err = vf.Open(filepath.Join(tmpdir, "file1"), os.O_RDWR, 0644)
+	if !assert.Nil(t, err) || !assert.Equal(t, 1, len(vf.files)) {
+		return
+	}
+	vf.Close()
+	_, err = file.fh.Stat()
+	if !assert.NotNil(t, err) {
+		return
+	}
+	_, err = vf.Open(filepath.Join(tmpdir, "file1"), os.O_RDWR, 0644)
+	if !assert.Equal(t, ErrVirtualFileClosed, err) {
+		return
+	}
+	n, err = file.ReadAt("class1", 0, rdata)
+	if !assert.Equal(t, -1, n) || !assert.Equal(t, ErrVirtualFileClosed, err) {
+		return
+	}
+	n, err = file.WriteAt("class1", 0, data)
+	if !assert.Equal(t, -1, n) || !assert.Equal(t, ErrVirtualFileClosed, err) {
+		return
+	}
+	if !assert.Equal(t, ErrVirtualFileClosed, file.Sync("class1")) {
+		return
+	}
+	// closed by the virtual file already
+	if !assert.Nil(t, file.Close()) || !assert.Nil(t, file.Close()) {
+		return
+	}
+}
+
+func TestVFile_Truncate_Fallocate(t *testing.T) {
+	vf, tmpdir := newTestVirtualFile(t)
+	defer os.RemoveAll(tmpdir)
+	defer vf.Close()
+
+	file, err := vf.Open(filepath.Join(tmpdir, "file1"), os.O_CREATE|os.O_RDWR, 0644)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	if !assert.Nil(t, file.Fallocate("class1", 0, 1<<20)) {
+		return
+	}
+	info, err := os.Stat(file.Name())
+	if !assert.Nil(t, err) || !assert.Equal(t, int64(1<<20), info.Size()) {
+		return
+	}
+
+	if !assert.Nil(t, file.Truncate("class1", 100)) {
+		return
+	}
+	info, err = os.Stat(file.Name())
+	if !assert.Nil(t, err) || !assert.Equal(t, int64(100), info.Size()) {
+		return
+	}
+
+	stats, err := vf.queue.PriorityClassStats("class1")
+	if !assert.Nil(t, err) || !assert.Equal(t, uint64(2), stats.Finished) {
+		return
+	}
+}
+
+func TestVFile_Direct(t *testing.T) {
+	if !assert.True(t, isAligned(0, AlignedBuffer(DirectIOAlignment))) {
+		return
+	}
+	if !assert.False(t, isAligned(1, AlignedBuffer(DirectIOAlignment))) {
+		return
+	}
+	if !assert.False(t, isAligned(0, AlignedBuffer(DirectIOAlignment + 1)[1:])) {
+		return
+	}
+	if O_DIRECT == 0 {
+		t.Skip("O_DIRECT not supported")
+	}
+
+	vf, tmpdir := newTestVirtualFile(t)
+	defer os.RemoveAll(tmpdir)
+	defer vf.Close()
+
+	file, err := vf.Open(filepath.Join(tmpdir, "file1"), os.O_CREATE|os.O_RDWR|O_DIRECT, 0644)
+	if err != nil {
+		// tmpfs and the like refuse O_DIRECT
+		t.Skipf("O_DIRECT refused. %v", err)
+	}
+	if !assert.True(t, file.Direct()) {
+		return
+	}
+
+	_, err = file.WriteAt("class1", 0, []byte("hello,world"))
+	if !assert.Equal(t, ErrUnaligned, err) {
+		return
+	}
+
+	data := AlignedBuffer(DirectIOAlignment)
+	copy(data, "hello,world")
+	n, err := file.WriteAt("class1", DirectIOAlignment, data)
+	if !assert.Equal(t, len(data), n) || !assert.Nil(t, err) {
+		return
+	}
+	rdata := AlignedBuffer(DirectIOAlignment)
+	n, err = file.ReadAt("class1", DirectIOAlignment, rdata)
+	if !assert.Equal(t, len(data), n) || !assert.Equal(t, data, rdata) {
+		return
+	}
+}
@@ -0,0 +1,278 @@
+package samlonfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// The backup stream is a sequence of entries encoded by encodeEntry, so
+// every record is protected by crc32. The records are told apart by the
+// meta bits below, which only appear in the backup stream.
+//
+// | header | entry ... | key ... | end |
+//
+// The header entry carries the magic key and the version backup since.
+// The key records list the live keys not sent in an incremental backup,
+// so the keys deleted since then are removed when loading. The end entry
+// carries the number of records before it and the version of snapshot.
+// The values are decoded in the stream, and encoded by the codec of the
+// store loading them.
+const (
+	bitBackupHeader byte = 1 << 4
+	bitBackupKey    byte = 1 << 5
+	bitBackupEnd    byte = 1 << 6
+
+	backupStreamVersion byte = 1
+	backupLoadBatchSize int  = 64
+	// the keys read from a snapshot by Backup
+	backupReadBatchSize int = 1024
+)
+
+var (
+	backupMagic []byte = []byte("samlon-backup")
+)
+
+var (
+	ErrBackupCorrupted error = errors.New("backup stream corrupted")
+	ErrLoadNotEmpty    error = errors.New("full backup must be loaded into an empty samlon")
+)
+
+// valueVersion tells the order of the values written, the later the
+// bigger. It's the end position of the value in the value log.
+func valueVersion(vp valuePointer) uint64 {
+	return uint64(vp.Fid)<<32 | uint64(vp.Offset+vp.Len)
+}
+
+// Backup streams all the live keys into w, or the keys changed since the
+// version returned by a previous backup. The writers keep going during the
+// backup.
+//
+// The keys are read in batches, each from a new snapshot, so no snapshot
+// blocks the gc and the meta store writers for the whole backup. It returns
+// the version of the first snapshot, the keys written later in the ranges
+// read already are sent by the next incremental backup.
+func (s *Samlon) Backup(w io.Writer, since uint64) (uint64, error) {
+	it, err := s.NewIterator(IteratorOptions{PrefetchValues: true})
+	if err != nil {
+		return 0, err
+	}
+	defer func() { it.Close() }()
+
+	head, err := it.snapshot.Head()
+	if err != nil {
+		return 0, err
+	}
+	version := valueVersion(head)
+
+	bw := bufio.NewWriter(w)
+	var buf bytes.Buffer
+	var records uint64
+	write := func(e *Entry) error {
+		buf.Reset()
+		if _, err := encodeEntry(e, &buf); err != nil {
+			return err
+		}
+		records++
+		_, err := bw.Write(buf.Bytes())
+		return err
+	}
+
+	hbuf := make([]byte, 9)
+	hbuf[0] = backupStreamVersion
+	binary.BigEndian.PutUint64(hbuf[1:9], since)
+	if err := write(&Entry{Key: backupMagic, Value: hbuf, meta: bitBackupHeader}); err != nil {
+		return 0, errors.Wrap(err, "Unable to write backup header")
+	}
+
+	var (
+		keys [][]byte
+		last []byte
+	)
+	it.Rewind()
+	for {
+		for n := 0; it.Valid() && n < backupReadBatchSize; it.Next() {
+			item := it.Item()
+			last = item.Key()
+			n++
+			// the ones moved by gc or written after the first snapshot
+			// sent again by the next incremental backup
+			if since > 0 && valueVersion(item.vp) <= since {
+				keys = append(keys, item.Key())
+				continue
+			}
+
+			value, err := item.Value()
+			if err != nil {
+				return 0, err
+			}
+			e := &Entry{
+				Key:       item.Key(),
+				Value:     value,
+				UserMeta:  item.UserMeta(),
+				ExpiresAt: item.expiresAt,
+			}
+			if err := write(e); err != nil {
+				return 0, errors.Wrapf(err, "Unable to write backup entry %q", item.Key())
+			}
+		}
+		if !it.Valid() {
+			break
+		}
+
+		// the next batch from a new snapshot, after the last key read
+		if err := it.Close(); err != nil {
+			return 0, err
+		}
+		if it, err = s.NewIterator(IteratorOptions{PrefetchValues: true}); err != nil {
+			return 0, err
+		}
+		it.Seek(last)
+		if it.Valid() && bytes.Equal(it.Item().Key(), last) {
+			it.Next()
+		}
+	}
+	for _, key := range keys {
+		if err := write(&Entry{Key: key, meta: bitBackupKey}); err != nil {
+			return 0, errors.Wrapf(err, "Unable to write backup key %q", key)
+		}
+	}
+
+	end := make([]byte, 16)
+	binary.BigEndian.PutUint64(end[0:8], records)
+	binary.BigEndian.PutUint64(end[8:16], version)
+	if err := write(&Entry{Key: backupMagic, Value: end, meta: bitBackupEnd}); err != nil {
+		return 0, errors.Wrap(err, "Unable to write backup end")
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, errors.Wrap(err, "Unable to flush backup")
+	}
+	return version, nil
+}
+
+// Load restores a backup stream. A full backup must be loaded into an
+// empty samlon, the incremental ones are loaded on top of it in order.
+func (s *Samlon) Load(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	read := &safeRead{}
+
+	e, err := read.Entry(reader)
+	if err != nil {
+		return errors.Wrap(err, "Unable to read backup header")
+	}
+	if e.meta&bitBackupHeader == 0 || !bytes.Equal(e.Key, backupMagic) ||
+		len(e.Value) != 9 || e.Value[0] != backupStreamVersion {
+		return ErrBackupCorrupted
+	}
+	since := binary.BigEndian.Uint64(e.Value[1:9])
+	if since == 0 {
+		empty, err := s.isEmpty()
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return ErrLoadNotEmpty
+		}
+	}
+
+	var ents []*Entry
+	flush := func() error {
+		if len(ents) == 0 {
+			return nil
+		}
+		req, err := s.sendToWriteCh(ents)
+		if err != nil {
+			return err
+		}
+		ents = nil
+		return req.Wait()
+	}
+
+	records := uint64(1)
+	live := make(map[string]struct{})
+	for {
+		e, err := read.Entry(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.Wrap(ErrBackupCorrupted, "backup stream truncated")
+		}
+		if err != nil {
+			return errors.Wrap(err, "Unable to read backup record")
+		}
+
+		if e.meta&bitBackupEnd > 0 {
+			if len(e.Value) != 16 || binary.BigEndian.Uint64(e.Value[0:8]) != records {
+				return errors.Wrap(ErrBackupCorrupted, "backup records missing")
+			}
+			break
+		}
+		records++
+
+		// the entry buffer is reused by reading
+		key := append([]byte{}, e.Key...)
+		live[string(key)] = struct{}{}
+		if e.meta&bitBackupKey > 0 {
+			continue
+		}
+		ents = append(ents, &Entry{
+			Key:       key,
+			Value:     append([]byte{}, e.Value...),
+			UserMeta:  e.UserMeta,
+			ExpiresAt: e.ExpiresAt,
+		})
+		if len(ents) >= backupLoadBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if since == 0 {
+		return nil
+	}
+
+	// the keys not listed have been deleted since the last backup
+	it, err := s.NewIterator(IteratorOptions{KeyOnly: true})
+	if err != nil {
+		return err
+	}
+	for it.Rewind(); it.Valid(); it.Next() {
+		if _, ok := live[string(it.Item().Key())]; ok {
+			continue
+		}
+		ents = append(ents, &Entry{Key: it.Item().Key(), meta: bitDelete})
+	}
+	if err := it.Close(); err != nil {
+		return err
+	}
+	for len(ents) > 0 {
+		n := len(ents)
+		if n > backupLoadBatchSize {
+			n = backupLoadBatchSize
+		}
+		batch := ents[:n]
+		ents = ents[n:]
+		req, err := s.sendToWriteCh(batch)
+		if err != nil {
+			return err
+		}
+		if err := req.Wait(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Samlon) isEmpty() (bool, error) {
+	it, err := s.NewIterator(IteratorOptions{KeyOnly: true})
+	if err != nil {
+		return false, err
+	}
+	defer it.Close()
+	it.Rewind()
+	return !it.Valid(), nil
+}
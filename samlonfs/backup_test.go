@@ -0,0 +1,181 @@
+package samlonfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func dumpSamlon(t *testing.T, s *Samlon) map[string]string {
+	it, err := s.NewIterator(IteratorOptions{})
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	defer it.Close()
+
+	kvs := make(map[string]string)
+	for it.Rewind(); it.Valid(); it.Next() {
+		v, err := it.Item().Value()
+		if !assert.Nil(t, err) {
+			return nil
+		}
+		kvs[string(it.Item().Key())] = string(v)
+	}
+	return kvs
+}
+
+func TestSamlonBackupLoad(t *testing.T) {
+	srcdir := path.Join(os.TempDir(), "samlon-backup-src")
+	dstdir := path.Join(os.TempDir(), "samlon-backup-dst")
+	defer os.RemoveAll(srcdir)
+	defer os.RemoveAll(dstdir)
+
+	src := NewSamlon(zap.NewNop(), testSamlonOpts(), srcdir)
+	if !assert.Nil(t, src.Open()) {
+		return
+	}
+	defer src.Close()
+	dst := NewSamlon(zap.NewNop(), testSamlonOpts(), dstdir)
+	if !assert.Nil(t, dst.Open()) {
+		return
+	}
+	defer dst.Close()
+
+	for i := 0; i < 50; i++ {
+		k := []byte(fmt.Sprintf("key#%02d", i))
+		assert.Nil(t, src.Put(k, []byte(fmt.Sprintf("value#%d", i))))
+	}
+	assert.Nil(t, src.SetEntry(&Entry{
+		Key:       []byte("user-meta"),
+		Value:     []byte("value"),
+		UserMeta:  0x3,
+		ExpiresAt: uint64(time.Now().Add(time.Hour).Unix()),
+	}))
+
+	var full bytes.Buffer
+	version, err := src.Backup(&full, 0)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.True(t, version > 0)
+	if !assert.Nil(t, dst.Load(bytes.NewReader(full.Bytes()))) {
+		return
+	}
+	assert.Equal(t, dumpSamlon(t, src), dumpSamlon(t, dst))
+	e, err := dst.GetEntry([]byte("user-meta"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, byte(0x3), e.UserMeta)
+		assert.True(t, e.ExpiresAt > 0)
+	}
+
+	// a full backup never overwrites
+	assert.Equal(t, ErrLoadNotEmpty, dst.Load(bytes.NewReader(full.Bytes())))
+
+	// incremental
+	assert.Nil(t, src.Put([]byte("key#00"), []byte("new-value")))
+	assert.Nil(t, src.Put([]byte("key#50"), []byte("value#50")))
+	assert.Nil(t, src.Delete([]byte("key#01")))
+
+	var incr bytes.Buffer
+	version1, err := src.Backup(&incr, version)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.True(t, version1 > version)
+	assert.True(t, incr.Len() < full.Len())
+	if !assert.Nil(t, dst.Load(bytes.NewReader(incr.Bytes()))) {
+		return
+	}
+	assert.Equal(t, dumpSamlon(t, src), dumpSamlon(t, dst))
+	_, err = dst.Get([]byte("key#01"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestSamlonLoadCorrupted(t *testing.T) {
+	srcdir := path.Join(os.TempDir(), "samlon-backup-src")
+	dstdir := path.Join(os.TempDir(), "samlon-backup-dst")
+	defer os.RemoveAll(srcdir)
+	defer os.RemoveAll(dstdir)
+
+	src := NewSamlon(zap.NewNop(), testSamlonOpts(), srcdir)
+	if !assert.Nil(t, src.Open()) {
+		return
+	}
+	defer src.Close()
+	for i := 0; i < 10; i++ {
+		k := []byte(fmt.Sprintf("key#%02d", i))
+		assert.Nil(t, src.Put(k, k))
+	}
+	var full bytes.Buffer
+	_, err := src.Backup(&full, 0)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	for _, stream := range [][]byte{
+		full.Bytes()[:full.Len()-10],
+		append(append([]byte{}, full.Bytes()[:100]...), full.Bytes()[101:]...),
+	} {
+		os.RemoveAll(dstdir)
+		dst := NewSamlon(zap.NewNop(), testSamlonOpts(), dstdir)
+		if !assert.Nil(t, dst.Open()) {
+			return
+		}
+		assert.NotNil(t, dst.Load(bytes.NewReader(stream)))
+		dst.Close()
+	}
+}
+
+func TestSamlonBackupBatches(t *testing.T) {
+	srcdir := path.Join(os.TempDir(), "samlon-backup-src")
+	dstdir := path.Join(os.TempDir(), "samlon-backup-dst")
+	defer os.RemoveAll(srcdir)
+	defer os.RemoveAll(dstdir)
+
+	opts := testSamlonOpts()
+	opts.FileBlockMaxEntries = 1000
+	opts.FileBlockMaxSize = 1 << 20
+	src := NewSamlon(zap.NewNop(), opts, srcdir)
+	if !assert.Nil(t, src.Open()) {
+		return
+	}
+	defer src.Close()
+	dst := NewSamlon(zap.NewNop(), opts, dstdir)
+	if !assert.Nil(t, dst.Open()) {
+		return
+	}
+	defer dst.Close()
+
+	// more keys than a snapshot reads
+	for i := 0; i < 2*backupReadBatchSize+10; i++ {
+		k := []byte(fmt.Sprintf("key#%05d", i))
+		assert.Nil(t, src.Put(k, k))
+	}
+	var full bytes.Buffer
+	version, err := src.Backup(&full, 0)
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Nil(t, dst.Load(bytes.NewReader(full.Bytes()))) {
+		return
+	}
+	assert.Equal(t, dumpSamlon(t, src), dumpSamlon(t, dst))
+
+	assert.Nil(t, src.Put([]byte("key#00000"), []byte("new-value")))
+	assert.Nil(t, src.Delete([]byte(fmt.Sprintf("key#%05d", backupReadBatchSize+1))))
+	var incr bytes.Buffer
+	_, err = src.Backup(&incr, version)
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.Nil(t, dst.Load(bytes.NewReader(incr.Bytes()))) {
+		return
+	}
+	assert.Equal(t, dumpSamlon(t, src), dumpSamlon(t, dst))
+}
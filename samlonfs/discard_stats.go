@@ -0,0 +1,207 @@
+package samlonfs
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const discardStatsFile = "DISCARD"
+
+var (
+	ErrDiscardStatsCorrupted error = errors.New("discard stats corrupted")
+)
+
+// discardStats counts the bytes no longer referenced by the index in
+// every log file, so gc picks the files without reading them. It's
+// persisted into the value store dir as
+//
+// | count(4) | fid(4) discard(4) expiresAt(8) ... | crc32(4) |
+//
+// The expiring values are never counted by writing, the file is counted
+// by scanning once the last of them expired. So does the files missing
+// from it. The counting is a hint, it may fall behind after crashing.
+type discardStats struct {
+	path        string
+	persistLock sync.Mutex // serializes writing the file
+
+	lock  sync.Mutex
+	files map[uint32]fileDiscard
+	dirty int64 // discard bytes counted since persisted
+}
+
+type fileDiscard struct {
+	discard   uint32
+	expiresAt uint64 // the latest expiring value in the file
+}
+
+const fileDiscardSize int = 16
+
+func newDiscardStats(dir string) *discardStats {
+	return &discardStats{
+		path:  filepath.Join(dir, discardStatsFile),
+		files: make(map[uint32]fileDiscard),
+	}
+}
+
+func (ds *discardStats) load() error {
+	buf, err := ioutil.ReadFile(ds.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to read discard stats %q", ds.path)
+	}
+	if len(buf) < 8 {
+		return ErrDiscardStatsCorrupted
+	}
+	body := buf[:len(buf)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(buf[len(buf)-4:]) {
+		return ErrDiscardStatsCorrupted
+	}
+	count := binary.BigEndian.Uint32(body[0:4])
+	if uint64(len(body)) != 4+uint64(count)*uint64(fileDiscardSize) {
+		return ErrDiscardStatsCorrupted
+	}
+
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	for off := 4; off < len(body); off += fileDiscardSize {
+		ds.files[binary.BigEndian.Uint32(body[off:off+4])] = fileDiscard{
+			discard:   binary.BigEndian.Uint32(body[off+4 : off+8]),
+			expiresAt: binary.BigEndian.Uint64(body[off+8 : off+16]),
+		}
+	}
+	return nil
+}
+
+// persist replaces the stats file by renaming, it's never torn.
+func (ds *discardStats) persist() error {
+	ds.persistLock.Lock()
+	defer ds.persistLock.Unlock()
+
+	ds.lock.Lock()
+	fids := make([]uint32, 0, len(ds.files))
+	for fid := range ds.files {
+		fids = append(fids, fid)
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	sz := 4 + len(fids)*fileDiscardSize
+	buf := make([]byte, sz, sz+4)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(fids)))
+	for i, fid := range fids {
+		off := 4 + i*fileDiscardSize
+		fd := ds.files[fid]
+		binary.BigEndian.PutUint32(buf[off:off+4], fid)
+		binary.BigEndian.PutUint32(buf[off+4:off+8], fd.discard)
+		binary.BigEndian.PutUint64(buf[off+8:off+16], fd.expiresAt)
+	}
+	ds.dirty = 0
+	ds.lock.Unlock()
+
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(buf))
+	buf = append(buf, crc[:]...)
+
+	tmp := ds.path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create file %q", tmp)
+	}
+	if _, err := fd.Write(buf); err != nil {
+		fd.Close()
+		return errors.Wrapf(err, "Unable to write file %q", tmp)
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return errors.Wrapf(err, "Unable to sync file %q", tmp)
+	}
+	if err := fd.Close(); err != nil {
+		return errors.Wrapf(err, "Unable to close file %q", tmp)
+	}
+	if err := os.Rename(tmp, ds.path); err != nil {
+		return errors.Wrapf(err, "Unable to rename %q to %q", tmp, ds.path)
+	}
+	return SyncDir(filepath.Dir(ds.path))
+}
+
+// get returns false if the file never counted.
+func (ds *discardStats) get(fid uint32) (uint32, bool) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	fd, ok := ds.files[fid]
+	return fd.discard, ok
+}
+
+// stale tells whether the file should be counted by scanning, it's never
+// counted or some values expired.
+func (ds *discardStats) stale(fid uint32, now uint64) bool {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	fd, ok := ds.files[fid]
+	return !ok || (fd.expiresAt > 0 && fd.expiresAt <= now)
+}
+
+// set saves the counting by scanning, the expired values included.
+func (ds *discardStats) set(fid uint32, discard uint32) {
+	ds.lock.Lock()
+	ds.files[fid] = fileDiscard{discard: discard}
+	ds.lock.Unlock()
+}
+
+// track starts counting a new file.
+func (ds *discardStats) track(fid uint32) {
+	ds.lock.Lock()
+	if _, ok := ds.files[fid]; !ok {
+		ds.files[fid] = fileDiscard{}
+	}
+	ds.lock.Unlock()
+}
+
+// expire records a value written into the file expiring at expiresAt.
+func (ds *discardStats) expire(fid uint32, expiresAt uint64) {
+	ds.lock.Lock()
+	if fd, ok := ds.files[fid]; ok && expiresAt > fd.expiresAt {
+		fd.expiresAt = expiresAt
+		ds.files[fid] = fd
+	}
+	ds.lock.Unlock()
+}
+
+// mark counts the values discarded, and returns the bytes counted since
+// persisted.
+func (ds *discardStats) mark(vps []valuePointer) int64 {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	for _, vp := range vps {
+		// the files never counted are scanned by gc
+		if fd, ok := ds.files[vp.Fid]; ok {
+			fd.discard += vp.Len
+			ds.files[vp.Fid] = fd
+			ds.dirty += int64(vp.Len)
+		}
+	}
+	return ds.dirty
+}
+
+func (ds *discardStats) fids() []uint32 {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	fids := make([]uint32, 0, len(ds.files))
+	for fid := range ds.files {
+		fids = append(fids, fid)
+	}
+	return fids
+}
+
+func (ds *discardStats) remove(fid uint32) {
+	ds.lock.Lock()
+	delete(ds.files, fid)
+	ds.lock.Unlock()
+}
@@ -0,0 +1,343 @@
+package samlonfs
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrKeyOnlyIterator error = errors.New("values unavailable in key-only iterator")
+)
+
+const (
+	defaultPrefetchSize    int = 16
+	defaultPrefetchWorkers int = 4
+)
+
+type IteratorOptions struct {
+	Prefix     []byte // only the keys with the prefix
+	LowerBound []byte // inclusive
+	UpperBound []byte // exclusive
+
+	// KeyOnly never reads the value log, the values unavailable.
+	KeyOnly bool
+
+	// PrefetchValues reads the values of the next PrefetchSize items by
+	// PrefetchWorkers goroutines in background.
+	PrefetchValues  bool
+	PrefetchSize    int
+	PrefetchWorkers int
+}
+
+// Item is a key visited by iterator, the value is read lazily.
+type Item struct {
+	it        *Iterator
+	key       []byte
+	vp        valuePointer
+	expiresAt uint64
+	userMeta  byte // available once the value read
+
+	once  sync.Once
+	value []byte
+	err   error
+}
+
+func (item *Item) Key() []byte {
+	return item.key
+}
+
+// ValuePointer returns where the value is in the value log.
+func (item *Item) ValuePointer() (fid, offset, length uint32) {
+	return item.vp.Fid, item.vp.Offset, item.vp.Len
+}
+
+func (item *Item) ExpiresAt() uint64 {
+	return item.expiresAt
+}
+
+// UserMeta returns the user meta of the entry, the value is read for it.
+// Zero for the key-only iterator.
+func (item *Item) UserMeta() byte {
+	if item.it.opts.KeyOnly {
+		return 0
+	}
+	item.once.Do(item.fetch)
+	return item.userMeta
+}
+
+// Value reads the value from the value log once, the value is valid
+// until the iterator closed.
+func (item *Item) Value() ([]byte, error) {
+	if item.it.opts.KeyOnly {
+		return nil, ErrKeyOnlyIterator
+	}
+	item.once.Do(item.fetch)
+	return item.value, item.err
+}
+
+func (item *Item) fetch() {
+	var slice Slice
+	e, unlock, err := item.it.s.valueStore.ReadEntry(item.vp, &slice)
+	if err != nil {
+		item.err = errors.Wrapf(err, "Unable to read value of %q by %s", item.key, item.vp)
+		return
+	}
+	item.value = append([]byte{}, e.Value...)
+	item.userMeta = e.UserMeta
+	if unlock != nil {
+		unlock()
+	}
+}
+
+// Iterator visits the keys of a snapshot in order. It must be closed,
+// and keep it short, the snapshot holds a read tx of the meta store.
+type Iterator struct {
+	s    *Samlon
+	opts IteratorOptions
+
+	snapshot metaSnapshot
+	// of the value store snapshots
+	epoch  uint64
+	cursor metaCursor
+	lower  []byte
+	upper  []byte
+
+	// items[0] is the current one, the others are read ahead in the
+	// direction.
+	items     []*Item
+	reversed  bool
+	exhausted bool // the cursor passed the bounds
+
+	fetchCh chan struct{}
+	fetchWG sync.WaitGroup
+}
+
+func (s *Samlon) NewIterator(opts IteratorOptions) (*Iterator, error) {
+	if opts.PrefetchValues && !opts.KeyOnly {
+		if opts.PrefetchSize <= 0 {
+			opts.PrefetchSize = defaultPrefetchSize
+		}
+		if opts.PrefetchWorkers <= 0 {
+			opts.PrefetchWorkers = defaultPrefetchWorkers
+		}
+	} else {
+		opts.PrefetchValues = false
+		opts.PrefetchSize = 0
+	}
+
+	// the collected value log files survive until snapshot released
+	epoch := s.valueStore.snapshots.acquire()
+	snapshot, err := s.metaStore.Snapshot()
+	if err != nil {
+		s.valueStore.snapshots.release(epoch)
+		return nil, err
+	}
+	it := &Iterator{
+		s:        s,
+		opts:     opts,
+		snapshot: snapshot,
+		epoch:    epoch,
+		cursor:   snapshot.Cursor(),
+		lower:    opts.LowerBound,
+		upper:    opts.UpperBound,
+		fetchCh:  make(chan struct{}, opts.PrefetchWorkers),
+	}
+	if len(opts.Prefix) > 0 {
+		if bytes.Compare(opts.Prefix, it.lower) > 0 {
+			it.lower = opts.Prefix
+		}
+		if end := prefixEnd(opts.Prefix); end != nil && (it.upper == nil || bytes.Compare(end, it.upper) < 0) {
+			it.upper = end
+		}
+	}
+	return it, nil
+}
+
+// prefixEnd returns the smallest key after all the keys with the
+// prefix, nil if no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func (it *Iterator) inBounds(key []byte) bool {
+	if key == nil {
+		return false
+	}
+	if it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+		return false
+	}
+	if it.upper != nil && bytes.Compare(key, it.upper) >= 0 {
+		return false
+	}
+	return bytes.HasPrefix(key, it.opts.Prefix)
+}
+
+// step reads the next item from the cursor in the direction, the
+// expired keys skipped.
+func (it *Iterator) step(k, v []byte) *Item {
+	now := uint64(time.Now().Unix())
+	for ; it.inBounds(k); k, v = it.advance() {
+		vp, expiresAt, ok := decodeIndexValue(v)
+		if !ok || (expiresAt > 0 && expiresAt <= now) {
+			continue
+		}
+		// the cursor key is only valid until moved
+		item := &Item{it: it, key: append([]byte{}, k...), vp: vp, expiresAt: expiresAt}
+		if it.opts.PrefetchValues {
+			it.prefetch(item)
+		}
+		return item
+	}
+	return nil
+}
+
+func (it *Iterator) advance() ([]byte, []byte) {
+	if it.reversed {
+		return it.cursor.Prev()
+	}
+	return it.cursor.Next()
+}
+
+func (it *Iterator) prefetch(item *Item) {
+	it.fetchWG.Add(1)
+	go func() {
+		defer it.fetchWG.Done()
+		it.fetchCh <- struct{}{}
+		item.once.Do(item.fetch)
+		<-it.fetchCh
+	}()
+}
+
+// fill reads ahead until PrefetchSize items behind the current one.
+func (it *Iterator) fill(k, v []byte) {
+	item := it.step(k, v)
+	for item != nil {
+		it.items = append(it.items, item)
+		if len(it.items) > it.opts.PrefetchSize {
+			return
+		}
+		item = it.step(it.advance())
+	}
+	it.exhausted = true
+}
+
+func (it *Iterator) reset(reversed bool) {
+	it.items = it.items[:0]
+	it.reversed = reversed
+	it.exhausted = false
+}
+
+// Seek moves to the first key not less than key.
+func (it *Iterator) Seek(key []byte) {
+	if it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+		key = it.lower
+	}
+	it.reset(false)
+	it.fill(it.cursor.Seek(key))
+}
+
+// SeekForPrev moves to the last key not greater than key, and the
+// direction reversed.
+func (it *Iterator) SeekForPrev(key []byte) {
+	it.reset(true)
+	if it.upper != nil && bytes.Compare(key, it.upper) >= 0 {
+		it.seekBefore(it.upper)
+		return
+	}
+	k, v := it.cursor.Seek(key)
+	if k == nil || !bytes.Equal(k, key) {
+		it.seekBefore(key)
+		return
+	}
+	it.fill(k, v)
+}
+
+// seekBefore moves to the last key less than key.
+func (it *Iterator) seekBefore(key []byte) {
+	k, _ := it.cursor.Seek(key)
+	if k == nil {
+		it.fill(it.cursor.Last())
+		return
+	}
+	it.fill(it.cursor.Prev())
+}
+
+// Rewind moves to the first key.
+func (it *Iterator) Rewind() {
+	if it.lower != nil {
+		it.Seek(it.lower)
+		return
+	}
+	it.reset(false)
+	it.fill(it.cursor.First())
+}
+
+// RewindLast moves to the last key, and the direction reversed.
+func (it *Iterator) RewindLast() {
+	it.reset(true)
+	if it.upper != nil {
+		it.seekBefore(it.upper)
+		return
+	}
+	it.fill(it.cursor.Last())
+}
+
+func (it *Iterator) Valid() bool {
+	return len(it.items) > 0
+}
+
+func (it *Iterator) Item() *Item {
+	return it.items[0]
+}
+
+// Next moves to the next key in order.
+func (it *Iterator) Next() {
+	it.move(false)
+}
+
+// Prev moves to the previous key in order.
+func (it *Iterator) Prev() {
+	it.move(true)
+}
+
+func (it *Iterator) move(reversed bool) {
+	if !it.Valid() {
+		return
+	}
+	if it.reversed != reversed {
+		// the cursor is ahead in the other direction, back to the
+		// current one and turn around.
+		curr := it.items[0]
+		it.reset(reversed)
+		it.cursor.Seek(curr.key)
+		it.fill(it.advance())
+		return
+	}
+	it.items = it.items[1:]
+	if !it.exhausted && len(it.items) <= it.opts.PrefetchSize {
+		it.fill(it.advance())
+	}
+}
+
+// Close waits for the prefetching done and releases the snapshot.
+func (it *Iterator) Close() error {
+	if it.snapshot == nil {
+		return nil
+	}
+	it.fetchWG.Wait()
+	err := it.snapshot.Release()
+	it.snapshot = nil
+	it.items = nil
+	it.s.valueStore.snapshots.release(it.epoch)
+	return err
+}
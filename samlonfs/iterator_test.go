@@ -0,0 +1,259 @@
+package samlonfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func prepareIteratorSamlon(t *testing.T, tmpdir string) *Samlon {
+	s := NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return nil
+	}
+	for _, dir := range []string{"a", "b", "c"} {
+		for i := 0; i < 10; i++ {
+			k := []byte(fmt.Sprintf("%s/%02d", dir, i))
+			assert.Nil(t, s.Put(k, []byte("value#"+string(k))))
+		}
+	}
+	assert.Nil(t, s.PutWithTTL([]byte("b/expired"), []byte("value"), -time.Second))
+	assert.Nil(t, s.Put([]byte("b/deleted"), []byte("value")))
+	assert.Nil(t, s.Delete([]byte("b/deleted")))
+	return s
+}
+
+func collectKeys(it *Iterator, forward bool) []string {
+	var keys []string
+	for ; it.Valid(); func() {
+		if forward {
+			it.Next()
+		} else {
+			it.Prev()
+		}
+	}() {
+		keys = append(keys, string(it.Item().Key()))
+	}
+	return keys
+}
+
+func TestIteratorPrefix(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+	s := prepareIteratorSamlon(t, tmpdir)
+	if s == nil {
+		return
+	}
+	defer s.Close()
+
+	for _, prefetch := range []bool{false, true} {
+		it, err := s.NewIterator(IteratorOptions{Prefix: []byte("b/"), PrefetchValues: prefetch, PrefetchSize: 3})
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		var expected []string
+		for i := 0; i < 10; i++ {
+			expected = append(expected, fmt.Sprintf("b/%02d", i))
+		}
+		it.Rewind()
+		assert.Equal(t, expected, collectKeys(it, true))
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			v, err := it.Item().Value()
+			if assert.Nil(t, err) {
+				assert.Equal(t, "value#"+string(it.Item().Key()), string(v))
+			}
+		}
+
+		var reversed []string
+		for i := len(expected) - 1; i >= 0; i-- {
+			reversed = append(reversed, expected[i])
+		}
+		it.RewindLast()
+		assert.Equal(t, reversed, collectKeys(it, false))
+		assert.Nil(t, it.Close())
+	}
+}
+
+func TestIteratorUserMeta(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+	s := prepareIteratorSamlon(t, tmpdir)
+	if s == nil {
+		return
+	}
+	defer s.Close()
+	assert.Nil(t, s.SetEntry(&Entry{Key: []byte("d/meta"), Value: []byte("value"), UserMeta: 0x7f}))
+
+	for _, keyOnly := range []bool{false, true} {
+		it, err := s.NewIterator(IteratorOptions{Prefix: []byte("d/"), KeyOnly: keyOnly})
+		if !assert.Nil(t, err) {
+			return
+		}
+		it.Rewind()
+		if assert.True(t, it.Valid()) {
+			if keyOnly {
+				assert.Equal(t, byte(0), it.Item().UserMeta())
+			} else {
+				assert.Equal(t, byte(0x7f), it.Item().UserMeta())
+			}
+		}
+		assert.Nil(t, it.Close())
+	}
+}
+
+func TestIteratorSeekAndTurn(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+	s := prepareIteratorSamlon(t, tmpdir)
+	if s == nil {
+		return
+	}
+	defer s.Close()
+
+	it, err := s.NewIterator(IteratorOptions{
+		LowerBound:     []byte("a/05"),
+		UpperBound:     []byte("c/03"),
+		PrefetchValues: true,
+		PrefetchSize:   2,
+	})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer it.Close()
+
+	it.Rewind()
+	if assert.True(t, it.Valid()) {
+		assert.Equal(t, "a/05", string(it.Item().Key()))
+	}
+	it.Seek([]byte("b/"))
+	if assert.True(t, it.Valid()) {
+		assert.Equal(t, "b/00", string(it.Item().Key()))
+	}
+	it.Prev()
+	if assert.True(t, it.Valid()) {
+		assert.Equal(t, "a/09", string(it.Item().Key()))
+	}
+	it.Next()
+	it.Next()
+	if assert.True(t, it.Valid()) {
+		assert.Equal(t, "b/01", string(it.Item().Key()))
+	}
+
+	it.SeekForPrev([]byte("b/05"))
+	if assert.True(t, it.Valid()) {
+		assert.Equal(t, "b/05", string(it.Item().Key()))
+	}
+	it.SeekForPrev([]byte("b/055"))
+	if assert.True(t, it.Valid()) {
+		assert.Equal(t, "b/05", string(it.Item().Key()))
+	}
+
+	it.Seek([]byte("c/02"))
+	it.Next()
+	assert.False(t, it.Valid())
+	it.RewindLast()
+	if assert.True(t, it.Valid()) {
+		assert.Equal(t, "c/02", string(it.Item().Key()))
+	}
+	it.Seek([]byte("a/00"))
+	it.Prev()
+	assert.False(t, it.Valid())
+}
+
+func TestIteratorKeyOnly(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+	s := prepareIteratorSamlon(t, tmpdir)
+	if s == nil {
+		return
+	}
+	defer s.Close()
+
+	it, err := s.NewIterator(IteratorOptions{Prefix: []byte("c/"), KeyOnly: true})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer it.Close()
+
+	// the snapshot never sees the later writes
+	assert.Nil(t, s.Put([]byte("c/10"), []byte("value")))
+
+	var n int
+	for it.Rewind(); it.Valid(); it.Next() {
+		_, _, length := it.Item().ValuePointer()
+		assert.True(t, length > 0)
+		_, err := it.Item().Value()
+		assert.Equal(t, ErrKeyOnlyIterator, err)
+		n++
+	}
+	assert.Equal(t, 10, n)
+}
+
+func TestIteratorWithGCWaiting(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	s := prepareIteratorSamlon(t, tmpdir)
+	if s == nil {
+		return
+	}
+	defer s.Close()
+
+	it, err := s.NewIterator(IteratorOptions{})
+	if !assert.Nil(t, err) {
+		return
+	}
+	gcDone := make(chan error, 1)
+	go func() {
+		gcDone <- s.RunValueLogGC(0.5)
+	}()
+	// the gc waiting for the iterator
+	assert.Eventually(t, func() bool {
+		s.valueStore.snapshots.mu.Lock()
+		defer s.valueStore.snapshots.mu.Unlock()
+		return s.valueStore.snapshots.epoch > 0
+	}, 5*time.Second, time.Millisecond)
+
+	// the snapshots taken meanwhile never wait for the gc
+	taken := make(chan error, 1)
+	go func() {
+		txn, err := s.NewTxn()
+		if err != nil {
+			taken <- err
+			return
+		}
+		it2, err := s.NewIterator(IteratorOptions{})
+		if err != nil {
+			taken <- err
+			return
+		}
+		txn.Discard()
+		taken <- it2.Close()
+	}()
+	select {
+	case err := <-taken:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("snapshot blocked by the gc waiting")
+	}
+	select {
+	case <-gcDone:
+		t.Fatal("gc done before the iterator closed")
+	default:
+	}
+
+	assert.Nil(t, it.Close())
+	select {
+	case err := <-gcDone:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("gc blocked after the iterator closed")
+	}
+}
@@ -0,0 +1,86 @@
+package lsm
+
+// bloomFilter is the filter of the user keys in a table, the same as
+// leveldb's. The last byte is the number of probes.
+type bloomFilter []byte
+
+func bloomHash(key []byte) uint32 {
+	const (
+		seed = 0xbc9f1d34
+		m    = 0xc6a4a793
+	)
+	h := uint32(seed) ^ uint32(len(key))*m
+	for ; len(key) >= 4; key = key[4:] {
+		h += uint32(key[0]) | uint32(key[1])<<8 | uint32(key[2])<<16 | uint32(key[3])<<24
+		h *= m
+		h ^= h >> 16
+	}
+	switch len(key) {
+	case 3:
+		h += uint32(key[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(key[1]) << 8
+		fallthrough
+	case 1:
+		h += uint32(key[0])
+		h *= m
+		h ^= h >> 24
+	}
+	return h
+}
+
+func newBloomFilter(hashes []uint32, bitsPerKey int) bloomFilter {
+	if bitsPerKey < 1 {
+		bitsPerKey = 1
+	}
+	// 0.69 is approximately ln(2), the optimal number of probes
+	k := uint8(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	nbits := len(hashes) * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	nbytes := (nbits + 7) / 8
+	nbits = nbytes * 8
+
+	filter := make([]byte, nbytes+1)
+	for _, h := range hashes {
+		delta := h>>17 | h<<15
+		for j := uint8(0); j < k; j++ {
+			pos := h % uint32(nbits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	filter[nbytes] = k
+	return filter
+}
+
+// mayContain returns false only if the key is absent for sure.
+func (f bloomFilter) mayContain(key []byte) bool {
+	if len(f) < 2 {
+		return true
+	}
+	k := f[len(f)-1]
+	if k > 30 {
+		// reserved for other encodings
+		return true
+	}
+	nbits := uint32(8 * (len(f) - 1))
+	h := bloomHash(key)
+	delta := h>>17 | h<<15
+	for j := uint8(0); j < k; j++ {
+		pos := h % nbits
+		if f[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
@@ -0,0 +1,363 @@
+package lsm
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// background flushes the memtables and compacts the levels, one at a
+// time, so the versions change in order.
+func (db *DB) background() {
+	defer db.wg.Done()
+	for {
+		select {
+		case <-db.workCh:
+		case <-db.closeCh:
+			return
+		}
+		if err := db.work(); err != nil {
+			log.Printf("lsm background work fail. %v", err)
+			db.lock.Lock()
+			db.bgErr = err
+			db.flushed.Broadcast()
+			db.lock.Unlock()
+			return
+		}
+	}
+}
+
+func (db *DB) work() error {
+	for {
+		db.lock.Lock()
+		var imm *memtable
+		if len(db.imms) > 0 {
+			imm = db.imms[0]
+		}
+		db.lock.Unlock()
+		if imm == nil {
+			break
+		}
+		if err := db.flush(imm); err != nil {
+			return errors.Wrap(err, "Unable to flush memtable")
+		}
+	}
+
+	for {
+		c := db.pickCompaction()
+		if c == nil {
+			return nil
+		}
+		err := db.compact(c)
+		c.base.unref(true)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to compact level %d", c.level)
+		}
+	}
+}
+
+func (db *DB) newFileNum() uint64 {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	num := db.nextFile
+	db.nextFile++
+	return num
+}
+
+// writeTables writes the entries of iter into tables, the entries drop
+// tells are skipped. An entry is shadowed if a newer version of the user
+// key is visible to all snapshots. The tables are split by TableSize if
+// asked, never in the middle of a user key.
+func (db *DB) writeTables(iter iterator, split bool, smallestSnapshot uint64, drop func(ukey []byte, seq uint64, k kind, shadowed bool) bool) ([]tableMeta, error) {
+	var (
+		metas   []tableMeta
+		w       *tableWriter
+		num     uint64
+		lastKey []byte
+		lastSeq uint64 = maxSeq
+	)
+	finish := func() error {
+		if w == nil {
+			return nil
+		}
+		size, err := w.finish()
+		if err != nil {
+			return err
+		}
+		metas = append(metas, tableMeta{num: num, size: size, smallest: w.smallest, largest: append([]byte{}, w.largest...)})
+		w = nil
+		return nil
+	}
+	abort := func() {
+		if w != nil {
+			w.abort()
+		}
+		for _, m := range metas {
+			removeTable(db.dir, m.num)
+		}
+	}
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		ukey, seq, k := parseInternalKey(iter.Key())
+		newKey := lastKey == nil || !bytes.Equal(ukey, lastKey)
+		if newKey {
+			lastKey = append(lastKey[:0], ukey...)
+			lastSeq = maxSeq
+			if split && w != nil && w.estimatedSize() >= uint64(db.opts.TableSize) {
+				if err := finish(); err != nil {
+					abort()
+					return nil, err
+				}
+			}
+		}
+		shadowed := lastSeq <= smallestSnapshot
+		lastSeq = seq
+		if drop != nil && drop(ukey, seq, k, shadowed) {
+			continue
+		}
+		if w == nil {
+			num = db.newFileNum()
+			var err error
+			if w, err = newTableWriter(tableFileName(db.dir, num), db.opts.BlockSize, db.opts.BloomBitsPerKey); err != nil {
+				abort()
+				return nil, err
+			}
+		}
+		if err := w.add(iter.Key(), iter.Value()); err != nil {
+			abort()
+			return nil, err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		abort()
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		abort()
+		return nil, err
+	}
+	return metas, nil
+}
+
+func (db *DB) snapshotSeq() uint64 {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.smallestSnapshotLocked()
+}
+
+func removeTable(dir string, num uint64) {
+	path := tableFileName(dir, num)
+	if err := os.Remove(path); err != nil {
+		log.Printf("lsm remove table %q fail. %v", path, err)
+	}
+}
+
+// flush writes the oldest immutable memtable into a level 0 table, all
+// the versions kept.
+func (db *DB) flush(imm *memtable) error {
+	metas, err := db.writeTables(imm.newIterator(), false, 0, nil)
+	if err != nil {
+		return err
+	}
+	tables, err := db.openTables(metas)
+	if err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	levels := db.current.levels
+	levels[0] = append(append([]*table{}, tables...), levels[0]...)
+	durable := db.durable
+	if imm.checkpoint != nil {
+		durable = imm.checkpoint
+	}
+	if err := db.installLocked(levels, imm.maxSeq, durable); err != nil {
+		return err
+	}
+	db.imms = db.imms[1:]
+	db.flushed.Broadcast()
+	return nil
+}
+
+func (db *DB) openTables(metas []tableMeta) ([]*table, error) {
+	var tables []*table
+	for _, m := range metas {
+		t, err := openTable(db.dir, m)
+		if err != nil {
+			for _, t := range tables {
+				t.fd.Close()
+			}
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+// installLocked persists the new version into the manifest then makes
+// it current. The tables in the old version only are removed once no
+// snapshot refers to them.
+func (db *DB) installLocked(levels [numLevels][]*table, flushedSeq uint64, durable []byte) error {
+	m := &manifest{nextFile: db.nextFile, lastSeq: db.flushedSeq, checkpoint: durable}
+	if flushedSeq > m.lastSeq {
+		m.lastSeq = flushedSeq
+	}
+	for level := range levels {
+		for _, t := range levels[level] {
+			m.levels[level] = append(m.levels[level], t.tableMeta)
+		}
+	}
+	if err := writeManifest(db.dir, m); err != nil {
+		return err
+	}
+	old := db.current
+	db.current = newVersion(levels)
+	db.flushedSeq = m.lastSeq
+	db.durable = durable
+	return old.unref(true)
+}
+
+type compaction struct {
+	level  int
+	base   *version
+	inputs [2][]*table // the tables of level and level+1
+}
+
+func (db *DB) maxLevelSize(level int) uint64 {
+	size := uint64(db.opts.LevelSizeBase)
+	for i := 1; i < level; i++ {
+		size *= uint64(db.opts.LevelSizeMultiplier)
+	}
+	return size
+}
+
+// userRange returns the smallest and the largest user keys of tables.
+func userRange(tables []*table) (smallest, largest []byte) {
+	for _, t := range tables {
+		if smallest == nil || bytes.Compare(userKey(t.smallest), smallest) < 0 {
+			smallest = userKey(t.smallest)
+		}
+		if largest == nil || bytes.Compare(userKey(t.largest), largest) > 0 {
+			largest = userKey(t.largest)
+		}
+	}
+	return smallest, largest
+}
+
+// pickCompaction compacts all the level 0 tables once there are too
+// many, or a table of the first level too big, from where the last one
+// ended.
+func (db *DB) pickCompaction() *compaction {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	v := db.current
+
+	c := &compaction{base: v, level: -1}
+	if len(v.levels[0]) >= db.opts.L0CompactionTrigger {
+		c.level = 0
+		c.inputs[0] = append([]*table{}, v.levels[0]...)
+	} else {
+		for level := 1; level < numLevels-1; level++ {
+			if v.levelSize(level) <= db.maxLevelSize(level) {
+				continue
+			}
+			c.level = level
+			tables := v.levels[level]
+			i := 0
+			if ptr := db.compactPtr[level]; ptr != nil {
+				i = sort.Search(len(tables), func(i int) bool {
+					return compareInternal(tables[i].largest, ptr) > 0
+				})
+				if i == len(tables) {
+					i = 0
+				}
+			}
+			c.inputs[0] = []*table{tables[i]}
+			db.compactPtr[level] = append([]byte{}, tables[i].largest...)
+			break
+		}
+	}
+	if c.level < 0 {
+		return nil
+	}
+	smallest, largest := userRange(c.inputs[0])
+	c.inputs[1] = v.overlapping(c.level+1, smallest, largest)
+	v.ref()
+	return c
+}
+
+// isBaseLevel tells whether no level below the output one holds ukey,
+// the tombstones of it are useless then.
+func (c *compaction) isBaseLevel(ukey []byte) bool {
+	for level := c.level + 2; level < numLevels; level++ {
+		if len(c.base.overlapping(level, ukey, ukey)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (db *DB) compact(c *compaction) error {
+	var iters []iterator
+	for _, t := range c.inputs[0] {
+		iters = append(iters, t.newIterator())
+	}
+	if len(c.inputs[1]) > 0 {
+		iters = append(iters, newLevelIterator(c.inputs[1]))
+	}
+	smallestSnapshot := db.snapshotSeq()
+	metas, err := db.writeTables(newMergingIterator(iters), true, smallestSnapshot, func(ukey []byte, seq uint64, k kind, shadowed bool) bool {
+		if shadowed {
+			return true
+		}
+		return k == kindDelete && seq <= smallestSnapshot && c.isBaseLevel(ukey)
+	})
+	if err != nil {
+		return err
+	}
+	tables, err := db.openTables(metas)
+	if err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	inputs := make(map[*table]struct{})
+	for i := range c.inputs {
+		for _, t := range c.inputs[i] {
+			inputs[t] = struct{}{}
+		}
+	}
+	// the compaction is the only one changing the levels besides
+	// flushing, which only prepends the level 0 tables.
+	levels := db.current.levels
+	for _, level := range []int{c.level, c.level + 1} {
+		var remain []*table
+		for _, t := range levels[level] {
+			if _, ok := inputs[t]; !ok {
+				remain = append(remain, t)
+			}
+		}
+		levels[level] = remain
+	}
+	out := append(append([]*table{}, levels[c.level+1]...), tables...)
+	sort.Slice(out, func(i, j int) bool {
+		return compareInternal(out[i].smallest, out[j].smallest) < 0
+	})
+	levels[c.level+1] = out
+
+	var inputSize, outputSize uint64
+	for t := range inputs {
+		inputSize += t.size
+	}
+	for _, t := range tables {
+		outputSize += t.size
+	}
+	log.Printf("lsm compact level %d: %d+%d tables %d bytes to %d tables %d bytes",
+		c.level, len(c.inputs[0]), len(c.inputs[1]), inputSize, len(tables), outputSize)
+	return db.installLocked(levels, 0, db.durable)
+}
@@ -0,0 +1,396 @@
+// Package lsm is an ordered key value store of a log structured merge
+// tree. The writes go into a skiplist memtable, which is flushed into
+// the level 0 tables and compacted down level by level.
+//
+// There is no write ahead log. Every write carries an optional
+// checkpoint, and the checkpoint of the last write flushed is durable.
+// The caller replays its own log from the durable checkpoint after
+// crashing, like samlonfs replays the value log from the head.
+package lsm
+
+import (
+	"container/list"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotFound error = errors.New("lsm: key not found")
+	ErrClosed   error = errors.New("lsm: db closed")
+)
+
+type Options struct {
+	MemTableSize        int64 // rotated once reached
+	MaxImmutables       int   // the writing stalls once more memtables waiting for flushing
+	TableSize           int64 // the compaction output split once reached
+	BlockSize           int
+	BloomBitsPerKey     int
+	L0CompactionTrigger int   // the number of level 0 tables
+	LevelSizeBase       int64 // the max bytes of level 1
+	LevelSizeMultiplier int
+}
+
+var DefaultOptions = Options{
+	MemTableSize:        4 << 20,
+	MaxImmutables:       2,
+	TableSize:           2 << 20,
+	BlockSize:           4 << 10,
+	BloomBitsPerKey:     10,
+	L0CompactionTrigger: 4,
+	LevelSizeBase:       10 << 20,
+	LevelSizeMultiplier: 10,
+}
+
+func (o Options) withDefaults() Options {
+	if o.MemTableSize <= 0 {
+		o.MemTableSize = DefaultOptions.MemTableSize
+	}
+	if o.MaxImmutables <= 0 {
+		o.MaxImmutables = DefaultOptions.MaxImmutables
+	}
+	if o.TableSize <= 0 {
+		o.TableSize = DefaultOptions.TableSize
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = DefaultOptions.BlockSize
+	}
+	if o.BloomBitsPerKey <= 0 {
+		o.BloomBitsPerKey = DefaultOptions.BloomBitsPerKey
+	}
+	if o.L0CompactionTrigger <= 0 {
+		o.L0CompactionTrigger = DefaultOptions.L0CompactionTrigger
+	}
+	if o.LevelSizeBase <= 0 {
+		o.LevelSizeBase = DefaultOptions.LevelSizeBase
+	}
+	if o.LevelSizeMultiplier <= 1 {
+		o.LevelSizeMultiplier = DefaultOptions.LevelSizeMultiplier
+	}
+	return o
+}
+
+type DB struct {
+	dir  string
+	opts Options
+
+	// guards the fields below
+	lock       sync.Mutex
+	flushed    *sync.Cond // signaled once a memtable flushed or failed
+	mem        *memtable
+	imms       []*memtable // from the oldest
+	current    *version
+	seq        uint64 // the last sequence
+	nextFile   uint64
+	checkpoint []byte // the checkpoint of the last write
+	durable    []byte // the checkpoint flushed
+	flushedSeq uint64
+	snapshots  *list.List // live snapshots from the oldest
+	compactPtr [numLevels][]byte
+	bgErr      error
+	closed     bool
+
+	workCh  chan struct{}
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Open loads the db in dir, it's created if not exists.
+func Open(dir string, opts Options) (*DB, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "Unable to create lsm directory %q", dir)
+	}
+	db := &DB{
+		dir:       dir,
+		opts:      opts.withDefaults(),
+		mem:       newMemtable(),
+		snapshots: list.New(),
+		nextFile:  1,
+		workCh:    make(chan struct{}, 1),
+		closeCh:   make(chan struct{}),
+	}
+	db.flushed = sync.NewCond(&db.lock)
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	var levels [numLevels][]*table
+	if m != nil {
+		db.nextFile = m.nextFile
+		db.seq = m.lastSeq
+		db.flushedSeq = m.lastSeq
+		db.checkpoint = m.checkpoint
+		db.durable = m.checkpoint
+		for level := range m.levels {
+			for _, meta := range m.levels[level] {
+				t, err := openTable(dir, meta)
+				if err != nil {
+					for l := range levels {
+						for _, t := range levels[l] {
+							t.fd.Close()
+						}
+					}
+					return nil, err
+				}
+				levels[level] = append(levels[level], t)
+			}
+		}
+	}
+	db.current = newVersion(levels)
+	if err := db.removeObsoleteTables(); err != nil {
+		db.current.unref(false)
+		return nil, err
+	}
+
+	db.wg.Add(1)
+	go db.background()
+	return db, nil
+}
+
+// removeObsoleteTables removes the tables left by crashing in the middle
+// of flushing or compacting.
+func (db *DB) removeObsoleteTables() error {
+	live := make(map[uint64]struct{})
+	for level := range db.current.levels {
+		for _, t := range db.current.levels[level] {
+			live[t.num] = struct{}{}
+		}
+	}
+	files, err := ioutil.ReadDir(db.dir)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to read directory %q", db.dir)
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), tableFileSuffix) {
+			continue
+		}
+		num, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), tableFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, ok := live[num]; ok {
+			continue
+		}
+		log.Printf("lsm remove obsolete table %q", f.Name())
+		if err := os.Remove(tableFileName(db.dir, num)); err != nil {
+			return errors.Wrapf(err, "Unable to remove obsolete table %q", f.Name())
+		}
+	}
+	return nil
+}
+
+// Batch is a group of writes applied atomically.
+type Batch struct {
+	kinds  []kind
+	keys   [][]byte
+	values [][]byte
+}
+
+func (b *Batch) Set(key, value []byte) {
+	b.kinds = append(b.kinds, kindSet)
+	b.keys = append(b.keys, key)
+	b.values = append(b.values, value)
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.kinds = append(b.kinds, kindDelete)
+	b.keys = append(b.keys, key)
+	b.values = append(b.values, nil)
+}
+
+func (b *Batch) Len() int {
+	return len(b.keys)
+}
+
+// Write applies the batch, the checkpoint is kept if nil. The writing
+// stalls if the memtables are flushed too slow.
+func (db *DB) Write(b *Batch, checkpoint []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if db.bgErr != nil {
+		return db.bgErr
+	}
+	for i := range b.keys {
+		db.seq++
+		db.mem.add(db.seq, b.kinds[i], append([]byte{}, b.keys[i]...), append([]byte{}, b.values[i]...))
+	}
+	if checkpoint != nil {
+		db.checkpoint = append([]byte{}, checkpoint...)
+		db.mem.checkpoint = db.checkpoint
+	}
+	if db.mem.size() < db.opts.MemTableSize {
+		return nil
+	}
+	return db.rotateLocked()
+}
+
+// rotateLocked makes the memtable immutable and waits for flushing.
+func (db *DB) rotateLocked() error {
+	if db.mem.empty() {
+		return nil
+	}
+	db.imms = append(db.imms, db.mem)
+	db.mem = newMemtable()
+	db.schedule()
+	for len(db.imms) > db.opts.MaxImmutables && db.bgErr == nil {
+		db.flushed.Wait()
+	}
+	return db.bgErr
+}
+
+func (db *DB) schedule() {
+	select {
+	case db.workCh <- struct{}{}:
+	default:
+	}
+}
+
+// Flush writes all the memtables into tables, the checkpoint written is
+// durable then.
+func (db *DB) Flush() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if !db.mem.empty() {
+		db.imms = append(db.imms, db.mem)
+		db.mem = newMemtable()
+		db.schedule()
+	}
+	for len(db.imms) > 0 && db.bgErr == nil {
+		db.flushed.Wait()
+	}
+	return db.bgErr
+}
+
+// Checkpoint returns the checkpoint of the last write flushed, nil if
+// never written.
+func (db *DB) Checkpoint() []byte {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.durable
+}
+
+func (db *DB) Get(key []byte) ([]byte, error) {
+	snap := db.NewSnapshot()
+	defer snap.Release()
+	return snap.Get(key)
+}
+
+func (db *DB) NewSnapshot() *Snapshot {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	s := &Snapshot{
+		db:         db,
+		seq:        db.seq,
+		mems:       append([]*memtable{db.mem}, reversed(db.imms)...),
+		version:    db.current,
+		checkpoint: db.checkpoint,
+	}
+	db.current.ref()
+	s.elem = db.snapshots.PushBack(s)
+	return s
+}
+
+func reversed(mems []*memtable) []*memtable {
+	r := make([]*memtable, 0, len(mems))
+	for i := len(mems) - 1; i >= 0; i-- {
+		r = append(r, mems[i])
+	}
+	return r
+}
+
+// smallestSnapshot returns the oldest sequence any reader may see.
+func (db *DB) smallestSnapshotLocked() uint64 {
+	if e := db.snapshots.Front(); e != nil {
+		return e.Value.(*Snapshot).seq
+	}
+	return db.seq
+}
+
+// Close flushes the memtables, so nothing is replayed next time.
+func (db *DB) Close() error {
+	err := db.Flush()
+	if err == ErrClosed {
+		return nil
+	}
+
+	db.lock.Lock()
+	db.closed = true
+	db.lock.Unlock()
+	close(db.closeCh)
+	db.wg.Wait()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if uerr := db.current.unref(false); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// Snapshot is a consistent view of the db, it must be released.
+type Snapshot struct {
+	db         *DB
+	seq        uint64
+	mems       []*memtable // from the newest
+	version    *version
+	checkpoint []byte
+	elem       *list.Element
+}
+
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	for _, m := range s.mems {
+		if value, k, ok := m.get(key, s.seq); ok {
+			if k == kindDelete {
+				return nil, ErrNotFound
+			}
+			return value, nil
+		}
+	}
+	value, k, ok, err := s.version.get(key, s.seq)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || k == kindDelete {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+// Checkpoint returns the checkpoint of the last write in the snapshot.
+func (s *Snapshot) Checkpoint() []byte {
+	return s.checkpoint
+}
+
+// NewIterator iterates the snapshot, valid until released.
+func (s *Snapshot) NewIterator() *Iterator {
+	var iters []iterator
+	for _, m := range s.mems {
+		iters = append(iters, m.newIterator())
+	}
+	iters = append(iters, s.version.iterators()...)
+	return newIterator(newMergingIterator(iters), s.seq)
+}
+
+func (s *Snapshot) Release() error {
+	db := s.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if s.elem == nil {
+		return nil
+	}
+	db.snapshots.Remove(s.elem)
+	s.elem = nil
+	return s.version.unref(!db.closed)
+}
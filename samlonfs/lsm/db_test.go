@@ -0,0 +1,342 @@
+package lsm
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testOptions() Options {
+	return Options{
+		MemTableSize:        4 << 10,
+		TableSize:           4 << 10,
+		BlockSize:           256,
+		L0CompactionTrigger: 2,
+		LevelSizeBase:       16 << 10,
+		LevelSizeMultiplier: 4,
+	}
+}
+
+func collect(it *Iterator) (keys []string) {
+	for k, _ := it.First(); k != nil; k, _ = it.Next() {
+		keys = append(keys, string(k))
+	}
+	return keys
+}
+
+func TestSkiplist(t *testing.T) {
+	list := newSkiplist()
+	var keys []string
+	for _, i := range rand.Perm(1000) {
+		k := fmt.Sprintf("key#%04d", i)
+		keys = append(keys, k)
+		list.insert(makeInternalKey([]byte(k), uint64(i+1), kindSet), []byte(k))
+	}
+	sort.Strings(keys)
+
+	it := list.newIterator()
+	var got []string
+	for it.First(); it.Valid(); it.Next() {
+		got = append(got, string(userKey(it.Key())))
+	}
+	assert.Equal(t, keys, got)
+
+	got = got[:0]
+	for it.Last(); it.Valid(); it.Prev() {
+		got = append(got, string(userKey(it.Key())))
+	}
+	assert.Equal(t, len(keys), len(got))
+	assert.Equal(t, keys[len(keys)-1], got[0])
+
+	it.SeekGE(seekKey([]byte("key#0500"), maxSeq))
+	if assert.True(t, it.Valid()) {
+		assert.Equal(t, "key#0500", string(userKey(it.Key())))
+	}
+	it.SeekLT(seekKey([]byte("key#0500"), maxSeq))
+	if assert.True(t, it.Valid()) {
+		assert.Equal(t, "key#0499", string(userKey(it.Key())))
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	var hashes []uint32
+	for i := 0; i < 1000; i++ {
+		hashes = append(hashes, bloomHash([]byte(fmt.Sprintf("key#%d", i))))
+	}
+	f := newBloomFilter(hashes, 10)
+	for i := 0; i < 1000; i++ {
+		assert.True(t, f.mayContain([]byte(fmt.Sprintf("key#%d", i))))
+	}
+	var fp int
+	for i := 0; i < 10000; i++ {
+		if f.mayContain([]byte(fmt.Sprintf("other#%d", i))) {
+			fp++
+		}
+	}
+	assert.True(t, fp < 300, "false positives %d", fp)
+}
+
+func TestTable(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "lsm")
+	os.MkdirAll(tmpdir, 0755)
+	defer os.RemoveAll(tmpdir)
+
+	w, err := newTableWriter(tableFileName(tmpdir, 1), 128, 10)
+	if !assert.Nil(t, err) {
+		return
+	}
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("key#%03d", i))
+		// two versions of every key
+		assert.Nil(t, w.add(makeInternalKey(k, 200, kindSet), []byte("new")))
+		assert.Nil(t, w.add(makeInternalKey(k, 100, kindSet), []byte("old")))
+	}
+	size, err := w.finish()
+	if !assert.Nil(t, err) {
+		return
+	}
+	tb, err := openTable(tmpdir, tableMeta{num: 1, size: size, smallest: w.smallest, largest: w.largest})
+	if !assert.Nil(t, err) {
+		return
+	}
+	tb.ref()
+	defer tb.unref(false)
+	assert.True(t, len(tb.handles) > 1)
+
+	v, _, ok, err := tb.get([]byte("key#050"), maxSeq)
+	if assert.Nil(t, err) && assert.True(t, ok) {
+		assert.Equal(t, "new", string(v))
+	}
+	v, _, ok, err = tb.get([]byte("key#050"), 150)
+	if assert.Nil(t, err) && assert.True(t, ok) {
+		assert.Equal(t, "old", string(v))
+	}
+	_, _, ok, err = tb.get([]byte("key#050"), 50)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, _, ok, _ = tb.get([]byte("missing"), maxSeq)
+	assert.False(t, ok)
+
+	it := tb.newIterator()
+	var n int
+	for it.Last(); it.Valid(); it.Prev() {
+		n++
+	}
+	assert.Equal(t, 200, n)
+	it.SeekLT(seekKey([]byte("key#050"), maxSeq))
+	if assert.True(t, it.Valid()) {
+		assert.Equal(t, "key#049", string(userKey(it.Key())))
+	}
+}
+
+func TestDBWriteAndCompact(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "lsm")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, testOptions())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	expected := make(map[string]string)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 500; i++ {
+			k := fmt.Sprintf("key#%04d", rand.Intn(1000))
+			var b Batch
+			if rand.Intn(10) == 0 {
+				b.Delete([]byte(k))
+				delete(expected, k)
+			} else {
+				v := fmt.Sprintf("value#%d#%d", round, i)
+				b.Set([]byte(k), []byte(v))
+				expected[k] = v
+			}
+			if !assert.Nil(t, db.Write(&b, []byte(fmt.Sprintf("checkpoint#%d", round)))) {
+				return
+			}
+		}
+	}
+
+	validate := func(db *DB) {
+		for i := 0; i < 1000; i++ {
+			k := fmt.Sprintf("key#%04d", i)
+			v, err := db.Get([]byte(k))
+			if ev, ok := expected[k]; ok {
+				if assert.Nil(t, err, k) {
+					assert.Equal(t, ev, string(v))
+				}
+			} else {
+				assert.Equal(t, ErrNotFound, err, k)
+			}
+		}
+		var keys []string
+		for k := range expected {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		snap := db.NewSnapshot()
+		assert.Equal(t, keys, collect(snap.NewIterator()))
+		snap.Release()
+	}
+	validate(db)
+	assert.Nil(t, db.Flush())
+	assert.Equal(t, "checkpoint#4", string(db.Checkpoint()))
+
+	db.lock.Lock()
+	var levels int
+	for level := 1; level < numLevels; level++ {
+		if len(db.current.levels[level]) > 0 {
+			levels++
+		}
+	}
+	db.lock.Unlock()
+	assert.True(t, levels > 0)
+	validate(db)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(tmpdir, testOptions())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+	assert.Equal(t, "checkpoint#4", string(db.Checkpoint()))
+	validate(db)
+}
+
+func TestDBSnapshot(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "lsm")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, testOptions())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	write := func(prefix string) {
+		for i := 0; i < 200; i++ {
+			var b Batch
+			b.Set([]byte(fmt.Sprintf("key#%03d", i)), []byte(prefix))
+			assert.Nil(t, db.Write(&b, nil))
+		}
+	}
+	write("v1")
+	snap := db.NewSnapshot()
+	defer snap.Release()
+
+	// the snapshot survives flushing and compacting
+	write("v2")
+	var b Batch
+	b.Delete([]byte("key#000"))
+	assert.Nil(t, db.Write(&b, nil))
+	assert.Nil(t, db.Flush())
+	write("v3")
+	assert.Nil(t, db.Flush())
+
+	v, err := snap.Get([]byte("key#000"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "v1", string(v))
+	}
+	it := snap.NewIterator()
+	var n int
+	for k, v := it.Last(); k != nil; k, v = it.Prev() {
+		assert.Equal(t, "v1", string(v))
+		n++
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 200, n)
+
+	v, err = db.Get([]byte("key#000"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "v3", string(v))
+	}
+}
+
+func TestIteratorDirections(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "lsm")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, testOptions())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	// the versions spread over the memtable and the tables
+	for round := 0; round < 3; round++ {
+		var b Batch
+		for i := 0; i < 10; i++ {
+			b.Set([]byte(fmt.Sprintf("key#%d", i)), []byte(fmt.Sprintf("%d", round)))
+		}
+		assert.Nil(t, db.Write(&b, nil))
+		if round < 2 {
+			assert.Nil(t, db.Flush())
+		}
+	}
+	var b Batch
+	b.Delete([]byte("key#5"))
+	assert.Nil(t, db.Write(&b, nil))
+
+	snap := db.NewSnapshot()
+	defer snap.Release()
+	it := snap.NewIterator()
+
+	k, v := it.Seek([]byte("key#4"))
+	assert.Equal(t, "key#4", string(k))
+	assert.Equal(t, "2", string(v))
+	k, _ = it.Next()
+	assert.Equal(t, "key#6", string(k))
+	k, _ = it.Prev()
+	assert.Equal(t, "key#4", string(k))
+	k, _ = it.Prev()
+	assert.Equal(t, "key#3", string(k))
+	k, _ = it.Next()
+	assert.Equal(t, "key#4", string(k))
+	k, _ = it.Seek([]byte("key#9a"))
+	assert.Nil(t, k)
+	k, _ = it.Last()
+	assert.Equal(t, "key#9", string(k))
+	k, _ = it.First()
+	assert.Equal(t, "key#0", string(k))
+	k, _ = it.Prev()
+	assert.Nil(t, k)
+}
+
+func TestDBConcurrentReadWrite(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "lsm")
+	defer os.RemoveAll(tmpdir)
+
+	db, err := Open(tmpdir, testOptions())
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				k := []byte(fmt.Sprintf("key#%d#%d", w, i))
+				var b Batch
+				b.Set(k, k)
+				assert.Nil(t, db.Write(&b, nil))
+				v, err := db.Get(k)
+				if assert.Nil(t, err) {
+					assert.Equal(t, k, v)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	snap := db.NewSnapshot()
+	assert.Equal(t, 2000, len(collect(snap.NewIterator())))
+	snap.Release()
+}
@@ -0,0 +1,68 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// The keys inside are internal keys, the user key followed by a trailer
+// of the sequence and the kind. They are ordered by the user key
+// ascending, then the trailer descending, so the newest version of a
+// user key comes first.
+//
+// | user key | seq(7) kind(1), little endian |
+
+type kind uint8
+
+const (
+	kindDelete kind = 0
+	kindSet    kind = 1
+
+	trailerSize int = 8
+
+	maxSeq uint64 = 1<<56 - 1
+)
+
+func makeInternalKey(ukey []byte, seq uint64, k kind) []byte {
+	ikey := make([]byte, len(ukey)+trailerSize)
+	copy(ikey, ukey)
+	binary.LittleEndian.PutUint64(ikey[len(ukey):], seq<<8|uint64(k))
+	return ikey
+}
+
+func userKey(ikey []byte) []byte {
+	return ikey[:len(ikey)-trailerSize]
+}
+
+func trailer(ikey []byte) uint64 {
+	return binary.LittleEndian.Uint64(ikey[len(ikey)-trailerSize:])
+}
+
+func parseInternalKey(ikey []byte) (ukey []byte, seq uint64, k kind) {
+	t := trailer(ikey)
+	return userKey(ikey), t >> 8, kind(t & 0xff)
+}
+
+func compareInternal(a, b []byte) int {
+	if c := bytes.Compare(userKey(a), userKey(b)); c != 0 {
+		return c
+	}
+	ta, tb := trailer(a), trailer(b)
+	if ta > tb {
+		return -1
+	}
+	if ta < tb {
+		return 1
+	}
+	return 0
+}
+
+// seekKey is the first internal key of ukey visible to seq.
+func seekKey(ukey []byte, seq uint64) []byte {
+	return makeInternalKey(ukey, seq, kindSet)
+}
+
+// afterKey is behind all the internal keys of ukey.
+func afterKey(ukey []byte) []byte {
+	return makeInternalKey(ukey, 0, kindDelete)
+}
@@ -0,0 +1,351 @@
+package lsm
+
+import (
+	"bytes"
+	"sort"
+)
+
+// iterator visits the internal keys in order.
+type iterator interface {
+	SeekGE(ikey []byte)
+	SeekLT(ikey []byte)
+	First()
+	Last()
+	Next()
+	Prev()
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+}
+
+// mergingIterator merges the children, the internal keys never repeat
+// among them.
+type mergingIterator struct {
+	children []iterator
+	curr     int
+	reversed bool
+}
+
+func newMergingIterator(children []iterator) *mergingIterator {
+	return &mergingIterator{children: children, curr: -1}
+}
+
+func (m *mergingIterator) pick() {
+	m.curr = -1
+	for i, c := range m.children {
+		if !c.Valid() {
+			continue
+		}
+		if m.curr < 0 {
+			m.curr = i
+			continue
+		}
+		cmp := compareInternal(c.Key(), m.children[m.curr].Key())
+		if (!m.reversed && cmp < 0) || (m.reversed && cmp > 0) {
+			m.curr = i
+		}
+	}
+}
+
+func (m *mergingIterator) SeekGE(ikey []byte) {
+	for _, c := range m.children {
+		c.SeekGE(ikey)
+	}
+	m.reversed = false
+	m.pick()
+}
+
+func (m *mergingIterator) SeekLT(ikey []byte) {
+	for _, c := range m.children {
+		c.SeekLT(ikey)
+	}
+	m.reversed = true
+	m.pick()
+}
+
+func (m *mergingIterator) First() {
+	for _, c := range m.children {
+		c.First()
+	}
+	m.reversed = false
+	m.pick()
+}
+
+func (m *mergingIterator) Last() {
+	for _, c := range m.children {
+		c.Last()
+	}
+	m.reversed = true
+	m.pick()
+}
+
+func (m *mergingIterator) Next() {
+	if m.reversed {
+		// the others are behind the current one, move them ahead
+		key := append([]byte{}, m.Key()...)
+		for i, c := range m.children {
+			if i != m.curr {
+				c.SeekGE(key)
+			}
+		}
+		m.reversed = false
+	}
+	m.children[m.curr].Next()
+	m.pick()
+}
+
+func (m *mergingIterator) Prev() {
+	if !m.reversed {
+		key := append([]byte{}, m.Key()...)
+		for i, c := range m.children {
+			if i != m.curr {
+				c.SeekLT(key)
+			}
+		}
+		m.reversed = true
+	}
+	m.children[m.curr].Prev()
+	m.pick()
+}
+
+func (m *mergingIterator) Valid() bool   { return m.curr >= 0 && m.Error() == nil }
+func (m *mergingIterator) Key() []byte   { return m.children[m.curr].Key() }
+func (m *mergingIterator) Value() []byte { return m.children[m.curr].Value() }
+
+func (m *mergingIterator) Error() error {
+	for _, c := range m.children {
+		if err := c.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// levelIterator concatenates the tables of a level above 0, they are
+// sorted and never overlap.
+type levelIterator struct {
+	tables []*table
+	ti     int
+	it     *tableIterator
+	err    error
+}
+
+func newLevelIterator(tables []*table) *levelIterator {
+	return &levelIterator{tables: tables, ti: -1}
+}
+
+func (l *levelIterator) open(ti int) bool {
+	if l.it != nil && l.it.Error() != nil {
+		l.err = l.it.Error()
+	}
+	l.it = nil
+	l.ti = ti
+	if ti < 0 || ti >= len(l.tables) {
+		return false
+	}
+	l.it = l.tables[ti].newIterator()
+	return true
+}
+
+func (l *levelIterator) SeekGE(ikey []byte) {
+	ti := sort.Search(len(l.tables), func(i int) bool {
+		return compareInternal(l.tables[i].largest, ikey) >= 0
+	})
+	if l.open(ti) {
+		l.it.SeekGE(ikey)
+		l.skipForward()
+	}
+}
+
+func (l *levelIterator) SeekLT(ikey []byte) {
+	ti := sort.Search(len(l.tables), func(i int) bool {
+		return compareInternal(l.tables[i].smallest, ikey) >= 0
+	}) - 1
+	if l.open(ti) {
+		l.it.SeekLT(ikey)
+		l.skipBackward()
+	}
+}
+
+func (l *levelIterator) First() {
+	if l.open(0) {
+		l.it.First()
+		l.skipForward()
+	}
+}
+
+func (l *levelIterator) Last() {
+	if l.open(len(l.tables) - 1) {
+		l.it.Last()
+		l.skipBackward()
+	}
+}
+
+func (l *levelIterator) Next() {
+	l.it.Next()
+	l.skipForward()
+}
+
+func (l *levelIterator) Prev() {
+	l.it.Prev()
+	l.skipBackward()
+}
+
+func (l *levelIterator) skipForward() {
+	for l.it != nil && !l.it.Valid() && l.it.Error() == nil {
+		if l.open(l.ti + 1) {
+			l.it.First()
+		}
+	}
+}
+
+func (l *levelIterator) skipBackward() {
+	for l.it != nil && !l.it.Valid() && l.it.Error() == nil {
+		if l.open(l.ti - 1) {
+			l.it.Last()
+		}
+	}
+}
+
+func (l *levelIterator) Valid() bool   { return l.it != nil && l.it.Valid() }
+func (l *levelIterator) Key() []byte   { return l.it.Key() }
+func (l *levelIterator) Value() []byte { return l.it.Value() }
+
+func (l *levelIterator) Error() error {
+	if l.err != nil {
+		return l.err
+	}
+	if l.it != nil {
+		return l.it.Error()
+	}
+	return nil
+}
+
+// Iterator visits the user keys of a snapshot in order, the same as a
+// bolt cursor. The keys and values returned are valid until moved.
+type Iterator struct {
+	iter     iterator
+	seq      uint64
+	key      []byte
+	value    []byte
+	valid    bool
+	reversed bool
+}
+
+func newIterator(iter iterator, seq uint64) *Iterator {
+	return &Iterator{iter: iter, seq: seq}
+}
+
+func (it *Iterator) result() ([]byte, []byte) {
+	if !it.valid {
+		return nil, nil
+	}
+	return it.key, it.value
+}
+
+// Err returns the error reading tables, the iterator stops then.
+func (it *Iterator) Err() error {
+	return it.iter.Error()
+}
+
+// findNext stops at the newest visible version of the first user key
+// from the position forward, the tombstones skipped with the versions
+// behind them. The user key skip is already visited.
+func (it *Iterator) findNext(skip []byte) {
+	it.reversed = false
+	it.valid = false
+	for ; it.iter.Valid(); it.iter.Next() {
+		ukey, seq, k := parseInternalKey(it.iter.Key())
+		if seq > it.seq {
+			continue
+		}
+		if skip != nil && bytes.Equal(ukey, skip) {
+			continue
+		}
+		if k == kindDelete {
+			skip = append(skip[:0:0], ukey...)
+			continue
+		}
+		it.key = append(it.key[:0], ukey...)
+		it.value = append(it.value[:0], it.iter.Value()...)
+		it.valid = true
+		return
+	}
+}
+
+// findPrev stops at the last user key visible from the position
+// backward. The versions of a user key come from the oldest then, the
+// last visible one is the newest.
+func (it *Iterator) findPrev() {
+	it.reversed = true
+	it.valid = false
+	var (
+		ukey, value []byte
+		k           kind
+		found       bool
+	)
+	for ; it.iter.Valid(); it.iter.Prev() {
+		iukey, seq, ik := parseInternalKey(it.iter.Key())
+		if seq > it.seq {
+			continue
+		}
+		if found && !bytes.Equal(iukey, ukey) && k == kindSet {
+			// the iter stays at the smaller one
+			break
+		}
+		ukey = append(ukey[:0], iukey...)
+		value = append(value[:0], it.iter.Value()...)
+		k = ik
+		found = true
+	}
+	if found && k == kindSet {
+		it.key = append(it.key[:0], ukey...)
+		it.value = append(it.value[:0], value...)
+		it.valid = true
+	}
+}
+
+func (it *Iterator) First() ([]byte, []byte) {
+	it.iter.First()
+	it.findNext(nil)
+	return it.result()
+}
+
+func (it *Iterator) Last() ([]byte, []byte) {
+	it.iter.Last()
+	it.findPrev()
+	return it.result()
+}
+
+// Seek moves to the first user key not less than key.
+func (it *Iterator) Seek(key []byte) ([]byte, []byte) {
+	it.iter.SeekGE(seekKey(key, maxSeq))
+	it.findNext(nil)
+	return it.result()
+}
+
+func (it *Iterator) Next() ([]byte, []byte) {
+	if !it.valid {
+		return nil, nil
+	}
+	if it.reversed {
+		it.iter.SeekGE(afterKey(it.key))
+		it.findNext(nil)
+	} else {
+		it.iter.Next()
+		it.findNext(append([]byte{}, it.key...))
+	}
+	return it.result()
+}
+
+func (it *Iterator) Prev() ([]byte, []byte) {
+	if !it.valid {
+		return nil, nil
+	}
+	if !it.reversed {
+		it.iter.SeekLT(seekKey(it.key, maxSeq))
+	}
+	it.findPrev()
+	return it.result()
+}
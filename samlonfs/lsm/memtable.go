@@ -0,0 +1,51 @@
+package lsm
+
+import (
+	"bytes"
+)
+
+// memtable buffers the latest writes in a skiplist, it's immutable
+// once rotated and flushed into a level 0 table later.
+type memtable struct {
+	list *skiplist
+
+	// guarded by the db lock
+	maxSeq     uint64
+	checkpoint []byte // the latest checkpoint written into it
+}
+
+func newMemtable() *memtable {
+	return &memtable{list: newSkiplist()}
+}
+
+func (m *memtable) add(seq uint64, k kind, ukey, value []byte) {
+	m.list.insert(makeInternalKey(ukey, seq, k), value)
+	if seq > m.maxSeq {
+		m.maxSeq = seq
+	}
+}
+
+// get returns the newest version of ukey visible to seq.
+func (m *memtable) get(ukey []byte, seq uint64) (value []byte, k kind, ok bool) {
+	n := m.list.findGE(seekKey(ukey, seq), nil)
+	if n == nil {
+		return nil, 0, false
+	}
+	nukey, _, nk := parseInternalKey(n.key)
+	if !bytes.Equal(nukey, ukey) {
+		return nil, 0, false
+	}
+	return n.value, nk, true
+}
+
+func (m *memtable) size() int64 {
+	return m.list.Size()
+}
+
+func (m *memtable) empty() bool {
+	return m.list.Len() == 0
+}
+
+func (m *memtable) newIterator() iterator {
+	return m.list.newIterator()
+}
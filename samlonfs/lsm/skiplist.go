@@ -0,0 +1,178 @@
+package lsm
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	maxHeight int = 12
+	branching int = 4
+)
+
+type node struct {
+	key   []byte
+	value []byte
+	next  []unsafe.Pointer // *node, accessed via atomics
+}
+
+func (n *node) getNext(level int) *node {
+	return (*node)(atomic.LoadPointer(&n.next[level]))
+}
+
+func (n *node) setNext(level int, next *node) {
+	atomic.StorePointer(&n.next[level], unsafe.Pointer(next))
+}
+
+// skiplist is ordered by internal keys. The inserting is serialized by
+// a lock, the readers never lock. A node is linked from the bottom up,
+// so the readers see it once it's linked at the level 0.
+type skiplist struct {
+	head   *node
+	height int32 // accessed via atomics
+
+	lock sync.Mutex
+	rnd  *rand.Rand
+
+	size  int64 // bytes of keys and values, accessed via atomics
+	count int64 // accessed via atomics
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:   &node{next: make([]unsafe.Pointer, maxHeight)},
+		height: 1,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *skiplist) randomHeight() int {
+	h := 1
+	for h < maxHeight && s.rnd.Intn(branching) == 0 {
+		h++
+	}
+	return h
+}
+
+func (s *skiplist) getHeight() int {
+	return int(atomic.LoadInt32(&s.height))
+}
+
+// findGE returns the first node not less than key, and fills the nodes
+// before it at every level into prev if not nil.
+func (s *skiplist) findGE(key []byte, prev []*node) *node {
+	x := s.head
+	level := s.getHeight() - 1
+	for {
+		next := x.getNext(level)
+		if next != nil && compareInternal(next.key, key) < 0 {
+			x = next
+			continue
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+		level--
+	}
+}
+
+// findLT returns the last node less than key, nil if no such one.
+func (s *skiplist) findLT(key []byte) *node {
+	x := s.head
+	level := s.getHeight() - 1
+	for {
+		next := x.getNext(level)
+		if next != nil && compareInternal(next.key, key) < 0 {
+			x = next
+			continue
+		}
+		if level == 0 {
+			if x == s.head {
+				return nil
+			}
+			return x
+		}
+		level--
+	}
+}
+
+func (s *skiplist) findLast() *node {
+	x := s.head
+	level := s.getHeight() - 1
+	for {
+		next := x.getNext(level)
+		if next != nil {
+			x = next
+			continue
+		}
+		if level == 0 {
+			if x == s.head {
+				return nil
+			}
+			return x
+		}
+		level--
+	}
+}
+
+// insert adds the internal key, it must not be in the list.
+func (s *skiplist) insert(key, value []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var prev [maxHeight]*node
+	s.findGE(key, prev[:])
+
+	h := s.randomHeight()
+	if curr := s.getHeight(); h > curr {
+		for i := curr; i < h; i++ {
+			prev[i] = s.head
+		}
+		// the readers seeing the new height before the node linked just
+		// go down from the head.
+		atomic.StoreInt32(&s.height, int32(h))
+	}
+
+	n := &node{key: key, value: value, next: make([]unsafe.Pointer, h)}
+	for i := 0; i < h; i++ {
+		n.next[i] = prev[i].next[i]
+		prev[i].setNext(i, n)
+	}
+	atomic.AddInt64(&s.size, int64(len(key)+len(value)))
+	atomic.AddInt64(&s.count, 1)
+}
+
+func (s *skiplist) Size() int64 {
+	return atomic.LoadInt64(&s.size)
+}
+
+func (s *skiplist) Len() int64 {
+	return atomic.LoadInt64(&s.count)
+}
+
+// skiplistIterator implements the internal iterator.
+type skiplistIterator struct {
+	list *skiplist
+	n    *node
+}
+
+func (s *skiplist) newIterator() *skiplistIterator {
+	return &skiplistIterator{list: s}
+}
+
+func (it *skiplistIterator) SeekGE(key []byte) { it.n = it.list.findGE(key, nil) }
+func (it *skiplistIterator) SeekLT(key []byte) { it.n = it.list.findLT(key) }
+func (it *skiplistIterator) First()            { it.n = it.list.head.getNext(0) }
+func (it *skiplistIterator) Last()             { it.n = it.list.findLast() }
+func (it *skiplistIterator) Next()             { it.n = it.n.getNext(0) }
+func (it *skiplistIterator) Prev()             { it.n = it.list.findLT(it.n.key) }
+func (it *skiplistIterator) Valid() bool       { return it.n != nil }
+func (it *skiplistIterator) Key() []byte       { return it.n.key }
+func (it *skiplistIterator) Value() []byte     { return it.n.value }
+func (it *skiplistIterator) Error() error      { return nil }
@@ -0,0 +1,455 @@
+package lsm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// The table file is immutable once written.
+//
+// | data block | crc32 | ... | filter | crc32 | index | crc32 | footer |
+//
+// The blocks are sequences of entries, the index block maps the last
+// internal key of every data block to its handle.
+//
+// entry:  | key len(uvarint) | value len(uvarint) | key | value |
+// footer: | filter offset(8) | filter len(8) | index offset(8) | index len(8) | magic(8) |
+const (
+	tableMagic       uint64 = 0x73616d6c6f6e7462 // "samlontb"
+	tableFooterSize  int    = 40
+	blockTrailerSize int    = crc32.Size
+	tableFileSuffix  string = ".sst"
+)
+
+var (
+	ErrTableCorrupted error = errors.New("table corrupted")
+)
+
+func tableFileName(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", num, tableFileSuffix))
+}
+
+type blockHandle struct {
+	offset uint64
+	length uint64
+}
+
+func (h blockHandle) encode() []byte {
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, h.offset)
+	n += binary.PutUvarint(buf[n:], h.length)
+	return buf[:n]
+}
+
+func decodeBlockHandle(buf []byte) (h blockHandle, ok bool) {
+	var n, m int
+	h.offset, n = binary.Uvarint(buf)
+	if n <= 0 {
+		return h, false
+	}
+	h.length, m = binary.Uvarint(buf[n:])
+	return h, m > 0
+}
+
+func appendEntry(dst, key, value []byte) []byte {
+	var buf [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(key)))
+	n += binary.PutUvarint(buf[n:], uint64(len(value)))
+	dst = append(dst, buf[:n]...)
+	dst = append(dst, key...)
+	return append(dst, value...)
+}
+
+// decodeBlock splits the block into entries, they refer to the block.
+func decodeBlock(block []byte) (keys, values [][]byte, err error) {
+	for len(block) > 0 {
+		klen, n := binary.Uvarint(block)
+		if n <= 0 {
+			return nil, nil, ErrTableCorrupted
+		}
+		block = block[n:]
+		vlen, n := binary.Uvarint(block)
+		if n <= 0 || uint64(len(block)-n) < klen+vlen {
+			return nil, nil, ErrTableCorrupted
+		}
+		block = block[n:]
+		keys = append(keys, block[:klen])
+		values = append(values, block[klen:klen+vlen])
+		block = block[klen+vlen:]
+	}
+	return keys, values, nil
+}
+
+// tableWriter writes the sorted internal keys into a new table file.
+type tableWriter struct {
+	path       string
+	fd         *os.File
+	bw         *bufio.Writer
+	offset     uint64
+	blockSize  int
+	bitsPerKey int
+
+	block     []byte
+	blockLast []byte
+	index     []byte
+	hashes    []uint32
+	lastUkey  []byte
+
+	smallest []byte
+	largest  []byte
+	count    int
+}
+
+func newTableWriter(path string, blockSize, bitsPerKey int) (*tableWriter, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to create table %q", path)
+	}
+	return &tableWriter{
+		path:       path,
+		fd:         fd,
+		bw:         bufio.NewWriter(fd),
+		blockSize:  blockSize,
+		bitsPerKey: bitsPerKey,
+	}, nil
+}
+
+// add appends the internal key, which must be bigger than the last one.
+func (w *tableWriter) add(ikey, value []byte) error {
+	if w.count == 0 {
+		w.smallest = append([]byte{}, ikey...)
+	}
+	w.largest = append(w.largest[:0], ikey...)
+	w.count++
+
+	ukey := userKey(ikey)
+	if w.count == 1 || !bytes.Equal(ukey, w.lastUkey) {
+		w.hashes = append(w.hashes, bloomHash(ukey))
+		w.lastUkey = append(w.lastUkey[:0], ukey...)
+	}
+
+	w.block = appendEntry(w.block, ikey, value)
+	w.blockLast = append(w.blockLast[:0], ikey...)
+	if len(w.block) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *tableWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	h, err := w.writeBlock(w.block)
+	if err != nil {
+		return err
+	}
+	w.index = appendEntry(w.index, w.blockLast, h.encode())
+	w.block = w.block[:0]
+	return nil
+}
+
+func (w *tableWriter) writeBlock(block []byte) (blockHandle, error) {
+	h := blockHandle{offset: w.offset, length: uint64(len(block))}
+	var crc [blockTrailerSize]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(block))
+	if _, err := w.bw.Write(block); err != nil {
+		return h, errors.Wrapf(err, "Unable to write table %q", w.path)
+	}
+	if _, err := w.bw.Write(crc[:]); err != nil {
+		return h, errors.Wrapf(err, "Unable to write table %q", w.path)
+	}
+	w.offset += uint64(len(block) + blockTrailerSize)
+	return h, nil
+}
+
+func (w *tableWriter) estimatedSize() uint64 {
+	return w.offset + uint64(len(w.block))
+}
+
+// finish writes the filter, the index and the footer, and syncs the
+// file. It returns the size of the table.
+func (w *tableWriter) finish() (uint64, error) {
+	defer w.fd.Close()
+	if err := w.flushBlock(); err != nil {
+		return 0, err
+	}
+	fh, err := w.writeBlock(newBloomFilter(w.hashes, w.bitsPerKey))
+	if err != nil {
+		return 0, err
+	}
+	ih, err := w.writeBlock(w.index)
+	if err != nil {
+		return 0, err
+	}
+	footer := make([]byte, tableFooterSize)
+	binary.BigEndian.PutUint64(footer[0:8], fh.offset)
+	binary.BigEndian.PutUint64(footer[8:16], fh.length)
+	binary.BigEndian.PutUint64(footer[16:24], ih.offset)
+	binary.BigEndian.PutUint64(footer[24:32], ih.length)
+	binary.BigEndian.PutUint64(footer[32:40], tableMagic)
+	if _, err := w.bw.Write(footer); err != nil {
+		return 0, errors.Wrapf(err, "Unable to write table %q", w.path)
+	}
+	if err := w.bw.Flush(); err != nil {
+		return 0, errors.Wrapf(err, "Unable to flush table %q", w.path)
+	}
+	if err := w.fd.Sync(); err != nil {
+		return 0, errors.Wrapf(err, "Unable to sync table %q", w.path)
+	}
+	return w.offset + uint64(tableFooterSize), nil
+}
+
+// abort drops the table unfinished.
+func (w *tableWriter) abort() {
+	w.fd.Close()
+	os.Remove(w.path)
+}
+
+// tableMeta is what the manifest knows about a table.
+type tableMeta struct {
+	num      uint64
+	size     uint64
+	smallest []byte // internal key
+	largest  []byte // internal key
+}
+
+// overlaps tells whether the table holds any user key in [smallest, largest].
+func (m *tableMeta) overlaps(smallest, largest []byte) bool {
+	return bytes.Compare(userKey(m.largest), smallest) >= 0 &&
+		bytes.Compare(userKey(m.smallest), largest) <= 0
+}
+
+// table reads an immutable table file, the filter and the index are
+// kept in memory. It's referenced by versions, and removed once no
+// version refers to it.
+type table struct {
+	tableMeta
+	path string
+	fd   *os.File
+
+	filter    bloomFilter
+	lastKeys  [][]byte
+	handles   []blockHandle
+	indexData []byte
+
+	refs int32 // accessed via atomics
+}
+
+func openTable(dir string, meta tableMeta) (*table, error) {
+	t := &table{tableMeta: meta, path: tableFileName(dir, meta.num)}
+	fd, err := os.Open(t.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to open table %q", t.path)
+	}
+	t.fd = fd
+	if err := t.load(); err != nil {
+		fd.Close()
+		return nil, errors.Wrapf(err, "Unable to load table %q", t.path)
+	}
+	return t, nil
+}
+
+func (t *table) load() error {
+	if t.size < uint64(tableFooterSize) {
+		return ErrTableCorrupted
+	}
+	footer := make([]byte, tableFooterSize)
+	if _, err := t.fd.ReadAt(footer, int64(t.size)-int64(tableFooterSize)); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(footer[32:40]) != tableMagic {
+		return ErrTableCorrupted
+	}
+	filter, err := t.readBlock(blockHandle{
+		offset: binary.BigEndian.Uint64(footer[0:8]),
+		length: binary.BigEndian.Uint64(footer[8:16]),
+	})
+	if err != nil {
+		return err
+	}
+	t.filter = filter
+
+	t.indexData, err = t.readBlock(blockHandle{
+		offset: binary.BigEndian.Uint64(footer[16:24]),
+		length: binary.BigEndian.Uint64(footer[24:32]),
+	})
+	if err != nil {
+		return err
+	}
+	keys, values, err := decodeBlock(t.indexData)
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		h, ok := decodeBlockHandle(values[i])
+		if !ok {
+			return ErrTableCorrupted
+		}
+		t.lastKeys = append(t.lastKeys, keys[i])
+		t.handles = append(t.handles, h)
+	}
+	return nil
+}
+
+func (t *table) readBlock(h blockHandle) ([]byte, error) {
+	if h.offset+h.length+uint64(blockTrailerSize) > t.size {
+		return nil, ErrTableCorrupted
+	}
+	buf := make([]byte, h.length+uint64(blockTrailerSize))
+	if _, err := t.fd.ReadAt(buf, int64(h.offset)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	block := buf[:h.length]
+	if crc32.ChecksumIEEE(block) != binary.BigEndian.Uint32(buf[h.length:]) {
+		return nil, ErrTableCorrupted
+	}
+	return block, nil
+}
+
+// get returns the newest version of ukey visible to seq.
+func (t *table) get(ukey []byte, seq uint64) (value []byte, k kind, ok bool, err error) {
+	if !t.filter.mayContain(ukey) {
+		return nil, 0, false, nil
+	}
+	it := t.newIterator()
+	it.SeekGE(seekKey(ukey, seq))
+	if !it.Valid() {
+		return nil, 0, false, it.Error()
+	}
+	iukey, _, ik := parseInternalKey(it.Key())
+	if !bytes.Equal(iukey, ukey) {
+		return nil, 0, false, nil
+	}
+	return it.Value(), ik, true, nil
+}
+
+func (t *table) ref() {
+	atomic.AddInt32(&t.refs, 1)
+}
+
+// unref closes the table once no one refers to it, the file is removed
+// as well if asked.
+func (t *table) unref(remove bool) error {
+	if atomic.AddInt32(&t.refs, -1) > 0 {
+		return nil
+	}
+	if err := t.fd.Close(); err != nil {
+		return errors.Wrapf(err, "Unable to close table %q", t.path)
+	}
+	if remove {
+		if err := os.Remove(t.path); err != nil {
+			return errors.Wrapf(err, "Unable to remove table %q", t.path)
+		}
+	}
+	return nil
+}
+
+// tableIterator implements the internal iterator, the current block is
+// decoded in memory.
+type tableIterator struct {
+	t      *table
+	bi     int
+	keys   [][]byte
+	values [][]byte
+	pos    int
+	err    error
+}
+
+func (t *table) newIterator() *tableIterator {
+	return &tableIterator{t: t}
+}
+
+func (it *tableIterator) loadBlock(bi int) bool {
+	it.keys, it.values, it.pos = nil, nil, 0
+	if bi < 0 || bi >= len(it.t.handles) {
+		return false
+	}
+	block, err := it.t.readBlock(it.t.handles[bi])
+	if err == nil {
+		it.keys, it.values, err = decodeBlock(block)
+	}
+	if err != nil {
+		it.err = errors.Wrapf(err, "Unable to read block %d of table %q", bi, it.t.path)
+		it.keys, it.values = nil, nil
+		return false
+	}
+	it.bi = bi
+	return len(it.keys) > 0
+}
+
+func (it *tableIterator) searchBlock(ikey []byte) int {
+	return sort.Search(len(it.t.lastKeys), func(i int) bool {
+		return compareInternal(it.t.lastKeys[i], ikey) >= 0
+	})
+}
+
+func (it *tableIterator) searchEntry(ikey []byte) int {
+	return sort.Search(len(it.keys), func(i int) bool {
+		return compareInternal(it.keys[i], ikey) >= 0
+	})
+}
+
+func (it *tableIterator) SeekGE(ikey []byte) {
+	if !it.loadBlock(it.searchBlock(ikey)) {
+		return
+	}
+	it.pos = it.searchEntry(ikey)
+}
+
+func (it *tableIterator) SeekLT(ikey []byte) {
+	bi := it.searchBlock(ikey)
+	if bi == len(it.t.handles) {
+		it.Last()
+		return
+	}
+	if !it.loadBlock(bi) {
+		return
+	}
+	it.pos = it.searchEntry(ikey) - 1
+	if it.pos < 0 && it.loadBlock(bi-1) {
+		it.pos = len(it.keys) - 1
+	}
+}
+
+func (it *tableIterator) First() {
+	it.loadBlock(0)
+}
+
+func (it *tableIterator) Last() {
+	if it.loadBlock(len(it.t.handles) - 1) {
+		it.pos = len(it.keys) - 1
+	}
+}
+
+func (it *tableIterator) Next() {
+	it.pos++
+	if it.pos >= len(it.keys) {
+		it.loadBlock(it.bi + 1)
+	}
+}
+
+func (it *tableIterator) Prev() {
+	it.pos--
+	if it.pos < 0 && it.loadBlock(it.bi-1) {
+		it.pos = len(it.keys) - 1
+	}
+}
+
+func (it *tableIterator) Valid() bool {
+	return it.err == nil && it.pos >= 0 && it.pos < len(it.keys)
+}
+
+func (it *tableIterator) Key() []byte   { return it.keys[it.pos] }
+func (it *tableIterator) Value() []byte { return it.values[it.pos] }
+func (it *tableIterator) Error() error  { return it.err }
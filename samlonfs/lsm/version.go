@@ -0,0 +1,261 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	numLevels    int    = 7
+	manifestFile string = "MANIFEST"
+)
+
+var (
+	ErrManifestCorrupted error = errors.New("manifest corrupted")
+)
+
+// version is an immutable set of tables. The level 0 tables are from
+// the newest, they may overlap. The tables of the other levels are
+// sorted and never overlap.
+type version struct {
+	levels [numLevels][]*table
+	refs   int32 // accessed via atomics
+}
+
+func newVersion(levels [numLevels][]*table) *version {
+	v := &version{levels: levels, refs: 1}
+	for level := range v.levels {
+		for _, t := range v.levels[level] {
+			t.ref()
+		}
+	}
+	return v
+}
+
+func (v *version) ref() {
+	atomic.AddInt32(&v.refs, 1)
+}
+
+// unref releases the tables once no one refers to the version, the
+// tables no longer in any version are removed if asked.
+func (v *version) unref(remove bool) error {
+	if atomic.AddInt32(&v.refs, -1) > 0 {
+		return nil
+	}
+	var firstErr error
+	for level := range v.levels {
+		for _, t := range v.levels[level] {
+			if err := t.unref(remove); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (v *version) levelSize(level int) uint64 {
+	var size uint64
+	for _, t := range v.levels[level] {
+		size += t.size
+	}
+	return size
+}
+
+// overlapping returns the tables of the level holding any user key in
+// [smallest, largest].
+func (v *version) overlapping(level int, smallest, largest []byte) []*table {
+	var tables []*table
+	for _, t := range v.levels[level] {
+		if t.overlaps(smallest, largest) {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// get returns the newest version of ukey visible to seq in the tables.
+func (v *version) get(ukey []byte, seq uint64) (value []byte, k kind, ok bool, err error) {
+	for _, t := range v.levels[0] {
+		if !t.overlaps(ukey, ukey) {
+			continue
+		}
+		if value, k, ok, err = t.get(ukey, seq); ok || err != nil {
+			return
+		}
+	}
+	for level := 1; level < numLevels; level++ {
+		tables := v.levels[level]
+		i := sort.Search(len(tables), func(i int) bool {
+			return bytes.Compare(userKey(tables[i].largest), ukey) >= 0
+		})
+		if i == len(tables) || bytes.Compare(userKey(tables[i].smallest), ukey) > 0 {
+			continue
+		}
+		if value, k, ok, err = tables[i].get(ukey, seq); ok || err != nil {
+			return
+		}
+	}
+	return nil, 0, false, nil
+}
+
+func (v *version) iterators() []iterator {
+	var iters []iterator
+	for _, t := range v.levels[0] {
+		iters = append(iters, t.newIterator())
+	}
+	for level := 1; level < numLevels; level++ {
+		if len(v.levels[level]) > 0 {
+			iters = append(iters, newLevelIterator(v.levels[level]))
+		}
+	}
+	return iters
+}
+
+// manifest is the state persisted, rewritten as a whole by renaming.
+//
+// | next file(8) | last seq(8) | checkpoint len(4) | checkpoint |
+// | level tables(4) | table ... | ... every level | crc32(4) |
+//
+// table: | num(8) | size(8) | smallest len(4) | smallest | largest len(4) | largest |
+type manifest struct {
+	nextFile   uint64
+	lastSeq    uint64
+	checkpoint []byte
+	levels     [numLevels][]tableMeta
+}
+
+func appendBytes(dst, b []byte) []byte {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+	dst = append(dst, l[:]...)
+	return append(dst, b...)
+}
+
+func (m *manifest) encode() []byte {
+	buf := make([]byte, 16, 64)
+	binary.BigEndian.PutUint64(buf[0:8], m.nextFile)
+	binary.BigEndian.PutUint64(buf[8:16], m.lastSeq)
+	buf = appendBytes(buf, m.checkpoint)
+	var u [8]byte
+	for level := range m.levels {
+		binary.BigEndian.PutUint32(u[:4], uint32(len(m.levels[level])))
+		buf = append(buf, u[:4]...)
+		for _, t := range m.levels[level] {
+			binary.BigEndian.PutUint64(u[:], t.num)
+			buf = append(buf, u[:]...)
+			binary.BigEndian.PutUint64(u[:], t.size)
+			buf = append(buf, u[:]...)
+			buf = appendBytes(buf, t.smallest)
+			buf = appendBytes(buf, t.largest)
+		}
+	}
+	binary.BigEndian.PutUint32(u[:4], crc32.ChecksumIEEE(buf))
+	return append(buf, u[:4]...)
+}
+
+type manifestReader struct {
+	buf []byte
+	err bool
+}
+
+func (r *manifestReader) next(n int) []byte {
+	if r.err || len(r.buf) < n {
+		r.err = true
+		return make([]byte, n)
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *manifestReader) uint32() uint32 { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *manifestReader) uint64() uint64 { return binary.BigEndian.Uint64(r.next(8)) }
+func (r *manifestReader) bytes() []byte {
+	return append([]byte{}, r.next(int(r.uint32()))...)
+}
+
+func decodeManifest(buf []byte) (*manifest, error) {
+	if len(buf) < 4 {
+		return nil, ErrManifestCorrupted
+	}
+	body := buf[:len(buf)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(buf[len(buf)-4:]) {
+		return nil, ErrManifestCorrupted
+	}
+	r := &manifestReader{buf: body}
+	m := &manifest{}
+	m.nextFile = r.uint64()
+	m.lastSeq = r.uint64()
+	m.checkpoint = r.bytes()
+	if len(m.checkpoint) == 0 {
+		m.checkpoint = nil
+	}
+	for level := range m.levels {
+		n := r.uint32()
+		for i := uint32(0); i < n && !r.err; i++ {
+			var t tableMeta
+			t.num = r.uint64()
+			t.size = r.uint64()
+			t.smallest = r.bytes()
+			t.largest = r.bytes()
+			m.levels[level] = append(m.levels[level], t)
+		}
+	}
+	if r.err || len(r.buf) > 0 {
+		return nil, ErrManifestCorrupted
+	}
+	return m, nil
+}
+
+// readManifest returns nil if the db is new.
+func readManifest(dir string) (*manifest, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to read manifest")
+	}
+	return decodeManifest(buf)
+}
+
+func writeManifest(dir string, m *manifest) error {
+	path := filepath.Join(dir, manifestFile)
+	tmp := path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create file %q", tmp)
+	}
+	if _, err := fd.Write(m.encode()); err != nil {
+		fd.Close()
+		return errors.Wrapf(err, "Unable to write file %q", tmp)
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return errors.Wrapf(err, "Unable to sync file %q", tmp)
+	}
+	if err := fd.Close(); err != nil {
+		return errors.Wrapf(err, "Unable to close file %q", tmp)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrapf(err, "Unable to rename %q to %q", tmp, path)
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
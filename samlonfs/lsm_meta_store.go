@@ -0,0 +1,159 @@
+package samlonfs
+
+import (
+	"path"
+
+	"github.com/EricYT/go-examples/samlonfs/lsm"
+	"github.com/pkg/errors"
+)
+
+const lsmDir string = "index"
+
+// lsmMetaStore keeps the index in a LSM tree, the writing never waits
+// for a single writer tx like bolt. The head is the checkpoint of the
+// LSM tree, which is durable once the memtable flushed, the value log is
+// replayed from it after crashing.
+type lsmMetaStore struct {
+	dirPath string
+	opts    lsm.Options
+
+	db *lsm.DB
+}
+
+func NewLSMMetaStore(dir string, opts lsm.Options) *lsmMetaStore {
+	return &lsmMetaStore{
+		dirPath: dir,
+		opts:    opts,
+	}
+}
+
+func (m *lsmMetaStore) dbPath() string {
+	return path.Join(m.dirPath, lsmDir)
+}
+
+func (m *lsmMetaStore) Open() error {
+	db, err := lsm.Open(m.dbPath(), m.opts)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open lsm db %q", m.dbPath())
+	}
+	m.db = db
+	return nil
+}
+
+func (m *lsmMetaStore) Close() error {
+	return m.db.Close()
+}
+
+func (m *lsmMetaStore) Get(key []byte) ([]byte, error) {
+	value, err := m.db.Get(key)
+	if err == lsm.ErrNotFound {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (m *lsmMetaStore) PutBatch(keys, values [][]byte, head valuePointer) ([]valuePointer, error) {
+	var b lsm.Batch
+	var olds []valuePointer
+	// the keys written before in the same batch
+	pending := make(map[string][]byte)
+	for i := range keys {
+		old, ok := pending[string(keys[i])]
+		if !ok {
+			var err error
+			if old, err = m.Get(keys[i]); err != nil {
+				return nil, err
+			}
+		}
+		if vp, _, ok := decodeIndexValue(old); ok {
+			olds = append(olds, vp)
+		}
+		pending[string(keys[i])] = values[i]
+
+		if values[i] == nil {
+			b.Delete(keys[i])
+		} else {
+			b.Set(keys[i], values[i])
+		}
+	}
+	buf := make([]byte, valuePointerSize)
+	head.Encode(buf)
+	if err := m.db.Write(&b, buf); err != nil {
+		return nil, err
+	}
+	return olds, nil
+}
+
+func (m *lsmMetaStore) Head() (valuePointer, error) {
+	return decodeHead(m.db.Checkpoint()), nil
+}
+
+func decodeHead(buf []byte) valuePointer {
+	var head valuePointer
+	if len(buf) == valuePointerSize {
+		head.Decode(buf)
+	}
+	return head
+}
+
+// CompareAndSwap keeps the expiry of the keys swapped. The writeLock of
+// value store is held, nothing is written between checking and swapping.
+func (m *lsmMetaStore) CompareAndSwap(keys [][]byte, olds, news []valuePointer) error {
+	var b lsm.Batch
+	for i := range keys {
+		buf, err := m.Get(keys[i])
+		if err != nil {
+			return err
+		}
+		vp, expiresAt, ok := decodeIndexValue(buf)
+		if !ok {
+			continue
+		}
+		if vp.Fid != olds[i].Fid || vp.Offset != olds[i].Offset {
+			continue
+		}
+		if news[i].Len == 0 {
+			b.Delete(keys[i])
+			continue
+		}
+		b.Set(keys[i], encodeIndexValue(news[i], expiresAt))
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	return m.db.Write(&b, nil)
+}
+
+// Sync flushes the memtable, the writes with no checkpoint are durable
+// only by it.
+func (m *lsmMetaStore) Sync() error {
+	return m.db.Flush()
+}
+
+type lsmSnapshot struct {
+	snap *lsm.Snapshot
+}
+
+func (m *lsmMetaStore) Snapshot() (metaSnapshot, error) {
+	return &lsmSnapshot{snap: m.db.NewSnapshot()}, nil
+}
+
+func (ms *lsmSnapshot) Get(key []byte) []byte {
+	value, err := ms.snap.Get(key)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+func (ms *lsmSnapshot) Head() (valuePointer, error) {
+	return decodeHead(ms.snap.Checkpoint()), nil
+}
+
+func (ms *lsmSnapshot) Cursor() metaCursor {
+	return ms.snap.NewIterator()
+}
+
+func (ms *lsmSnapshot) Release() error {
+	return ms.snap.Release()
+}
@@ -0,0 +1,221 @@
+package samlonfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/EricYT/go-examples/samlonfs/lsm"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func testLSMSamlonOpts() Opts {
+	opts := testSamlonOpts()
+	opts.MetaStore = LSMMetaStore
+	opts.LSM = lsm.Options{
+		MemTableSize:        2 << 10,
+		TableSize:           2 << 10,
+		BlockSize:           256,
+		L0CompactionTrigger: 2,
+		LevelSizeBase:       8 << 10,
+	}
+	return opts
+}
+
+func TestSamlonLSMMetaStore(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	s := NewSamlon(zap.NewNop(), testLSMSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+
+	expected := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprintf("key#%03d", i)
+			if i%10 == round {
+				assert.Nil(t, s.Delete([]byte(k)))
+				delete(expected, k)
+				continue
+			}
+			v := fmt.Sprintf("value#%d#%d", round, i)
+			assert.Nil(t, s.Put([]byte(k), []byte(v)))
+			expected[k] = v
+		}
+	}
+	txn, err := s.NewTxn()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, txn.Set([]byte("key#txn"), []byte("value")))
+	assert.Nil(t, txn.Commit())
+	expected["key#txn"] = "value"
+
+	validate := func(s *Samlon) {
+		assert.Equal(t, expected, dumpSamlon(t, s))
+		for k, v := range expected {
+			got, err := s.Get([]byte(k))
+			if assert.Nil(t, err, k) {
+				assert.Equal(t, v, string(got))
+			}
+		}
+		// deleted in the last round
+		_, err := s.Get([]byte("key#002"))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	validate(s)
+
+	assert.Nil(t, s.RunValueLogGC(0.5))
+	validate(s)
+	assert.Nil(t, s.Close())
+
+	s = NewSamlon(zap.NewNop(), testLSMSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+	validate(s)
+}
+
+func TestSamlonLSMReplay(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	opts := testLSMSamlonOpts()
+	opts.LSM.MemTableSize = 1 << 20
+	s := NewSamlon(zap.NewNop(), opts, tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	for i := 0; i < 100; i++ {
+		k := []byte(fmt.Sprintf("key#%03d", i))
+		assert.Nil(t, s.Put(k, k))
+	}
+	ms := s.metaStore.(*lsmMetaStore)
+	assert.Nil(t, ms.db.Flush())
+	durable, err := s.metaStore.Head()
+	if !assert.Nil(t, err) {
+		return
+	}
+	for i := 100; i < 150; i++ {
+		k := []byte(fmt.Sprintf("key#%03d", i))
+		assert.Nil(t, s.Put(k, k))
+	}
+	assert.Nil(t, s.Delete([]byte("key#000")))
+	head, err := s.metaStore.Head()
+	if assert.Nil(t, err) {
+		assert.Equal(t, durable, head)
+	}
+
+	// crash, the memtable never flushed
+	close(s.closeCh)
+	s.writerWG.Wait()
+	assert.Nil(t, s.valueStore.Close())
+
+	s = NewSamlon(zap.NewNop(), opts, tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+	for i := 1; i < 150; i++ {
+		k := []byte(fmt.Sprintf("key#%03d", i))
+		v, err := s.Get(k)
+		if assert.Nil(t, err, string(k)) {
+			assert.Equal(t, k, v)
+		}
+	}
+	_, err = s.Get([]byte("key#000"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestSamlonLSMGCCrash(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	opts := testLSMSamlonOpts()
+	opts.LSM.MemTableSize = 1 << 20
+	opts.FileBlockMaxEntries = 4
+	s := NewSamlon(zap.NewNop(), opts, tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	assert.Nil(t, s.Put([]byte("a"), []byte("a")))
+	assert.Nil(t, s.Put([]byte("b"), []byte("b")))
+	ms := s.metaStore.(*lsmMetaStore)
+	assert.Nil(t, ms.db.Flush())
+	// the tombstone indexed only by the memtable
+	assert.Nil(t, s.Delete([]byte("a")))
+	for i := 0; i < 10; i++ {
+		k := []byte(fmt.Sprintf("key#%03d", i))
+		assert.Nil(t, s.Put(k, k))
+	}
+	// the file of the durable head kept for replaying
+	assert.Nil(t, s.RunValueLogGC(0))
+
+	// crash, the memtable never flushed
+	close(s.closeCh)
+	s.writerWG.Wait()
+	assert.Nil(t, s.valueStore.Close())
+
+	s = NewSamlon(zap.NewNop(), opts, tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+	_, err := s.Get([]byte("a"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	v, err := s.Get([]byte("b"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("b"), v)
+	}
+	for i := 0; i < 10; i++ {
+		k := []byte(fmt.Sprintf("key#%03d", i))
+		v, err := s.Get(k)
+		if assert.Nil(t, err, string(k)) {
+			assert.Equal(t, k, v)
+		}
+	}
+}
+
+func TestSamlonLSMGCExpiredCrash(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	opts := testLSMSamlonOpts()
+	opts.LSM.MemTableSize = 1 << 20
+	opts.FileBlockMaxEntries = 4
+	s := NewSamlon(zap.NewNop(), opts, tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	expiresAt := uint64(time.Now().Add(-time.Second).Unix())
+	assert.Nil(t, s.SetEntry(&Entry{Key: []byte("ttl"), Value: []byte("value"), ExpiresAt: expiresAt}))
+	for i := 0; i < 10; i++ {
+		k := []byte(fmt.Sprintf("key#%03d", i))
+		assert.Nil(t, s.Put(k, k))
+	}
+	ms := s.metaStore.(*lsmMetaStore)
+	assert.Nil(t, ms.db.Flush())
+	// the log file of the expired key removed
+	assert.Nil(t, s.RunValueLogGC(0))
+	_, err := os.Stat(s.valueStore.fpath(0))
+	assert.True(t, os.IsNotExist(err))
+
+	// crash, nothing flushed after gc
+	close(s.closeCh)
+	s.writerWG.Wait()
+	assert.Nil(t, s.valueStore.Close())
+
+	s = NewSamlon(zap.NewNop(), opts, tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+	_, err = s.Get([]byte("ttl"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
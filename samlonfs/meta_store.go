@@ -1,6 +1,7 @@
 package samlonfs
 
 import (
+	"encoding/binary"
 	"fmt"
 	"os"
 
@@ -13,8 +14,53 @@ var (
 	metaOthersBucket []byte = []byte("meta-others-bucket")
 
 	boltDBFile string = "meta.db"
+
+	metaInitialMmapSize int = 1 << 30
+
+	// the last value pointer indexed, in the others bucket
+	headKey []byte = []byte("head")
 )
 
+// metaEngine keeps the index of the keys to the value pointers and the
+// head, implemented by the bolt MetaStore and the LSM one.
+type metaEngine interface {
+	Open() error
+	Close() error
+	Get(key []byte) ([]byte, error)
+	// PutBatch puts all the keys and moves the head to the last one
+	// value pointer in one batch. A nil value deletes the key. It returns
+	// the value pointers replaced or deleted.
+	PutBatch(keys, values [][]byte, head valuePointer) ([]valuePointer, error)
+	// Head returns the last value pointer indexed durably, the value log
+	// is replayed from it after crashing.
+	Head() (valuePointer, error)
+	Snapshot() (metaSnapshot, error)
+	// CompareAndSwap serves the value store gc, see IndexEngine.
+	CompareAndSwap(keys [][]byte, olds, news []valuePointer) error
+	// Sync makes all the writes before durable.
+	Sync() error
+}
+
+// metaSnapshot is a consistent view of meta store.
+type metaSnapshot interface {
+	Get(key []byte) []byte
+	// Head returns the last value pointer indexed in the snapshot.
+	Head() (valuePointer, error)
+	// Cursor iterates the keys in order, valid before released.
+	Cursor() metaCursor
+	Release() error
+}
+
+// metaCursor is the part of bolt cursor used.
+type metaCursor interface {
+	First() ([]byte, []byte)
+	Last() ([]byte, []byte)
+	Seek(seek []byte) ([]byte, []byte)
+	Next() ([]byte, []byte)
+	Prev() ([]byte, []byte)
+}
+
+// MetaStore is the meta store of bolt.
 type MetaStore struct {
 	dirPath string
 
@@ -35,8 +81,11 @@ func (m *MetaStore) dbPath() string {
 
 func (m *MetaStore) Open() error {
 	// FIXME: options
-	opts := bolt.DefaultOptions
-	db, err := bolt.Open(m.dbPath(), 0666, opts)
+	opts := *bolt.DefaultOptions
+	// the long read txs of transactions block the writing tx which
+	// remaps the growing db, so reserve enough at the beginning.
+	opts.InitialMmapSize = metaInitialMmapSize
+	db, err := bolt.Open(m.dbPath(), 0666, &opts)
 	if err != nil {
 		return errors.Wrapf(err, "Unable to open bolt db %q", m.dbPath())
 	}
@@ -73,12 +122,178 @@ func (m *MetaStore) Put(key, value []byte) error {
 	return err
 }
 
+func (m *MetaStore) PutBatch(keys, values [][]byte, head valuePointer) ([]valuePointer, error) {
+	var olds []valuePointer
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metaDataBucket)
+		for i := range keys {
+			if vp, _, ok := decodeIndexValue(b.Get(keys[i])); ok {
+				olds = append(olds, vp)
+			}
+			var err error
+			if values[i] == nil {
+				err = b.Delete(keys[i])
+			} else {
+				err = b.Put(keys[i], values[i])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		buf := make([]byte, valuePointerSize)
+		head.Encode(buf)
+		return tx.Bucket(metaOthersBucket).Put(headKey, buf)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return olds, nil
+}
+
+// Head returns the last value pointer indexed, a zero pointer
+// returned if nothing indexed.
+func (m *MetaStore) Head() (valuePointer, error) {
+	var head valuePointer
+	err := m.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(metaOthersBucket).Get(headKey); len(v) == valuePointerSize {
+			head.Decode(v)
+		}
+		return nil
+	})
+	return head, err
+}
+
 func (m *MetaStore) Get(key []byte) ([]byte, error) {
 	var value []byte
 	err := m.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(metaDataBucket)
-		value = b.Get(key)
+		// the bolt value is only valid during the tx
+		if v := b.Get(key); v != nil {
+			value = append([]byte{}, v...)
+		}
 		return nil
 	})
 	return value, err
 }
+
+// Sync does nothing, every tx is durable once committed.
+func (m *MetaStore) Sync() error {
+	return nil
+}
+
+// CompareAndSwap keeps the expiry of the keys swapped.
+func (m *MetaStore) CompareAndSwap(keys [][]byte, olds, news []valuePointer) error {
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metaDataBucket)
+		for i := range keys {
+			vp, expiresAt, ok := decodeIndexValue(b.Get(keys[i]))
+			if !ok {
+				continue
+			}
+			if vp.Fid != olds[i].Fid || vp.Offset != olds[i].Offset {
+				continue
+			}
+			if news[i].Len == 0 {
+				if err := b.Delete(keys[i]); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := b.Put(keys[i], encodeIndexValue(news[i], expiresAt)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+type boltSnapshot struct {
+	tx *bolt.Tx
+}
+
+// Snapshot returns a read-only view, it must be released and the
+// writing may be blocked until then.
+func (m *MetaStore) Snapshot() (metaSnapshot, error) {
+	tx, err := m.db.Begin(false)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to begin read tx")
+	}
+	return &boltSnapshot{tx: tx}, nil
+}
+
+func (ms *boltSnapshot) Get(key []byte) []byte {
+	v := ms.tx.Bucket(metaDataBucket).Get(key)
+	if v == nil {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
+
+func (ms *boltSnapshot) Head() (valuePointer, error) {
+	var head valuePointer
+	if v := ms.tx.Bucket(metaOthersBucket).Get(headKey); len(v) == valuePointerSize {
+		head.Decode(v)
+	}
+	return head, nil
+}
+
+func (ms *boltSnapshot) Cursor() metaCursor {
+	return ms.tx.Bucket(metaDataBucket).Cursor()
+}
+
+func (ms *boltSnapshot) Release() error {
+	return ms.tx.Rollback()
+}
+
+// index value layout:
+// | value pointer(12) | expires at(8), only if the entry expires |
+func encodeIndexValue(vp valuePointer, expiresAt uint64) []byte {
+	sz := valuePointerSize
+	if expiresAt > 0 {
+		sz += 8
+	}
+	buf := make([]byte, sz)
+	vp.Encode(buf)
+	if expiresAt > 0 {
+		binary.BigEndian.PutUint64(buf[valuePointerSize:], expiresAt)
+	}
+	return buf
+}
+
+func decodeIndexValue(buf []byte) (vp valuePointer, expiresAt uint64, ok bool) {
+	if len(buf) != valuePointerSize && len(buf) != valuePointerSize+8 {
+		return vp, 0, false
+	}
+	vp.Decode(buf)
+	if len(buf) > valuePointerSize {
+		expiresAt = binary.BigEndian.Uint64(buf[valuePointerSize:])
+	}
+	return vp, expiresAt, true
+}
+
+// metaIndexEngine serves the value pointers kept in meta store
+// to the value store.
+type metaIndexEngine struct {
+	me metaEngine
+}
+
+func (e metaIndexEngine) Get(key []byte) (valuePointer, error) {
+	buf, err := e.me.Get(key)
+	if err != nil {
+		return valuePointer{}, errors.Wrapf(err, "Unable to get %q from meta store", key)
+	}
+	vp, _, ok := decodeIndexValue(buf)
+	if !ok {
+		return vp, ErrValuePointerNotFound
+	}
+	return vp, nil
+}
+
+func (e metaIndexEngine) CompareAndSwap(keys [][]byte, olds, news []valuePointer) error {
+	return e.me.CompareAndSwap(keys, olds, news)
+}
+
+func (e metaIndexEngine) Sync() error {
+	return e.me.Sync()
+}
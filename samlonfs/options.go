@@ -1,5 +1,10 @@
 package samlonfs
 
+import (
+	"github.com/EricYT/go-examples/pkg/codec"
+	"github.com/EricYT/go-examples/samlonfs/lsm"
+)
+
 type FileLoadingMode int
 
 const (
@@ -7,9 +12,33 @@ const (
 	MemoryMap
 )
 
+// MetaStoreType selects the index of keys.
+type MetaStoreType int
+
+const (
+	BoltMetaStore MetaStoreType = iota
+	LSMMetaStore                // for write-heavy workloads
+)
+
 type Opts struct {
 	LoadingMode         FileLoadingMode
 	FileBlockMaxSize    int64
 	FileBlockMaxEntries uint32
 	SyncedFileIO        bool
+
+	MetaStore MetaStoreType
+	LSM       lsm.Options // for the LSMMetaStore, zero for the defaults
+
+	// the values written are compressed, and encrypted by the current
+	// key of Encryption if set. The values written before are readable
+	// as long as the keys sealed them registered.
+	Compression codec.Compression
+	Encryption  *codec.KeyRegistry
+}
+
+var DefaultOpts = Opts{
+	LoadingMode:         MemoryMap,
+	FileBlockMaxSize:    64 << 20,
+	FileBlockMaxEntries: 100000,
+	SyncedFileIO:        true,
 }
@@ -1,8 +1,12 @@
 package samlonfs
 
 import (
+	"os"
+	"path"
 	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
@@ -10,32 +14,200 @@ import (
 
 const (
 	valueStoreDir string = "data"
+
+	maxWriteBatchSize int = 64 // requests merged into one value store write
+)
+
+var (
+	ErrKeyNotFound  error = errors.New("key not found")
+	ErrEmptyKey     error = errors.New("key cannot be empty")
+	ErrSamlonClosed error = errors.New("samlon closed")
 )
 
 type Samlon struct {
 	logger *zap.Logger
+	opts   Opts
 
 	rootDir string
 
 	valueStore *ValueStore // append log value store
-	metaStore  *MetaStore  // LSM tree meta store
+	metaStore  metaEngine  // bolt or LSM tree meta store
+
+	// guards closed, so no request is sent after the writer quit.
+	closeLock sync.RWMutex
+	closed    bool
+	closeCh   chan struct{}
+	writerWG  sync.WaitGroup
 
 	writeCh chan *request
+
+	oracle *oracle
 }
 
 func NewSamlon(lg *zap.Logger, opts Opts, rootdir string) *Samlon {
 	s := &Samlon{
 		logger:  lg,
+		opts:    opts,
 		rootDir: rootdir,
-		writeCh: make(chan *request),
+		closeCh: make(chan struct{}),
+		writeCh: make(chan *request, maxWriteBatchSize),
+		oracle:  newOracle(),
 	}
 
-	// FIXME: value store and meta store
+	switch opts.MetaStore {
+	case LSMMetaStore:
+		s.metaStore = NewLSMMetaStore(rootdir, opts.LSM)
+	default:
+		s.metaStore = NewMetaStore(rootdir)
+	}
+	s.valueStore = NewValueStore(s.valueStorePath(), opts, metaIndexEngine{me: s.metaStore})
 
 	return s
 }
 
+func (s *Samlon) valueStorePath() string {
+	return path.Join(s.rootDir, valueStoreDir)
+}
+
 func (s *Samlon) Open() error {
+	if err := os.MkdirAll(s.valueStorePath(), 0755); err != nil {
+		return errors.Wrapf(err, "Unable to create value store directory %q", s.valueStorePath())
+	}
+	if err := s.metaStore.Open(); err != nil {
+		return errors.Wrap(err, "Unable to open meta store")
+	}
+	if err := s.valueStore.Load(); err != nil {
+		s.metaStore.Close()
+		return errors.Wrap(err, "Unable to load value store")
+	}
+	if err := s.replay(); err != nil {
+		s.valueStore.Close()
+		s.metaStore.Close()
+		return errors.Wrap(err, "Unable to replay value store")
+	}
+
+	s.writerWG.Add(1)
+	go s.doWrites()
+
+	s.logger.Info("samlon opened", zap.String("root", s.rootDir))
+	return nil
+}
+
+// replay indexes the entries which reached value log, but never
+// reached meta store before crashing.
+func (s *Samlon) replay() error {
+	head, err := s.metaStore.Head()
+	if err != nil {
+		return errors.Wrap(err, "Unable to get head from meta store")
+	}
+	s.logger.Info("samlon replay start", zap.Stringer("head", head))
+
+	var keys, ptrs [][]byte
+	var discards []valuePointer
+	var replayed int
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		olds, err := s.metaStore.PutBatch(keys, ptrs, head)
+		if err != nil {
+			return err
+		}
+		if err := s.valueStore.markDiscard(append(olds, discards...)); err != nil {
+			return err
+		}
+		replayed += len(keys)
+		keys, ptrs, discards = keys[:0], ptrs[:0], discards[:0]
+		return nil
+	}
+
+	// the entries of a transaction are applied once its last
+	// entry replayed.
+	var txnKeys, txnPtrs [][]byte
+	var txnVps []valuePointer
+	var txnHead valuePointer
+	err = s.valueStore.Replay(head, func(e *Entry, vp valuePointer) error {
+		var buf []byte
+		if e.meta&bitDelete == 0 {
+			buf = encodeIndexValue(vp, e.ExpiresAt)
+		}
+		// the entry buffer is reused by iterating
+		key := append([]byte{}, e.Key...)
+		if e.meta&bitTxn > 0 {
+			txnKeys = append(txnKeys, key)
+			txnPtrs = append(txnPtrs, buf)
+			txnVps = append(txnVps, vp)
+			txnHead = vp
+			if e.meta&bitFinTxn == 0 {
+				return nil
+			}
+			keys = append(keys, txnKeys...)
+			ptrs = append(ptrs, txnPtrs...)
+			for i := range txnPtrs {
+				if txnPtrs[i] == nil {
+					discards = append(discards, txnVps[i])
+				}
+			}
+			txnKeys, txnPtrs, txnVps = nil, nil, nil
+		} else {
+			keys = append(keys, key)
+			ptrs = append(ptrs, buf)
+			if buf == nil {
+				discards = append(discards, vp)
+			}
+		}
+		head = vp
+		if len(keys) >= maxWriteBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(txnKeys) > 0 {
+		// the transaction torn by crashing, skip it forever. The later
+		// writing goes into a new log file.
+		s.logger.Warn("samlon replay drop incomplete transaction", zap.Int("entries", len(txnKeys)))
+		head = txnHead
+		discards = append(discards, txnVps...)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if len(txnKeys) > 0 {
+		if _, err := s.metaStore.PutBatch(nil, nil, head); err != nil {
+			return err
+		}
+		if err := s.valueStore.markDiscard(discards); err != nil {
+			return err
+		}
+	}
+
+	s.logger.Info("samlon replay done", zap.Int("entries", replayed), zap.Stringer("head", head))
+	return nil
+}
+
+func (s *Samlon) Close() error {
+	s.closeLock.Lock()
+	if s.closed {
+		s.closeLock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.closeLock.Unlock()
+
+	close(s.closeCh)
+	s.writerWG.Wait()
+
+	if err := s.valueStore.Close(); err != nil {
+		s.metaStore.Close()
+		return errors.Wrap(err, "Unable to close value store")
+	}
+	if err := s.metaStore.Close(); err != nil {
+		return errors.Wrap(err, "Unable to close meta store")
+	}
+	s.logger.Info("samlon closed", zap.String("root", s.rootDir))
 	return nil
 }
 
@@ -57,15 +229,240 @@ type request struct {
 func (req *request) Wait() error {
 	req.Wg.Wait()
 	req.Ents = nil
+	req.Ptrs = nil
 	err := req.Err
+	req.Err = nil
 	requestPool.Put(req)
 	return err
 }
 
+func (s *Samlon) sendToWriteCh(ents []*Entry) (*request, error) {
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+	if s.closed {
+		return nil, ErrSamlonClosed
+	}
+
+	req := requestPool.Get().(*request)
+	req.Ents = ents
+	req.Wg.Add(1)
+	s.writeCh <- req
+	return req, nil
+}
+
+// doWrites merges the pending requests and writes them in one
+// batch, until samlon closed.
+func (s *Samlon) doWrites() {
+	defer s.writerWG.Done()
+
+	reqs := make([]*request, 0, maxWriteBatchSize)
+	for {
+		select {
+		case r := <-s.writeCh:
+			reqs = append(reqs, r)
+		case <-s.closeCh:
+			// nobody sends any more, flush the rest.
+			for {
+				select {
+				case r := <-s.writeCh:
+					reqs = append(reqs, r)
+				default:
+					s.writeRequests(reqs)
+					return
+				}
+			}
+		}
+
+		// trying to merge more requests
+	merge:
+		for len(reqs) < maxWriteBatchSize {
+			select {
+			case r := <-s.writeCh:
+				reqs = append(reqs, r)
+			default:
+				break merge
+			}
+		}
+
+		s.writeRequests(reqs)
+		reqs = reqs[:0]
+	}
+}
+
+func (s *Samlon) writeRequests(reqs []*request) {
+	if len(reqs) == 0 {
+		return
+	}
+	done := func(err error) {
+		for _, req := range reqs {
+			req.Err = err
+			req.Wg.Done()
+		}
+	}
+
+	// gc rewrites never interleave between writing and indexing
+	s.valueStore.writeLock.Lock()
+	defer s.valueStore.writeLock.Unlock()
+
+	for _, req := range reqs {
+		if err := s.valueStore.Write(req); err != nil {
+			s.logger.Error("samlon write value store failed", zap.Error(err))
+			done(err)
+			return
+		}
+	}
+
+	// value pointers go into meta store once the values persisted.
+	if err := s.valueStore.Sync(); err != nil {
+		s.logger.Error("samlon sync value store failed", zap.Error(err))
+		done(err)
+		return
+	}
+	var keys, ptrs [][]byte
+	var head valuePointer
+	var tombstones []valuePointer
+	for _, req := range reqs {
+		for i := range req.Ents {
+			// tombstones remove the keys from meta store
+			var buf []byte
+			if req.Ents[i].meta&bitDelete == 0 {
+				buf = encodeIndexValue(req.Ptrs[i], req.Ents[i].ExpiresAt)
+			} else {
+				tombstones = append(tombstones, req.Ptrs[i])
+			}
+			keys = append(keys, req.Ents[i].Key)
+			ptrs = append(ptrs, buf)
+			head = req.Ptrs[i]
+		}
+	}
+	olds, err := s.metaStore.PutBatch(keys, ptrs, head)
+	if err != nil {
+		s.logger.Error("samlon write meta store failed", zap.Error(err))
+		done(err)
+		return
+	}
+	// the values replaced and the tombstones are garbage now
+	if err := s.valueStore.markDiscard(append(olds, tombstones...)); err != nil {
+		s.logger.Warn("samlon mark discard failed", zap.Error(err))
+	}
+
+	// the writes outside transactions may conflict with the running ones
+	written := make(map[string]struct{})
+	for _, req := range reqs {
+		for _, e := range req.Ents {
+			if e.meta&bitTxn == 0 {
+				written[string(e.Key)] = struct{}{}
+			}
+		}
+	}
+	if len(written) > 0 {
+		s.oracle.recordWrites(written)
+	}
+	done(nil)
+}
+
+// SetEntry writes the entry with its user meta and expiration.
+func (s *Samlon) SetEntry(e *Entry) error {
+	if len(e.Key) == 0 {
+		return ErrEmptyKey
+	}
+	req, err := s.sendToWriteCh([]*Entry{e})
+	if err != nil {
+		return err
+	}
+	return req.Wait()
+}
+
 func (s *Samlon) Put(key, value []byte) (err error) {
-	return
+	return s.SetEntry(&Entry{Key: key, Value: value})
+}
+
+// PutWithTTL puts the key which is invisible after ttl.
+func (s *Samlon) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	return s.SetEntry(&Entry{
+		Key:       key,
+		Value:     value,
+		ExpiresAt: uint64(time.Now().Add(ttl).Unix()),
+	})
+}
+
+// Delete writes a tombstone of the key into value log, and removes
+// the key from meta store.
+func (s *Samlon) Delete(key []byte) error {
+	return s.SetEntry(&Entry{Key: key, meta: bitDelete})
 }
 
 func (s *Samlon) Get(key []byte) (value []byte, err error) {
-	return
+	e, err := s.GetEntry(key)
+	if err != nil {
+		return nil, err
+	}
+	return e.Value, nil
+}
+
+// the times a Get reads the index again for the value moved by gc
+const maxGetRetries = 10
+
+// GetEntry returns the entry with its user meta and expiration.
+func (s *Samlon) GetEntry(key []byte) (*Entry, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	var prev valuePointer
+	for retries := 0; ; retries++ {
+		vp, err := metaIndexEngine{me: s.metaStore}.Get(key)
+		if err != nil {
+			if err == ErrValuePointerNotFound {
+				return nil, ErrKeyNotFound
+			}
+			return nil, err
+		}
+		if retries > 0 && (vp == prev || retries > maxGetRetries) {
+			// the index still points to the log file collected
+			return nil, errors.Wrapf(ErrDataMissing, "value of %q by %s collected", key, vp)
+		}
+		prev = vp
+
+		var slice Slice
+		e, unlock, err := s.valueStore.ReadEntry(vp, &slice)
+		if err == ErrRetry {
+			// the log file was collected by gc, the value moved to
+			// the head already.
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to read value of %q by %s", key, vp)
+		}
+		if e.isDeletedOrExpired() {
+			if unlock != nil {
+				unlock()
+			}
+			return nil, ErrKeyNotFound
+		}
+		ent := &Entry{
+			Key:       append([]byte{}, e.Key...),
+			Value:     append([]byte{}, e.Value...),
+			UserMeta:  e.UserMeta,
+			ExpiresAt: e.ExpiresAt,
+		}
+		if unlock != nil {
+			unlock()
+		}
+		return ent, nil
+	}
+}
+
+// RunValueLogGC collects the value log files whose discarded ratio
+// reaches the ratio, the live values are moved to the head.
+func (s *Samlon) RunValueLogGC(ratio float64) error {
+	head, err := s.metaStore.Head()
+	if err != nil {
+		return errors.Wrap(err, "Unable to get head from meta store")
+	}
+	return s.valueStore.RunGC(head, ratio)
+}
+
+// ValueLogStats reports the disk usage of the value log files.
+func (s *Samlon) ValueLogStats() ValueStoreStats {
+	return s.valueStore.Stats()
 }
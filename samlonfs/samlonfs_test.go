@@ -0,0 +1,439 @@
+package samlonfs
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EricYT/go-examples/pkg/codec"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func testSamlonOpts() Opts {
+	return Opts{
+		LoadingMode:         MemoryMap,
+		FileBlockMaxSize:    1024,
+		FileBlockMaxEntries: 20,
+		SyncedFileIO:        true,
+	}
+}
+
+func TestSamlonPutGet(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	s := NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				k := []byte(fmt.Sprintf("key#%d#%d", i, j))
+				v := []byte(fmt.Sprintf("value#%d#%d", i, j))
+				assert.Nil(t, s.Put(k, v))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	validate := func() {
+		for i := 0; i < 8; i++ {
+			for j := 0; j < 50; j++ {
+				k := []byte(fmt.Sprintf("key#%d#%d", i, j))
+				v, err := s.Get(k)
+				if !assert.Nil(t, err) {
+					return
+				}
+				assert.Equal(t, []byte(fmt.Sprintf("value#%d#%d", i, j)), v)
+			}
+		}
+	}
+	validate()
+
+	_, err := s.Get([]byte("not-exist"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// overwrite
+	assert.Nil(t, s.Put([]byte("key#0#0"), []byte("new-value")))
+	v, err := s.Get([]byte("key#0#0"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new-value"), v)
+	assert.Nil(t, s.Put([]byte("key#0#0"), []byte("value#0#0")))
+
+	// reopen
+	if !assert.Nil(t, s.Close()) {
+		return
+	}
+	assert.Equal(t, ErrSamlonClosed, s.Put([]byte("k"), []byte("v")))
+
+	s = NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+	validate()
+}
+
+func TestSamlonReplay(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	opts := testSamlonOpts()
+	opts.FileBlockMaxSize = 64 * 1024
+	opts.FileBlockMaxEntries = 1000
+	s := NewSamlon(zap.NewNop(), opts, tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	for i := 0; i < 10; i++ {
+		k := []byte(fmt.Sprintf("key#%d", i))
+		assert.Nil(t, s.Put(k, k))
+	}
+
+	// entries reach the value log but never reach the meta store
+	ents := make([]*Entry, 0, 10)
+	for i := 10; i < 20; i++ {
+		k := []byte(fmt.Sprintf("key#%d", i))
+		ents = append(ents, &Entry{Key: k, Value: k})
+	}
+	req := &request{Ents: ents}
+	if !assert.Nil(t, s.valueStore.Write(req)) {
+		return
+	}
+	lastvp := req.Ptrs[len(req.Ptrs)-1]
+	lfpath := s.valueStore.fpath(lastvp.Fid)
+
+	// torn tail
+	fd, err := os.OpenFile(lfpath, os.O_WRONLY|os.O_APPEND, 0666)
+	if !assert.Nil(t, err) {
+		return
+	}
+	fd.Write([]byte("torn entry"))
+	fd.Close()
+	if !assert.Nil(t, s.Close()) {
+		return
+	}
+
+	s = NewSamlon(zap.NewNop(), opts, tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+
+	stat, err := os.Stat(lfpath)
+	if assert.Nil(t, err) {
+		assert.Equal(t, int64(lastvp.Offset+lastvp.Len), stat.Size())
+	}
+	for i := 0; i < 20; i++ {
+		k := []byte(fmt.Sprintf("key#%d", i))
+		v, err := s.Get(k)
+		if assert.Nil(t, err) {
+			assert.Equal(t, k, v)
+		}
+	}
+	head, err := s.metaStore.Head()
+	if assert.Nil(t, err) {
+		assert.Equal(t, lastvp, head)
+	}
+}
+
+func TestSamlonValueLogGC(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	s := NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+
+	// overwrite the keys, the older values are garbage
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 50; i++ {
+			k := []byte(fmt.Sprintf("key#%d", i))
+			v := []byte(fmt.Sprintf("value#%d#%d", i, round))
+			assert.Nil(t, s.Put(k, v))
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 50; i < 100; i++ {
+			k := []byte(fmt.Sprintf("key#%d", i))
+			assert.Nil(t, s.Put(k, k))
+		}
+	}()
+	err := s.RunValueLogGC(0.5)
+	assert.Nil(t, err)
+	wg.Wait()
+
+	// the first log file holds the overwritten values only
+	_, err = os.Stat(s.valueStore.fpath(0))
+	assert.True(t, os.IsNotExist(err))
+	for i := 0; i < 50; i++ {
+		k := []byte(fmt.Sprintf("key#%d", i))
+		v, err := s.Get(k)
+		if assert.Nil(t, err) {
+			assert.Equal(t, []byte(fmt.Sprintf("value#%d#2", i)), v)
+		}
+	}
+	for i := 50; i < 100; i++ {
+		k := []byte(fmt.Sprintf("key#%d", i))
+		v, err := s.Get(k)
+		if assert.Nil(t, err) {
+			assert.Equal(t, k, v)
+		}
+	}
+}
+
+func TestSamlonGetCollected(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	s := NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+
+	for i := 0; i < 50; i++ {
+		k := []byte(fmt.Sprintf("key#%d", i))
+		assert.Nil(t, s.Put(k, k))
+	}
+	// the index left pointing to the file removed
+	s.valueStore.filesLock.RLock()
+	lf := s.valueStore.filesMap[0]
+	s.valueStore.filesLock.RUnlock()
+	if !assert.Nil(t, s.valueStore.deleteLogFile(lf)) {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Get([]byte("key#0"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(t, ErrDataMissing, errors.Cause(err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("get retries forever")
+	}
+}
+
+func TestSamlonDeleteAndExpire(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	s := NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+
+	assert.Nil(t, s.Put([]byte("deleted"), []byte("value")))
+	assert.Nil(t, s.Delete([]byte("deleted")))
+	assert.Nil(t, s.PutWithTTL([]byte("ttl"), []byte("value"), time.Hour))
+	err := s.SetEntry(&Entry{
+		Key:       []byte("expired"),
+		Value:     []byte("value"),
+		UserMeta:  0x01,
+		ExpiresAt: uint64(time.Now().Add(-time.Second).Unix()),
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, s.SetEntry(&Entry{Key: []byte("user-meta"), Value: []byte("value"), UserMeta: 0x7f}))
+
+	validate := func() {
+		_, err := s.Get([]byte("deleted"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = s.Get([]byte("expired"))
+		assert.Equal(t, ErrKeyNotFound, err)
+		v, err := s.Get([]byte("ttl"))
+		if assert.Nil(t, err) {
+			assert.Equal(t, []byte("value"), v)
+		}
+		e, err := s.GetEntry([]byte("user-meta"))
+		if assert.Nil(t, err) {
+			assert.Equal(t, byte(0x7f), e.UserMeta)
+			assert.Equal(t, []byte("value"), e.Value)
+		}
+	}
+	validate()
+
+	// the tombstones replayed
+	assert.Nil(t, s.Close())
+	os.Remove(path.Join(tmpdir, boltDBFile))
+	s = NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+	validate()
+}
+
+func TestSamlonValueLogGCExpired(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	s := NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+
+	expiresAt := uint64(time.Now().Add(-time.Second).Unix())
+	for i := 0; i < 50; i++ {
+		k := []byte(fmt.Sprintf("key#%d", i))
+		assert.Nil(t, s.SetEntry(&Entry{Key: k, Value: k, ExpiresAt: expiresAt}))
+	}
+	for i := 50; i < 100; i++ {
+		k := []byte(fmt.Sprintf("key#%d", i))
+		assert.Nil(t, s.Put(k, k))
+		assert.Nil(t, s.Delete(k))
+	}
+	assert.Nil(t, s.Put([]byte("live"), []byte("value")))
+
+	if !assert.Nil(t, s.RunValueLogGC(0.5)) {
+		return
+	}
+	_, err := os.Stat(s.valueStore.fpath(0))
+	assert.True(t, os.IsNotExist(err))
+	for i := 0; i < 50; i++ {
+		k := []byte(fmt.Sprintf("key#%d", i))
+		v, err := s.metaStore.Get(k)
+		assert.Nil(t, err)
+		assert.Nil(t, v)
+	}
+	v, err := s.Get([]byte("live"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("value"), v)
+	}
+}
+
+func TestSamlonValueLogStats(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	s := NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	for i := 0; i < 30; i++ {
+		k := []byte(fmt.Sprintf("key#%d", i))
+		assert.Nil(t, s.Put(k, k))
+	}
+	// overwritten and deleted
+	for i := 0; i < 10; i++ {
+		k := []byte(fmt.Sprintf("key#%d", i))
+		assert.Nil(t, s.Put(k, []byte("new-value")))
+	}
+	for i := 10; i < 20; i++ {
+		assert.Nil(t, s.Delete([]byte(fmt.Sprintf("key#%d", i))))
+	}
+
+	// the old values, the deleted values and the tombstones
+	discard := 10*(headerSize+5+5+crc32.Size) +
+		10*(headerSize+6+6+crc32.Size) +
+		10*(headerSize+6+crc32.Size)
+	stats := s.ValueLogStats()
+	assert.True(t, len(stats.Files) > 1)
+	assert.Equal(t, uint64(discard), stats.Discard)
+	var size uint64
+	for _, st := range stats.Files {
+		size += uint64(st.Size)
+	}
+	assert.Equal(t, size, stats.Size)
+	assert.Nil(t, s.Close())
+
+	s = NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+	assert.Equal(t, stats.Discard, s.ValueLogStats().Discard)
+}
+
+func TestSamlonValueCodec(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	keys := codec.NewKeyRegistry()
+	assert.Nil(t, keys.Rotate(1, bytes.Repeat([]byte{1}, 32)))
+	opts := testSamlonOpts()
+	opts.FileBlockMaxSize = 64 << 10
+	opts.Compression = codec.Zstd
+	opts.Encryption = keys
+
+	value := func(i, round int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("payload#%d#%d ", i, round)), 50)
+	}
+	s := NewSamlon(zap.NewNop(), opts, tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	// the first log file is full of the values sealed by key 1
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprintf("key#%d", i)), value(i, 0)))
+	}
+	assert.True(t, s.ValueLogStats().Size < uint64(20*len(value(0, 0))/4))
+	buf, err := ioutil.ReadFile(s.valueStore.fpath(0))
+	if assert.Nil(t, err) {
+		assert.False(t, bytes.Contains(buf, []byte("payload")))
+	}
+
+	// the live values are sealed by key 2 once collected
+	assert.Nil(t, keys.Rotate(2, bytes.Repeat([]byte{2}, 32)))
+	for i := 0; i < 15; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprintf("key#%d", i)), value(i, 1)))
+	}
+	assert.Nil(t, s.RunValueLogGC(0.5))
+	_, err = os.Stat(s.valueStore.fpath(0))
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, s.Close())
+
+	validate := func(s *Samlon) {
+		for i := 0; i < 20; i++ {
+			round := 1
+			if i >= 15 {
+				round = 0
+			}
+			v, err := s.Get([]byte(fmt.Sprintf("key#%d", i)))
+			if assert.Nil(t, err) {
+				assert.Equal(t, value(i, round), v)
+			}
+		}
+	}
+	rotated := codec.NewKeyRegistry()
+	assert.Nil(t, rotated.Rotate(2, bytes.Repeat([]byte{2}, 32)))
+	opts.Encryption = rotated
+	s = NewSamlon(zap.NewNop(), opts, tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	validate(s)
+	assert.Nil(t, s.Close())
+
+	// unreadable without the keys
+	opts.Encryption = nil
+	s = NewSamlon(zap.NewNop(), opts, tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+	_, err = s.Get([]byte("key#0"))
+	assert.Equal(t, codec.ErrNoEncryption, errors.Cause(err))
+}
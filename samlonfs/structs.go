@@ -5,15 +5,34 @@ import (
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 var CastagnoliTable = crc32.MakeTable(crc32.Castagnoli)
 
 const (
-	headerSize       int = 8
+	headerSize       int = 19
 	valuePointerSize int = 12
 )
 
+const (
+	// entryVersion is the version of the entry header layout.
+	entryVersion byte = 1
+
+	// meta bits
+	bitDelete     byte = 1 << 0 // the entry is a delete tombstone
+	bitValueInLog byte = 1 << 1 // the value bytes are stored in the log
+	bitTxn        byte = 1 << 2 // the entry is written by a transaction
+	bitFinTxn     byte = 1 << 3 // the last entry of a transaction
+	bitValueCodec byte = 1 << 7 // the value is encoded by the codec
+)
+
+var (
+	ErrEntryVersion error = errors.New("entry version unsupported")
+)
+
 type valuePointer struct {
 	Fid    uint32
 	Len    uint32
@@ -36,31 +55,68 @@ func (vp *valuePointer) Decode(in []byte) {
 	vp.Offset = binary.BigEndian.Uint32(in[8:12])
 }
 
-// FIXME: right now, expired or some other meta not supported
+// header layout:
+// | version(1) | meta(1) | user meta(1) | klen(4) | vlen(4) | expires at(8) |
 type header struct {
-	klen uint32
-	vlen uint32
+	version   byte
+	meta      byte
+	userMeta  byte
+	klen      uint32
+	vlen      uint32
+	expiresAt uint64 // unix seconds, zero means never expired
 }
 
 func (h *header) Encode(out []byte) {
-	binary.BigEndian.PutUint32(out[:4], h.klen)
-	binary.BigEndian.PutUint32(out[4:8], h.vlen)
+	out[0] = h.version
+	out[1] = h.meta
+	out[2] = h.userMeta
+	binary.BigEndian.PutUint32(out[3:7], h.klen)
+	binary.BigEndian.PutUint32(out[7:11], h.vlen)
+	binary.BigEndian.PutUint64(out[11:19], h.expiresAt)
 }
 
 func (h *header) Decode(in []byte) {
-	h.klen = binary.BigEndian.Uint32(in[:4])
-	h.vlen = binary.BigEndian.Uint32(in[4:8])
+	h.version = in[0]
+	h.meta = in[1]
+	h.userMeta = in[2]
+	h.klen = binary.BigEndian.Uint32(in[3:7])
+	h.vlen = binary.BigEndian.Uint32(in[7:11])
+	h.expiresAt = binary.BigEndian.Uint64(in[11:19])
 }
 
 type Entry struct {
-	Key   []byte
-	Value []byte
+	Key       []byte
+	Value     []byte
+	UserMeta  byte
+	ExpiresAt uint64 // unix seconds, zero means never expired
+
+	meta byte
+}
+
+// isDeletedOrExpired reports whether the entry should be hidden
+// from the readers.
+func (e *Entry) isDeletedOrExpired() bool {
+	if e.meta&bitDelete > 0 {
+		return true
+	}
+	if e.ExpiresAt == 0 {
+		return false
+	}
+	return e.ExpiresAt <= uint64(time.Now().Unix())
 }
 
 func encodeEntry(e *Entry, buf *bytes.Buffer) (n uint32, err error) {
+	meta := e.meta
+	if len(e.Value) > 0 {
+		meta |= bitValueInLog
+	}
 	h := header{
-		klen: uint32(len(e.Key)),
-		vlen: uint32(len(e.Value)),
+		version:   entryVersion,
+		meta:      meta,
+		userMeta:  e.UserMeta,
+		klen:      uint32(len(e.Key)),
+		vlen:      uint32(len(e.Value)),
+		expiresAt: e.ExpiresAt,
 	}
 
 	hash := crc32.New(CastagnoliTable)
@@ -24,6 +24,19 @@ func TestHeadEncode(t *testing.T) {
 	ht2.Decode(head[:])
 
 	assert.Equal(t, *ht2, *ht1)
+
+	ht3 := &header{
+		version:   entryVersion,
+		meta:      bitDelete,
+		userMeta:  0xfe,
+		klen:      1,
+		vlen:      0,
+		expiresAt: 1583452800,
+	}
+	ht3.Encode(head[:])
+	var ht4 header
+	ht4.Decode(head[:])
+	assert.Equal(t, *ht3, ht4)
 }
 
 func BenchmarkHeadEncode(b *testing.B) {
@@ -58,7 +71,7 @@ func TestEncodeEntry(t *testing.T) {
 	dataCrc32 := hash.Sum32()
 
 	// payload
-	payload := make([]byte, 0, 12+4*1024*1024+4)
+	payload := make([]byte, 0, headerSize+3+4*1024*1024+4)
 	pbuf := bytes.NewBuffer(payload)
 
 	key := []byte("foo")
@@ -88,7 +101,7 @@ func BenchmarkEntryEncode(b *testing.B) {
 	data := make([]byte, 4*1024*1024)
 	rand.Read(data)
 	// payload
-	payload := make([]byte, 0, 12+4*1024*1024+4)
+	payload := make([]byte, 0, headerSize+3+4*1024*1024+4)
 	pbuf := bytes.NewBuffer(payload)
 	e := &Entry{
 		Key:   []byte("foo"),
@@ -0,0 +1,271 @@
+package samlonfs
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrConflict     error = errors.New("transaction conflict, please retry")
+	ErrTxnDiscarded error = errors.New("transaction has been discarded")
+)
+
+type committedTxn struct {
+	ts   uint64
+	keys map[string]struct{}
+}
+
+// oracle hands out the timestamps and detects the conflicts when
+// committing.
+type oracle struct {
+	// held by committing, so a transaction begins after all the
+	// committed transactions applied.
+	commitLock sync.RWMutex
+
+	lock      sync.Mutex
+	lastTs    uint64
+	active    map[uint64]int // read ts -> number of transactions
+	committed []committedTxn
+}
+
+func newOracle() *oracle {
+	return &oracle{
+		active: make(map[uint64]int),
+	}
+}
+
+func (o *oracle) readTs() uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.active[o.lastTs]++
+	return o.lastTs
+}
+
+func (o *oracle) hasConflict(readTs uint64, reads map[string]struct{}) bool {
+	for i := range o.committed {
+		ct := o.committed[i]
+		if ct.ts <= readTs {
+			continue
+		}
+		for k := range reads {
+			if _, ok := ct.keys[k]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newCommitTs returns zero if the reads have been modified after
+// the transaction began.
+func (o *oracle) newCommitTs(readTs uint64, reads map[string]struct{}, writes map[string]struct{}) uint64 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.hasConflict(readTs, reads) {
+		return 0
+	}
+	o.lastTs++
+	o.committed = append(o.committed, committedTxn{ts: o.lastTs, keys: writes})
+	return o.lastTs
+}
+
+// recordWrites records the writes outside any transaction, which
+// are applied already.
+func (o *oracle) recordWrites(keys map[string]struct{}) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if len(o.active) == 0 {
+		// nobody cares about them
+		return
+	}
+	o.lastTs++
+	o.committed = append(o.committed, committedTxn{ts: o.lastTs, keys: keys})
+}
+
+func (o *oracle) done(readTs uint64) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.active[readTs]--
+	if o.active[readTs] == 0 {
+		delete(o.active, readTs)
+	}
+
+	// the committed ones before all the active transactions are useless
+	minTs := o.lastTs
+	for ts := range o.active {
+		if ts < minTs {
+			minTs = ts
+		}
+	}
+	i := 0
+	for i < len(o.committed) && o.committed[i].ts <= minTs {
+		i++
+	}
+	o.committed = append(o.committed[:0], o.committed[i:]...)
+}
+
+// Txn reads a consistent snapshot and commits its writes atomically.
+// A transaction must be committed or discarded, and keep it short,
+// the snapshot holds a read tx of the meta store.
+type Txn struct {
+	s *Samlon
+
+	readTs   uint64
+	snapshot metaSnapshot
+	// of the value store snapshots
+	epoch uint64
+
+	reads   map[string]struct{}
+	writes  map[string]*Entry
+	ordered []*Entry
+
+	discarded bool
+}
+
+// NewTxn begins a transaction on the snapshot of the latest commit.
+func (s *Samlon) NewTxn() (*Txn, error) {
+	s.oracle.commitLock.RLock()
+	defer s.oracle.commitLock.RUnlock()
+
+	// the collected value log files survive until snapshot released
+	epoch := s.valueStore.snapshots.acquire()
+	readTs := s.oracle.readTs()
+	snapshot, err := s.metaStore.Snapshot()
+	if err != nil {
+		s.oracle.done(readTs)
+		s.valueStore.snapshots.release(epoch)
+		return nil, err
+	}
+	txn := &Txn{
+		s:        s,
+		readTs:   readTs,
+		snapshot: snapshot,
+		epoch:    epoch,
+		reads:    make(map[string]struct{}),
+		writes:   make(map[string]*Entry),
+	}
+	return txn, nil
+}
+
+func (txn *Txn) Set(key, value []byte) error {
+	return txn.SetEntry(&Entry{Key: key, Value: value})
+}
+
+func (txn *Txn) SetEntry(e *Entry) error {
+	if txn.discarded {
+		return ErrTxnDiscarded
+	}
+	if len(e.Key) == 0 {
+		return ErrEmptyKey
+	}
+	if old, ok := txn.writes[string(e.Key)]; ok {
+		*old = *e
+		return nil
+	}
+	ent := *e
+	txn.writes[string(e.Key)] = &ent
+	txn.ordered = append(txn.ordered, &ent)
+	return nil
+}
+
+func (txn *Txn) Delete(key []byte) error {
+	return txn.SetEntry(&Entry{Key: key, meta: bitDelete})
+}
+
+// Get reads the pending writes of the transaction first, then the
+// snapshot.
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if txn.discarded {
+		return nil, ErrTxnDiscarded
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if e, ok := txn.writes[string(key)]; ok {
+		if e.isDeletedOrExpired() {
+			return nil, ErrKeyNotFound
+		}
+		return e.Value, nil
+	}
+	txn.reads[string(key)] = struct{}{}
+
+	vp, _, ok := decodeIndexValue(txn.snapshot.Get(key))
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	var slice Slice
+	e, unlock, err := txn.s.valueStore.ReadEntry(vp, &slice)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read value of %q by %s", key, vp)
+	}
+	if unlock != nil {
+		defer unlock()
+	}
+	if e.isDeletedOrExpired() {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte{}, e.Value...), nil
+}
+
+// Discard releases the snapshot, it's safe to be called after Commit.
+func (txn *Txn) Discard() {
+	if txn.discarded {
+		return
+	}
+	txn.discarded = true
+	txn.release()
+}
+
+func (txn *Txn) release() {
+	if txn.snapshot != nil {
+		txn.snapshot.Release()
+		txn.snapshot = nil
+		txn.s.valueStore.snapshots.release(txn.epoch)
+		txn.s.oracle.done(txn.readTs)
+	}
+}
+
+// Commit writes all the pending writes in one request, ErrConflict
+// returned if any key read by the transaction was committed by others
+// after it began.
+func (txn *Txn) Commit() error {
+	if txn.discarded {
+		return ErrTxnDiscarded
+	}
+	txn.discarded = true
+	// the meta store writing may wait for all the read txs closed
+	txn.snapshot.Release()
+	txn.snapshot = nil
+	txn.s.valueStore.snapshots.release(txn.epoch)
+	defer txn.s.oracle.done(txn.readTs)
+
+	if len(txn.ordered) == 0 {
+		return nil
+	}
+
+	o := txn.s.oracle
+	o.commitLock.Lock()
+	defer o.commitLock.Unlock()
+
+	keys := make(map[string]struct{}, len(txn.writes))
+	for k := range txn.writes {
+		keys[k] = struct{}{}
+	}
+	if o.newCommitTs(txn.readTs, txn.reads, keys) == 0 {
+		return ErrConflict
+	}
+
+	// the entries are marked, so replay applies them all or nothing
+	for _, e := range txn.ordered {
+		e.meta |= bitTxn
+	}
+	txn.ordered[len(txn.ordered)-1].meta |= bitFinTxn
+
+	req, err := txn.s.sendToWriteCh(txn.ordered)
+	if err != nil {
+		return err
+	}
+	return req.Wait()
+}
@@ -0,0 +1,231 @@
+package samlonfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestTxnCommit(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	s := NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+
+	assert.Nil(t, s.Put([]byte("index#old"), []byte("object")))
+
+	txn, err := s.NewTxn()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, txn.Set([]byte("object"), []byte("value")))
+	assert.Nil(t, txn.Set([]byte("index#new"), []byte("object")))
+	assert.Nil(t, txn.Delete([]byte("index#old")))
+
+	// the pending writes visible to the transaction only
+	v, err := txn.Get([]byte("object"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("value"), v)
+	}
+	_, err = txn.Get([]byte("index#old"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = s.Get([]byte("object"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, txn.Commit())
+	txn.Discard()
+	assert.Equal(t, ErrTxnDiscarded, txn.Set([]byte("k"), []byte("v")))
+
+	v, err = s.Get([]byte("object"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("value"), v)
+	}
+	v, err = s.Get([]byte("index#new"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("object"), v)
+	}
+	_, err = s.Get([]byte("index#old"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestTxnSnapshotAndConflict(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	s := NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+
+	assert.Nil(t, s.Put([]byte("counter"), []byte("0")))
+
+	txn1, err := s.NewTxn()
+	if !assert.Nil(t, err) {
+		return
+	}
+	v, err := txn1.Get([]byte("counter"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("0"), v)
+	}
+
+	txn2, err := s.NewTxn()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, txn2.Set([]byte("counter"), []byte("1")))
+	assert.Nil(t, txn2.Commit())
+
+	// the snapshot never changes
+	v, err = txn1.Get([]byte("counter"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("0"), v)
+	}
+	assert.Nil(t, txn1.Set([]byte("counter"), []byte("1")))
+	assert.Equal(t, ErrConflict, txn1.Commit())
+
+	// the writes outside transactions conflict as well
+	txn3, err := s.NewTxn()
+	if !assert.Nil(t, err) {
+		return
+	}
+	_, err = txn3.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Nil(t, s.Put([]byte("counter"), []byte("2")))
+	assert.Nil(t, txn3.Set([]byte("other"), []byte("value")))
+	assert.Equal(t, ErrConflict, txn3.Commit())
+
+	// write only transactions never conflict
+	txn4, err := s.NewTxn()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, s.Put([]byte("counter"), []byte("3")))
+	assert.Nil(t, txn4.Set([]byte("counter"), []byte("4")))
+	assert.Nil(t, txn4.Commit())
+	v, err = s.Get([]byte("counter"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("4"), v)
+	}
+}
+
+func TestTxnConcurrentIncrease(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	s := NewSamlon(zap.NewNop(), testSamlonOpts(), tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+	defer s.Close()
+
+	assert.Nil(t, s.Put([]byte("counter"), []byte("0")))
+
+	increase := func() error {
+		txn, err := s.NewTxn()
+		if err != nil {
+			return err
+		}
+		defer txn.Discard()
+		v, err := txn.Get([]byte("counter"))
+		if err != nil {
+			return err
+		}
+		var n int
+		fmt.Sscanf(string(v), "%d", &n)
+		if err := txn.Set([]byte("counter"), []byte(fmt.Sprintf("%d", n+1))); err != nil {
+			return err
+		}
+		return txn.Commit()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				for {
+					err := increase()
+					if err == ErrConflict {
+						continue
+					}
+					assert.Nil(t, err)
+					break
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := s.Get([]byte("counter"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte("40"), v)
+	}
+}
+
+func TestTxnReplayAllOrNothing(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "samlon")
+	defer os.RemoveAll(tmpdir)
+
+	opts := testSamlonOpts()
+	opts.FileBlockMaxEntries = 1000
+	s := NewSamlon(zap.NewNop(), opts, tmpdir)
+	if !assert.Nil(t, s.Open()) {
+		return
+	}
+
+	txn, err := s.NewTxn()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, txn.Set([]byte("committed#1"), []byte("value")))
+	assert.Nil(t, txn.Set([]byte("committed#2"), []byte("value")))
+	assert.Nil(t, txn.Commit())
+
+	// a transaction torn by crashing, the last entry never reached
+	// the value log.
+	req := &request{Ents: []*Entry{
+		{Key: []byte("torn#1"), Value: []byte("value"), meta: bitTxn},
+		{Key: []byte("torn#2"), Value: []byte("value"), meta: bitTxn},
+	}}
+	if !assert.Nil(t, s.valueStore.Write(req)) {
+		return
+	}
+	assert.Nil(t, s.Close())
+
+	// lose the meta store, everything comes from replaying
+	os.Remove(path.Join(tmpdir, boltDBFile))
+	for round := 0; round < 2; round++ {
+		s = NewSamlon(zap.NewNop(), opts, tmpdir)
+		if !assert.Nil(t, s.Open()) {
+			return
+		}
+		for _, k := range []string{"committed#1", "committed#2"} {
+			_, err := s.Get([]byte(k))
+			assert.Nil(t, err)
+		}
+		for _, k := range []string{"torn#1", "torn#2"} {
+			_, err := s.Get([]byte(k))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+
+		// the later transaction never merges with the torn one
+		txn, err := s.NewTxn()
+		if !assert.Nil(t, err) {
+			return
+		}
+		assert.Nil(t, txn.Set([]byte(fmt.Sprintf("round#%d", round)), []byte("value")))
+		assert.Nil(t, txn.Commit())
+		assert.Nil(t, s.Close())
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/EricYT/go-examples/pkg/codec"
 	"github.com/pkg/errors"
 )
 
@@ -31,6 +32,13 @@ var (
 
 type IndexEngine interface {
 	Get(key []byte) (valuePointer, error)
+	// CompareAndSwap swaps the keys to the news pointers in one batch,
+	// the key skipped if it's not pointing to the old one any more.
+	// A zero news pointer removes the key.
+	CompareAndSwap(keys [][]byte, olds, news []valuePointer) error
+	// Sync makes the swapping durable, the keys removed are never
+	// brought back by replaying the value log.
+	Sync() error
 }
 
 type ValueStore struct {
@@ -45,8 +53,20 @@ type ValueStore struct {
 	writableBlockOffset uint32 // read by read, write by write. Must access via atomics.
 	numEntriesWritten   uint32
 
+	// serializes writing entries and indexing them, between the user
+	// writes and gc rewrites. Held by the callers of Write.
+	writeLock sync.Mutex
+
+	// the readers of the old index snapshots, the collected files are
+	// deleted after all of them released.
+	snapshots *snapshotRefs
+
 	// gc
-	filesToBeDeleted []uint32
+	filesToBeDeleted []uint32 // guarded by filesLock
+	discard          *discardStats
+
+	// encodes the values written, decodes the values read
+	codec *codec.Codec
 
 	runGC chan struct{}
 
@@ -59,15 +79,88 @@ func NewValueStore(dir string, opts Opts, ie IndexEngine) *ValueStore {
 		opts:        opts,
 		dirPath:     dir,
 		runGC:       make(chan struct{}, 1),
+		discard:     newDiscardStats(dir),
 		indexEngine: ie,
+		snapshots:   newSnapshotRefs(),
 	}
 	return e
 }
 
+// snapshotRefs counts the index snapshots by the gc epoch they are taken
+// in. A gc waits only for the ones taken before it, the ones taken later
+// never blocked as the readers behind a RWMutex writer waiting, which
+// deadlocks a reader taking the second one.
+type snapshotRefs struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	epoch uint64
+	refs  map[uint64]int
+}
+
+func newSnapshotRefs() *snapshotRefs {
+	r := &snapshotRefs{refs: make(map[uint64]int)}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// acquire returns the epoch released by the snapshot.
+func (r *snapshotRefs) acquire() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refs[r.epoch]++
+	return r.epoch
+}
+
+func (r *snapshotRefs) release(epoch uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refs[epoch]--
+	if r.refs[epoch] <= 0 {
+		delete(r.refs, epoch)
+		r.cond.Broadcast()
+	}
+}
+
+// wait begins a new epoch, and waits for the snapshots of the ones before
+// released.
+func (r *snapshotRefs) wait() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	epoch := r.epoch
+	r.epoch++
+	for r.heldBefore(epoch) {
+		r.cond.Wait()
+	}
+}
+
+func (r *snapshotRefs) heldBefore(epoch uint64) bool {
+	for e := range r.refs {
+		if e <= epoch {
+			return true
+		}
+	}
+	return false
+}
+
 func (vs *ValueStore) Load() error {
+	c, err := codec.New(vs.opts.Compression, vs.opts.Encryption)
+	if err != nil {
+		return errors.Wrap(err, "Unable to create value codec")
+	}
+	vs.codec = c
 	if err := vs.populateFilesMap(); err != nil {
 		return errors.Wrap(err, "Unable to populate files map")
 	}
+	if err := vs.discard.load(); err != nil {
+		// count them by scanning again
+		log.Printf("value store load discard stats fail. %v", err)
+		vs.discard = newDiscardStats(vs.dirPath)
+	}
+	for _, fid := range vs.discard.fids() {
+		if _, ok := vs.filesMap[fid]; !ok {
+			vs.discard.remove(fid)
+		}
+	}
 	if len(vs.filesMap) == 0 {
 		_, err := vs.createLogFile(0)
 		if err != nil {
@@ -88,7 +181,7 @@ func (vs *ValueStore) Load() error {
 	// FIXME: we don't use the last one file any more, in case
 	// something wrong cause we modified the file.
 	maxFid := atomic.AddUint32(&vs.maxFid, 1)
-	_, err := vs.createLogFile(maxFid)
+	_, err = vs.createLogFile(maxFid)
 	if err != nil {
 		return errors.Wrapf(err, "Unable to create the current writing file %q", vs.fpath(maxFid))
 	}
@@ -97,6 +190,12 @@ func (vs *ValueStore) Load() error {
 }
 
 func (vs *ValueStore) Close() error {
+	if vs.codec != nil {
+		vs.codec.Close()
+	}
+	if err := vs.discard.persist(); err != nil {
+		return errors.Wrap(err, "Unable to persist discard stats")
+	}
 	for _, lf := range vs.filesMap {
 		if err := lf.sync(); err != nil {
 			return errors.Wrapf(err, "Unable to sync file %q", lf.path)
@@ -112,6 +211,8 @@ func (vs *ValueStore) Close() error {
 }
 
 func (vs *ValueStore) sortedFilesId() []uint32 {
+	vs.filesLock.RLock()
+	defer vs.filesLock.RUnlock()
 	filesToBeDeleted := make(map[uint32]struct{})
 	for i := range vs.filesToBeDeleted {
 		filesToBeDeleted[vs.filesToBeDeleted[i]] = struct{}{}
@@ -210,6 +311,7 @@ func (vs *ValueStore) createLogFile(fid uint32) (lf *logFile, err error) {
 	vs.filesLock.Lock()
 	vs.filesMap[fid] = lf
 	vs.filesLock.Unlock()
+	vs.discard.track(fid)
 
 	return lf, nil
 }
@@ -238,8 +340,7 @@ func (vs *ValueStore) Write(req *request) (err error) {
 
 		atomic.AddUint32(&vs.writableBlockOffset, uint32(nr))
 
-		if vs.numEntriesWritten >= vs.opts.FileBlockMaxEntries ||
-			vs.woffset() >= uint32(vs.opts.FileBlockMaxSize) {
+		if vs.full() {
 			if err := currlf.doneWriting(); err != nil {
 				return errors.Wrapf(err, "Done writing file %d fail", currlf.fid)
 			}
@@ -249,12 +350,29 @@ func (vs *ValueStore) Write(req *request) (err error) {
 				return err
 			}
 			currlf = newlf
+			// a good time to save the stats of the sealed file
+			if err := vs.discard.persist(); err != nil {
+				log.Printf("value store persist discard stats fail. %v", err)
+			}
 		}
 		return nil
 	}
 
 	for i := range req.Ents {
-		e := req.Ents[i]
+		e, err := vs.encodeValue(req.Ents[i])
+		if err != nil {
+			return errors.Wrapf(err, "Unable to encode value of %q", string(req.Ents[i].Key))
+		}
+
+		// roll to a new file before the entry once either limit reached,
+		// a file never exceeds FileBlockMaxEntries entries, nor more than
+		// one entry beyond FileBlockMaxSize.
+		if vs.numEntriesWritten >= vs.opts.FileBlockMaxEntries ||
+			vs.woffset()+uint32(buf.Len()) >= uint32(vs.opts.FileBlockMaxSize) {
+			if err := toDisk(); err != nil {
+				return err
+			}
+		}
 
 		var vp valuePointer
 		vp.Fid = currlf.fid
@@ -265,19 +383,80 @@ func (vs *ValueStore) Write(req *request) (err error) {
 		}
 		vs.numEntriesWritten += 1
 		req.Ptrs = append(req.Ptrs, vp)
-		writeNow :=
-			vs.woffset()+uint32(buf.Len()) > uint32(vs.opts.FileBlockMaxSize) ||
-				vs.numEntriesWritten > vs.opts.FileBlockMaxEntries
-		if writeNow {
-			if err := toDisk(); err != nil {
-				return err
-			}
+		if e.ExpiresAt > 0 {
+			vs.discard.expire(vp.Fid, e.ExpiresAt)
 		}
 	}
 
 	return toDisk()
 }
 
+// encodeValue returns the entry with the value encoded by the codec, the
+// entry of the caller is never modified. The values encoded already, which
+// are rewritten by gc, are kept unless sealed by a key rotated out.
+func (vs *ValueStore) encodeValue(e *Entry) (*Entry, error) {
+	if len(e.Value) == 0 {
+		return e, nil
+	}
+	value := e.Value
+	if e.meta&bitValueCodec > 0 {
+		if !vs.codec.Stale(value) {
+			return e, nil
+		}
+		var err error
+		if value, err = vs.codec.Decode(value, e.Key); err != nil {
+			return nil, err
+		}
+	} else if !vs.codec.Enabled() {
+		return e, nil
+	}
+	encoded, err := vs.codec.Encode(value, e.Key)
+	if err != nil {
+		return nil, err
+	}
+	ne := *e
+	ne.Value = encoded
+	ne.meta |= bitValueCodec
+	return &ne, nil
+}
+
+// full tells whether the current writing file reached either limit.
+func (vs *ValueStore) full() bool {
+	return vs.numEntriesWritten >= vs.opts.FileBlockMaxEntries ||
+		vs.woffset() >= uint32(vs.opts.FileBlockMaxSize)
+}
+
+// markDiscard counts the values no longer referenced by the index, the
+// stats persisted every FileBlockMaxSize bytes counted. Called with the
+// writeLock held.
+func (vs *ValueStore) markDiscard(vps []valuePointer) error {
+	if len(vps) == 0 {
+		return nil
+	}
+	if vs.discard.mark(vps) < vs.opts.FileBlockMaxSize {
+		return nil
+	}
+	if err := vs.discard.persist(); err != nil {
+		return errors.Wrap(err, "Unable to persist discard stats")
+	}
+	return nil
+}
+
+// Sync flushes the current writing log file, it's no necessary if
+// the file was opened with O_SYNC.
+func (vs *ValueStore) Sync() error {
+	if vs.opts.SyncedFileIO {
+		return nil
+	}
+	vs.filesLock.RLock()
+	currlf := vs.filesMap[atomic.LoadUint32(&vs.maxFid)]
+	vs.filesLock.RUnlock()
+	if err := currlf.sync(); err != nil {
+		return errors.Wrapf(err, "Unable to sync log file %q", currlf.path)
+	}
+	return nil
+}
+
 // FIXME: thread-safe
 func (vs *ValueStore) Read(vp valuePointer, s *Slice) ([]byte, func(), error) {
 	maxFid := atomic.LoadUint32(&vs.maxFid)
@@ -287,13 +466,47 @@ func (vs *ValueStore) Read(vp valuePointer, s *Slice) ([]byte, func(), error) {
 			vp.Offset, vs.woffset())
 	}
 
+	e, unlock, err := vs.ReadEntry(vp, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e.Value, unlock, nil
+}
+
+// ReadEntry reads the whole entry, the key and value are only valid
+// before unlock called.
+func (vs *ValueStore) ReadEntry(vp valuePointer, s *Slice) (*Entry, func(), error) {
 	buf, unlock, err := vs.getValueBytes(vp, s)
 	if err != nil {
 		return nil, nil, err
 	}
 	var head header
 	head.Decode(buf)
-	return buf[uint32(headerSize)+head.klen : uint32(headerSize)+head.klen+head.vlen], unlock, nil
+	if head.version != entryVersion {
+		if unlock != nil {
+			unlock()
+		}
+		return nil, nil, ErrEntryVersion
+	}
+	e := &Entry{
+		Key:       buf[uint32(headerSize) : uint32(headerSize)+head.klen],
+		Value:     buf[uint32(headerSize)+head.klen : uint32(headerSize)+head.klen+head.vlen],
+		UserMeta:  head.userMeta,
+		ExpiresAt: head.expiresAt,
+		meta:      head.meta,
+	}
+	if e.meta&bitValueCodec > 0 {
+		value, err := vs.codec.Decode(e.Value, e.Key)
+		if err != nil {
+			if unlock != nil {
+				unlock()
+			}
+			return nil, nil, errors.Wrapf(err, "Unable to decode value by %s", vp)
+		}
+		e.Value = value
+		e.meta &^= bitValueCodec
+	}
+	return e, unlock, nil
 }
 
 func (vs *ValueStore) getValueBytes(vp valuePointer, s *Slice) ([]byte, func(), error) {
@@ -321,6 +534,10 @@ func (vs *ValueStore) getFileRLocked(fid uint32) (*logFile, error) {
 		return nil, ErrRetry
 	}
 	lf.lock.RLock()
+	if lf.deleted {
+		lf.lock.RUnlock()
+		return nil, ErrRetry
+	}
 	return lf, nil
 }
 
@@ -357,6 +574,9 @@ func (r *safeRead) Entry(reader *bufio.Reader) (*Entry, error) {
 	e := &Entry{}
 	e.Key = r.k[:head.klen]
 	e.Value = r.v[:head.vlen]
+	e.UserMeta = head.userMeta
+	e.ExpiresAt = head.expiresAt
+	e.meta = head.meta
 
 	if _, err := io.ReadFull(tee, e.Key); err != nil {
 		return nil, err
@@ -373,6 +593,9 @@ func (r *safeRead) Entry(reader *bufio.Reader) (*Entry, error) {
 	if crc != hash.Sum32() {
 		return nil, ErrCrcInvalid
 	}
+	if head.version != entryVersion {
+		return nil, ErrEntryVersion
+	}
 
 	return e, nil
 }
@@ -391,10 +614,11 @@ func (vs *ValueStore) iterate(lf *logFile, offset uint32, fn valueEntry) (eof ui
 
 	reader := bufio.NewReader(lf.fd)
 	read := &safeRead{
-		v: make([]byte, 10), // maybe 1M
+		v:            make([]byte, 10), // maybe 1M
+		recordOffset: offset,
 	}
 
-	var validEof uint32
+	validEof := offset
 	for {
 		var entry *Entry
 		entry, err = read.Entry(reader)
@@ -423,12 +647,61 @@ func (vs *ValueStore) iterate(lf *logFile, offset uint32, fn valueEntry) (eof ui
 	return validEof, nil
 }
 
+// Replay iterates all the entries behind the head, they are written into
+// log files but maybe never reach the index engine before crashing. The torn
+// or crc invalid tail of the newest log file is truncated. It must be called
+// after Load and before any writing.
+func (vs *ValueStore) Replay(head valuePointer, fn valueEntry) error {
+	currFid := atomic.LoadUint32(&vs.maxFid)
+	var filesId []uint32
+	for _, fid := range vs.sortedFilesId() {
+		if fid >= head.Fid && fid < currFid {
+			filesId = append(filesId, fid)
+		}
+	}
+
+	for i, fid := range filesId {
+		lf := vs.filesMap[fid]
+		var offset uint32
+		if fid == head.Fid {
+			offset = head.Offset + head.Len
+		}
+		log.Printf("value store replay log file %q from offset %d", lf.path, offset)
+
+		eof, err := vs.iterate(lf, offset, fn)
+		if err == ErrEOF {
+			continue
+		}
+		if err != nil && err != ErrCrcInvalid {
+			return errors.Wrapf(err, "Unable to replay log file %q", lf.path)
+		}
+		if eof == lf.size {
+			continue
+		}
+
+		// Only the newest one can be torn by crashing, the others have been
+		// synced before we rolled to the next file.
+		if i != len(filesId)-1 {
+			return errors.Wrapf(ErrCrcInvalid, "Log file %q corrupted at offset %d", lf.path, eof)
+		}
+		log.Printf("value store truncate log file %q from %d to %d", lf.path, lf.size, eof)
+		if err := lf.truncate(eof); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var (
 	ErrDataMissing error = errors.New("data missing")
 )
 
 func (vs *ValueStore) pickLogFiles(head valuePointer, ratio float64) (lfs []*logFile, err error) {
+	// wait for the writing in flight indexed, all the files before
+	// maxFid are sealed and indexed then.
+	vs.writeLock.Lock()
 	maxFid := atomic.LoadUint32(&vs.maxFid)
+	vs.writeLock.Unlock()
 	writeOffset := atomic.LoadUint32(&vs.writableBlockOffset)
 	if head.Fid > maxFid || (head.Fid == maxFid && head.Offset > writeOffset) {
 		return nil, ErrDataMissing
@@ -438,7 +711,10 @@ func (vs *ValueStore) pickLogFiles(head valuePointer, ratio float64) (lfs []*log
 	sortedFilesId := vs.sortedFilesId()
 	for i := range sortedFilesId {
 		fileId := sortedFilesId[i]
-		if fileId > head.Fid {
+		// the current writing one, and the ones replayed from head after
+		// crashing. The head may be the one flushed by the index engine,
+		// the entries after it in its file indexed only in memory.
+		if fileId >= head.Fid || fileId >= maxFid {
 			continue
 		}
 
@@ -451,48 +727,27 @@ func (vs *ValueStore) pickLogFiles(head valuePointer, ratio float64) (lfs []*log
 			continue
 		}
 
-		var discard uint32
-		eofOffset, err := vs.iterate(lf, 0, func(entry *Entry, vp valuePointer) error {
-			if vp.Fid == head.Fid && vp.Offset >= head.Offset {
-				return ErrStop
-			}
-
-			key := entry.Key
-			currvp, err := vs.indexEngine.Get(key)
+		discard, _ := vs.discard.get(fileId)
+		size := lf.size
+		if vs.discard.stale(fileId, uint64(time.Now().Unix())) {
+			discard, size, err = vs.scanDiscard(lf, head)
 			if err != nil {
-				if ErrValuePointerNotFound == err {
-					discard += vp.Len
-					return nil
-				}
-				return errors.Wrapf(err, "Unable to get %q value pointer from index", key)
+				log.Printf("value store iterate file %q fail. %v", lf.path, err)
+				return nil, err
 			}
-
-			if currvp.Fid > vp.Fid {
-				// the entry already move to the head
-				discard += vp.Len
-			} else if currvp.Fid == vp.Fid {
-				if currvp.Offset > vp.Offset {
-					// the entry already move to the head
-					discard += vp.Len
-				}
+			if size == lf.size {
+				vs.discard.set(fileId, discard)
 			}
-			// FIXME: small than the index store ? Damn it.
-
-			return nil
-		})
-		if err != nil {
-			log.Printf("value store iterate file %q fail. %v", lf.path, err)
-			return nil, err
 		}
-		if eofOffset == 0 {
+		if size == 0 {
 			// Empty file
 			log.Printf("value store got a empty log file %q", lf.path)
 			lfs = append(lfs, lf)
 			continue
 		}
 
-		sparseRatio := float64(discard) / float64(eofOffset)
-		log.Printf("value store file %q discard: %d log size: %d sparse ratio: %f target ratio: %f", lf.path, discard, eofOffset, sparseRatio, ratio)
+		sparseRatio := float64(discard) / float64(size)
+		log.Printf("value store file %q discard: %d log size: %d sparse ratio: %f target ratio: %f", lf.path, discard, size, sparseRatio, ratio)
 		if sparseRatio >= ratio {
 			lfs = append(lfs, lf)
 		}
@@ -501,37 +756,100 @@ func (vs *ValueStore) pickLogFiles(head valuePointer, ratio float64) (lfs []*log
 	return lfs, nil
 }
 
+// scanDiscard counts the discard bytes of the file missing from the
+// discard stats by checking every entry with the index engine, the
+// entries from head not counted.
+func (vs *ValueStore) scanDiscard(lf *logFile, head valuePointer) (discard uint32, eof uint32, err error) {
+	eof, err = vs.iterate(lf, 0, func(entry *Entry, vp valuePointer) error {
+		if vp.Fid == head.Fid && vp.Offset >= head.Offset {
+			return ErrStop
+		}
+
+		if entry.isDeletedOrExpired() {
+			discard += vp.Len
+			return nil
+		}
+
+		key := entry.Key
+		currvp, err := vs.indexEngine.Get(key)
+		if err != nil {
+			if ErrValuePointerNotFound == err {
+				discard += vp.Len
+				return nil
+			}
+			return errors.Wrapf(err, "Unable to get %q value pointer from index", key)
+		}
+
+		if currvp.Fid > vp.Fid {
+			// the entry already move to the head
+			discard += vp.Len
+		} else if currvp.Fid == vp.Fid {
+			if currvp.Offset > vp.Offset {
+				// the entry already move to the head
+				discard += vp.Len
+			}
+		}
+		// FIXME: small than the index store ? Damn it.
+
+		return nil
+	})
+	if err == ErrEOF {
+		// Empty file
+		return 0, 0, nil
+	}
+	return discard, eof, err
+}
+
+// gcRewriteBatchSize is the number of live entries moved to the head
+// in one batch.
+const gcRewriteBatchSize int = 64
+
 func (vs *ValueStore) runGCLogFile(lf *logFile, ratio float64) error {
 	log.Printf("value store ready to gc log file %q", lf.path)
 
-	_, err := vs.iterate(lf, 0, func(e *Entry, vp valuePointer) error {
+	var ents []*Entry
+	var vps []valuePointer
+	rewrite := func() error {
+		if len(ents) == 0 {
+			return nil
+		}
+		err := vs.rewrite(ents, vps)
+		ents, vps = ents[:0], vps[:0]
+		return err
+	}
 
+	_, err := vs.iterate(lf, 0, func(e *Entry, vp valuePointer) error {
 		key := e.Key
 		currvp, err := vs.indexEngine.Get(key)
 		if err != nil {
 			if err == ErrValuePointerNotFound {
 				// discard the entry
-				log.Printf("discard entry key: %v", key)
 				return nil
 			}
 			return errors.Wrapf(err, "Unable to index %v from index engine", key)
 		}
-
-		if currvp.Fid > vp.Fid {
+		if currvp.Fid != vp.Fid || currvp.Offset != vp.Offset {
 			// there is a new value after this one, discard it.
 			return nil
-		} else if currvp.Fid == vp.Fid {
-			if currvp.Offset > vp.Offset {
-				// discard it
-				return nil
-			}
-			// FIXME: rewrite this one.
-			log.Printf("rewrite entry key: %v", key)
 		}
-		// FIXME: currence writing ?
-		// discard it
+
+		// the entry buffer is reused by iterating
+		ents = append(ents, &Entry{
+			Key:       append([]byte{}, e.Key...),
+			Value:     append([]byte{}, e.Value...),
+			UserMeta:  e.UserMeta,
+			ExpiresAt: e.ExpiresAt,
+			meta:      e.meta &^ (bitValueInLog | bitTxn | bitFinTxn),
+		})
+		vps = append(vps, vp)
+		if len(ents) >= gcRewriteBatchSize {
+			return rewrite()
+		}
 		return nil
 	})
+	if err == nil {
+		err = rewrite()
+	}
 	if err != nil {
 		log.Printf("value store run gc in log file %q fail. %v", lf.path, err)
 		return errors.Wrapf(err, "Unable to gc file %q", lf.path)
@@ -540,6 +858,84 @@ func (vs *ValueStore) runGCLogFile(lf *logFile, ratio float64) error {
 	return nil
 }
 
+// rewrite moves the live entries to the head log file, and swaps their
+// value pointers in the index engine. The expired ones are removed from
+// the index engine instead. The writeLock is held from checking the index
+// to swapping, so the entries rewritten are always the newest ones even
+// replayed after crashing.
+func (vs *ValueStore) rewrite(ents []*Entry, olds []valuePointer) error {
+	vs.writeLock.Lock()
+	defer vs.writeLock.Unlock()
+
+	req := &request{}
+	var keys, expiredKeys [][]byte
+	var moved, expired []valuePointer
+	for i := range ents {
+		// the writing happened before we got the lock
+		currvp, err := vs.indexEngine.Get(ents[i].Key)
+		if err == ErrValuePointerNotFound {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Unable to index %v from index engine", ents[i].Key)
+		}
+		if currvp.Fid != olds[i].Fid || currvp.Offset != olds[i].Offset {
+			continue
+		}
+		if ents[i].isDeletedOrExpired() {
+			expiredKeys = append(expiredKeys, ents[i].Key)
+			expired = append(expired, olds[i])
+			continue
+		}
+		req.Ents = append(req.Ents, ents[i])
+		keys = append(keys, ents[i].Key)
+		moved = append(moved, olds[i])
+	}
+
+	if len(req.Ents) > 0 {
+		if err := vs.Write(req); err != nil {
+			return errors.Wrap(err, "Unable to rewrite entries")
+		}
+		if err := vs.Sync(); err != nil {
+			return err
+		}
+	}
+	news := append(req.Ptrs, make([]valuePointer, len(expired))...)
+	keys = append(keys, expiredKeys...)
+	moved = append(moved, expired...)
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := vs.indexEngine.CompareAndSwap(keys, moved, news); err != nil {
+		return errors.Wrap(err, "Unable to swap value pointers in index engine")
+	}
+	log.Printf("value store gc rewrite %d entries, remove %d expired entries", len(req.Ents), len(expired))
+	return nil
+}
+
+// deleteLogFile removes the file once all the readers holding it
+// released, the readers coming later get ErrRetry.
+func (vs *ValueStore) deleteLogFile(lf *logFile) error {
+	vs.filesLock.Lock()
+	delete(vs.filesMap, lf.fid)
+	vs.filesLock.Unlock()
+	vs.discard.remove(lf.fid)
+
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	lf.deleted = true
+	if err := lf.munmap(); err != nil {
+		return err
+	}
+	if err := lf.fd.Close(); err != nil {
+		return errors.Wrapf(err, "Unable to close the file: %q", lf.path)
+	}
+	if err := os.Remove(lf.path); err != nil {
+		return errors.Wrapf(err, "Unable to remove the file: %q", lf.path)
+	}
+	return SyncDir(vs.dirPath)
+}
+
 var (
 	ErrGCRunning error = errors.New("gc running")
 )
@@ -569,7 +965,40 @@ func (vs *ValueStore) RunGC(head valuePointer, ratio float64) error {
 			if err != nil {
 				return errors.Wrapf(err, "Unable to gc log file %q", lf.path)
 			}
+			vs.filesLock.Lock()
 			vs.filesToBeDeleted = append(vs.filesToBeDeleted, lf.fid)
+			vs.filesLock.Unlock()
+		}
+
+		// the snapshots taken before rewriting may point to the files
+		vs.snapshots.wait()
+
+		// the expired keys removed never point to the files deleted
+		// after crashing
+		if len(lfs) > 0 {
+			if err := vs.indexEngine.Sync(); err != nil {
+				return errors.Wrap(err, "Unable to sync index engine")
+			}
+		}
+
+		for i := range lfs {
+			lf := lfs[i]
+			if err := vs.deleteLogFile(lf); err != nil {
+				return errors.Wrapf(err, "Unable to delete log file %q", lf.path)
+			}
+			vs.filesLock.Lock()
+			for j, fid := range vs.filesToBeDeleted {
+				if fid == lf.fid {
+					vs.filesToBeDeleted = append(vs.filesToBeDeleted[:j], vs.filesToBeDeleted[j+1:]...)
+					break
+				}
+			}
+			vs.filesLock.Unlock()
+		}
+		if len(lfs) > 0 {
+			if err := vs.discard.persist(); err != nil {
+				return errors.Wrap(err, "Unable to persist discard stats")
+			}
 		}
 
 	default:
@@ -579,6 +1008,54 @@ func (vs *ValueStore) RunGC(head valuePointer, ratio float64) error {
 	return nil
 }
 
+// LogFileStats is the disk usage of a value log file.
+type LogFileStats struct {
+	Fid      uint32
+	Size     uint32 // bytes written
+	Discard  uint32 // bytes no longer referenced by the index
+	Writable bool   // the current writing one
+	Counted  bool   // false if the discard bytes never counted
+}
+
+func (st LogFileStats) Live() uint32 {
+	if st.Discard > st.Size {
+		return 0
+	}
+	return st.Size - st.Discard
+}
+
+type ValueStoreStats struct {
+	Files   []LogFileStats // in order of fid
+	Size    uint64
+	Discard uint64
+}
+
+// Stats reports the disk usage of every log file from the discard stats,
+// the files never counted since loaded are counted by gc.
+func (vs *ValueStore) Stats() ValueStoreStats {
+	var stats ValueStoreStats
+	maxFid := atomic.LoadUint32(&vs.maxFid)
+	for _, fid := range vs.sortedFilesId() {
+		vs.filesLock.RLock()
+		lf, ok := vs.filesMap[fid]
+		vs.filesLock.RUnlock()
+		if !ok {
+			continue
+		}
+		lf.lock.RLock()
+		st := LogFileStats{Fid: fid, Size: lf.size, Writable: fid == maxFid}
+		lf.lock.RUnlock()
+		if st.Writable {
+			st.Size = vs.woffset()
+		}
+		st.Discard, st.Counted = vs.discard.get(fid)
+		stats.Files = append(stats.Files, st)
+		stats.Size += uint64(st.Size)
+		stats.Discard += uint64(st.Discard)
+	}
+	return stats
+}
+
 type logFile struct {
 	path string
 
@@ -590,6 +1067,7 @@ type logFile struct {
 	fmap        []byte // for mmap
 	size        uint32
 	loadingMode FileLoadingMode
+	deleted     bool // removed by gc
 }
 
 var (
@@ -610,9 +1088,13 @@ func (f *logFile) read(vp valuePointer, s *Slice) (buf []byte, err error) {
 		size := int64(len(f.fmap))
 		valsz := vp.Len
 		if int64(offset) >= size || int64(offset+valsz) > size {
-			err = ErrEOF
-		}
-		if err == nil {
+			// the writing file grew beyond the mapped region by a
+			// huge entry, read it from the file.
+			buf = s.Resize(int(valsz))
+			var n int
+			n, err = f.fd.ReadAt(buf, int64(offset))
+			nbr = int64(n)
+		} else {
 			buf = f.fmap[offset : offset+valsz]
 			nbr = int64(valsz)
 		}
@@ -642,7 +1124,7 @@ func (f *logFile) openReadOnly() error {
 }
 
 func (f *logFile) mmap(sz int64) error {
-	if f.loadingMode != MemoryMap {
+	if f.loadingMode != MemoryMap || sz == 0 {
 		return nil
 	}
 	var err error
@@ -653,12 +1135,13 @@ func (f *logFile) mmap(sz int64) error {
 }
 
 func (f *logFile) munmap() error {
-	if f.loadingMode != MemoryMap {
+	if f.loadingMode != MemoryMap || f.fmap == nil {
 		return nil
 	}
 	if err := Munmap(f.fmap); err != nil {
 		return errors.Wrapf(err, "Unable to munmap log file: %q", f.path)
 	}
+	f.fmap = nil
 	return nil
 }
 
@@ -679,6 +1162,22 @@ func (f *logFile) doneWriting() error {
 	return f.openReadOnly()
 }
 
+// truncate drops the data after size, the file is reopened as read-only.
+func (f *logFile) truncate(size uint32) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.munmap(); err != nil {
+		return err
+	}
+	if err := f.fd.Close(); err != nil {
+		return errors.Wrapf(err, "Unable to close the file: %q", f.path)
+	}
+	if err := os.Truncate(f.path, int64(size)); err != nil {
+		return errors.Wrapf(err, "Unable to truncate file %q to %d", f.path, size)
+	}
+	return f.openReadOnly()
+}
+
 func (f *logFile) sync() error {
 	return f.fd.Sync()
 }
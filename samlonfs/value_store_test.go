@@ -255,7 +255,8 @@ func TestValueStoreIterate(t *testing.T) {
 }
 
 var (
-	stubIndexEngineGet = func(_ []byte) (vp valuePointer, err error) { return }
+	stubIndexEngineGet            = func(_ []byte) (vp valuePointer, err error) { return }
+	stubIndexEngineCompareAndSwap = func(_ [][]byte, _, _ []valuePointer) error { return nil }
 )
 
 type fakeIndexEngine struct{}
@@ -264,6 +265,14 @@ func (f fakeIndexEngine) Get(key []byte) (valuePointer, error) {
 	return stubIndexEngineGet(key)
 }
 
+func (f fakeIndexEngine) CompareAndSwap(keys [][]byte, olds, news []valuePointer) error {
+	return stubIndexEngineCompareAndSwap(keys, olds, news)
+}
+
+func (f fakeIndexEngine) Sync() error {
+	return nil
+}
+
 func TestValueStorePickLogs(t *testing.T) {
 	tmpdir := path.Join(os.TempDir(), "value_store")
 	t.Logf("tmpdir: %q", tmpdir)
@@ -306,12 +315,38 @@ func TestValueStorePickLogs(t *testing.T) {
 	}
 	defer func() { stubIndexEngineGet = origStubIndexEngineGet }()
 
+	// the files never counted are scanned
+	for _, fid := range vs.discard.fids() {
+		vs.discard.remove(fid)
+	}
 	head := vps[len(ents)-1]
 	lfs, err := vs.pickLogFiles(head, 1)
+	if !assert.Nil(t, err) {
+		return
+	}
+	var scanned []uint32
+	for i := range lfs {
+		t.Logf("Got log files: %q fid: %d", lfs[i].path, lfs[i].fid)
+		scanned = append(scanned, lfs[i].fid)
+	}
+	assert.NotEmpty(t, scanned)
+
+	// the same files picked by counting, without scanning
+	for _, fid := range vs.sortedFilesId() {
+		vs.discard.set(fid, 0)
+	}
+	assert.Nil(t, vs.markDiscard(vps[:50]))
+	stubIndexEngineGet = func(key []byte) (valuePointer, error) {
+		t.Errorf("unexpected index lookup %q", key)
+		return valuePointer{}, ErrValuePointerNotFound
+	}
+	lfs, err = vs.pickLogFiles(head, 1)
 	if assert.Nil(t, err) {
+		var counted []uint32
 		for i := range lfs {
-			t.Logf("Got log files: %q fid: %d", lfs[i].path, lfs[i].fid)
+			counted = append(counted, lfs[i].fid)
 		}
+		assert.Equal(t, scanned, counted)
 	}
 }
 
@@ -353,6 +388,7 @@ func TestValueStoreGC(t *testing.T) {
 	}
 
 	// rewrite the first request data
+	olds := reqs[0].Ptrs
 	reqs[0].Ptrs = nil
 	err = vs.Write(reqs[0])
 	if !assert.Nil(t, err) {
@@ -366,6 +402,13 @@ func TestValueStoreGC(t *testing.T) {
 	}
 
 	anchor := binary.BigEndian.Uint32(reqs[1].Ents[0].Key[:4])
+	discards := append([]valuePointer{}, olds...)
+	for k, vp := range vps {
+		if k >= anchor && k%2 == 0 {
+			discards = append(discards, vp)
+		}
+	}
+	assert.Nil(t, vs.markDiscard(discards))
 
 	origStubIndexEngineGet := stubIndexEngineGet
 	stubIndexEngineGet = func(key []byte) (valuePointer, error) {
@@ -379,8 +422,177 @@ func TestValueStoreGC(t *testing.T) {
 	}
 	defer func() { stubIndexEngineGet = origStubIndexEngineGet }()
 
+	origStubIndexEngineCompareAndSwap := stubIndexEngineCompareAndSwap
+	stubIndexEngineCompareAndSwap = func(keys [][]byte, olds, news []valuePointer) error {
+		for i := range keys {
+			k := binary.BigEndian.Uint32(keys[i][:4])
+			if vps[k] == olds[i] {
+				vps[k] = news[i]
+			}
+		}
+		return nil
+	}
+	defer func() { stubIndexEngineCompareAndSwap = origStubIndexEngineCompareAndSwap }()
+
 	headEntry := ents[len(ents)-3]
 	head := vps[binary.BigEndian.Uint32(headEntry.Key[:4])]
 	err = vs.RunGC(head, 0.5)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// the collected files removed
+	var collected int
+	for fid := uint32(0); fid < head.Fid; fid++ {
+		if _, ok := vs.filesMap[fid]; !ok {
+			_, err := os.Stat(vs.fpath(fid))
+			assert.True(t, os.IsNotExist(err))
+			collected++
+		}
+	}
+	assert.True(t, collected > 0)
+	assert.Empty(t, vs.filesToBeDeleted)
+
+	// the live entries still readable
+	for i := range ents {
+		k := binary.BigEndian.Uint32(ents[i].Key[:4])
+		if _, err := stubIndexEngineGet(ents[i].Key); err != nil {
+			continue
+		}
+		s := &Slice{}
+		buf, unlock, err := vs.Read(vps[k], s)
+		if !assert.Nil(t, err, "key %d", k) {
+			return
+		}
+		assert.Equal(t, ents[i].Value, buf)
+		if unlock != nil {
+			unlock()
+		}
+	}
+}
+
+func TestValueStoreRotate(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "value_store")
+	err := os.MkdirAll(tmpdir, 0755)
 	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	opts := Opts{
+		LoadingMode:         MemoryMap,
+		FileBlockMaxSize:    200,
+		FileBlockMaxEntries: 8,
+		SyncedFileIO:        true,
+	}
+	vs := NewValueStore(tmpdir, opts, &fakeIndexEngine{})
+	if !assert.Nil(t, vs.Load()) {
+		return
+	}
+	defer vs.Close()
+
+	// small values reach the entries limit, big ones the size limit,
+	// and the huge one is beyond the mapped region.
+	ents := prepareEntries(100, func(i int) []byte {
+		switch {
+		case i < 40:
+			return []byte(strconv.Itoa(i))
+		case i == 70:
+			return make([]byte, 1000)
+		default:
+			return make([]byte, 60)
+		}
+	})
+	reqs := prepareRequests(7, ents)
+	for i := range reqs {
+		if !assert.Nil(t, vs.Write(reqs[i])) {
+			return
+		}
+	}
+	validateEntries(t, vs, reqs)
+
+	entries := make(map[uint32]uint32)
+	maxLen := make(map[uint32]uint32)
+	for _, req := range reqs {
+		for _, vp := range req.Ptrs {
+			entries[vp.Fid]++
+			if vp.Len > maxLen[vp.Fid] {
+				maxLen[vp.Fid] = vp.Len
+			}
+		}
+	}
+	stats := vs.Stats()
+	assert.True(t, len(stats.Files) > 5)
+	var size uint64
+	for _, st := range stats.Files {
+		assert.True(t, entries[st.Fid] <= opts.FileBlockMaxEntries, "file %d entries %d", st.Fid, entries[st.Fid])
+		assert.True(t, st.Size < uint32(opts.FileBlockMaxSize)+maxLen[st.Fid], "file %d size %d", st.Fid, st.Size)
+		assert.True(t, st.Counted)
+		assert.Equal(t, uint32(0), st.Discard)
+		size += uint64(st.Size)
+	}
+	assert.Equal(t, size, stats.Size)
+	last := stats.Files[len(stats.Files)-1]
+	assert.True(t, last.Writable)
+	assert.Equal(t, vs.woffset(), last.Size)
+}
+
+func TestValueStoreDiscardStats(t *testing.T) {
+	tmpdir := path.Join(os.TempDir(), "value_store")
+	err := os.MkdirAll(tmpdir, 0755)
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	opts := Opts{
+		LoadingMode:         FileIO,
+		FileBlockMaxSize:    1 << 20,
+		FileBlockMaxEntries: 10,
+		SyncedFileIO:        true,
+	}
+	vs := NewValueStore(tmpdir, opts, &fakeIndexEngine{})
+	if !assert.Nil(t, vs.Load()) {
+		return
+	}
+	ents := prepareEntries(30, func(i int) []byte {
+		return []byte(strconv.Itoa(i))
+	})
+	req := &request{Ents: ents}
+	if !assert.Nil(t, vs.Write(req)) {
+		return
+	}
+	assert.Nil(t, vs.markDiscard(req.Ptrs[:15]))
+
+	discards := func(vs *ValueStore) map[uint32]uint32 {
+		m := make(map[uint32]uint32)
+		for _, st := range vs.Stats().Files {
+			if st.Counted && st.Discard > 0 {
+				m[st.Fid] = st.Discard
+				assert.Equal(t, st.Size-st.Discard, st.Live())
+			}
+		}
+		return m
+	}
+	expected := make(map[uint32]uint32)
+	for _, vp := range req.Ptrs[:15] {
+		expected[vp.Fid] += vp.Len
+	}
+	assert.Equal(t, expected, discards(vs))
+	assert.Nil(t, vs.Close())
+
+	// persisted across reloading
+	vs = NewValueStore(tmpdir, opts, &fakeIndexEngine{})
+	if !assert.Nil(t, vs.Load()) {
+		return
+	}
+	assert.Equal(t, expected, discards(vs))
+	assert.Nil(t, vs.Close())
+
+	// a corrupted stats file is counted by scanning again
+	assert.Nil(t, os.WriteFile(path.Join(tmpdir, discardStatsFile), []byte("garbage"), 0666))
+	vs = NewValueStore(tmpdir, opts, &fakeIndexEngine{})
+	if !assert.Nil(t, vs.Load()) {
+		return
+	}
+	defer vs.Close()
+	for _, st := range vs.Stats().Files {
+		assert.Equal(t, st.Writable, st.Counted, "file %d", st.Fid)
+	}
 }
@@ -7,26 +7,30 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 
-	"git.jd.com/cloud-storage/newds-datanode/pkg/logutil"
+	"github.com/EricYT/go-examples/pkg/codec"
 	"github.com/pkg/errors"
 	"go.etcd.io/etcd/pkg/fileutil"
 )
 
 var (
-	ErrBlockFileNotFound error = errors.New("block file not found")
+	ErrBlockFileNotFound  error = errors.New("block file not found")
+	ErrBlobPointerInvalid error = errors.New("blob pointer beyond block file")
+	ErrBlobCorrupted      error = errors.New("blob corrupted")
 )
 
 var (
 	blockFilePrefix string = "block_"
 	blockFileSuffix string = ".data"
+	// the block files of a snapshot being installed
+	stagedBlockFileSuffix string = ".tmp"
 )
 
-const maxBlockFileSize int64 = 128
 const blockFilePreallocateSize int64 = 1 * 1024
 
 type BlobStore interface {
@@ -34,15 +38,48 @@ type BlobStore interface {
 	Close()
 
 	Write(reqs []*Request) error
+	// Read verifies the crc of the blob, ErrBlobCorrupted returned if
+	// mismatched.
 	Read(bp BlobPointer) (val []byte, err error)
+	// Verify checks the blob pointer is within a block file.
+	Verify(bp BlobPointer) error
+
+	// OpenBlockFile opens the block file for the replicas installing a
+	// snapshot, it's readable until closed even if removed meanwhile.
+	OpenBlockFile(fid uint32) (io.ReadCloser, error)
+	// StageBlockFile writes the block file into a temporary file synced,
+	// which is put in place by ResetBlockFiles.
+	StageBlockFile(fid uint32, r io.Reader) error
+	// DiscardStagedBlockFiles removes the block files staged.
+	DiscardStagedBlockFiles() error
+	// ResetBlockFiles replaces all the block files by the ones staged.
+	ResetBlockFiles(fids []uint32) error
+
+	// BlockFiles returns the block files by id, the last one is the one
+	// being written.
+	BlockFiles() []BlockFileInfo
+	// RemoveBlockFiles removes the block files compacted.
+	RemoveBlockFiles(fids []uint32) error
+	// SyncBlockFiles flushes the block files written to disk.
+	SyncBlockFiles() error
+}
 
-	// FIXME: snapshot
+type BlockFileInfo struct {
+	Id   uint32
+	Size int64
+	// the largest blob id written into it since loaded, zero for the
+	// ones loaded from disk.
+	MaxBlobId int64
 }
 
 type blobStore struct {
-	logger logutil.Logger
+	logger Logger
 
 	root string
+	opts Opts
+
+	// encodes the blobs written, decodes the blobs read
+	codec *codec.Codec
 
 	blockFileLock  sync.RWMutex
 	blocks         map[uint32]*blockFile
@@ -50,10 +87,14 @@ type blobStore struct {
 	Sync           bool
 }
 
-func NewBlobStore(logger logutil.Logger, root string) *blobStore {
+func NewBlobStore(logger Logger, root string, opts Opts) *blobStore {
+	if opts.BlockFileSize <= 0 {
+		opts.BlockFileSize = DefaultOpts.BlockFileSize
+	}
 	bs := &blobStore{
 		logger: logger,
 		root:   root,
+		opts:   opts,
 	}
 	return bs
 }
@@ -61,6 +102,13 @@ func NewBlobStore(logger logutil.Logger, root string) *blobStore {
 func (b *blobStore) Load() error {
 	b.logger.Info("blob store loading start.")
 
+	c, err := codec.New(b.opts.Compression, b.opts.Encryption)
+	if err != nil {
+		b.logger.Errorf("blob store %s create codec failed. %v", b.root, err)
+		return errors.Wrap(err, "Unable to create blob codec")
+	}
+	b.codec = c
+
 	if err := b.populateBlockFiles(); err != nil {
 		b.logger.Errorf("blob store %s populated block files failed. %v", b.root, err)
 		return err
@@ -100,6 +148,13 @@ func (b *blobStore) populateBlockFiles() error {
 		}
 
 		name := bf.Name()
+		if strings.HasSuffix(name, stagedBlockFileSuffix) {
+			// left by installing a snapshot not done
+			if err := os.Remove(filepath.Join(b.root, name)); err != nil {
+				return errors.Wrapf(err, "Unable to remove staged block file %s", name)
+			}
+			continue
+		}
 		if !strings.HasPrefix(name, blockFilePrefix) || !strings.HasSuffix(name, blockFileSuffix) {
 			b.logger.Errorf("blob store %s has wrong name file %s", b.root, name)
 			continue
@@ -139,6 +194,9 @@ func (b *blobStore) Close() {
 	for _, block := range b.blocks {
 		block.Close()
 	}
+	if b.codec != nil {
+		b.codec.Close()
+	}
 }
 
 func (b *blobStore) blockFilePathById(fid uint32) string {
@@ -178,7 +236,7 @@ func (b *blobStore) Write(reqs []*Request) error {
 			return err
 		}
 
-		if int64(buf.Len())+bf.Size() >= maxBlockFileSize {
+		if int64(buf.Len())+bf.Size() >= b.opts.BlockFileSize {
 			fid++
 			bf, err = b.createBlockFile(fid)
 			if err != nil {
@@ -193,7 +251,11 @@ func (b *blobStore) Write(reqs []*Request) error {
 
 	off := bf.Size()
 	for _, req := range reqs {
-		n := encodeRequest(req, &buf)
+		n, err := encodeRequest(req, &buf, b.codec)
+		if err != nil {
+			b.logger.Errorf("blob store %s encode blob %d failed. %v", b.root, req.BlobId, err)
+			return errors.Wrapf(err, "Unable to encode blob %d", req.BlobId)
+		}
 
 		var bp BlobPointer
 		bp.FileId = fid
@@ -202,8 +264,11 @@ func (b *blobStore) Write(reqs []*Request) error {
 
 		off += int64(n)
 		req.Ptr = bp
+		if req.BlobId > bf.maxBlobId {
+			bf.maxBlobId = req.BlobId
+		}
 
-		if int64(buf.Len())+bf.Size() >= maxBlockFileSize {
+		if int64(buf.Len())+bf.Size() >= b.opts.BlockFileSize {
 			if err := toDisk(); err != nil {
 				b.logger.Errorf("blob store %s persist to disk %d failed. %v", b.root, fid, err)
 				return err
@@ -230,10 +295,174 @@ func (b *blobStore) Read(bp BlobPointer) (blob []byte, err error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "Unable to read blob %v from block file", bp)
 	}
+	if err := verifyRecord(blob); err != nil {
+		b.logger.Errorf("blob store %s verify ptr %s failed. %v", b.root, bp, err)
+		return nil, errors.Wrapf(err, "blob %v", bp)
+	}
+
+	blob, err = decodeBlob(blob, b.codec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to decode blob %v", bp)
+	}
+	return blob, nil
+}
+
+func (b *blobStore) Verify(bp BlobPointer) error {
+	b.blockFileLock.RLock()
+	bf, found := b.blocks[bp.FileId]
+	b.blockFileLock.RUnlock()
+	if !found {
+		return ErrBlockFileNotFound
+	}
+	if bp.Offset < 0 || bp.Offset+int64(bp.Length) > bf.Size() {
+		return errors.Wrapf(ErrBlobPointerInvalid, "block file %d size %d", bp.FileId, bf.Size())
+	}
+	return nil
+}
+
+func (b *blobStore) OpenBlockFile(fid uint32) (io.ReadCloser, error) {
+	b.blockFileLock.RLock()
+	defer b.blockFileLock.RUnlock()
+	if _, found := b.blocks[fid]; !found {
+		return nil, ErrBlockFileNotFound
+	}
+	fd, err := os.Open(b.blockFilePathById(fid))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to open block file %d", fid)
+	}
+	return fd, nil
+}
+
+func (b *blobStore) stagedBlockFilePath(fid uint32) string {
+	return b.blockFilePathById(fid) + stagedBlockFileSuffix
+}
+
+func (b *blobStore) StageBlockFile(fid uint32, r io.Reader) error {
+	path := b.stagedBlockFilePath(fid)
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create staged block file %s", path)
+	}
+	defer fd.Close()
+	if _, err := io.Copy(fd, r); err != nil {
+		return errors.Wrapf(err, "Unable to write staged block file %s", path)
+	}
+	if err := fd.Sync(); err != nil {
+		return errors.Wrapf(err, "Unable to sync staged block file %s", path)
+	}
+	return nil
+}
+
+func (b *blobStore) DiscardStagedBlockFiles() error {
+	names, err := filepath.Glob(filepath.Join(b.root, blockFilePrefix+"*"+blockFileSuffix+stagedBlockFileSuffix))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			return errors.Wrapf(err, "Unable to remove staged block file %s", name)
+		}
+	}
+	return nil
+}
+
+// ResetBlockFiles renames the block files staged in place, the others are
+// removed, the writing goes on in the largest one. The caller serializes
+// it with writing and reading.
+func (b *blobStore) ResetBlockFiles(fids []uint32) error {
+	b.logger.Infof("blob store %s reset %d block files", b.root, len(fids))
+
+	b.blockFileLock.Lock()
+	defer b.blockFileLock.Unlock()
+	for _, block := range b.blocks {
+		block.Close()
+	}
+	staged := make(map[uint32]struct{}, len(fids))
+	for _, fid := range fids {
+		staged[fid] = struct{}{}
+	}
+	for fid, block := range b.blocks {
+		if _, ok := staged[fid]; ok {
+			continue
+		}
+		if err := os.Remove(block.path); err != nil {
+			b.logger.Errorf("blob store %s remove block file %d failed. %v", b.root, fid, err)
+			return errors.Wrapf(err, "Unable to remove block file %s", block.path)
+		}
+	}
+	b.blocks = make(map[uint32]*blockFile)
+	atomic.StoreUint32(&b.maxBlockFileId, 0)
+
+	for _, fid := range fids {
+		path := b.blockFilePathById(fid)
+		if err := os.Rename(b.stagedBlockFilePath(fid), path); err != nil {
+			return errors.Wrapf(err, "Unable to rename staged block file %d", fid)
+		}
+	}
+	if dir, err := os.Open(b.root); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	if len(fids) == 0 {
+		fids = []uint32{1}
+	}
+	for _, fid := range fids {
+		blockFile, err := newBlockFile(fid, b.blockFilePathById(fid), b.Sync)
+		if err != nil {
+			b.logger.Errorf("blob store %s open block file %d failed. %v", b.root, fid, err)
+			return err
+		}
+		b.blocks[fid] = blockFile
+		if fid > b.maxBlockFileId {
+			atomic.StoreUint32(&b.maxBlockFileId, fid)
+		}
+	}
+	return nil
+}
+
+func (b *blobStore) BlockFiles() []BlockFileInfo {
+	b.blockFileLock.RLock()
+	defer b.blockFileLock.RUnlock()
+	infos := make([]BlockFileInfo, 0, len(b.blocks))
+	for fid, bf := range b.blocks {
+		infos = append(infos, BlockFileInfo{Id: fid, Size: bf.Size(), MaxBlobId: bf.maxBlobId})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+	return infos
+}
+
+// RemoveBlockFiles never removes the one being written, the caller makes
+// sure no reader on them.
+func (b *blobStore) RemoveBlockFiles(fids []uint32) error {
+	b.blockFileLock.Lock()
+	defer b.blockFileLock.Unlock()
+	for _, fid := range fids {
+		bf, found := b.blocks[fid]
+		if !found {
+			continue
+		}
+		if fid == atomic.LoadUint32(&b.maxBlockFileId) {
+			return errors.Errorf("Unable to remove block file %d being written", fid)
+		}
+		bf.Close()
+		if err := os.Remove(bf.path); err != nil {
+			return errors.Wrapf(err, "Unable to remove block file %s", bf.path)
+		}
+		delete(b.blocks, fid)
+		b.logger.Infof("blob store %s remove block file %d", b.root, fid)
+	}
+	return nil
+}
 
-	var h header
-	h.Decode(blob)
-	return blob[headerSize+int(h.userMetaLen) : headerSize+int(h.userMetaLen)+int(h.blobLen)], nil
+func (b *blobStore) SyncBlockFiles() error {
+	b.blockFileLock.RLock()
+	defer b.blockFileLock.RUnlock()
+	for _, bf := range b.blocks {
+		if err := bf.fd.Sync(); err != nil {
+			return errors.Wrapf(err, "Unable to sync block file %s", bf.path)
+		}
+	}
+	return nil
 }
 
 // block file
@@ -242,6 +471,8 @@ type blockFile struct {
 	path string
 	size int64
 	fd   *os.File
+
+	maxBlobId int64
 }
 
 func newBlockFile(id uint32, path string, syn bool) (*blockFile, error) {
@@ -1,11 +1,12 @@
 package store
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"testing"
 
-	"git.jd.com/cloud-storage/newds-datanode/pkg/logutil"
+	"github.com/EricYT/go-examples/pkg/codec"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,8 +18,8 @@ func TestBlockFile(t *testing.T) {
 	//defer os.RemoveAll(d)
 	d := "./test_blob"
 	os.Mkdir(d, 0755)
-	logger := logutil.NewProduction()
-	bs := NewBlobStore(logger, d)
+	logger := testLogger()
+	bs := NewBlobStore(logger, d, DefaultOpts)
 	err := bs.Load()
 	if !assert.Nil(t, err) {
 		return
@@ -48,7 +49,7 @@ func TestBlockFile(t *testing.T) {
 
 	bs.Close()
 
-	bs = NewBlobStore(logger, d)
+	bs = NewBlobStore(logger, d, DefaultOpts)
 	err = bs.Load()
 	if !assert.Nil(t, err) {
 		return
@@ -62,3 +63,46 @@ func TestBlockFile(t *testing.T) {
 	}
 
 }
+
+func TestBlockFileCodec(t *testing.T) {
+	d := "./test_blob_codec"
+	os.Mkdir(d, 0755)
+	defer os.RemoveAll(d)
+	logger := testLogger()
+
+	keys := codec.NewKeyRegistry()
+	assert.Nil(t, keys.Rotate(1, bytes.Repeat([]byte{1}, 32)))
+	opts := Opts{Compression: codec.Zstd, Encryption: keys}
+	bs := NewBlobStore(logger, d, opts)
+	if !assert.Nil(t, bs.Load()) {
+		return
+	}
+
+	reqs := make([]*Request, 0)
+	for i := 0; i < 10; i++ {
+		reqs = append(reqs, &Request{
+			BlobId: int64(i),
+			Blob:   bytes.Repeat([]byte(fmt.Sprintf("#value%d#", i)), 20),
+		})
+	}
+	if !assert.Nil(t, bs.Write(reqs)) {
+		return
+	}
+	for _, req := range reqs {
+		assert.True(t, int(req.Ptr.Length) < len(req.Blob))
+		blob, err := bs.Read(req.Ptr)
+		if assert.Nil(t, err) {
+			assert.Equal(t, req.Blob, blob)
+		}
+	}
+	bs.Close()
+
+	// the blobs are unreadable without the key
+	bs = NewBlobStore(logger, d, DefaultOpts)
+	if !assert.Nil(t, bs.Load()) {
+		return
+	}
+	defer bs.Close()
+	_, err := bs.Read(reqs[0].Ptr)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	blobMetaBucket  []byte = []byte("blob-meta-bucket")
+	blobStateBucket []byte = []byte("blob-state-bucket")
+
+	// the largest blob id ever committed, in the state bucket
+	committedKey []byte = []byte("committed")
+)
+
+// boltMetaStore keeps the metas in a bolt db, a blob id in big endian as
+// the key, so they are iterated in order.
+type boltMetaStore struct {
+	logger Logger
+	path   string
+
+	db *bolt.DB
+}
+
+func NewBoltMetaStore(logger Logger, path string) *boltMetaStore {
+	return &boltMetaStore{logger: logger, path: path}
+}
+
+func encodeBlobId(blobId int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(blobId))
+	return buf
+}
+
+func decodeBlobId(buf []byte) int64 {
+	return int64(binary.BigEndian.Uint64(buf))
+}
+
+func (m *boltMetaStore) Load() error {
+	m.logger.Infof("bolt meta store %s loading start.", m.path)
+
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return errors.Wrapf(err, "Unable to create meta store directory %s", filepath.Dir(m.path))
+	}
+	db, err := bolt.Open(m.path, 0644, nil)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open bolt db %q", m.path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(blobMetaBucket); err != nil {
+			return errors.Wrapf(err, "Unable to create bucket %s", string(blobMetaBucket))
+		}
+		if _, err := tx.CreateBucketIfNotExists(blobStateBucket); err != nil {
+			return errors.Wrapf(err, "Unable to create bucket %s", string(blobStateBucket))
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	m.db = db
+	return nil
+}
+
+func (m *boltMetaStore) Close() error {
+	if m.db == nil {
+		return nil
+	}
+	return m.db.Close()
+}
+
+// Put moves the committed forward with the meta in one tx.
+func (m *boltMetaStore) Put(key int64, value []byte) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(blobMetaBucket).Put(encodeBlobId(key), value); err != nil {
+			return err
+		}
+		state := tx.Bucket(blobStateBucket)
+		if v := state.Get(committedKey); v != nil && decodeBlobId(v) >= key {
+			return nil
+		}
+		return state.Put(committedKey, encodeBlobId(key))
+	})
+}
+
+func (m *boltMetaStore) Get(key int64) (val []byte, err error) {
+	err = m.db.View(func(tx *bolt.Tx) error {
+		// the bolt value is only valid during the tx
+		if v := tx.Bucket(blobMetaBucket).Get(encodeBlobId(key)); v != nil {
+			val = append([]byte{}, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, ErrMetaNotFound
+	}
+	return val, nil
+}
+
+func (m *boltMetaStore) Delete(key int64) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(blobMetaBucket).Delete(encodeBlobId(key))
+	})
+}
+
+func (m *boltMetaStore) CompareAndSwap(key int64, old, value []byte) (swapped bool, err error) {
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blobMetaBucket)
+		k := encodeBlobId(key)
+		if cur := b.Get(k); cur == nil || !bytes.Equal(cur, old) {
+			return nil
+		}
+		swapped = true
+		return b.Put(k, value)
+	})
+	return swapped, err
+}
+
+func (m *boltMetaStore) Committed() (committed int64, err error) {
+	err = m.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(blobStateBucket).Get(committedKey); v != nil {
+			committed = decodeBlobId(v)
+		}
+		return nil
+	})
+	return committed, err
+}
+
+func (m *boltMetaStore) Snapshot() (map[int64][]byte, error) {
+	metas := make(map[int64][]byte)
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(blobMetaBucket).ForEach(func(k, v []byte) error {
+			metas[decodeBlobId(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to iterate metas")
+	}
+	return metas, nil
+}
+
+func (m *boltMetaStore) Restore(metas map[int64][]byte, committed int64) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(blobMetaBucket); err != nil {
+			return errors.Wrapf(err, "Unable to delete bucket %s", string(blobMetaBucket))
+		}
+		b, err := tx.CreateBucket(blobMetaBucket)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to create bucket %s", string(blobMetaBucket))
+		}
+		for k, v := range metas {
+			if err := b.Put(encodeBlobId(k), v); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(blobStateBucket).Put(committedKey, encodeBlobId(committed))
+	})
+}
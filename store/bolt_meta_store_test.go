@@ -0,0 +1,56 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltMetaStore(t *testing.T) {
+	d, err := ioutil.TempDir("", "meta")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(d)
+	logger := testLogger()
+	path := filepath.Join(d, metaStoreFile)
+
+	ms := NewBoltMetaStore(logger, path)
+	if !assert.Nil(t, ms.Load()) {
+		return
+	}
+	for i := int64(1); i <= 5; i++ {
+		assert.Nil(t, ms.Put(i, []byte{byte(i)}))
+	}
+	assert.Nil(t, ms.Delete(5))
+	_, err = ms.Get(5)
+	assert.Equal(t, ErrMetaNotFound, err)
+	assert.Nil(t, ms.Close())
+
+	ms = NewBoltMetaStore(logger, path)
+	if !assert.Nil(t, ms.Load()) {
+		return
+	}
+	defer ms.Close()
+	committed, err := ms.Committed()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), committed)
+	meta, err := ms.Get(3)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []byte{3}, meta)
+	}
+	metas, err := ms.Snapshot()
+	assert.Nil(t, err)
+	assert.Len(t, metas, 4)
+
+	assert.Nil(t, ms.Restore(map[int64][]byte{7: []byte{7}}, 8))
+	committed, _ = ms.Committed()
+	assert.Equal(t, int64(8), committed)
+	_, err = ms.Get(3)
+	assert.Equal(t, ErrMetaNotFound, err)
+	metas, _ = ms.Snapshot()
+	assert.Equal(t, map[int64][]byte{7: []byte{7}}, metas)
+}
@@ -0,0 +1,196 @@
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The compactor reclaims the space of the blobs deleted. The live blobs
+// of a block file with enough dead bytes are written again into the
+// block file being written, like putting them, and their metas swapped
+// to the new pointers. A block file compacted is removed once:
+//
+//  1. no reader in flight, the readers hold removeLock across looking
+//     up the meta and reading the blob.
+//  2. not referenced by the last snapshot taken, the followers may be
+//     fetching it to install the snapshot.
+//
+// A block file is skipped if it may hold the blobs not committed yet,
+// they would be committed with the pointers into it. The blob ids are
+// increasing and the ones below committed are refused as stale, so it's
+// safe once all the blob ids in it are below committed.
+//
+// The chunks of no manifest are collected by the leader before every
+// round, see collectChunks.
+
+func (s *Store) compactor() {
+	s.logger.Infof("store compactor run every %s", s.opts.CompactInterval)
+
+	ticker := time.NewTicker(s.opts.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n, err := s.collectChunks(); err != nil {
+				s.logger.Errorf("store collect chunks failed. %v", err)
+			} else if n > 0 {
+				s.logger.Infof("store collected %d chunks", n)
+			}
+			if err := s.Compact(); err != nil {
+				s.logger.Errorf("store compact failed. %v", err)
+			}
+		case <-s.stopCh:
+			s.logger.Info("store compactor stopped.")
+			return
+		}
+	}
+}
+
+// Compact runs a round of compaction.
+func (s *Store) Compact() error {
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+
+	// the blobs below committed are all in metas now or never be
+	s.committedLock.Lock()
+	committed := s.committed
+	s.committedLock.Unlock()
+	metas, err := s.ms.Snapshot()
+	if err != nil {
+		return err
+	}
+	lives := make(map[uint32][]liveBlob)
+	for blobId, meta := range metas {
+		var bm BlobMeta
+		if err := json.Unmarshal(meta, &bm); err != nil {
+			return errors.Wrapf(err, "Unable to unmarshal meta of blob %d", blobId)
+		}
+		if s.isQuarantined(blobId) {
+			// nothing to move, written anew once repaired
+			continue
+		}
+		lives[bm.Ptr.FileId] = append(lives[bm.Ptr.FileId], liveBlob{bm: bm, meta: meta})
+	}
+
+	s.blobWriteLock.Lock()
+	files := s.bs.BlockFiles()
+	s.blobWriteLock.Unlock()
+	if len(files) > 0 {
+		// the one being written
+		files = files[:len(files)-1]
+	}
+	for _, file := range files {
+		if _, found := s.compactedFiles[file.Id]; found {
+			continue
+		}
+		if file.MaxBlobId >= committed {
+			s.logger.Debugf("store compact skip block file %d, blob %d not committed", file.Id, file.MaxBlobId)
+			continue
+		}
+		var live int64
+		for _, lb := range lives[file.Id] {
+			live += int64(lb.bm.Ptr.Length)
+		}
+		if file.Size == 0 || float64(file.Size-live) < s.opts.CompactRatio*float64(file.Size) {
+			continue
+		}
+		s.logger.Infof("store compact block file %d, %d of %d bytes live", file.Id, live, file.Size)
+		if err := s.compactBlockFile(file.Id, lives[file.Id]); err != nil {
+			if errors.Cause(err) == ErrBlobCorrupted {
+				// left to the scrubber repairing
+				s.logger.Errorf("store compact skip block file %d. %v", file.Id, err)
+				continue
+			}
+			return err
+		}
+		s.compactedFiles[file.Id] = struct{}{}
+	}
+
+	return s.removeCompactedFiles()
+}
+
+// liveBlob is a blob meta with the bytes it's stored as.
+type liveBlob struct {
+	bm   BlobMeta
+	meta []byte
+}
+
+// compactBlockFile moves the live blobs out of the block file, the ones
+// deleted meanwhile are left dead in the new block files.
+func (s *Store) compactBlockFile(fid uint32, lives []liveBlob) error {
+	sort.Slice(lives, func(i, j int) bool { return lives[i].bm.Ptr.Offset < lives[j].bm.Ptr.Offset })
+
+	s.blobWriteLock.Lock()
+	defer s.blobWriteLock.Unlock()
+	reqs := make([]*Request, 0, len(lives))
+	for _, lb := range lives {
+		bm := lb.bm
+		blob, err := s.bs.Read(bm.Ptr)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to read blob %d of block file %d", bm.BlobId, fid)
+		}
+		reqs = append(reqs, &Request{BlobId: bm.BlobId, Blob: blob, Meta: bm.Meta, Crc: bm.Crc})
+	}
+	if err := s.bs.Write(reqs); err != nil {
+		return errors.Wrapf(err, "Unable to write blobs of block file %d", fid)
+	}
+	// the metas point to them only after they are on disk
+	if err := s.bs.SyncBlockFiles(); err != nil {
+		return err
+	}
+
+	var moved int
+	for i, req := range reqs {
+		bm := lives[i].bm
+		bm.Ptr = req.Ptr
+		blobMeta, _ := json.Marshal(&bm)
+		swapped, err := s.ms.CompareAndSwap(bm.BlobId, lives[i].meta, blobMeta)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to swap meta of blob %d", bm.BlobId)
+		}
+		if swapped {
+			moved++
+		}
+	}
+	s.logger.Infof("store compact block file %d done, %d of %d blobs moved", fid, moved, len(reqs))
+	return nil
+}
+
+// removeCompactedFiles removes the block files compacted, except the
+// ones referenced by the last snapshot.
+func (s *Store) removeCompactedFiles() error {
+	s.snapFilesLock.Lock()
+	defer s.snapFilesLock.Unlock()
+	var fids []uint32
+	for fid := range s.compactedFiles {
+		if _, found := s.snapFiles[fid]; !found {
+			fids = append(fids, fid)
+		}
+	}
+	if len(fids) == 0 {
+		return nil
+	}
+
+	s.removeLock.Lock()
+	err := s.bs.RemoveBlockFiles(fids)
+	s.removeLock.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, fid := range fids {
+		delete(s.compactedFiles, fid)
+	}
+	return nil
+}
+
+// setSnapFiles records the block files referenced by the snapshot.
+// The caller holds snapFilesLock.
+func (s *Store) setSnapFiles(fids []uint32) {
+	s.snapFiles = make(map[uint32]struct{}, len(fids))
+	for _, fid := range fids {
+		s.snapFiles[fid] = struct{}{}
+	}
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func blockFileSizes(s *Store) map[uint32]int64 {
+	sizes := make(map[uint32]int64)
+	for _, file := range s.bs.BlockFiles() {
+		sizes[file.Id] = file.Size
+	}
+	return sizes
+}
+
+func TestStoreCompact(t *testing.T) {
+	root := "./test_compact"
+	os.MkdirAll(root+"/"+blobStoreDir, 0755)
+	defer os.RemoveAll(root)
+	logger := testLogger()
+	opts := DefaultOpts
+	opts.BlockFileSize = 128
+	opts.CompactInterval = 0
+
+	s := NewStore(logger, root, opts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	reqs := putBlobs(t, logger, s, 40)
+	var lives []*Request
+	for i, req := range reqs {
+		if i%4 == 0 {
+			lives = append(lives, req)
+			continue
+		}
+		dr, err := s.Delete(logger, req.BlobId)
+		if !assert.Nil(t, err) || !assert.Nil(t, <-dr.ErrCh) {
+			return
+		}
+	}
+	check := func() {
+		for _, req := range lives {
+			blob, err := s.Get(logger, req.BlobId)
+			if assert.Nil(t, err, "blob %d", req.BlobId) {
+				assert.Equal(t, req.Blob, blob)
+			}
+		}
+	}
+
+	// the block files referenced by the snapshot are kept
+	if _, err := s.snapshot(0, 0, nil); !assert.Nil(t, err) {
+		return
+	}
+	before := blockFileSizes(s)
+	assert.Nil(t, s.Compact())
+	check()
+	after := blockFileSizes(s)
+	for fid := range before {
+		_, found := after[fid]
+		assert.True(t, found, "block file %d", fid)
+	}
+	compacted := make([]uint32, 0, len(s.compactedFiles))
+	for fid := range s.compactedFiles {
+		compacted = append(compacted, fid)
+	}
+	assert.True(t, len(compacted) > 0)
+
+	// removed once the snapshot taken again
+	if _, err := s.snapshot(0, 0, nil); !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, s.Compact())
+	check()
+	assert.Len(t, s.compactedFiles, 0)
+	after = blockFileSizes(s)
+	for _, fid := range compacted {
+		_, found := after[fid]
+		assert.False(t, found, "block file %d", fid)
+	}
+	var total, totalBefore int64
+	for _, size := range after {
+		total += size
+	}
+	for _, size := range before {
+		totalBefore += size
+	}
+	assert.True(t, total < totalBefore, "%d >= %d", total, totalBefore)
+	s.Close()
+
+	s = NewStore(logger, root, opts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	defer s.Close()
+	check()
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"hash/crc32"
+
+	"github.com/EricYT/go-examples/pkg/codec"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -14,35 +17,64 @@ var (
 //  |--           header           --|--    meta   --|--   data    --|--  crc --|
 //  |--64bits--|--32bits--|--32bits--|--dynamice-len-|--dynamic-len--|--32bits--|
 //  |--blobId--|--blobLen-|--metaLen-|-- user-meta  -|--   data    --|--  crc --|
+//
+//  The highest bit of metaLen tells the data is encoded by the codec,
+//  blobLen is the length of the data on disk then.
 
 const (
 	headerSize int = 16
+
+	metaLenCodec uint32 = 1 << 31
 )
 
 type header struct {
 	blobId      uint64
 	blobLen     uint32
 	userMetaLen uint32
+	encoded     bool
 }
 
 func (h header) Encode(p []byte) {
+	metaLen := h.userMetaLen
+	if h.encoded {
+		metaLen |= metaLenCodec
+	}
 	binary.BigEndian.PutUint64(p[0:8], h.blobId)
 	binary.BigEndian.PutUint32(p[8:12], h.blobLen)
-	binary.BigEndian.PutUint32(p[12:16], h.userMetaLen)
+	binary.BigEndian.PutUint32(p[12:16], metaLen)
 }
 
 func (h *header) Decode(p []byte) {
 	h.blobId = binary.BigEndian.Uint64(p[0:8])
 	h.blobLen = binary.BigEndian.Uint32(p[8:12])
-	h.userMetaLen = binary.BigEndian.Uint32(p[12:16])
+	metaLen := binary.BigEndian.Uint32(p[12:16])
+	h.userMetaLen = metaLen &^ metaLenCodec
+	h.encoded = metaLen&metaLenCodec > 0
 }
 
-func encodeRequest(r *Request, buf *bytes.Buffer) int {
+// blobAD binds the encrypted blob to its id.
+func blobAD(blobId uint64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, blobId)
+	return ad
+}
+
+// encodeRequest encodes the blob by c if enabled, the crc covers the
+// bytes on disk.
+func encodeRequest(r *Request, buf *bytes.Buffer, c *codec.Codec) (int, error) {
 	h := header{
 		blobId:      uint64(r.BlobId),
-		blobLen:     uint32(len(r.Blob)),
 		userMetaLen: uint32(len(r.Meta)),
 	}
+	blob := r.Blob
+	if c.Enabled() && len(blob) > 0 {
+		var err error
+		if blob, err = c.Encode(blob, blobAD(h.blobId)); err != nil {
+			return 0, err
+		}
+		h.encoded = true
+	}
+	h.blobLen = uint32(len(blob))
 
 	hash := crc32.New(CastagnoliCrcTable)
 
@@ -57,13 +89,64 @@ func encodeRequest(r *Request, buf *bytes.Buffer) int {
 	hash.Write(r.Meta)
 
 	// data
-	buf.Write(r.Blob)
-	hash.Write(r.Blob)
+	buf.Write(blob)
+	hash.Write(blob)
 
 	// crc32
 	var crcbuf [crc32.Size]byte
 	binary.BigEndian.PutUint32(crcbuf[:], hash.Sum32())
 	buf.Write(crcbuf[:])
 
-	return len(hbuf) + len(r.Blob) + len(r.Meta) + len(crcbuf)
+	return len(hbuf) + len(blob) + len(r.Meta) + len(crcbuf), nil
+}
+
+// verifyRecord checks the record read is whole and matches its crc.
+func verifyRecord(record []byte) error {
+	if len(record) < headerSize+crc32.Size {
+		return errors.Wrapf(ErrBlobCorrupted, "record of %d bytes truncated", len(record))
+	}
+	var h header
+	h.Decode(record)
+	n := headerSize + int(h.userMetaLen) + int(h.blobLen) + crc32.Size
+	if n != len(record) {
+		return errors.Wrapf(ErrBlobCorrupted, "record of %d bytes, %d in header", len(record), n)
+	}
+	body := record[:n-crc32.Size]
+	if crc32.Checksum(body, CastagnoliCrcTable) != binary.BigEndian.Uint32(record[n-crc32.Size:]) {
+		return errors.Wrap(ErrBlobCorrupted, "crc mismatch")
+	}
+	return nil
+}
+
+// verifyBlob checks the original blob against the crc supplied to Put,
+// the Castagnoli crc32 in big endian. Nothing checked if no crc supplied.
+func verifyBlob(blob, crc []byte) error {
+	if len(crc) == 0 {
+		return nil
+	}
+	if len(crc) != crc32.Size {
+		return errors.Wrapf(ErrBlobCorrupted, "crc of %d bytes", len(crc))
+	}
+	if crc32.Checksum(blob, CastagnoliCrcTable) != binary.BigEndian.Uint32(crc) {
+		return errors.Wrap(ErrBlobCorrupted, "blob crc mismatch")
+	}
+	return nil
+}
+
+// blobCrc returns the crc of the blob as verifyBlob expects.
+func blobCrc(blob []byte) []byte {
+	crc := make([]byte, crc32.Size)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(blob, CastagnoliCrcTable))
+	return crc
+}
+
+// decodeBlob returns the original blob of the record read.
+func decodeBlob(record []byte, c *codec.Codec) ([]byte, error) {
+	var h header
+	h.Decode(record)
+	blob := record[headerSize+int(h.userMetaLen) : headerSize+int(h.userMetaLen)+int(h.blobLen)]
+	if !h.encoded {
+		return blob, nil
+	}
+	return c.Decode(blob, blobAD(h.blobId))
 }
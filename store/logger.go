@@ -0,0 +1,34 @@
+package store
+
+import (
+	"go.uber.org/zap"
+)
+
+// Logger is the logger store logs by, a zap one adapted by NewZapLogger.
+type Logger interface {
+	Debugf(template string, args ...interface{})
+	Info(args ...interface{})
+	Infof(template string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(template string, args ...interface{})
+
+	Named(name string) Logger
+	// With adds the key value pairs to the logs.
+	With(keysAndValues ...interface{}) Logger
+}
+
+type zapLogger struct {
+	*zap.SugaredLogger
+}
+
+func NewZapLogger(l *zap.Logger) Logger {
+	return zapLogger{l.Sugar()}
+}
+
+func (l zapLogger) Named(name string) Logger {
+	return zapLogger{l.SugaredLogger.Named(name)}
+}
+
+func (l zapLogger) With(keysAndValues ...interface{}) Logger {
+	return zapLogger{l.SugaredLogger.With(keysAndValues...)}
+}
@@ -1,9 +1,9 @@
 package store
 
 import (
+	"bytes"
 	"sync"
 
-	"git.jd.com/cloud-storage/newds-datanode/pkg/logutil"
 	"github.com/pkg/errors"
 )
 
@@ -18,17 +18,28 @@ type MetaStore interface {
 	Put(key int64, value []byte) (err error)
 	Get(key int64) (val []byte, err error)
 	Delete(key int64) (err error)
+	// CompareAndSwap puts the value only if the current one equals old,
+	// for the compactor moving the blobs.
+	CompareAndSwap(key int64, old, value []byte) (swapped bool, err error)
 
-	// FIXME: snapshot
+	// Committed returns the largest blob id ever put, the deleted ones
+	// included, so the blob ids are never reused.
+	Committed() (int64, error)
+
+	// Snapshot returns a copy of all the metas.
+	Snapshot() (map[int64][]byte, error)
+	// Restore replaces all the metas and the committed.
+	Restore(metas map[int64][]byte, committed int64) error
 }
 
 // memory meta store
 type MemoryMetaStore struct {
-	metaLock sync.RWMutex
-	meta     map[int64][]byte
+	metaLock  sync.RWMutex
+	meta      map[int64][]byte
+	committed int64
 }
 
-func NewMemoryMetaStore(logger logutil.Logger) *MemoryMetaStore {
+func NewMemoryMetaStore(logger Logger) *MemoryMetaStore {
 	ms := &MemoryMetaStore{
 		meta: make(map[int64][]byte),
 	}
@@ -45,6 +56,9 @@ func (m *MemoryMetaStore) Put(key int64, meta []byte) error {
 	m.metaLock.Lock()
 	defer m.metaLock.Unlock()
 	m.meta[key] = meta
+	if key > m.committed {
+		m.committed = key
+	}
 	return nil
 }
 
@@ -64,3 +78,41 @@ func (m *MemoryMetaStore) Delete(key int64) (err error) {
 	delete(m.meta, key)
 	return nil
 }
+
+func (m *MemoryMetaStore) CompareAndSwap(key int64, old, value []byte) (bool, error) {
+	m.metaLock.Lock()
+	defer m.metaLock.Unlock()
+	if cur, found := m.meta[key]; !found || !bytes.Equal(cur, old) {
+		return false, nil
+	}
+	m.meta[key] = value
+	return true, nil
+}
+
+func (m *MemoryMetaStore) Committed() (int64, error) {
+	m.metaLock.RLock()
+	defer m.metaLock.RUnlock()
+	return m.committed, nil
+}
+
+func (m *MemoryMetaStore) Snapshot() (map[int64][]byte, error) {
+	m.metaLock.RLock()
+	defer m.metaLock.RUnlock()
+	metas := make(map[int64][]byte, len(m.meta))
+	for k, v := range m.meta {
+		metas[k] = v
+	}
+	return metas, nil
+}
+
+func (m *MemoryMetaStore) Restore(metas map[int64][]byte, committed int64) error {
+	meta := make(map[int64][]byte, len(metas))
+	for k, v := range metas {
+		meta[k] = v
+	}
+	m.metaLock.Lock()
+	defer m.metaLock.Unlock()
+	m.meta = meta
+	m.committed = committed
+	return nil
+}
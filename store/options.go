@@ -0,0 +1,69 @@
+package store
+
+import (
+	"time"
+
+	"github.com/EricYT/go-examples/pkg/codec"
+)
+
+// MetaStoreType selects where the blob metas kept.
+type MetaStoreType int
+
+const (
+	MetaStoreBolt   MetaStoreType = iota
+	MetaStoreMemory               // lost on restarting, for tests
+)
+
+type Opts struct {
+	MetaStore MetaStoreType
+
+	// the blobs written are compressed, and encrypted by the current key
+	// of Encryption if set. The blobs written before are readable as long
+	// as the keys sealed them registered.
+	Compression codec.Compression
+	Encryption  *codec.KeyRegistry
+
+	// the replica group, a group of the only replica 1 if no peers
+	ReplicaId    uint64
+	Peers        []uint64
+	Transport    Transport
+	TickInterval time.Duration // of raft, the election timeout is 10 ticks
+
+	// a snapshot taken every SnapshotEntries entries applied, the last
+	// SnapshotCatchUpEntries entries are kept in the log for the followers
+	SnapshotEntries        uint64
+	SnapshotCatchUpEntries uint64
+
+	// a new block file is written once the current one reaches
+	// BlockFileSize. Every CompactInterval, the block files with dead
+	// bytes at least CompactRatio of them are compacted, never if zero.
+	BlockFileSize   int64
+	CompactRatio    float64
+	CompactInterval time.Duration
+
+	// every ScrubInterval, all the blobs are verified at most ScrubRate
+	// bytes per second, the corrupted ones fetched from the peers if the
+	// Transport is a BlobFetcher. Never if zero, unlimited rate if zero.
+	ScrubInterval time.Duration
+	ScrubRate     int64
+	// the streams put are split into the chunks of ChunkSize
+	ChunkSize int64
+}
+
+var DefaultOpts = Opts{
+	MetaStore:    MetaStoreBolt,
+	Compression:  codec.NoCompression,
+	TickInterval: 100 * time.Millisecond,
+
+	SnapshotEntries:        10000,
+	SnapshotCatchUpEntries: 5000,
+
+	BlockFileSize:   64 << 20,
+	CompactRatio:    0.5,
+	CompactInterval: 10 * time.Minute,
+
+	ScrubInterval: 24 * time.Hour,
+	ScrubRate:     32 << 20,
+
+	ChunkSize: 4 << 20,
+}
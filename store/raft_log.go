@@ -0,0 +1,272 @@
+package store
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/EricYT/go-examples/wal"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/raft"
+	"go.etcd.io/etcd/raft/raftpb"
+)
+
+var (
+	ErrRaftLogCorrupted error = errors.New("raft log corrupted")
+)
+
+//  the records of raft log, the type of one byte first
+//
+//  ready:    | hardStateLen(4) | hard state | entryLen(4) | entry | ...
+//  snapshot: | index(8) | term(8) |
+//
+//  A ready record is appended every Ready of raft, the hard state is empty
+//  if unchanged. A snapshot record is appended once the snapshot of the
+//  leader installed, the entries before are replaced by it.
+
+const (
+	raftLogReady byte = iota + 1
+	raftLogSnapshot
+)
+
+// raftLog persists the hard state and the entries of raft in a wal, they
+// are restored into the memory storage when restarting. The entries
+// appended replace the ones from the first of them on, as raft does.
+//
+// The records needed by restoring from the last snapshot are the ones from
+// the last writing the entry after it, and the hard state current. The
+// segments of the wal before both are removed.
+type raftLog struct {
+	w *wal.WAL
+
+	// the seq of the record of the hard state current
+	hardStateSeq uint64
+	// the records of the entries, in the order appended
+	records []entriesRecord
+}
+
+type entriesRecord struct {
+	seq         uint64
+	first, last uint64
+}
+
+func openRaftLog(dir string) (*raftLog, error) {
+	w, err := wal.Open(dir, wal.DefaultOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open raft log")
+	}
+	return &raftLog{w: w}, nil
+}
+
+func (l *raftLog) close() error {
+	return l.w.Close()
+}
+
+// restore replays the log into the storage, which is restored from the
+// snapshot at snapIndex already, zero if none. The entries not after the
+// snapshot are skipped. False returned if nothing logged.
+func (l *raftLog) restore(storage *raft.MemoryStorage, snapIndex, snapTerm uint64) (bool, error) {
+	var (
+		hs     raftpb.HardState
+		ents   []raftpb.Entry
+		logged bool
+	)
+	it := l.w.ReadFrom(l.w.FirstSeq())
+	for it.Next() {
+		logged = true
+		rec := it.Value()
+		if len(rec) == 0 {
+			return false, errors.Wrapf(ErrRaftLogCorrupted, "record %d empty", it.Seq())
+		}
+		switch rec[0] {
+		case raftLogReady:
+			rhs, appended, err := decodeReady(rec[1:])
+			if err != nil {
+				return false, errors.Wrapf(err, "record %d", it.Seq())
+			}
+			if !raft.IsEmptyHardState(rhs) {
+				hs = rhs
+				l.hardStateSeq = it.Seq()
+			}
+			if len(appended) == 0 {
+				continue
+			}
+			l.records = append(l.records, entriesRecord{seq: it.Seq(), first: appended[0].Index, last: appended[len(appended)-1].Index})
+			ents = replayEntries(ents, appended, snapIndex)
+		case raftLogSnapshot:
+			if len(rec) != 17 {
+				return false, errors.Wrapf(ErrRaftLogCorrupted, "snapshot record %d of %d bytes", it.Seq(), len(rec))
+			}
+			if index := binary.BigEndian.Uint64(rec[1:9]); index > snapIndex {
+				return false, errors.Wrapf(ErrRaftLogCorrupted, "snapshot %d installed, restored from %d", index, snapIndex)
+			}
+			ents = nil
+		default:
+			return false, errors.Wrapf(ErrRaftLogCorrupted, "record %d of type %d", it.Seq(), rec[0])
+		}
+	}
+	if err := it.Err(); err != nil {
+		return false, errors.Wrap(err, "Unable to read raft log")
+	}
+	if !logged {
+		return false, nil
+	}
+
+	// the hard state logged may be older than the snapshot installed
+	if hs.Commit < snapIndex {
+		hs.Commit = snapIndex
+	}
+	if hs.Term < snapTerm {
+		hs.Term, hs.Vote = snapTerm, 0
+	}
+	if err := storage.SetHardState(hs); err != nil {
+		return false, err
+	}
+	if err := storage.Append(ents); err != nil {
+		return false, errors.Wrap(err, "Unable to append entries restored")
+	}
+	return true, nil
+}
+
+// replayEntries appends the entries after snapIndex replacing the ones
+// from the first of them on. The ones not following are of a log replaced
+// later, left by the segments removed partly, and skipped.
+func replayEntries(ents, appended []raftpb.Entry, snapIndex uint64) []raftpb.Entry {
+	for len(appended) > 0 && appended[0].Index <= snapIndex {
+		appended = appended[1:]
+	}
+	if len(appended) == 0 {
+		return ents
+	}
+	next := snapIndex + 1
+	if len(ents) > 0 {
+		next = ents[len(ents)-1].Index + 1
+	}
+	first := appended[0].Index
+	if first > next {
+		return ents
+	}
+	return append(ents[:first-snapIndex-1], appended...)
+}
+
+// save appends the hard state if not empty and the entries, it returns
+// once synced.
+func (l *raftLog) save(hs raftpb.HardState, ents []raftpb.Entry) error {
+	if raft.IsEmptyHardState(hs) && len(ents) == 0 {
+		return nil
+	}
+	rec, err := encodeReady(hs, ents)
+	if err != nil {
+		return err
+	}
+	seq, err := l.w.Append(rec)
+	if err != nil {
+		return errors.Wrap(err, "Unable to append raft log")
+	}
+	if !raft.IsEmptyHardState(hs) {
+		l.hardStateSeq = seq
+	}
+	if len(ents) > 0 {
+		l.records = append(l.records, entriesRecord{seq: seq, first: ents[0].Index, last: ents[len(ents)-1].Index})
+	}
+	return nil
+}
+
+// saveSnapshot logs the snapshot installed, after it saved into the snap
+// store.
+func (l *raftLog) saveSnapshot(index, term uint64) error {
+	rec := make([]byte, 17)
+	rec[0] = raftLogSnapshot
+	binary.BigEndian.PutUint64(rec[1:9], index)
+	binary.BigEndian.PutUint64(rec[9:], term)
+	if _, err := l.w.Append(rec); err != nil {
+		return errors.Wrap(err, "Unable to append raft log")
+	}
+	return nil
+}
+
+// compact removes the records not needed by restoring from the snapshot
+// at index, in segments.
+func (l *raftLog) compact(index uint64) error {
+	seq := l.w.LastSeq() + 1
+	for i := len(l.records) - 1; i >= 0; i-- {
+		if r := l.records[i]; r.first <= index+1 && index+1 <= r.last {
+			seq = r.seq
+			break
+		}
+	}
+	if l.hardStateSeq < seq {
+		seq = l.hardStateSeq
+	}
+	if err := l.w.TruncateBefore(seq); err != nil {
+		return errors.Wrapf(err, "Unable to truncate raft log before %d", seq)
+	}
+	i := sort.Search(len(l.records), func(i int) bool { return l.records[i].seq >= seq })
+	l.records = append(l.records[:0], l.records[i:]...)
+	return nil
+}
+
+func encodeReady(hs raftpb.HardState, ents []raftpb.Entry) ([]byte, error) {
+	size := 1 + 4
+	if !raft.IsEmptyHardState(hs) {
+		size += hs.Size()
+	}
+	for i := range ents {
+		size += 4 + ents[i].Size()
+	}
+	rec := make([]byte, size)
+	rec[0] = raftLogReady
+	off := 1
+	if raft.IsEmptyHardState(hs) {
+		off += 4
+	} else {
+		binary.BigEndian.PutUint32(rec[off:], uint32(hs.Size()))
+		n, err := hs.MarshalTo(rec[off+4:])
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to marshal hard state")
+		}
+		off += 4 + n
+	}
+	for i := range ents {
+		binary.BigEndian.PutUint32(rec[off:], uint32(ents[i].Size()))
+		n, err := ents[i].MarshalTo(rec[off+4:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to marshal entry %d", ents[i].Index)
+		}
+		off += 4 + n
+	}
+	return rec, nil
+}
+
+func decodeReady(body []byte) (hs raftpb.HardState, ents []raftpb.Entry, err error) {
+	next := func() ([]byte, error) {
+		if len(body) < 4 {
+			return nil, errors.Wrapf(ErrRaftLogCorrupted, "%d bytes left", len(body))
+		}
+		n := binary.BigEndian.Uint32(body)
+		if uint64(len(body)-4) < uint64(n) {
+			return nil, errors.Wrapf(ErrRaftLogCorrupted, "%d bytes left, %d expected", len(body)-4, n)
+		}
+		b := body[4 : 4+n]
+		body = body[4+n:]
+		return b, nil
+	}
+	b, err := next()
+	if err != nil {
+		return hs, nil, err
+	}
+	if err := hs.Unmarshal(b); err != nil {
+		return hs, nil, errors.Wrap(ErrRaftLogCorrupted, err.Error())
+	}
+	for len(body) > 0 {
+		b, err := next()
+		if err != nil {
+			return hs, nil, err
+		}
+		var ent raftpb.Entry
+		if err := ent.Unmarshal(b); err != nil {
+			return hs, nil, errors.Wrap(ErrRaftLogCorrupted, err.Error())
+		}
+		ents = append(ents, ent)
+	}
+	return hs, ents, nil
+}
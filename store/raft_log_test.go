@@ -0,0 +1,106 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/raft"
+	"go.etcd.io/etcd/raft/raftpb"
+)
+
+func raftEntries(from, to, term uint64) []raftpb.Entry {
+	var ents []raftpb.Entry
+	for i := from; i <= to; i++ {
+		ents = append(ents, raftpb.Entry{Index: i, Term: term, Data: []byte{byte(i)}})
+	}
+	return ents
+}
+
+func restoreRaftLog(t *testing.T, dir string, snapIndex, snapTerm uint64) (*raft.MemoryStorage, error) {
+	l, err := openRaftLog(dir)
+	if !assert.Nil(t, err) {
+		return nil, err
+	}
+	defer l.close()
+	storage := raft.NewMemoryStorage()
+	if snapIndex > 0 {
+		storage.ApplySnapshot(raftpb.Snapshot{Metadata: raftpb.SnapshotMetadata{Index: snapIndex, Term: snapTerm}})
+	}
+	logged, err := l.restore(storage, snapIndex, snapTerm)
+	if err != nil {
+		return nil, err
+	}
+	assert.True(t, logged)
+	return storage, nil
+}
+
+func storageEntries(t *testing.T, storage *raft.MemoryStorage) []raftpb.Entry {
+	first, _ := storage.FirstIndex()
+	last, _ := storage.LastIndex()
+	ents, err := storage.Entries(first, last+1, 1<<30)
+	assert.Nil(t, err)
+	return ents
+}
+
+func TestRaftLogRestore(t *testing.T) {
+	dir := "./test_raft_log"
+	defer os.RemoveAll(dir)
+
+	l, err := openRaftLog(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	logged, err := l.restore(raft.NewMemoryStorage(), 0, 0)
+	assert.Nil(t, err)
+	assert.False(t, logged)
+	assert.Nil(t, l.save(raftpb.HardState{Term: 1, Vote: 1}, raftEntries(1, 5, 1)))
+	// the entries from 4 on replaced by the new leader
+	hs := raftpb.HardState{Term: 2, Vote: 2, Commit: 5}
+	assert.Nil(t, l.save(hs, raftEntries(4, 6, 2)))
+	assert.Nil(t, l.save(raftpb.HardState{}, raftEntries(7, 8, 2)))
+	assert.Nil(t, l.close())
+
+	storage, err := restoreRaftLog(t, dir, 0, 0)
+	if !assert.Nil(t, err) {
+		return
+	}
+	got, _, _ := storage.InitialState()
+	assert.Equal(t, hs, got)
+	expected := append(raftEntries(1, 3, 1), raftEntries(4, 8, 2)...)
+	assert.Equal(t, expected, storageEntries(t, storage))
+
+	// the entries of the snapshot skipped, the hard state not behind it
+	storage, err = restoreRaftLog(t, dir, 6, 2)
+	if !assert.Nil(t, err) {
+		return
+	}
+	got, _, _ = storage.InitialState()
+	assert.Equal(t, uint64(6), got.Commit)
+	assert.Equal(t, raftEntries(7, 8, 2), storageEntries(t, storage))
+}
+
+func TestRaftLogSnapshotInstalled(t *testing.T) {
+	dir := "./test_raft_log_snap"
+	defer os.RemoveAll(dir)
+
+	l, err := openRaftLog(dir)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, l.save(raftpb.HardState{Term: 1, Commit: 3}, raftEntries(1, 12, 1)))
+	// the entries before replaced by the snapshot of the leader
+	assert.Nil(t, l.saveSnapshot(10, 3))
+	assert.Nil(t, l.save(raftpb.HardState{Term: 3, Commit: 10}, raftEntries(11, 12, 3)))
+	assert.Nil(t, l.compact(10))
+	assert.Nil(t, l.close())
+
+	storage, err := restoreRaftLog(t, dir, 10, 3)
+	if assert.Nil(t, err) {
+		assert.Equal(t, raftEntries(11, 12, 3), storageEntries(t, storage))
+	}
+	// the snap store behind the snapshot installed
+	_, err = restoreRaftLog(t, dir, 5, 1)
+	assert.Equal(t, ErrRaftLogCorrupted, errors.Cause(err))
+}
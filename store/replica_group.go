@@ -2,40 +2,700 @@ package store
 
 import (
 	"context"
+	"encoding/binary"
+	"io"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"git.jd.com/cloud-storage/newds-datanode/pkg/logutil"
-	dsproto "git.jd.com/cloud-storage/newds-datanode/proto"
+	"github.com/EricYT/go-examples/store/storepb"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/raft"
+	"go.etcd.io/etcd/raft/raftpb"
+)
+
+var (
+	ErrNotLeader             error = errors.New("replica is not leader")
+	ErrReplicaGroupStopped   error = errors.New("replica group stopped")
+	ErrReplicaEntryCorrupted error = errors.New("replica entry corrupted")
+	ErrReplicaGroupFailed    error = errors.New("replica group failed")
 )
 
 type ReplicaGroup interface {
-	Propose(ctx context.Context, msg *dsproto.ReplicaMessage) error
+	// Start runs the group from the snapshot restored, nil if none.
+	Start(snap *Snapshot) error
+	Stop()
+
+	// Propose replicates the message, it's committed by Store.Commit on
+	// every replica once agreed.
+	Propose(ctx context.Context, msg *storepb.ReplicaMessage) error
+	// Process steps the raft message received from the transport.
+	Process(ctx context.Context, m raftpb.Message) error
+	// Leader returns the id of the leader known, zero if none.
+	Leader() uint64
 }
 
-func NewReplicaGroup(logger logutil.Logger, s *Store) ReplicaGroup {
-	rg := &fakeReplicaGroup{s: s}
-	go rg.run()
-	// Leader ok
-	s.ReplicaGroupReady()
+// Transport delivers the raft messages between the replicas, the messages
+// may be lost or reordered.
+type Transport interface {
+	Send(msgs []raftpb.Message)
+}
+
+// SnapshotSender delivers the snapshot message to another replica, the
+// error returned if not delivered. The transport implements it to report
+// the snapshots failed to raft, by which they're sent again soon.
+type SnapshotSender interface {
+	SendSnapshot(ctx context.Context, m raftpb.Message) error
+}
+
+// BlockFetcher fetches the block file from another replica, see
+// Store.OpenBlockFile, by which the snapshots are installed. The transport
+// implements it if the replicas may fall behind the compacted log.
+type BlockFetcher interface {
+	FetchBlockFile(ctx context.Context, from uint64, fid uint32) (io.ReadCloser, error)
+}
+
+// BlobFetcher fetches a blob as stored from another replica, see
+// Store.ReadBlob, by which the scrubber repairs the blobs corrupted.
+type BlobFetcher interface {
+	FetchBlob(ctx context.Context, from uint64, blobId int64) ([]byte, error)
+}
+
+// ChunkFetcher fetches the chunk written by another replica at the
+// pointer, see Store.ReadChunk. The transport implements it if the
+// streams are put, the chunks travel outside the raft entries.
+type ChunkFetcher interface {
+	FetchChunk(ctx context.Context, from uint64, ptr BlobPointer) ([]byte, error)
+}
+
+// the chunk fetched from the replicas in rounds, tickInterval*10 apart
+const maxChunkFetchRounds int = 10
+
+// the snapshot given up after installing failed so many times, see
+// installSnapshot.
+const maxSnapshotInstallRetries int = 10
+
+// raftReplicaGroup replicates the messages by raft. The blobs travel with
+// the put messages, the replica proposing one wrote it already, the others
+// write it into their blob stores when committing. The chunks of streams
+// are fetched from the replicas instead.
+//
+// The entry data is | proposer(8) | replica message |. The hard state and
+// the entries are persisted by the raft log before the messages sent.
+//
+// A snapshot of store is taken every SnapshotEntries entries applied, the
+// log before is compacted except the last SnapshotCatchUpEntries ones for
+// the slow followers. The followers behind the log install the snapshot.
+type raftReplicaGroup struct {
+	logger Logger
+	s      *Store
+
+	id           uint64
+	peers        []uint64
+	transport    Transport
+	tickInterval time.Duration
+
+	snapshotEntries uint64
+	catchUpEntries  uint64
+
+	// replaced by run only, see restartNode
+	nodeLock sync.RWMutex
+	node     raft.Node
+	storage  *raft.MemoryStorage
+	logDir   string
+	log      *raftLog // accessed by run only after started
+
+	// accessed by run only
+	applied   uint64
+	snapIndex uint64
+	confState raftpb.ConfState
+
+	leader uint64 // access atomic
+	term   uint64 // the term of hard state, accessed by run only
+	ready  bool   // accessed by run only
+
+	// the requests proposed by us and not committed yet, they are
+	// failed once we lost the leadership.
+	pendingLock sync.Mutex
+	pending     map[int64]struct{}
+
+	startedCh chan struct{}
+	stopCh    chan struct{}
+	doneCh    chan struct{}
+}
+
+func NewReplicaGroup(logger Logger, s *Store, opts Opts) ReplicaGroup {
+	rg := &raftReplicaGroup{
+		logger:       logger,
+		s:            s,
+		id:           opts.ReplicaId,
+		peers:        opts.Peers,
+		transport:    opts.Transport,
+		tickInterval: opts.TickInterval,
+
+		snapshotEntries: opts.SnapshotEntries,
+		catchUpEntries:  opts.SnapshotCatchUpEntries,
+
+		storage:   raft.NewMemoryStorage(),
+		logDir:    path.Join(s.root, raftLogDir),
+		pending:   make(map[int64]struct{}),
+		startedCh: make(chan struct{}),
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+	if rg.id == 0 {
+		rg.id = 1
+	}
+	if len(rg.peers) == 0 {
+		rg.peers = []uint64{rg.id}
+	}
+	if rg.tickInterval <= 0 {
+		rg.tickInterval = DefaultOpts.TickInterval
+	}
+	if rg.snapshotEntries == 0 {
+		rg.snapshotEntries = DefaultOpts.SnapshotEntries
+	}
 	return rg
 }
 
-// fake one
-type fakeReplicaGroup struct {
-	s   *Store
-	msg chan *dsproto.ReplicaMessage
+// Start restarts the raft node from the snapshot and the raft log if any.
+// The entries after the snapshot are applied again.
+func (rg *raftReplicaGroup) Start(snap *Snapshot) error {
+	rg.logger.Infof("replica group %d start with peers %v", rg.id, rg.peers)
+
+	log, err := openRaftLog(rg.logDir)
+	if err != nil {
+		return err
+	}
+	restarted, err := rg.restore(log, snap)
+	if err != nil {
+		log.close()
+		return err
+	}
+	rg.log = log
+
+	c := rg.raftConfig()
+	if restarted {
+		rg.node = raft.RestartNode(c)
+	} else {
+		peers := make([]raft.Peer, 0, len(rg.peers))
+		for _, id := range rg.peers {
+			peers = append(peers, raft.Peer{ID: id})
+		}
+		rg.node = raft.StartNode(c, peers)
+	}
+	if len(rg.peers) == 1 {
+		// no one else to wait for
+		if err := rg.node.Campaign(context.TODO()); err != nil {
+			rg.node.Stop()
+			rg.log.close()
+			return errors.Wrap(err, "Unable to campaign single replica group")
+		}
+	}
+	close(rg.startedCh)
+	go rg.run()
+	return nil
+}
+
+func (rg *raftReplicaGroup) raftConfig() *raft.Config {
+	return &raft.Config{
+		ID:              rg.id,
+		ElectionTick:    10,
+		HeartbeatTick:   1,
+		Storage:         rg.storage,
+		MaxSizePerMsg:   1 << 20,
+		MaxInflightMsgs: 256,
+		CheckQuorum:     true, // the leader isolated steps down
+		PreVote:         true,
+		Applied:         rg.applied,
+	}
+}
+
+// restartNode drops the snapshot of the Ready not installed, the raft node
+// restarted from the storage, untouched by it. The leader sends its last
+// snapshot once the entries of it rejected by us.
+func (rg *raftReplicaGroup) restartNode() {
+	rg.node.Stop()
+	node := raft.RestartNode(rg.raftConfig())
+	rg.nodeLock.Lock()
+	rg.node = node
+	rg.nodeLock.Unlock()
+}
+
+// raftNode returns the raft node for the ones other than run.
+func (rg *raftReplicaGroup) raftNode() raft.Node {
+	rg.nodeLock.RLock()
+	defer rg.nodeLock.RUnlock()
+	return rg.node
+}
+
+// restore restores the storage from the snapshot and the raft log, false
+// returned if neither.
+func (rg *raftReplicaGroup) restore(log *raftLog, snap *Snapshot) (bool, error) {
+	var snapIndex, snapTerm uint64
+	if snap != nil {
+		data, err := encodeSnapshot(snap)
+		if err != nil {
+			return false, err
+		}
+		rs := raftpb.Snapshot{
+			Data: data,
+			Metadata: raftpb.SnapshotMetadata{
+				Index:     snap.Index,
+				Term:      snap.Term,
+				ConfState: raftpb.ConfState{Voters: snap.Voters},
+			},
+		}
+		if err := rg.storage.ApplySnapshot(rs); err != nil {
+			return false, errors.Wrapf(err, "Unable to apply snapshot %d", snap.Index)
+		}
+		rg.storage.SetHardState(raftpb.HardState{Term: snap.Term, Commit: snap.Index})
+		rg.applied, rg.snapIndex = snap.Index, snap.Index
+		rg.confState = rs.Metadata.ConfState
+		snapIndex, snapTerm = snap.Index, snap.Term
+	}
+	logged, err := log.restore(rg.storage, snapIndex, snapTerm)
+	if err != nil {
+		return false, err
+	}
+	hs, _, _ := rg.storage.InitialState()
+	rg.term = hs.Term
+	return snap != nil || logged, nil
 }
 
-func (f *fakeReplicaGroup) run() {
-	f.msg = make(chan *dsproto.ReplicaMessage, 10)
+func (rg *raftReplicaGroup) Stop() {
+	select {
+	case <-rg.stopCh:
+		return
+	default:
+	}
+	close(rg.stopCh)
+	select {
+	case <-rg.startedCh:
+	default:
+		return
+	}
+	<-rg.doneCh
+	rg.failPending(ErrReplicaGroupStopped)
+	rg.logger.Infof("replica group %d stopped.", rg.id)
+}
+
+func (rg *raftReplicaGroup) run() {
+	defer close(rg.doneCh)
+	defer func() {
+		rg.node.Stop()
+		if err := rg.log.close(); err != nil {
+			rg.logger.Errorf("replica group %d close raft log failed. %v", rg.id, err)
+		}
+	}()
+
+	ticker := time.NewTicker(rg.tickInterval)
+	defer ticker.Stop()
 	for {
 		select {
-		case msg := <-f.msg:
-			f.s.Commit(context.TODO(), msg)
+		case <-ticker.C:
+			rg.node.Tick()
+
+		case rd := <-rg.node.Ready():
+			if rd.SoftState != nil {
+				rg.leaderChanged(rd.SoftState.Lead)
+			}
+			if !raft.IsEmptySnap(rd.Snapshot) {
+				if err := rg.installSnapshot(rd.Snapshot); err == errSnapshotGivenUp {
+					rg.restartNode()
+					continue
+				} else if err != nil {
+					if err != ErrReplicaGroupStopped {
+						rg.fail(err)
+					}
+					return
+				}
+			}
+			// persisted before the messages sent, the votes and the
+			// acknowledgements of appending are never taken back.
+			if err := rg.log.save(rd.HardState, rd.Entries); err != nil {
+				rg.fail(err)
+				return
+			}
+			if !raft.IsEmptyHardState(rd.HardState) {
+				rg.term = rd.HardState.Term
+				rg.storage.SetHardState(rd.HardState)
+			}
+			if err := rg.storage.Append(rd.Entries); err != nil {
+				rg.logger.Errorf("replica group %d append entries failed. %v", rg.id, err)
+			}
+			rg.send(rd.Messages)
+			if err := rg.apply(rd.CommittedEntries); err != nil {
+				if errors.Cause(err) != ErrReplicaGroupStopped {
+					rg.fail(err)
+				}
+				return
+			}
+			rg.maybeSnapshot(false)
+			rg.node.Advance()
+
+		case <-rg.stopCh:
+			rg.maybeSnapshot(true)
+			return
+		}
+	}
+}
+
+func (rg *raftReplicaGroup) leaderChanged(lead uint64) {
+	old := atomic.SwapUint64(&rg.leader, lead)
+	if old == lead {
+		return
+	}
+	rg.logger.Infof("replica group %d leader changed from %d to %d", rg.id, old, lead)
+	if old == rg.id {
+		rg.ready = false
+		rg.s.ReplicaGroupStepDown()
+		rg.failPending(ErrNotLeader)
+	}
+}
+
+// fail stops the replica, whose state on disk is unknown now. It serves
+// nothing until restarted.
+func (rg *raftReplicaGroup) fail(err error) {
+	rg.logger.Errorf("replica group %d failed. %v", rg.id, err)
+	rg.leaderChanged(0)
+	rg.failPending(ErrReplicaGroupFailed)
+}
+
+func (rg *raftReplicaGroup) send(msgs []raftpb.Message) {
+	if rg.transport == nil || len(msgs) == 0 {
+		return
+	}
+	sender, ok := rg.transport.(SnapshotSender)
+	if !ok {
+		rg.transport.Send(msgs)
+		for _, m := range msgs {
+			if m.Type == raftpb.MsgSnap {
+				// delivered or not, the follower rejects the appending if
+				// not installed, and the snapshot is sent again.
+				rg.node.ReportSnapshot(m.To, raft.SnapshotFinish)
+			}
+		}
+		return
+	}
+
+	others := make([]raftpb.Message, 0, len(msgs))
+	for _, m := range msgs {
+		if m.Type == raftpb.MsgSnap {
+			go rg.sendSnapshot(sender, m)
+			continue
+		}
+		others = append(others, m)
+	}
+	rg.transport.Send(others)
+}
+
+// sendSnapshot sends the snapshot apart from the other messages, it's
+// reported to raft once delivered or failed.
+func (rg *raftReplicaGroup) sendSnapshot(sender SnapshotSender, m raftpb.Message) {
+	status := raft.SnapshotFinish
+	if err := sender.SendSnapshot(context.TODO(), m); err != nil {
+		rg.logger.Errorf("replica group %d send snapshot %d to %d failed. %v", rg.id, m.Snapshot.Metadata.Index, m.To, err)
+		status = raft.SnapshotFailure
+	}
+	rg.raftNode().ReportSnapshot(m.To, status)
+}
+
+// errSnapshotGivenUp tells the snapshot can't be installed, the block
+// files of it compacted by the leader maybe.
+var errSnapshotGivenUp = errors.New("snapshot given up")
+
+// installSnapshot installs the snapshot of leader into store, fetching
+// the block files is retried a few times, then the snapshot is given up
+// for the next one. The state of raft is ahead of store already, nothing
+// could be applied before that.
+func (rg *raftReplicaGroup) installSnapshot(rs raftpb.Snapshot) error {
+	snap, err := decodeSnapshot(rs.Data)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to decode snapshot %d", rs.Metadata.Index)
+	}
+	fetcher, _ := rg.transport.(BlockFetcher)
+	if fetcher == nil {
+		return errors.New("transport can't fetch block files")
+	}
+	for retries := 0; ; retries++ {
+		from := rg.Leader()
+		err := rg.s.installSnapshot(&snap, func(fid uint32) (io.ReadCloser, error) {
+			return fetcher.FetchBlockFile(context.TODO(), from, fid)
+		})
+		if err == nil {
+			break
+		}
+		rg.logger.Errorf("replica group %d install snapshot %d failed. %v", rg.id, rs.Metadata.Index, err)
+		// the files removed never come back
+		if errors.Cause(err) == ErrBlockFileNotFound || retries >= maxSnapshotInstallRetries {
+			rg.logger.Infof("replica group %d give up snapshot %d", rg.id, rs.Metadata.Index)
+			return errSnapshotGivenUp
+		}
+		select {
+		case <-time.After(rg.tickInterval):
+		case <-rg.stopCh:
+			return ErrReplicaGroupStopped
+		}
+	}
+	// the entries logged before are replaced by it
+	if err := rg.log.saveSnapshot(rs.Metadata.Index, rs.Metadata.Term); err != nil {
+		return err
+	}
+	if err := rg.storage.ApplySnapshot(rs); err != nil {
+		rg.logger.Errorf("replica group %d apply snapshot %d failed. %v", rg.id, rs.Metadata.Index, err)
+	}
+	rg.applied, rg.snapIndex = rs.Metadata.Index, rs.Metadata.Index
+	rg.confState = rs.Metadata.ConfState
+	return nil
+}
+
+// maybeSnapshot takes a snapshot once enough entries applied, or any
+// applied since the last one if forced.
+func (rg *raftReplicaGroup) maybeSnapshot(force bool) {
+	if rg.applied <= rg.snapIndex || (!force && rg.applied-rg.snapIndex < rg.snapshotEntries) {
+		return
+	}
+	term, err := rg.storage.Term(rg.applied)
+	if err != nil {
+		rg.logger.Errorf("replica group %d term of %d failed. %v", rg.id, rg.applied, err)
+		return
+	}
+	snap, err := rg.s.snapshot(rg.applied, term, rg.confState.Voters)
+	if err != nil {
+		rg.logger.Errorf("replica group %d snapshot store failed. %v", rg.id, err)
+		return
+	}
+	data, err := encodeSnapshot(snap)
+	if err != nil {
+		rg.logger.Errorf("replica group %d encode snapshot failed. %v", rg.id, err)
+		return
+	}
+	if err := rg.s.ss.SaveSnapshot(*snap); err != nil {
+		rg.logger.Errorf("replica group %d save snapshot failed. %v", rg.id, err)
+		return
+	}
+	if _, err := rg.storage.CreateSnapshot(rg.applied, &rg.confState, data); err != nil {
+		rg.logger.Errorf("replica group %d create snapshot failed. %v", rg.id, err)
+		return
+	}
+	rg.snapIndex = rg.applied
+	if err := rg.log.compact(rg.snapIndex); err != nil {
+		rg.logger.Errorf("replica group %d compact raft log to %d failed. %v", rg.id, rg.snapIndex, err)
+	}
+
+	if rg.applied <= rg.catchUpEntries {
+		return
+	}
+	compact := rg.applied - rg.catchUpEntries
+	if first, _ := rg.storage.FirstIndex(); compact <= first {
+		return
+	}
+	if err := rg.storage.Compact(compact); err != nil {
+		rg.logger.Errorf("replica group %d compact log to %d failed. %v", rg.id, compact, err)
+		return
+	}
+	rg.logger.Infof("replica group %d snapshot at %d, log compacted to %d", rg.id, rg.applied, compact)
+}
+
+// apply stops at the entry failed, which is left not applied. The replica
+// diverges from the others if it goes on.
+func (rg *raftReplicaGroup) apply(ents []raftpb.Entry) error {
+	for _, ent := range ents {
+		if ent.Index <= rg.applied {
+			continue
 		}
+		switch ent.Type {
+		case raftpb.EntryNormal:
+			if len(ent.Data) == 0 {
+				// the empty entry of a new leader, all the entries
+				// before are committed by us once applied.
+				if !rg.ready && ent.Term == rg.term && rg.Leader() == rg.id {
+					rg.ready = true
+					rg.s.ReplicaGroupReady()
+				}
+				break
+			}
+			if err := rg.commit(ent.Data); err != nil {
+				return errors.Wrapf(err, "Unable to commit entry %d", ent.Index)
+			}
+		case raftpb.EntryConfChange:
+			var cc raftpb.ConfChange
+			if err := cc.Unmarshal(ent.Data); err != nil {
+				return errors.Wrapf(err, "Unable to unmarshal conf change %d", ent.Index)
+			}
+			rg.confState = *rg.node.ApplyConfChange(cc)
+		}
+		rg.applied = ent.Index
 	}
+	return nil
 }
 
-func (f *fakeReplicaGroup) Propose(ctx context.Context, msg *dsproto.ReplicaMessage) error {
-	f.msg <- msg
+// commit hands the message to the store. The messages of other replicas
+// carry no request id, which means nothing to us, and no pointer of the
+// blob, which is written into our blob store then. So do ours written
+// before the block files reset by installing a snapshot.
+func (rg *raftReplicaGroup) commit(data []byte) error {
+	if len(data) < 8 {
+		return ErrReplicaEntryCorrupted
+	}
+	proposer := binary.BigEndian.Uint64(data[:8])
+	msg := &storepb.ReplicaMessage{}
+	if err := msg.Unmarshal(data[8:]); err != nil {
+		return errors.Wrap(ErrReplicaEntryCorrupted, err.Error())
+	}
+
+	var (
+		reqId   int64
+		missing *storepb.PutBlob
+	)
+	switch msg.GetType() {
+	case storepb.ReplicaMessage_PUT:
+		if pb := msg.GetPut(); pb != nil {
+			reqId = pb.ReqId
+			own := proposer == rg.id && rg.s.blobWritten(pb.BlobId)
+			if !own && pb.Chunk {
+				blob, err := rg.fetchChunk(proposer, pb)
+				if err == ErrReplicaGroupStopped {
+					return err
+				}
+				if err != nil {
+					// never wedge the group on it, repaired or collected later
+					rg.logger.Errorf("replica group %d commit chunk %d missing. %v", rg.id, pb.BlobId, err)
+					missing = pb
+				}
+				pb.Blob = blob
+			}
+			if proposer != rg.id {
+				pb.ReqId = 0
+			}
+			if !own {
+				pb.Ptr = nil
+			}
+		}
+	case storepb.ReplicaMessage_DELETE:
+		if db := msg.GetDel(); db != nil {
+			reqId = db.ReqId
+			if proposer != rg.id {
+				db.ReqId = 0
+			}
+		}
+	}
+	if proposer == rg.id {
+		rg.pendingLock.Lock()
+		delete(rg.pending, reqId)
+		rg.pendingLock.Unlock()
+	}
+	if missing != nil {
+		return rg.s.commitMissingChunk(missing)
+	}
+	return rg.s.Commit(context.TODO(), msg)
+}
+
+// fetchChunk fetches the chunk from the proposer by the pointer, or from
+// the others committed it already. It's retried in rounds, the committing
+// waits for it, and the chunk is committed missing if never fetched.
+func (rg *raftReplicaGroup) fetchChunk(proposer uint64, pb *storepb.PutBlob) ([]byte, error) {
+	chunkFetcher, _ := rg.transport.(ChunkFetcher)
+	blobFetcher, _ := rg.transport.(BlobFetcher)
+	if chunkFetcher == nil {
+		return nil, errors.New("transport can't fetch chunks")
+	}
+	ptr := BlobPointer{FileId: uint32(pb.Ptr.BlockId), Length: uint32(pb.Ptr.Len), Offset: pb.Ptr.Offset}
+	var err error
+	// verified as the blobs put, the pointer may be reused once compacted
+	verified := func(blob []byte, ferr error) bool {
+		if ferr == nil {
+			ferr = verifyBlob(blob, pb.Crc)
+		}
+		err = ferr
+		return ferr == nil
+	}
+	for round := 0; round < maxChunkFetchRounds; round++ {
+		if round > 0 {
+			rg.logger.Errorf("replica group %d fetch chunk %d from %d failed. %v", rg.id, pb.BlobId, proposer, err)
+			select {
+			case <-time.After(10 * rg.tickInterval):
+			case <-rg.stopCh:
+				return nil, ErrReplicaGroupStopped
+			}
+		}
+		if blob, ferr := chunkFetcher.FetchChunk(context.TODO(), proposer, ptr); verified(blob, ferr) {
+			return blob, nil
+		}
+		for _, peer := range rg.peers {
+			if peer == rg.id || blobFetcher == nil {
+				continue
+			}
+			if blob, ferr := blobFetcher.FetchBlob(context.TODO(), peer, pb.BlobId); verified(blob, ferr) {
+				return blob, nil
+			}
+		}
+	}
+	return nil, errors.Wrapf(err, "Unable to fetch chunk %d", pb.BlobId)
+}
+
+func (rg *raftReplicaGroup) failPending(err error) {
+	rg.pendingLock.Lock()
+	pending := rg.pending
+	rg.pending = make(map[int64]struct{})
+	rg.pendingLock.Unlock()
+	for reqId := range pending {
+		rg.s.wait.Trigger(uint64(reqId), err)
+	}
+}
+
+func (rg *raftReplicaGroup) Propose(ctx context.Context, msg *storepb.ReplicaMessage) error {
+	if rg.Leader() != rg.id {
+		return ErrNotLeader
+	}
+	body, err := msg.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "Unable to marshal replica message")
+	}
+	data := make([]byte, 8+len(body))
+	binary.BigEndian.PutUint64(data[:8], rg.id)
+	copy(data[8:], body)
+
+	var reqId int64
+	switch msg.GetType() {
+	case storepb.ReplicaMessage_PUT:
+		reqId = msg.GetPut().GetReqId()
+	case storepb.ReplicaMessage_DELETE:
+		reqId = msg.GetDel().GetReqId()
+	}
+	rg.pendingLock.Lock()
+	rg.pending[reqId] = struct{}{}
+	rg.pendingLock.Unlock()
+
+	if err := rg.raftNode().Propose(ctx, data); err != nil {
+		rg.pendingLock.Lock()
+		delete(rg.pending, reqId)
+		rg.pendingLock.Unlock()
+		if err == raft.ErrStopped {
+			return ErrReplicaGroupStopped
+		}
+		return err
+	}
 	return nil
 }
+
+func (rg *raftReplicaGroup) Process(ctx context.Context, m raftpb.Message) error {
+	select {
+	case <-rg.startedCh:
+	default:
+		// not started yet, the sender retries anyway
+		return ErrReplicaGroupStopped
+	}
+	select {
+	case <-rg.stopCh:
+		return ErrReplicaGroupStopped
+	default:
+	}
+	return rg.raftNode().Step(ctx, m)
+}
+
+func (rg *raftReplicaGroup) Leader() uint64 {
+	return atomic.LoadUint64(&rg.leader)
+}
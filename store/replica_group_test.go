@@ -0,0 +1,547 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/raft/raftpb"
+)
+
+func waitLeader(s *Store) bool {
+	for i := 0; i < 500; i++ {
+		if s.IsLeader() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// memoryNetwork connects the stores in process, the replicas isolated
+// lose all the messages from and to them. The snapshots sent fail the
+// first failSnapshots times, the block files fetched are missing the first
+// missingBlockFiles times, the blobs and the chunks fetched are all lost
+// while lostFetches.
+type memoryNetwork struct {
+	lock     sync.RWMutex
+	stores   map[uint64]*Store
+	isolated map[uint64]bool
+
+	failSnapshots     int
+	snapshotsSent     int
+	missingBlockFiles int
+	lostFetches       bool
+}
+
+func newMemoryNetwork() *memoryNetwork {
+	return &memoryNetwork{
+		stores:   make(map[uint64]*Store),
+		isolated: make(map[uint64]bool),
+	}
+}
+
+func (n *memoryNetwork) Send(msgs []raftpb.Message) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	for _, m := range msgs {
+		if n.isolated[m.From] || n.isolated[m.To] {
+			continue
+		}
+		if s, ok := n.stores[m.To]; ok {
+			// never block the raft loop of the sender
+			go s.Process(context.TODO(), m)
+		}
+	}
+}
+
+func (n *memoryNetwork) SendSnapshot(ctx context.Context, m raftpb.Message) error {
+	n.lock.Lock()
+	n.snapshotsSent++
+	s, ok := n.stores[m.To]
+	if !ok || n.isolated[m.From] || n.isolated[m.To] {
+		n.lock.Unlock()
+		return fmt.Errorf("replica %d unreachable", m.To)
+	}
+	if n.failSnapshots > 0 {
+		n.failSnapshots--
+		n.lock.Unlock()
+		return fmt.Errorf("snapshot to replica %d dropped", m.To)
+	}
+	n.lock.Unlock()
+	return s.Process(ctx, m)
+}
+
+func (n *memoryNetwork) FetchBlockFile(ctx context.Context, from uint64, fid uint32) (io.ReadCloser, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	s, ok := n.stores[from]
+	if !ok || n.isolated[from] {
+		return nil, fmt.Errorf("replica %d unreachable", from)
+	}
+	if n.missingBlockFiles > 0 {
+		n.missingBlockFiles--
+		return nil, ErrBlockFileNotFound
+	}
+	return s.OpenBlockFile(fid)
+}
+
+func (n *memoryNetwork) FetchBlob(ctx context.Context, from uint64, blobId int64) ([]byte, error) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	s, ok := n.stores[from]
+	if !ok || n.isolated[from] || n.lostFetches {
+		return nil, fmt.Errorf("replica %d unreachable", from)
+	}
+	return s.ReadBlob(blobId)
+}
+
+func (n *memoryNetwork) FetchChunk(ctx context.Context, from uint64, ptr BlobPointer) ([]byte, error) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	s, ok := n.stores[from]
+	if !ok || n.isolated[from] || n.lostFetches {
+		return nil, fmt.Errorf("replica %d unreachable", from)
+	}
+	return s.ReadChunk(ptr)
+}
+
+func (n *memoryNetwork) isolate(id uint64, isolated bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.isolated[id] = isolated
+}
+
+func (n *memoryNetwork) leader(except uint64) (uint64, *Store) {
+	for i := 0; i < 500; i++ {
+		n.lock.RLock()
+		for id, s := range n.stores {
+			if id != except && s.IsLeader() {
+				n.lock.RUnlock()
+				return id, s
+			}
+		}
+		n.lock.RUnlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return 0, nil
+}
+
+func eventually(f func() bool) bool {
+	for i := 0; i < 500; i++ {
+		if f() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func startReplicas(t *testing.T, logger Logger, network *memoryNetwork, peers []uint64, opts Opts) bool {
+	for _, id := range peers {
+		root := fmt.Sprintf("./test_replica_%d", id)
+		os.MkdirAll(root+"/"+blobStoreDir, 0755)
+
+		opts.ReplicaId = id
+		opts.Peers = peers
+		opts.Transport = network
+		opts.TickInterval = 10 * time.Millisecond
+		network.stores[id] = NewStore(logger, root, opts)
+	}
+	for _, s := range network.stores {
+		if !assert.Nil(t, s.Load()) {
+			return false
+		}
+	}
+	return true
+}
+
+func stopReplicas(network *memoryNetwork) {
+	for id, s := range network.stores {
+		s.Close()
+		os.RemoveAll(fmt.Sprintf("./test_replica_%d", id))
+	}
+}
+
+func putBlobs(t *testing.T, logger Logger, s *Store, count int) []*Request {
+	var reqs []*Request
+	for i := 0; i < count; i++ {
+		req, err := s.Put(logger, []byte(fmt.Sprintf("#blob%d#", i)), []byte{}, []byte{})
+		if !assert.Nil(t, err) {
+			return nil
+		}
+		reqs = append(reqs, req)
+	}
+	for _, req := range reqs {
+		assert.Nil(t, <-req.ErrCh)
+	}
+	return reqs
+}
+
+func TestRaftReplicaGroup(t *testing.T) {
+	logger := testLogger()
+	network := newMemoryNetwork()
+	peers := []uint64{1, 2, 3}
+	defer stopReplicas(network)
+	if !startReplicas(t, logger, network, peers, DefaultOpts) {
+		return
+	}
+
+	put := func(s *Store, count int) []*Request {
+		return putBlobs(t, logger, s, count)
+	}
+	replicated := func(ids []uint64, reqs []*Request) {
+		for _, id := range ids {
+			s := network.stores[id]
+			for _, req := range reqs {
+				assert.True(t, eventually(func() bool {
+					blob, err := s.Get(logger, req.BlobId)
+					return err == nil && string(blob) == string(req.Blob)
+				}), "replica %d blob %d", id, req.BlobId)
+			}
+		}
+	}
+
+	leaderId, leader := network.leader(0)
+	if !assert.NotNil(t, leader) {
+		return
+	}
+	// the followers refuse the writes
+	for id, s := range network.stores {
+		if id != leaderId {
+			_, err := s.Put(logger, []byte("blob"), nil, nil)
+			assert.Equal(t, ErrNotLeader, err)
+		}
+	}
+	reqs := put(leader, 10)
+	replicated(peers, reqs)
+
+	// a new leader elected by the majority
+	network.isolate(leaderId, true)
+	newLeaderId, newLeader := network.leader(leaderId)
+	if !assert.NotNil(t, newLeader) {
+		return
+	}
+	more := put(newLeader, 10)
+	for i := range more {
+		assert.True(t, more[i].BlobId > reqs[len(reqs)-1].BlobId)
+	}
+	var majority []uint64
+	for _, id := range peers {
+		if id != leaderId {
+			majority = append(majority, id)
+		}
+	}
+	replicated(majority, more)
+
+	dr, err := newLeader.Delete(logger, more[0].BlobId)
+	if assert.Nil(t, err) {
+		assert.Nil(t, <-dr.ErrCh)
+	}
+
+	// the old leader steps down and catches up once healed
+	network.isolate(leaderId, false)
+	assert.True(t, eventually(func() bool {
+		return !network.stores[leaderId].IsLeader()
+	}))
+	replicated(peers, more[1:])
+	for _, id := range peers {
+		s := network.stores[id]
+		assert.True(t, eventually(func() bool {
+			_, err := s.Get(logger, more[0].BlobId)
+			return err == ErrMetaNotFound
+		}), "replica %d", id)
+	}
+	assert.Equal(t, newLeaderId, network.stores[leaderId].rg.Leader())
+}
+
+func TestRaftReplicaGroupSnapshot(t *testing.T) {
+	logger := testLogger()
+	network := newMemoryNetwork()
+	peers := []uint64{1, 2, 3}
+	opts := DefaultOpts
+	opts.SnapshotEntries = 10
+	opts.SnapshotCatchUpEntries = 5
+	defer stopReplicas(network)
+	if !startReplicas(t, logger, network, peers, opts) {
+		return
+	}
+
+	leaderId, leader := network.leader(0)
+	if !assert.NotNil(t, leader) {
+		return
+	}
+	followerId := peers[0]
+	if followerId == leaderId {
+		followerId = peers[1]
+	}
+	network.isolate(followerId, true)
+	reqs := putBlobs(t, logger, leader, 50)
+	dr, err := leader.Delete(logger, reqs[0].BlobId)
+	if assert.Nil(t, err) {
+		assert.Nil(t, <-dr.ErrCh)
+	}
+
+	// the log is compacted, the follower installs a snapshot sent again
+	// once failed
+	network.lock.Lock()
+	network.failSnapshots = 2
+	network.lock.Unlock()
+	network.isolate(followerId, false)
+	follower := network.stores[followerId]
+	for _, req := range reqs[1:] {
+		assert.True(t, eventually(func() bool {
+			blob, err := follower.Get(logger, req.BlobId)
+			return err == nil && string(blob) == string(req.Blob)
+		}), "blob %d", req.BlobId)
+	}
+	assert.True(t, eventually(func() bool {
+		_, err := follower.Get(logger, reqs[0].BlobId)
+		return err == ErrMetaNotFound
+	}))
+	network.lock.RLock()
+	assert.True(t, network.snapshotsSent > 2)
+	network.lock.RUnlock()
+	snaps, err := follower.ss.Load()
+	if assert.Nil(t, err) && assert.True(t, len(snaps) > 0) {
+		first := snaps[0]
+		assert.True(t, first.Committed > 0)
+		assert.True(t, len(first.BlockFiles) > 0)
+	}
+
+	// the follower applies the log after the snapshot
+	more := putBlobs(t, logger, leader, 5)
+	for _, req := range more {
+		assert.True(t, eventually(func() bool {
+			blob, err := follower.Get(logger, req.BlobId)
+			return err == nil && string(blob) == string(req.Blob)
+		}), "blob %d", req.BlobId)
+	}
+}
+
+func TestRaftReplicaGroupSnapshotGivenUp(t *testing.T) {
+	logger := testLogger()
+	network := newMemoryNetwork()
+	peers := []uint64{1, 2, 3}
+	opts := DefaultOpts
+	opts.SnapshotEntries = 10
+	opts.SnapshotCatchUpEntries = 5
+	defer stopReplicas(network)
+	if !startReplicas(t, logger, network, peers, opts) {
+		return
+	}
+
+	leaderId, leader := network.leader(0)
+	if !assert.NotNil(t, leader) {
+		return
+	}
+	followerId := peers[0]
+	if followerId == leaderId {
+		followerId = peers[1]
+	}
+	network.isolate(followerId, true)
+	reqs := putBlobs(t, logger, leader, 50)
+
+	// the block files of the snapshot compacted by the leader, the
+	// follower gives it up and installs the one sent next
+	network.lock.Lock()
+	network.missingBlockFiles = 1
+	network.lock.Unlock()
+	network.isolate(followerId, false)
+	follower := network.stores[followerId]
+	for _, req := range reqs {
+		assert.True(t, eventually(func() bool {
+			blob, err := follower.Get(logger, req.BlobId)
+			return err == nil && string(blob) == string(req.Blob)
+		}), "blob %d", req.BlobId)
+	}
+	network.lock.RLock()
+	assert.Equal(t, 0, network.missingBlockFiles)
+	network.lock.RUnlock()
+	staged, err := filepath.Glob(filepath.Join(follower.blobStorePath(), "*"+stagedBlockFileSuffix))
+	assert.Nil(t, err)
+	assert.Empty(t, staged)
+
+	more := putBlobs(t, logger, leader, 5)
+	for _, req := range more {
+		assert.True(t, eventually(func() bool {
+			blob, err := follower.Get(logger, req.BlobId)
+			return err == nil && string(blob) == string(req.Blob)
+		}), "blob %d", req.BlobId)
+	}
+}
+
+func TestStoreRestartFromSnapshot(t *testing.T) {
+	root := "./test_restart"
+	os.MkdirAll(root+"/"+blobStoreDir, 0755)
+	defer os.RemoveAll(root)
+	logger := testLogger()
+	// nothing left in the memory meta store after restarting
+	opts := DefaultOpts
+	opts.MetaStore = MetaStoreMemory
+
+	s := NewStore(logger, root, opts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	reqs := putBlobs(t, logger, s, 20)
+	s.Close()
+
+	// the snapshot taken when closing
+	s = NewStore(logger, root, opts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	defer s.Close()
+	for _, req := range reqs {
+		blob, err := s.Get(logger, req.BlobId)
+		if assert.Nil(t, err) {
+			assert.Equal(t, req.Blob, blob)
+		}
+	}
+	more := putBlobs(t, logger, s, 1)
+	if assert.Len(t, more, 1) {
+		assert.True(t, more[0].BlobId > reqs[len(reqs)-1].BlobId)
+	}
+}
+
+func TestStoreRestartFromLog(t *testing.T) {
+	root := "./test_restart_log"
+	os.MkdirAll(root+"/"+blobStoreDir, 0755)
+	defer os.RemoveAll(root)
+	logger := testLogger()
+	opts := DefaultOpts
+	opts.MetaStore = MetaStoreMemory
+
+	s := NewStore(logger, root, opts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	reqs := putBlobs(t, logger, s, 20)
+	s.Close()
+
+	// no snapshot, all the blobs committed again by the raft log
+	os.RemoveAll(root + "/" + snapStoreDir)
+	s = NewStore(logger, root, opts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	defer s.Close()
+	for _, req := range reqs {
+		blob, err := s.Get(logger, req.BlobId)
+		if assert.Nil(t, err) {
+			assert.Equal(t, req.Blob, blob)
+		}
+	}
+	more := putBlobs(t, logger, s, 1)
+	if assert.Len(t, more, 1) {
+		assert.True(t, more[0].BlobId > reqs[len(reqs)-1].BlobId)
+	}
+}
+
+// failedBlobStore fails all the writes.
+type failedBlobStore struct {
+	BlobStore
+}
+
+func (bs failedBlobStore) Write(reqs []*Request) error {
+	return fmt.Errorf("block file unwritable")
+}
+
+func TestRaftReplicaGroupCommitFailed(t *testing.T) {
+	logger := testLogger()
+	network := newMemoryNetwork()
+	peers := []uint64{1, 2, 3}
+	defer stopReplicas(network)
+	if !startReplicas(t, logger, network, peers, DefaultOpts) {
+		return
+	}
+	leaderId, leader := network.leader(0)
+	if !assert.NotNil(t, leader) {
+		return
+	}
+	followerId := peers[0]
+	if followerId == leaderId {
+		followerId = peers[1]
+	}
+	follower := network.stores[followerId]
+	follower.blobWriteLock.Lock()
+	follower.removeLock.Lock()
+	follower.bs = failedBlobStore{follower.bs}
+	follower.removeLock.Unlock()
+	follower.blobWriteLock.Unlock()
+
+	// committed by the majority still, the follower stops applying
+	reqs := putBlobs(t, logger, leader, 3)
+	rg := follower.rg.(*raftReplicaGroup)
+	select {
+	case <-rg.doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replica group not failed")
+	}
+	for _, req := range reqs {
+		_, err := follower.Get(logger, req.BlobId)
+		assert.Equal(t, ErrMetaNotFound, err)
+	}
+	last, _ := rg.storage.LastIndex()
+	assert.True(t, rg.applied < last)
+	assert.Equal(t, uint64(0), rg.Leader())
+}
+
+func TestRaftReplicaGroupCommitAfterReset(t *testing.T) {
+	root := "./test_commit_reset"
+	os.MkdirAll(root+"/"+blobStoreDir, 0755)
+	defer os.RemoveAll(root)
+	logger := testLogger()
+	opts := DefaultOpts
+	opts.MetaStore = MetaStoreMemory
+	// a block file for every blob
+	opts.BlockFileSize = 1
+
+	s := NewStore(logger, root, opts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	defer s.Close()
+	reqs := putBlobs(t, logger, s, 3)
+
+	// written by us, then the block files reset before it committed
+	blob := []byte("#blob-reset#")
+	req := &Request{BlobId: s.nextBlobId(), Blob: blob, Crc: blobCrc(blob)}
+	s.blobWriteLock.Lock()
+	assert.Nil(t, s.bs.Write([]*Request{req}))
+	s.written[req.BlobId] = struct{}{}
+	s.blobWriteLock.Unlock()
+	snap, err := s.snapshot(1, 1, []uint64{1})
+	if !assert.Nil(t, err) || !assert.Nil(t, s.installSnapshot(snap, s.OpenBlockFile)) {
+		return
+	}
+	_, err = s.bs.Read(req.Ptr)
+	assert.NotNil(t, err)
+
+	rg := s.rg.(*raftReplicaGroup)
+	body, _ := convertPutBlobMessage(req).Marshal()
+	data := make([]byte, 8+len(body))
+	binary.BigEndian.PutUint64(data[:8], rg.id)
+	copy(data[8:], body)
+	if !assert.Nil(t, rg.commit(data)) {
+		return
+	}
+	got, err := s.Get(logger, req.BlobId)
+	if assert.Nil(t, err) {
+		assert.Equal(t, blob, got)
+	}
+	for _, req := range reqs {
+		got, err := s.Get(logger, req.BlobId)
+		if assert.Nil(t, err) {
+			assert.Equal(t, req.Blob, got)
+		}
+	}
+}
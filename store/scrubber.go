@@ -0,0 +1,283 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoPeerToRepair error = errors.New("no peer to repair from")
+)
+
+// ScrubReport is the result of a round of scrubbing.
+type ScrubReport struct {
+	Blobs int
+	Bytes int64
+	// the blobs failed the verification, and the ones of them fetched
+	// from the peers.
+	Corrupted []int64
+	Repaired  []int64
+}
+
+func (s *Store) scrubber() {
+	s.logger.Infof("store scrubber run every %s", s.opts.ScrubInterval)
+
+	ticker := time.NewTicker(s.opts.ScrubInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report, err := s.Scrub()
+			if err != nil {
+				s.logger.Errorf("store scrub failed. %v", err)
+				continue
+			}
+			s.logger.Infof("store scrub %d blobs %d bytes, corrupted %v repaired %v",
+				report.Blobs, report.Bytes, report.Corrupted, report.Repaired)
+		case <-s.stopCh:
+			s.logger.Info("store scrubber stopped.")
+			return
+		}
+	}
+}
+
+// Scrub verifies all the blobs in the order of their block files, the
+// corrupted ones are repaired by the good copies of the peers.
+func (s *Store) Scrub() (*ScrubReport, error) {
+	metas, err := s.ms.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	ptrs := make(map[int64]BlobPointer, len(metas))
+	blobIds := make([]int64, 0, len(metas))
+	for blobId, meta := range metas {
+		var bm BlobMeta
+		if err := json.Unmarshal(meta, &bm); err != nil {
+			return nil, errors.Wrapf(err, "Unable to unmarshal meta of blob %d", blobId)
+		}
+		ptrs[blobId] = bm.Ptr
+		blobIds = append(blobIds, blobId)
+	}
+	sort.Slice(blobIds, func(i, j int) bool {
+		pi, pj := ptrs[blobIds[i]], ptrs[blobIds[j]]
+		if pi.FileId != pj.FileId {
+			return pi.FileId < pj.FileId
+		}
+		return pi.Offset < pj.Offset
+	})
+
+	report := &ScrubReport{}
+	limiter := newRateLimiter(s.opts.ScrubRate)
+	for _, blobId := range blobIds {
+		n, err := s.scrubBlob(blobId)
+		if err != nil {
+			if errors.Cause(err) != ErrBlobCorrupted {
+				return report, err
+			}
+			s.logger.Errorf("store scrub blob %d corrupted. %v", blobId, err)
+			report.Corrupted = append(report.Corrupted, blobId)
+		}
+		report.Blobs++
+		report.Bytes += n
+		if !limiter.wait(n, s.stopCh) {
+			return report, ErrStoreStopped
+		}
+	}
+
+	for _, blobId := range report.Corrupted {
+		if err := s.repairBlob(blobId); err != nil {
+			s.logger.Errorf("store repair blob %d failed. %v", blobId, err)
+			continue
+		}
+		s.logger.Infof("store repair blob %d done", blobId)
+		report.Repaired = append(report.Repaired, blobId)
+	}
+	return report, nil
+}
+
+// scrubBlob verifies the blob where it is now, it may be deleted or
+// moved by the compactor since the metas taken.
+func (s *Store) scrubBlob(blobId int64) (int64, error) {
+	s.removeLock.RLock()
+	defer s.removeLock.RUnlock()
+	meta, err := s.ms.Get(blobId)
+	if err == ErrMetaNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var bm BlobMeta
+	if err := json.Unmarshal(meta, &bm); err != nil {
+		return 0, errors.Wrapf(err, "Unable to unmarshal meta of blob %d", blobId)
+	}
+	if bm.Missing || s.isQuarantined(blobId) {
+		return 0, errors.Wrapf(ErrBlobCorrupted, "blob %d quarantined", blobId)
+	}
+	blob, err := s.bs.Read(bm.Ptr)
+	if err == nil {
+		err = verifyBlob(blob, bm.Crc)
+	}
+	return int64(bm.Ptr.Length), err
+}
+
+// repairBlob writes the blob fetched from a peer, and points the meta to
+// it like the compactor. The corrupted one left is dead then.
+func (s *Store) repairBlob(blobId int64) error {
+	err := s.fetchAndRepairBlob(blobId)
+	if err == nil || errors.Cause(err) == ErrMetaNotFound {
+		s.unquarantine(blobId)
+	}
+	return err
+}
+
+func (s *Store) fetchAndRepairBlob(blobId int64) error {
+	fetcher, ok := s.opts.Transport.(BlobFetcher)
+	if !ok {
+		return ErrNoPeerToRepair
+	}
+	var (
+		blob []byte
+		err  error = ErrNoPeerToRepair
+	)
+	for _, peer := range s.opts.Peers {
+		if peer == s.opts.ReplicaId {
+			continue
+		}
+		if blob, err = fetcher.FetchBlob(context.TODO(), peer, blobId); err == nil {
+			break
+		}
+		s.logger.Errorf("store fetch blob %d from replica %d failed. %v", blobId, peer, err)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Unable to fetch blob %d", blobId)
+	}
+
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+	meta, err := s.ms.Get(blobId)
+	if err != nil {
+		return err
+	}
+	var bm BlobMeta
+	if err := json.Unmarshal(meta, &bm); err != nil {
+		return errors.Wrapf(err, "Unable to unmarshal meta of blob %d", blobId)
+	}
+	if err := verifyBlob(blob, bm.Crc); err != nil {
+		return errors.Wrapf(err, "blob %d fetched", blobId)
+	}
+
+	s.blobWriteLock.Lock()
+	defer s.blobWriteLock.Unlock()
+	req := &Request{BlobId: blobId, Blob: blob, Meta: bm.Meta, Crc: bm.Crc}
+	if err := s.bs.Write([]*Request{req}); err != nil {
+		return errors.Wrapf(err, "Unable to write blob %d", blobId)
+	}
+	if err := s.bs.SyncBlockFiles(); err != nil {
+		return err
+	}
+	bm.Ptr = req.Ptr
+	bm.Missing = false
+	blobMeta, _ := json.Marshal(&bm)
+	if _, err := s.ms.CompareAndSwap(blobId, meta, blobMeta); err != nil {
+		return errors.Wrapf(err, "Unable to swap meta of blob %d", blobId)
+	}
+	return nil
+}
+
+// repairQuarantined repairs the quarantined blobs from the peers every
+// election timeout, until all of them repaired or deleted. It's started
+// by the first blob quarantined.
+func (s *Store) repairQuarantined() {
+	ticker := time.NewTicker(10 * s.opts.TickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stopCh:
+			return
+		}
+		s.quarantineLock.Lock()
+		if len(s.quarantined) == 0 {
+			s.repairing = false
+			s.quarantineLock.Unlock()
+			s.logger.Info("store quarantined blobs all repaired.")
+			return
+		}
+		s.quarantineLock.Unlock()
+		for _, blobId := range s.quarantinedBlobs() {
+			if err := s.repairBlob(blobId); err != nil {
+				s.logger.Errorf("store repair quarantined blob %d failed. %v", blobId, err)
+				continue
+			}
+			s.logger.Infof("store repair quarantined blob %d done", blobId)
+		}
+	}
+}
+
+func (s *Store) quarantine(blobId int64) {
+	s.quarantineLock.Lock()
+	defer s.quarantineLock.Unlock()
+	s.quarantined[blobId] = struct{}{}
+	if !s.repairing {
+		s.repairing = true
+		s.goAttach(s.repairQuarantined)
+	}
+}
+
+func (s *Store) unquarantine(blobId int64) {
+	s.quarantineLock.Lock()
+	defer s.quarantineLock.Unlock()
+	delete(s.quarantined, blobId)
+}
+
+func (s *Store) isQuarantined(blobId int64) bool {
+	s.quarantineLock.Lock()
+	defer s.quarantineLock.Unlock()
+	_, found := s.quarantined[blobId]
+	return found
+}
+
+func (s *Store) quarantinedBlobs() []int64 {
+	s.quarantineLock.Lock()
+	defer s.quarantineLock.Unlock()
+	blobIds := make([]int64, 0, len(s.quarantined))
+	for blobId := range s.quarantined {
+		blobIds = append(blobIds, blobId)
+	}
+	sort.Slice(blobIds, func(i, j int) bool { return blobIds[i] < blobIds[j] })
+	return blobIds
+}
+
+// rateLimiter sleeps to keep the bytes passed at most rate per second,
+// unlimited if rate not positive.
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate, start: time.Now()}
+}
+
+// wait returns false if stopped while waiting.
+func (l *rateLimiter) wait(n int64, stopCh <-chan struct{}) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.bytes += n
+	expected := time.Duration(float64(l.bytes) / float64(l.rate) * float64(time.Second))
+	if d := expected - time.Since(l.start); d > 0 {
+		select {
+		case <-time.After(d):
+		case <-stopCh:
+			return false
+		}
+	}
+	return true
+}
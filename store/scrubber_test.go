@@ -0,0 +1,211 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// corruptBlob flips a byte of the blob on disk.
+func corruptBlob(t *testing.T, s *Store, blobId int64) bool {
+	meta, err := s.ms.Get(blobId)
+	if !assert.Nil(t, err) {
+		return false
+	}
+	var bm BlobMeta
+	if !assert.Nil(t, json.Unmarshal(meta, &bm)) {
+		return false
+	}
+	fd, err := os.OpenFile(s.bs.(*blobStore).blockFilePathById(bm.Ptr.FileId), os.O_RDWR, 0644)
+	if !assert.Nil(t, err) {
+		return false
+	}
+	defer fd.Close()
+	b := make([]byte, 1)
+	off := bm.Ptr.Offset + int64(headerSize)
+	fd.ReadAt(b, off)
+	b[0] ^= 0xff
+	_, err = fd.WriteAt(b, off)
+	return assert.Nil(t, err)
+}
+
+func TestStoreScrub(t *testing.T) {
+	root := "./test_scrub"
+	os.MkdirAll(root+"/"+blobStoreDir, 0755)
+	defer os.RemoveAll(root)
+	logger := testLogger()
+
+	s := NewStore(logger, root, DefaultOpts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	defer s.Close()
+	reqs := putBlobs(t, logger, s, 10)
+	bad := reqs[3].BlobId
+	if !corruptBlob(t, s, bad) {
+		return
+	}
+	_, err := s.Get(logger, bad)
+	assert.Equal(t, ErrBlobCorrupted, errors.Cause(err))
+
+	report, err := s.Scrub()
+	if assert.Nil(t, err) {
+		assert.Equal(t, 10, report.Blobs)
+		assert.Equal(t, []int64{bad}, report.Corrupted)
+		// no peers
+		assert.Len(t, report.Repaired, 0)
+	}
+}
+
+func TestStoreScrubRepair(t *testing.T) {
+	logger := testLogger()
+	network := newMemoryNetwork()
+	peers := []uint64{1, 2, 3}
+	opts := DefaultOpts
+	opts.ScrubRate = 1 << 10
+	defer stopReplicas(network)
+	if !startReplicas(t, logger, network, peers, opts) {
+		return
+	}
+	leaderId, leader := network.leader(0)
+	if !assert.NotNil(t, leader) {
+		return
+	}
+	reqs := putBlobs(t, logger, leader, 10)
+	followerId := peers[0]
+	if followerId == leaderId {
+		followerId = peers[1]
+	}
+	follower := network.stores[followerId]
+	for _, req := range reqs {
+		assert.True(t, eventually(func() bool {
+			_, err := follower.Get(logger, req.BlobId)
+			return err == nil
+		}), "blob %d", req.BlobId)
+	}
+
+	bad := reqs[5]
+	if !corruptBlob(t, follower, bad.BlobId) {
+		return
+	}
+	start := time.Now()
+	report, err := follower.Scrub()
+	if assert.Nil(t, err) {
+		assert.Equal(t, []int64{bad.BlobId}, report.Corrupted)
+		assert.Equal(t, []int64{bad.BlobId}, report.Repaired)
+		// limited by the rate
+		assert.True(t, time.Since(start) >= time.Duration(report.Bytes)*time.Second/(1<<10)-100*time.Millisecond)
+	}
+	blob, err := follower.Get(logger, bad.BlobId)
+	if assert.Nil(t, err) {
+		assert.Equal(t, bad.Blob, blob)
+	}
+	report, err = follower.Scrub()
+	if assert.Nil(t, err) {
+		assert.Len(t, report.Corrupted, 0)
+	}
+}
+
+func TestStoreScrubBlobCrc(t *testing.T) {
+	root := "./test_scrub_crc"
+	os.MkdirAll(root+"/"+blobStoreDir, 0755)
+	defer os.RemoveAll(root)
+	logger := testLogger()
+
+	s := NewStore(logger, root, DefaultOpts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	defer s.Close()
+	blob := []byte("#blob#")
+	_, err := s.Put(logger, blob, nil, blobCrc([]byte("#other#")))
+	assert.Equal(t, ErrBlobCorrupted, errors.Cause(err))
+	req, err := s.Put(logger, blob, nil, blobCrc(blob))
+	if !assert.Nil(t, err) || !assert.Nil(t, <-req.ErrCh) {
+		return
+	}
+	got, err := s.Get(logger, req.BlobId)
+	if assert.Nil(t, err) {
+		assert.Equal(t, blob, got)
+	}
+
+	// the record on disk is intact, only the blob mismatches the crc
+	meta, err := s.ms.Get(req.BlobId)
+	if !assert.Nil(t, err) {
+		return
+	}
+	var bm BlobMeta
+	json.Unmarshal(meta, &bm)
+	bm.Crc = blobCrc([]byte("#other#"))
+	meta, _ = json.Marshal(&bm)
+	if !assert.Nil(t, s.ms.Put(req.BlobId, meta)) {
+		return
+	}
+	_, err = s.Get(logger, req.BlobId)
+	assert.Equal(t, ErrBlobCorrupted, errors.Cause(err))
+	report, err := s.Scrub()
+	if assert.Nil(t, err) {
+		assert.Equal(t, []int64{req.BlobId}, report.Corrupted)
+	}
+}
+
+func TestStoreRepairQuarantined(t *testing.T) {
+	logger := testLogger()
+	network := newMemoryNetwork()
+	peers := []uint64{1, 2, 3}
+	opts := DefaultOpts
+	defer stopReplicas(network)
+	if !startReplicas(t, logger, network, peers, opts) {
+		return
+	}
+	leaderId, leader := network.leader(0)
+	if !assert.NotNil(t, leader) {
+		return
+	}
+	reqs := putBlobs(t, logger, leader, 10)
+	followerId := peers[0]
+	if followerId == leaderId {
+		followerId = peers[1]
+	}
+	follower := network.stores[followerId]
+	for _, req := range reqs {
+		assert.True(t, eventually(func() bool {
+			_, err := follower.Get(logger, req.BlobId)
+			return err == nil
+		}), "blob %d", req.BlobId)
+	}
+	// repaired from the peers even if isolated from the group
+	network.isolate(followerId, true)
+	follower.Close()
+
+	// the blobs lost by crashing, but their metas durable
+	root := fmt.Sprintf("./test_replica_%d", followerId)
+	files, _ := filepath.Glob(root + "/" + blobStoreDir + "/" + blockFilePrefix + "*")
+	for _, file := range files {
+		assert.Nil(t, os.Truncate(file, 0))
+	}
+	opts.ReplicaId = followerId
+	opts.Peers = peers
+	opts.Transport = network
+	opts.TickInterval = 10 * time.Millisecond
+	follower = NewStore(logger, root, opts)
+	network.lock.Lock()
+	network.stores[followerId] = follower
+	network.lock.Unlock()
+	if !assert.Nil(t, follower.Load()) {
+		return
+	}
+	for _, req := range reqs {
+		assert.True(t, eventually(func() bool {
+			blob, err := follower.Get(logger, req.BlobId)
+			return err == nil && string(blob) == string(req.Blob)
+		}), "blob %d", req.BlobId)
+	}
+	assert.Len(t, follower.quarantinedBlobs(), 0)
+}
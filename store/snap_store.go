@@ -1,12 +1,202 @@
 package store
 
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrSnapshotNotFound  error = errors.New("snapshot not found")
+	ErrSnapshotCorrupted error = errors.New("snapshot corrupted")
+)
+
+var (
+	snapFileSuffix string = ".snap"
+)
+
+// the number of snapshots kept on disk
+const snapshotsKept int = 3
+
 type SnapStore interface {
+	// Load returns the valid snapshots from the oldest.
 	Load() (ss []Snapshot, err error)
 	Close() error
 
-	SaveSnapshot(id int32, s Snapshot) error
-	FetchSnapshot(id int32) (s Snapshot, err error)
+	SaveSnapshot(s Snapshot) error
+	// FetchSnapshot returns the snapshot taken at index.
+	FetchSnapshot(index uint64) (s Snapshot, err error)
 }
 
+// Snapshot is the state of store at the raft index, the blobs are kept
+// in the block files referenced.
 type Snapshot struct {
+	Index      uint64           `json:"index"`
+	Term       uint64           `json:"term"`
+	Voters     []uint64         `json:"voters"`
+	MaxBlobId  int64            `json:"max_blob_id"`
+	Committed  int64            `json:"committed"`
+	Metas      map[int64][]byte `json:"metas"`
+	BlockFiles []uint32         `json:"block_files"`
+}
+
+//  snapshot format
+//  |--  crc --|--   json   --|
+//  |--32bits--|--dynamic-len-|
+
+func encodeSnapshot(s *Snapshot) ([]byte, error) {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to marshal snapshot")
+	}
+	buf := make([]byte, crc32.Size+len(body))
+	binary.BigEndian.PutUint32(buf[:crc32.Size], crc32.Checksum(body, CastagnoliCrcTable))
+	copy(buf[crc32.Size:], body)
+	return buf, nil
+}
+
+func decodeSnapshot(buf []byte) (s Snapshot, err error) {
+	if len(buf) < crc32.Size {
+		return s, ErrSnapshotCorrupted
+	}
+	body := buf[crc32.Size:]
+	if binary.BigEndian.Uint32(buf[:crc32.Size]) != crc32.Checksum(body, CastagnoliCrcTable) {
+		return s, ErrSnapshotCorrupted
+	}
+	if err := json.Unmarshal(body, &s); err != nil {
+		return s, errors.Wrap(ErrSnapshotCorrupted, err.Error())
+	}
+	return s, nil
+}
+
+// fileSnapStore keeps a snapshot a file named by its term and index, so
+// they are sorted by name.
+type fileSnapStore struct {
+	logger Logger
+	dir    string
+}
+
+func NewFileSnapStore(logger Logger, dir string) *fileSnapStore {
+	return &fileSnapStore{logger: logger, dir: dir}
+}
+
+func (f *fileSnapStore) snapPath(term, index uint64) string {
+	return filepath.Join(f.dir, fmt.Sprintf("%016x-%016x%s", term, index, snapFileSuffix))
+}
+
+func (f *fileSnapStore) names() ([]string, error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read snapshot directory %s", f.dir)
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), snapFileSuffix) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (f *fileSnapStore) Load() (ss []Snapshot, err error) {
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "Unable to create snapshot directory %s", f.dir)
+	}
+	names, err := f.names()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		path := filepath.Join(f.dir, name)
+		s, err := f.read(path)
+		if err != nil {
+			// a torn one, left by crashing in the middle of saving
+			f.logger.Errorf("snap store load snapshot %s failed. %v", path, err)
+			if err := os.Rename(path, path+".broken"); err != nil {
+				return nil, errors.Wrapf(err, "Unable to rename broken snapshot %s", path)
+			}
+			continue
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
+
+func (f *fileSnapStore) read(path string) (Snapshot, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Snapshot{}, errors.Wrapf(err, "Unable to read snapshot %s", path)
+	}
+	return decodeSnapshot(buf)
+}
+
+func (f *fileSnapStore) Close() error { return nil }
+
+// SaveSnapshot writes the snapshot into a temporary file and renames it,
+// the oldest ones beyond snapshotsKept are removed then.
+func (f *fileSnapStore) SaveSnapshot(s Snapshot) error {
+	buf, err := encodeSnapshot(&s)
+	if err != nil {
+		return err
+	}
+	path := f.snapPath(s.Term, s.Index)
+	tmp := path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create snapshot %s", tmp)
+	}
+	if _, err := fd.Write(buf); err != nil {
+		fd.Close()
+		return errors.Wrapf(err, "Unable to write snapshot %s", tmp)
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return errors.Wrapf(err, "Unable to sync snapshot %s", tmp)
+	}
+	if err := fd.Close(); err != nil {
+		return errors.Wrapf(err, "Unable to close snapshot %s", tmp)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrapf(err, "Unable to rename snapshot %s", tmp)
+	}
+	if dir, err := os.Open(f.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	f.logger.Infof("snap store save snapshot term %d index %d", s.Term, s.Index)
+
+	names, err := f.names()
+	if err != nil {
+		return err
+	}
+	for len(names) > snapshotsKept {
+		if err := os.Remove(filepath.Join(f.dir, names[0])); err != nil {
+			f.logger.Errorf("snap store remove snapshot %s failed. %v", names[0], err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+func (f *fileSnapStore) FetchSnapshot(index uint64) (s Snapshot, err error) {
+	names, err := f.names()
+	if err != nil {
+		return s, err
+	}
+	suffix := fmt.Sprintf("-%016x%s", index, snapFileSuffix)
+	for i := len(names) - 1; i >= 0; i-- {
+		if strings.HasSuffix(names[i], suffix) {
+			return f.read(filepath.Join(f.dir, names[i]))
+		}
+	}
+	return s, ErrSnapshotNotFound
 }
@@ -3,29 +3,35 @@ package store
 import (
 	"context"
 	"encoding/json"
-	"errors"
+	"io"
 	"path"
+	"sort"
 	"sync"
 	"sync/atomic"
 
-	"git.jd.com/cloud-storage/newds-datanode/pkg/logutil"
-	dsproto "git.jd.com/cloud-storage/newds-datanode/proto"
+	"github.com/EricYT/go-examples/store/storepb"
+	"github.com/pkg/errors"
 	"go.etcd.io/etcd/pkg/wait"
-	"go.uber.org/zap"
+	"go.etcd.io/etcd/raft/raftpb"
 )
 
 const maxWriteBlobSize = 100
 const blobStoreDir = "blob"
+const snapStoreDir = "snap"
+const raftLogDir = "raft"
+const metaStoreFile = "meta.db"
 
 var (
-	ErrStoreStopped error = errors.New("store stopped")
-	ErrStaleBlob    error = errors.New("stale blob")
+	ErrStoreStopped      error = errors.New("store stopped")
+	ErrStaleBlob         error = errors.New("stale blob")
+	ErrDanglingBlobMetas error = errors.New("blob meta points to nowhere")
 )
 
 type Store struct {
-	logger logutil.Logger
+	logger Logger
 
 	root       string
+	opts       Opts
 	attachedWG sync.WaitGroup
 
 	storeLock sync.RWMutex
@@ -37,11 +43,38 @@ type Store struct {
 	ss SnapStore
 	// replica group
 	rg ReplicaGroup
+	// serializes writing the blob store, between the blobs put and the
+	// ones replicated from others.
+	blobWriteLock sync.Mutex
+	leading       int32 // access atomic, the replica group ready for writing
+	// the blobs written by us and not committed yet, under blobWriteLock.
+	// They're lost once the block files reset, see blobWritten.
+	written map[int64]struct{}
+	resets  int
 
 	maxBlobId     int64 // access atomic
 	committedLock sync.Mutex
 	committed     int64
 
+	// serializes the compaction with installing snapshot
+	compactLock    sync.Mutex
+	compactedFiles map[uint32]struct{}
+	// the block files referenced by the last snapshot
+	snapFilesLock sync.Mutex
+	snapFiles     map[uint32]struct{}
+	// held by the readers, the block files compacted are removed under
+	// it, see compactor.
+	removeLock sync.RWMutex
+	// the max blob id when the streams in flight started, the chunks
+	// after it are not collected, see collectChunks.
+	streamsLock sync.Mutex
+	streams     map[int64]int
+	// the blobs found dangling by recover and the chunks committed missing,
+	// unreadable until repaired from the peers, see repairQuarantined.
+	quarantineLock sync.Mutex
+	quarantined    map[int64]struct{}
+	repairing      bool
+
 	writeBlobCh chan *Request
 
 	wait wait.Wait
@@ -49,12 +82,25 @@ type Store struct {
 	stopCh chan struct{}
 }
 
-func NewStore(logger logutil.Logger, root string) *Store {
+func NewStore(logger Logger, root string, opts Opts) *Store {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultOpts.ChunkSize
+	}
+	if opts.TickInterval <= 0 {
+		opts.TickInterval = DefaultOpts.TickInterval
+	}
 	logger = logger.Named("store")
-	logger = logger.With(zap.String("store-root", root))
+	logger = logger.With("store-root", root)
 	s := &Store{
 		logger: logger,
 		root:   root,
+		opts:   opts,
+
+		compactedFiles: make(map[uint32]struct{}),
+		snapFiles:      make(map[uint32]struct{}),
+		streams:        make(map[int64]int),
+		quarantined:    make(map[int64]struct{}),
+		written:        make(map[int64]struct{}),
 
 		writeBlobCh: make(chan *Request, maxWriteBlobSize),
 		wait:        wait.New(),
@@ -62,12 +108,18 @@ func NewStore(logger logutil.Logger, root string) *Store {
 	}
 
 	// meta store
-	s.ms = NewMemoryMetaStore(logger)
+	switch opts.MetaStore {
+	case MetaStoreMemory:
+		s.ms = NewMemoryMetaStore(logger)
+	default:
+		s.ms = NewBoltMetaStore(logger, path.Join(root, metaStoreFile))
+	}
 	// blob store
-	s.bs = NewBlobStore(logger, s.blobStorePath())
+	s.bs = NewBlobStore(logger, s.blobStorePath(), opts)
 	// replica group
-	s.rg = NewReplicaGroup(logger, s)
+	s.rg = NewReplicaGroup(logger, s, opts)
 	// snapshot store
+	s.ss = NewFileSnapStore(logger, path.Join(root, snapStoreDir))
 
 	return s
 }
@@ -79,7 +131,6 @@ func (s *Store) blobStorePath() string {
 func (s *Store) Load() error {
 	s.logger.Info("store loading start.")
 
-	// FIXME:
 	if err := s.bs.Load(); err != nil {
 		s.logger.Errorf("store loading blob store failed. %v", err)
 		return err
@@ -90,7 +141,32 @@ func (s *Store) Load() error {
 		return err
 	}
 
+	snaps, err := s.ss.Load()
+	if err != nil {
+		s.logger.Errorf("store loading snap store failed. %v", err)
+		return err
+	}
+	var snap *Snapshot
+	if len(snaps) > 0 {
+		snap = &snaps[len(snaps)-1]
+	}
+	if err := s.recover(snap); err != nil {
+		s.logger.Errorf("store recover failed. %v", err)
+		return err
+	}
+
 	s.goAttach(s.run)
+	if s.opts.CompactInterval > 0 {
+		s.goAttach(s.compactor)
+	}
+	if s.opts.ScrubInterval > 0 {
+		s.goAttach(s.scrubber)
+	}
+
+	if err := s.rg.Start(snap); err != nil {
+		s.logger.Errorf("store starting replica group failed. %v", err)
+		return err
+	}
 
 	s.logger.Info("store loading stopped.")
 	return nil
@@ -101,15 +177,22 @@ func (s *Store) Close() {
 
 	s.storeLock.Lock()
 	defer s.storeLock.Unlock()
+	s.rg.Stop()
 	close(s.stopCh)
-
-	// meta engine
-	// blob engine
-	// snapshot engine
+	if err := s.ss.Close(); err != nil {
+		s.logger.Errorf("store close snap store failed. %v", err)
+	}
 
 	// wait all gorotines done.
 	s.attachedWG.Wait()
 
+	if err := s.ms.Close(); err != nil {
+		s.logger.Errorf("store close meta store failed. %v", err)
+	}
+	s.blobWriteLock.Lock()
+	s.bs.Close()
+	s.blobWriteLock.Unlock()
+
 	s.logger.Info("store stopped.")
 }
 
@@ -179,7 +262,19 @@ func (s *Store) writeEntries(reqs []*Request) error {
 		req.BlobId = s.nextBlobId()
 	}
 	// merge writes
-	if err := s.bs.Write(reqs); err != nil {
+	// the blobs are durable before their metas committed
+	s.blobWriteLock.Lock()
+	err := s.bs.Write(reqs)
+	if err == nil {
+		err = s.bs.SyncBlockFiles()
+	}
+	if err == nil {
+		for _, req := range reqs {
+			s.written[req.BlobId] = struct{}{}
+		}
+	}
+	s.blobWriteLock.Unlock()
+	if err != nil {
 		// all failed
 		for _, req := range reqs {
 			s.wait.Trigger(req.reqId, err)
@@ -191,7 +286,9 @@ func (s *Store) writeEntries(reqs []*Request) error {
 	for _, req := range reqs {
 		msg := convertPutBlobMessage(req)
 		if err := s.rg.Propose(context.TODO(), msg); err != nil {
-			s.wait.Trigger(req.reqId, nil)
+			s.logger.Errorf("store propose blob %d failed. %v", req.BlobId, err)
+			s.blobWritten(req.BlobId)
+			s.wait.Trigger(req.reqId, err)
 		}
 	}
 	return nil
@@ -202,10 +299,35 @@ type BlobMeta struct {
 	Meta   []byte      `json:"meta"`
 	Crc    []byte      `json:"crc"`
 	Ptr    BlobPointer `json:"ptr"`
+	// the blob is the manifest of the chunks, see PutStream
+	Manifest bool    `json:"manifest,omitempty"`
+	Chunks   []int64 `json:"chunks,omitempty"`
+	// the blob is a chunk, read and deleted only with the manifest
+	Chunk bool `json:"chunk,omitempty"`
+	// the chunk never fetched when committed, quarantined until repaired
+	// or collected, see commitMissingChunk.
+	Missing bool `json:"missing,omitempty"`
+}
+
+// putBlobMeta returns the meta of the blob put, the chunks of a manifest
+// recorded in it.
+func putBlobMeta(pb *storepb.PutBlob, ptr BlobPointer) (BlobMeta, error) {
+	bm := BlobMeta{BlobId: pb.BlobId, Meta: pb.Meta, Crc: pb.Crc, Ptr: ptr, Manifest: pb.Manifest, Chunk: pb.Chunk}
+	if pb.Manifest {
+		m, err := decodeManifest(pb.Blob)
+		if err != nil {
+			return bm, errors.Wrapf(err, "manifest %d", pb.BlobId)
+		}
+		bm.Chunks = m.Chunks
+	}
+	return bm, nil
 }
 
-func (s *Store) commitPut(reqId int64, blobId int64, meta, crc []byte, ptr BlobPointer) {
-	s.logger.Debugf("store commit blob %d ptr: %s", blobId, ptr)
+// commitPut returns the error of the meta store only, the replica group
+// fails by it.
+func (s *Store) commitPut(reqId int64, bm BlobMeta) error {
+	blobId := bm.BlobId
+	s.logger.Debugf("store commit blob %d ptr: %s", blobId, bm.Ptr)
 
 	// FIXME: id compared. In case staled blob committed
 	s.committedLock.Lock()
@@ -214,51 +336,76 @@ func (s *Store) commitPut(reqId int64, blobId int64, meta, crc []byte, ptr BlobP
 		s.committedLock.Unlock()
 		s.logger.Errorf("store commit blob %d staled. current max blob id %d", blobId, committed)
 		s.wait.Trigger(uint64(reqId), ErrStaleBlob)
-		return
+		return nil
 	}
 	if blobId > committed {
 		s.committed = blobId
 	}
 	s.committedLock.Unlock()
 
-	bm := BlobMeta{BlobId: blobId, Meta: meta, Crc: crc, Ptr: ptr}
 	blobMeta, _ := json.Marshal(&bm)
 
 	if err := s.ms.Put(blobId, blobMeta); err != nil {
-		s.logger.Errorf("store blob id %d meta %s failed. %v", blobId, meta, err)
+		s.logger.Errorf("store blob id %d meta %s failed. %v", blobId, bm.Meta, err)
 		s.wait.Trigger(uint64(reqId), err)
-		return
+		return err
 	}
 	s.wait.Trigger(uint64(reqId), nil)
-	return
+	return nil
 }
 
-func (s *Store) commitDelete(reqId int64, blobId int64) {
+// commitDelete deletes the chunks of a manifest with it, the chunks are
+// deleted alone only by the store itself.
+func (s *Store) commitDelete(reqId int64, blobId int64, chunk bool) error {
 	s.logger.Debugf("store commit delete blob %d", blobId)
 
+	var bm BlobMeta
+	if meta, err := s.ms.Get(blobId); err == nil {
+		json.Unmarshal(meta, &bm)
+	}
+	if bm.Chunk && !chunk {
+		s.wait.Trigger(uint64(reqId), ErrInternalBlob)
+		return nil
+	}
+	for _, chunk := range bm.Chunks {
+		if err := s.ms.Delete(chunk); err != nil {
+			s.logger.Errorf("store delete chunk %d of blob %d failed. %v", chunk, blobId, err)
+			s.wait.Trigger(uint64(reqId), err)
+			return err
+		}
+	}
 	if err := s.ms.Delete(blobId); err != nil {
 		s.logger.Errorf("store blob %d meta delete failed. %v", blobId, err)
 		s.wait.Trigger(uint64(reqId), err)
-		return
+		return err
 	}
 	s.wait.Trigger(uint64(reqId), nil)
-	return
+	return nil
 }
 
-func convertPutBlobMessage(req *Request) *dsproto.ReplicaMessage {
-	return &dsproto.ReplicaMessage{
-		Type: dsproto.ReplicaMessage_PUT,
-		Msg: &dsproto.ReplicaMessage_Put{
-			Put: &dsproto.PutBlob{
+// convertPutBlobMessage leaves the chunks out, the other replicas fetch
+// them by the pointer, see ChunkFetcher.
+func convertPutBlobMessage(req *Request) *storepb.ReplicaMessage {
+	blob := req.Blob
+	if req.chunk {
+		blob = nil
+	}
+	return &storepb.ReplicaMessage{
+		Type: storepb.ReplicaMessage_PUT,
+		Msg: &storepb.ReplicaMessage_Put{
+			Put: &storepb.PutBlob{
 				ReqId:  int64(req.reqId),
 				BlobId: req.BlobId,
+				Blob:   blob,
 				Meta:   req.Meta,
 				Crc:    req.Crc,
-				Ptr: &dsproto.BlobPointer{
+				Ptr: &storepb.BlobPointer{
 					BlockId: int32(req.Ptr.FileId),
 					Len:     int32(req.Ptr.Length),
 					Offset:  req.Ptr.Offset,
 				},
+				Manifest: req.manifest,
+				Chunk:    req.chunk,
 			},
 		},
 	}
@@ -272,25 +419,34 @@ type Request struct {
 	Ptr    BlobPointer
 
 	// internal done
-	reqId uint64
-	ErrCh <-chan interface{}
+	reqId    uint64
+	manifest bool
+	chunk    bool
+	ErrCh    <-chan interface{}
 }
 
 var (
 	_reqId uint64
 )
 
-func (s *Store) Put(logger logutil.Logger, blob, meta, crc []byte) (req *Request, err error) {
+// Put writes the blob, crc is the Castagnoli crc32 of it in big endian,
+// verified here and by every read, empty if none.
+func (s *Store) Put(logger Logger, blob, meta, crc []byte) (req *Request, err error) {
 	logger.Debugf("store put blob start.")
 
-	reqId := atomic.AddUint64(&_reqId, 1)
-	req = &Request{
-		Blob:  blob,
-		Meta:  meta,
-		Crc:   crc,
-		reqId: reqId,
-		ErrCh: s.wait.Register(reqId),
+	return s.put(&Request{Blob: blob, Meta: meta, Crc: crc})
+}
+
+func (s *Store) put(req *Request) (*Request, error) {
+	if !s.IsLeader() {
+		return nil, ErrNotLeader
+	}
+	// corrupted before it reaches us
+	if err := verifyBlob(req.Blob, req.Crc); err != nil {
+		return nil, err
 	}
+	req.reqId = atomic.AddUint64(&_reqId, 1)
+	req.ErrCh = s.wait.Register(req.reqId)
 
 	select {
 	case s.writeBlobCh <- req:
@@ -300,24 +456,34 @@ func (s *Store) Put(logger logutil.Logger, blob, meta, crc []byte) (req *Request
 	return req, nil
 }
 
-// replica call back
-func (s *Store) Commit(ctx context.Context, msg *dsproto.ReplicaMessage) error {
+// replica call back, the replica group stops applying once it failed.
+func (s *Store) Commit(ctx context.Context, msg *storepb.ReplicaMessage) error {
 	s.logger.Debugf("store commit message type %s msg: %s", msg.Type, msg.String())
 
 	switch msg.GetType() {
-	case dsproto.ReplicaMessage_PUT:
+	case storepb.ReplicaMessage_PUT:
 		pb := msg.GetPut()
 		if pb == nil {
 			return nil
 		}
+		if pb.Ptr == nil {
+			return s.commitReplicatedPut(pb)
+		}
 		ptr := BlobPointer{FileId: uint32(pb.Ptr.BlockId), Length: uint32(pb.Ptr.Len), Offset: pb.Ptr.Offset}
-		s.commitPut(pb.ReqId, pb.BlobId, pb.Meta, pb.Crc, ptr)
-	case dsproto.ReplicaMessage_DELETE:
+		bm, err := putBlobMeta(pb, ptr)
+		if err != nil {
+			// checked by PutStream before proposing
+			s.logger.Errorf("store commit blob %d failed. %v", pb.BlobId, err)
+			s.wait.Trigger(uint64(pb.ReqId), err)
+			return nil
+		}
+		return s.commitPut(pb.ReqId, bm)
+	case storepb.ReplicaMessage_DELETE:
 		db := msg.GetDel()
 		if db == nil {
 			return nil
 		}
-		s.commitDelete(db.ReqId, db.BlobId)
+		return s.commitDelete(db.ReqId, db.BlobId, db.Chunk)
 	default:
 		s.logger.Errorf("store commit receive unknow message type %s", msg.GetType())
 	}
@@ -325,35 +491,315 @@ func (s *Store) Commit(ctx context.Context, msg *dsproto.ReplicaMessage) error {
 	return nil
 }
 
-// NOTICE: If replica group implemented by Raft, so
-// when this replica became leader and commited all pending
-// requests, there is a callback below.
+// blobWritten tells whether the blob written by us is still where it's
+// proposed. It's forgotten once asked, the blob is committed by then.
+func (s *Store) blobWritten(blobId int64) bool {
+	s.blobWriteLock.Lock()
+	defer s.blobWriteLock.Unlock()
+	_, found := s.written[blobId]
+	delete(s.written, blobId)
+	// the ones proposed before restarting never reset if none since
+	return found || s.resets == 0
+}
+
+// commitMissingChunk commits the chunk failed to fetch from the proposer
+// without its bytes, so the replica group goes on. It's repaired from the
+// peers later, or deleted by collectChunks if no manifest references it.
+func (s *Store) commitMissingChunk(pb *storepb.PutBlob) error {
+	bm, _ := putBlobMeta(pb, BlobPointer{})
+	bm.Missing = true
+	if err := s.commitPut(pb.ReqId, bm); err != nil {
+		return err
+	}
+	s.quarantine(bm.BlobId)
+	return nil
+}
+
+// commitReplicatedPut writes the blob proposed by another replica into
+// our blob store, then commits it as ours.
+func (s *Store) commitReplicatedPut(pb *storepb.PutBlob) error {
+	s.committedLock.Lock()
+	committed := s.committed
+	s.committedLock.Unlock()
+	if pb.BlobId < committed {
+		s.logger.Errorf("store replicated blob %d staled. current max blob id %d", pb.BlobId, committed)
+		return nil
+	}
+
+	req := &Request{BlobId: pb.BlobId, Blob: pb.Blob, Meta: pb.Meta, Crc: pb.Crc}
+	s.blobWriteLock.Lock()
+	err := s.bs.Write([]*Request{req})
+	if err == nil {
+		err = s.bs.SyncBlockFiles()
+	}
+	s.blobWriteLock.Unlock()
+	if err != nil {
+		// the replica group fails, committed again once restarted
+		s.logger.Errorf("store write replicated blob %d failed. %v", pb.BlobId, err)
+		return err
+	}
+	bm, err := putBlobMeta(pb, req.Ptr)
+	if err != nil {
+		s.logger.Errorf("store commit replicated blob %d failed. %v", pb.BlobId, err)
+		return nil
+	}
+	return s.commitPut(pb.ReqId, bm)
+}
+
+// snapshot captures the state of store committed at the raft index, it's
+// called by the replica group between committing.
+func (s *Store) snapshot(index, term uint64, voters []uint64) (*Snapshot, error) {
+	// the block files compacted are not removed before recorded
+	s.snapFilesLock.Lock()
+	defer s.snapFilesLock.Unlock()
+	metas, err := s.ms.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[uint32]struct{})
+	for blobId, meta := range metas {
+		var bm BlobMeta
+		if err := json.Unmarshal(meta, &bm); err != nil {
+			return nil, errors.Wrapf(err, "Unable to unmarshal meta of blob %d", blobId)
+		}
+		if s.isQuarantined(blobId) {
+			// its block file may be gone, fetched by the peers from others
+			continue
+		}
+		files[bm.Ptr.FileId] = struct{}{}
+	}
+	snap := &Snapshot{
+		Index:     index,
+		Term:      term,
+		Voters:    voters,
+		MaxBlobId: atomic.LoadInt64(&s.maxBlobId),
+		Metas:     metas,
+	}
+	for fid := range files {
+		snap.BlockFiles = append(snap.BlockFiles, fid)
+	}
+	sort.Slice(snap.BlockFiles, func(i, j int) bool { return snap.BlockFiles[i] < snap.BlockFiles[j] })
+	s.setSnapFiles(snap.BlockFiles)
+	s.committedLock.Lock()
+	snap.Committed = s.committed
+	s.committedLock.Unlock()
+	return snap, nil
+}
+
+// recover brings back the committed and the max blob id from the meta
+// store, or the snapshot if the meta store is behind it, the memory one
+// or a fresh one. The blob metas not pointing into a block file, the
+// blobs lost by crashing, are quarantined for repairing.
+func (s *Store) recover(snap *Snapshot) error {
+	committed, err := s.ms.Committed()
+	if err != nil {
+		return errors.Wrap(err, "Unable to read committed of meta store")
+	}
+	if snap != nil {
+		s.snapFilesLock.Lock()
+		s.setSnapFiles(snap.BlockFiles)
+		s.snapFilesLock.Unlock()
+	}
+	if snap != nil && snap.Committed > committed {
+		s.logger.Infof("store restore snapshot term %d index %d committed %d", snap.Term, snap.Index, snap.Committed)
+		if err := s.restoreSnapshot(snap); err != nil {
+			return errors.Wrapf(err, "Unable to restore snapshot %d", snap.Index)
+		}
+		committed = snap.Committed
+	} else {
+		s.committedLock.Lock()
+		s.committed = committed
+		s.committedLock.Unlock()
+		atomic.StoreInt64(&s.maxBlobId, committed)
+	}
+	s.logger.Infof("store recover committed %d", committed)
+
+	metas, err := s.ms.Snapshot()
+	if err != nil {
+		return err
+	}
+	var dangling int
+	for blobId, meta := range metas {
+		var bm BlobMeta
+		if err := json.Unmarshal(meta, &bm); err != nil {
+			return errors.Wrapf(err, "Unable to unmarshal meta of blob %d", blobId)
+		}
+		if bm.Missing {
+			s.quarantine(blobId)
+			dangling++
+			continue
+		}
+		if err := s.bs.Verify(bm.Ptr); err != nil {
+			s.logger.Errorf("store blob %d ptr %s invalid. %v", blobId, bm.Ptr, err)
+			s.quarantine(blobId)
+			dangling++
+		}
+	}
+	if dangling > 0 {
+		s.logger.Errorf("store quarantine %d of %d blobs dangling", dangling, len(metas))
+	}
+	return nil
+}
+
+func (s *Store) restoreSnapshot(snap *Snapshot) error {
+	if err := s.ms.Restore(snap.Metas, snap.Committed); err != nil {
+		return err
+	}
+	s.committedLock.Lock()
+	s.committed = snap.Committed
+	s.committedLock.Unlock()
+	atomic.StoreInt64(&s.maxBlobId, snap.MaxBlobId)
+	return nil
+}
+
+// installSnapshot replaces the state of store by the snapshot of another
+// replica. The block files referenced are staged on disk first, so nothing
+// is changed if any one unavailable, then put in place before the metas.
+func (s *Store) installSnapshot(snap *Snapshot, fetch func(fid uint32) (io.ReadCloser, error)) error {
+	s.logger.Infof("store install snapshot term %d index %d with %d block files", snap.Term, snap.Index, len(snap.BlockFiles))
+
+	for _, fid := range snap.BlockFiles {
+		if err := s.stageBlockFile(fid, fetch); err != nil {
+			if err := s.bs.DiscardStagedBlockFiles(); err != nil {
+				s.logger.Errorf("store discard staged block files failed. %v", err)
+			}
+			return err
+		}
+	}
+
+	s.compactLock.Lock()
+	defer s.compactLock.Unlock()
+	s.blobWriteLock.Lock()
+	defer s.blobWriteLock.Unlock()
+	s.removeLock.Lock()
+	defer s.removeLock.Unlock()
+	// the ones written by us are written again once committed
+	s.written = make(map[int64]struct{})
+	s.resets++
+	if err := s.bs.ResetBlockFiles(snap.BlockFiles); err != nil {
+		return err
+	}
+	// the ones compacted are gone with the others
+	s.compactedFiles = make(map[uint32]struct{})
+	if err := s.restoreSnapshot(snap); err != nil {
+		return err
+	}
+	s.snapFilesLock.Lock()
+	s.setSnapFiles(snap.BlockFiles)
+	s.snapFilesLock.Unlock()
+	return s.ss.SaveSnapshot(*snap)
+}
+
+func (s *Store) stageBlockFile(fid uint32, fetch func(fid uint32) (io.ReadCloser, error)) error {
+	r, err := fetch(fid)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to fetch block file %d", fid)
+	}
+	defer r.Close()
+	return s.bs.StageBlockFile(fid, r)
+}
+
+// ReadBlob serves the replicas repairing the blob, it's returned as
+// stored, the manifest for the ones put by PutStream.
+func (s *Store) ReadBlob(blobId int64) ([]byte, error) {
+	_, blob, err := s.readBlob(blobId)
+	return blob, err
+}
+
+// ReadChunk serves the replicas fetching the chunk proposed by us, which
+// may not be committed yet.
+func (s *Store) ReadChunk(ptr BlobPointer) ([]byte, error) {
+	s.removeLock.RLock()
+	defer s.removeLock.RUnlock()
+	return s.bs.Read(ptr)
+}
+
+// OpenBlockFile serves the replicas fetching block files of a snapshot,
+// the block file is streamed and closed once sent.
+func (s *Store) OpenBlockFile(fid uint32) (io.ReadCloser, error) {
+	return s.bs.OpenBlockFile(fid)
+}
+
+// Process steps the raft message sent by other replicas.
+func (s *Store) Process(ctx context.Context, m raftpb.Message) error {
+	return s.rg.Process(ctx, m)
+}
+
+// ReplicaGroupReady is called by the replica group when this replica
+// became leader and commited all pending requests.
 func (s *Store) ReplicaGroupReady() {
 	s.logger.Info("store replica group ready")
 	s.committedLock.Lock()
 	defer s.committedLock.Unlock()
 	atomic.StoreInt64(&s.maxBlobId, s.committed)
+	atomic.StoreInt32(&s.leading, 1)
+}
+
+// ReplicaGroupStepDown is called by the replica group when this replica
+// lost the leadership, the writes are refused from now on.
+func (s *Store) ReplicaGroupStepDown() {
+	s.logger.Info("store replica group step down")
+	atomic.StoreInt32(&s.leading, 0)
+	// the proposals dropped are never asked
+	s.blobWriteLock.Lock()
+	s.written = make(map[int64]struct{})
+	s.blobWriteLock.Unlock()
+}
+
+// IsLeader tells whether this replica accepts the writes.
+func (s *Store) IsLeader() bool {
+	return atomic.LoadInt32(&s.leading) == 1
 }
 
-func (s *Store) Get(logger logutil.Logger, blobId int64) (blob []byte, err error) {
+// Get returns the whole blob, the ones put by PutStream are assembled
+// from the chunks, read them by NewReader if large.
+func (s *Store) Get(logger Logger, blobId int64) (blob []byte, err error) {
 	s.logger.Debugf("store get blob %d", blobId)
 
+	ms, blob, err := s.readBlob(blobId)
+	if err != nil {
+		return nil, err
+	}
+	if ms.Chunk {
+		return nil, errors.Wrapf(ErrInternalBlob, "blob %d", blobId)
+	}
+	if !ms.Manifest {
+		return blob, nil
+	}
+	m, err := decodeManifest(blob)
+	if err != nil {
+		return nil, errors.Wrapf(err, "blob %d", blobId)
+	}
+	return s.readChunks(m)
+}
+
+// readBlob returns the blob as it's stored, the manifest for the ones
+// put by PutStream.
+func (s *Store) readBlob(blobId int64) (ms BlobMeta, blob []byte, err error) {
+	// the block file is not removed by compacting before read
+	s.removeLock.RLock()
+	defer s.removeLock.RUnlock()
 	meta, err := s.ms.Get(blobId)
 	if err != nil {
 		s.logger.Errorf("store get blob %d failed. %v", blobId, err)
-		return nil, err
+		return ms, nil, err
 	}
 
-	var ms BlobMeta
 	json.Unmarshal(meta, &ms)
+	if ms.Missing || s.isQuarantined(blobId) {
+		return ms, nil, errors.Wrapf(ErrDanglingBlobMetas, "blob %d quarantined", blobId)
+	}
 
 	blob, err = s.bs.Read(ms.Ptr)
+	if err == nil {
+		err = verifyBlob(blob, ms.Crc)
+	}
 	if err != nil {
 		s.logger.Errorf("Unable to read blob %d ptr %s. %v", blobId, ms.Ptr, err)
-		return nil, err
+		return ms, nil, err
 	}
 
-	return blob, nil
+	return ms, blob, nil
 }
 
 type DeleteRequest struct {
@@ -362,27 +808,45 @@ type DeleteRequest struct {
 	ErrCh <-chan interface{}
 }
 
-func (s *Store) Delete(logger logutil.Logger, blobId int64) (req *DeleteRequest, err error) {
+// Delete deletes the blob, the chunks of it with it if put by PutStream.
+// The chunks can't be deleted alone.
+func (s *Store) Delete(logger Logger, blobId int64) (req *DeleteRequest, err error) {
 	s.logger.Debugf("store delete blob %d", blobId)
 
+	if meta, err := s.ms.Get(blobId); err == nil {
+		var bm BlobMeta
+		if json.Unmarshal(meta, &bm); bm.Chunk {
+			return nil, errors.Wrapf(ErrInternalBlob, "blob %d", blobId)
+		}
+	}
+	return s.delete(blobId, false)
+}
+
+func (s *Store) delete(blobId int64, chunk bool) (req *DeleteRequest, err error) {
+	if !s.IsLeader() {
+		return nil, ErrNotLeader
+	}
 	reqId := atomic.AddUint64(&_reqId, 1)
 
-	msg := &dsproto.ReplicaMessage{
-		Type: dsproto.ReplicaMessage_DELETE,
-		Msg: &dsproto.ReplicaMessage_Del{
-			Del: &dsproto.DeleteBlob{
+	msg := &storepb.ReplicaMessage{
+		Type: storepb.ReplicaMessage_DELETE,
+		Msg: &storepb.ReplicaMessage_Del{
+			Del: &storepb.DeleteBlob{
 				ReqId:  int64(reqId),
 				BlobId: blobId,
+				Chunk:  chunk,
 			},
 		},
 	}
 
-	if s.rg.Propose(context.TODO(), msg); err != nil {
+	// registered before proposing, it may be committed at once
+	req = &DeleteRequest{BlobId: blobId}
+	req.ErrCh = s.wait.Register(reqId)
+	if err = s.rg.Propose(context.TODO(), msg); err != nil {
 		s.logger.Errorf("store delete blob %d propose failed. %v", blobId, err)
+		s.wait.Trigger(reqId, err)
 		return nil, err
 	}
-	req = &DeleteRequest{BlobId: blobId}
-	req.ErrCh = s.wait.Register(reqId)
 
 	return req, nil
 }
@@ -2,19 +2,31 @@ package store
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
-	"git.jd.com/cloud-storage/newds-datanode/pkg/logutil"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
+func testLogger() Logger {
+	return NewZapLogger(zap.NewNop())
+}
+
 func TestStore(t *testing.T) {
-	logger := logutil.NewProduction()
-	ns := NewStore(logger, "./store_root/")
+	os.MkdirAll("./store_root/"+blobStoreDir, 0755)
+	defer os.RemoveAll("./store_root/")
+	logger := testLogger()
+	ns := NewStore(logger, "./store_root/", DefaultOpts)
 	err := ns.Load()
 	if !assert.Nil(t, err) {
 		return
 	}
+	if !assert.True(t, waitLeader(ns)) {
+		return
+	}
 
 	empty := []byte{}
 	reqs := make([]*Request, 0)
@@ -60,3 +72,57 @@ func TestStore(t *testing.T) {
 	}
 
 }
+
+func TestStoreRestartFromMetaStore(t *testing.T) {
+	root := "./test_restart_meta"
+	os.MkdirAll(root+"/"+blobStoreDir, 0755)
+	defer os.RemoveAll(root)
+	logger := testLogger()
+
+	s := NewStore(logger, root, DefaultOpts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	reqs := putBlobs(t, logger, s, 20)
+	// the largest one deleted, its id is not reused
+	last := reqs[len(reqs)-1]
+	dr, err := s.Delete(logger, last.BlobId)
+	if !assert.Nil(t, err) || !assert.Nil(t, <-dr.ErrCh) {
+		return
+	}
+	s.Close()
+
+	// recovered from the meta store without any snapshot
+	assert.Nil(t, os.RemoveAll(root+"/"+snapStoreDir))
+	s = NewStore(logger, root, DefaultOpts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	for _, req := range reqs[:len(reqs)-1] {
+		blob, err := s.Get(logger, req.BlobId)
+		if assert.Nil(t, err) {
+			assert.Equal(t, req.Blob, blob)
+		}
+	}
+	_, err = s.Get(logger, last.BlobId)
+	assert.Equal(t, ErrMetaNotFound, err)
+	more := putBlobs(t, logger, s, 1)
+	if assert.Len(t, more, 1) {
+		assert.True(t, more[0].BlobId > last.BlobId)
+	}
+	s.Close()
+
+	// the block files lost
+	files, _ := filepath.Glob(root + "/" + blobStoreDir + "/" + blockFilePrefix + "*")
+	for _, file := range files {
+		assert.Nil(t, os.Truncate(file, 0))
+	}
+	s = NewStore(logger, root, DefaultOpts)
+	if !assert.Nil(t, s.Load()) {
+		return
+	}
+	defer s.Close()
+	// quarantined, no peers to repair from
+	_, err = s.Get(logger, reqs[0].BlobId)
+	assert.Equal(t, ErrDanglingBlobMetas, errors.Cause(err))
+}
@@ -0,0 +1,8 @@
+// Package storepb holds the messages replicated between the replicas of
+// store, generated from new_store.proto by protoc-gen-gogofaster of
+// github.com/gogo/protobuf v1.3.2: the marshalers and sizers generated, no
+// XXX_ fields. The header of the file generated says protoc-gen-gogo, it's
+// written by the generator shared by all the gogo plugins.
+package storepb
+
+//go:generate protoc --plugin=protoc-gen-gogofaster=$GOPATH/bin/protoc-gen-gogofaster --gogofaster_out=paths=source_relative:. new_store.proto
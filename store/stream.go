@@ -0,0 +1,303 @@
+package store
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrInvalidRange error = errors.New("invalid blob range")
+	ErrInternalBlob error = errors.New("blob is a chunk of a stream")
+)
+
+// the chunks of a stream in flight, at most streamWindow*ChunkSize bytes
+// of the stream buffered.
+const streamWindow int = 4
+
+// manifest is the blob of the chunks a stream put split into, all
+// ChunkSize but the last one. The chunks are blobs internal, read and
+// deleted only with the manifest, and travel outside the raft entries.
+type manifest struct {
+	Size      int64   `json:"size"`
+	ChunkSize int64   `json:"chunk_size"`
+	Chunks    []int64 `json:"chunks"`
+}
+
+func decodeManifest(blob []byte) (*manifest, error) {
+	var m manifest
+	if err := json.Unmarshal(blob, &m); err != nil {
+		return nil, errors.Wrap(ErrBlobCorrupted, err.Error())
+	}
+	if m.ChunkSize <= 0 || m.Size > m.ChunkSize*int64(len(m.Chunks)) {
+		return nil, errors.Wrapf(ErrBlobCorrupted, "manifest of %d bytes in %d chunks of %d", m.Size, len(m.Chunks), m.ChunkSize)
+	}
+	return &m, nil
+}
+
+// PutStream puts the stream as chunks, then the manifest of them with
+// meta, the blob id of the manifest returned once committed. The chunks
+// committed are deleted if failed, or collected later, see collectChunks.
+func (s *Store) PutStream(logger Logger, r io.Reader, meta []byte) (blobId int64, err error) {
+	logger.Debugf("store put stream start.")
+
+	defer s.endStream(s.startStream())
+
+	m := manifest{ChunkSize: s.opts.ChunkSize}
+	var pending []*Request
+	// waits the oldest chunk committed
+	waitChunk := func() error {
+		req := pending[0]
+		pending = pending[1:]
+		if e, ok := (<-req.ErrCh).(error); ok && e != nil {
+			return e
+		}
+		m.Chunks = append(m.Chunks, req.BlobId)
+		return nil
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		for len(pending) > 0 {
+			waitChunk()
+		}
+		for _, chunk := range m.Chunks {
+			if _, err := s.delete(chunk, true); err != nil {
+				logger.Errorf("store delete chunk %d of stream failed. %v", chunk, err)
+			}
+		}
+	}()
+
+	for eof := false; !eof; {
+		buf := make([]byte, m.ChunkSize)
+		n, rerr := io.ReadFull(r, buf)
+		switch rerr {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			eof = true
+		default:
+			return 0, errors.Wrap(rerr, "Unable to read stream")
+		}
+		if n > 0 {
+			chunk := buf[:n]
+			req, err := s.put(&Request{Blob: chunk, Crc: blobCrc(chunk), chunk: true})
+			if err != nil {
+				return 0, err
+			}
+			pending = append(pending, req)
+			m.Size += int64(n)
+		}
+		for len(pending) >= streamWindow || (eof && len(pending) > 0) {
+			if err := waitChunk(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	body, err := json.Marshal(&m)
+	if err != nil {
+		return 0, errors.Wrap(err, "Unable to marshal manifest")
+	}
+	req, err := s.put(&Request{Blob: body, Meta: meta, manifest: true})
+	if err != nil {
+		return 0, err
+	}
+	if e, ok := (<-req.ErrCh).(error); ok && e != nil {
+		return 0, e
+	}
+	logger.Debugf("store put stream blob %d of %d bytes in %d chunks", req.BlobId, m.Size, len(m.Chunks))
+	return req.BlobId, nil
+}
+
+// readChunks assembles the whole blob of the manifest.
+func (s *Store) readChunks(m *manifest) ([]byte, error) {
+	blob := make([]byte, 0, m.Size)
+	for _, chunk := range m.Chunks {
+		_, buf, err := s.readBlob(chunk)
+		if err != nil {
+			return nil, errors.Wrapf(err, "chunk %d", chunk)
+		}
+		blob = append(blob, buf...)
+	}
+	if int64(len(blob)) != m.Size {
+		return nil, errors.Wrapf(ErrBlobCorrupted, "chunks of %d bytes, %d in manifest", len(blob), m.Size)
+	}
+	return blob, nil
+}
+
+// startStream returns the max blob id by now, the chunks of the stream
+// are after it.
+func (s *Store) startStream() int64 {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	start := atomic.LoadInt64(&s.maxBlobId)
+	s.streams[start]++
+	return start
+}
+
+func (s *Store) endStream(start int64) {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+	if s.streams[start]--; s.streams[start] == 0 {
+		delete(s.streams, start)
+	}
+}
+
+// collectChunks deletes the chunks of no manifest, left by the streams
+// failed or the leaders lost before their streams done. It runs on the
+// leader only, which applied all the manifests of the leaders before.
+// The chunks of the streams in flight are after the start of them.
+func (s *Store) collectChunks() (int, error) {
+	if !s.IsLeader() {
+		return 0, nil
+	}
+	s.streamsLock.Lock()
+	threshold := atomic.LoadInt64(&s.maxBlobId)
+	for start := range s.streams {
+		if start < threshold {
+			threshold = start
+		}
+	}
+	s.streamsLock.Unlock()
+
+	metas, err := s.ms.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	var chunks []int64
+	referenced := make(map[int64]struct{})
+	for blobId, meta := range metas {
+		var bm BlobMeta
+		if err := json.Unmarshal(meta, &bm); err != nil {
+			return 0, errors.Wrapf(err, "Unable to unmarshal meta of blob %d", blobId)
+		}
+		if bm.Chunk && blobId <= threshold {
+			chunks = append(chunks, blobId)
+		}
+		for _, chunk := range bm.Chunks {
+			referenced[chunk] = struct{}{}
+		}
+	}
+
+	var collected int
+	for _, chunk := range chunks {
+		if _, ok := referenced[chunk]; ok {
+			continue
+		}
+		req, err := s.delete(chunk, true)
+		if err != nil {
+			return collected, errors.Wrapf(err, "Unable to delete chunk %d", chunk)
+		}
+		if e, ok := (<-req.ErrCh).(error); ok && e != nil {
+			return collected, errors.Wrapf(e, "Unable to delete chunk %d", chunk)
+		}
+		collected++
+	}
+	return collected, nil
+}
+
+// GetRange returns length bytes of the blob from off, less if the blob
+// ends before.
+func (s *Store) GetRange(logger Logger, blobId int64, off, length int64) ([]byte, error) {
+	logger.Debugf("store get blob %d range %d-%d", blobId, off, off+length)
+
+	r, err := s.newBlobReader(blobId)
+	if err != nil {
+		return nil, err
+	}
+	if off < 0 || length < 0 || off > r.size {
+		return nil, errors.Wrapf(ErrInvalidRange, "%d-%d of %d bytes", off, off+length, r.size)
+	}
+	if length > r.size-off {
+		length = r.size - off
+	}
+	r.off = off
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// NewReader reads the blob a chunk at a time, it fails once the blob
+// deleted.
+func (s *Store) NewReader(logger Logger, blobId int64) (io.ReadSeeker, error) {
+	return s.newBlobReader(blobId)
+}
+
+// blobReader keeps the chunk being read in memory, or the whole blob not
+// put by PutStream.
+type blobReader struct {
+	s    *Store
+	m    *manifest
+	size int64
+	off  int64
+
+	chunk int
+	data  []byte
+}
+
+func (s *Store) newBlobReader(blobId int64) (*blobReader, error) {
+	bm, blob, err := s.readBlob(blobId)
+	if err != nil {
+		return nil, err
+	}
+	if bm.Chunk {
+		return nil, errors.Wrapf(ErrInternalBlob, "blob %d", blobId)
+	}
+	r := &blobReader{s: s, chunk: -1}
+	if !bm.Manifest {
+		r.size = int64(len(blob))
+		r.data = blob
+		return r, nil
+	}
+	if r.m, err = decodeManifest(blob); err != nil {
+		return nil, errors.Wrapf(err, "blob %d", blobId)
+	}
+	r.size = r.m.Size
+	return r, nil
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	within := r.off
+	if r.m != nil {
+		chunk := int(r.off / r.m.ChunkSize)
+		if chunk != r.chunk {
+			_, data, err := r.s.readBlob(r.m.Chunks[chunk])
+			if err != nil {
+				return 0, errors.Wrapf(err, "chunk %d", r.m.Chunks[chunk])
+			}
+			r.chunk, r.data = chunk, data
+		}
+		within -= int64(chunk) * r.m.ChunkSize
+	}
+	if within >= int64(len(r.data)) {
+		return 0, errors.Wrapf(ErrBlobCorrupted, "chunk %d short of %d bytes", r.chunk, within)
+	}
+	n := copy(p, r.data[within:])
+	r.off += int64(n)
+	return n, nil
+}
+
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.Wrapf(ErrInvalidRange, "seek to %d", offset)
+	}
+	r.off = offset
+	return offset, nil
+}
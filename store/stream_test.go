@@ -0,0 +1,243 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorePutStream(t *testing.T) {
+	root := "./test_stream"
+	os.MkdirAll(root+"/"+blobStoreDir, 0755)
+	defer os.RemoveAll(root)
+	logger := testLogger()
+	opts := DefaultOpts
+	opts.BlockFileSize = 4 << 10
+	opts.ChunkSize = 1 << 10
+
+	s := NewStore(logger, root, opts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	defer s.Close()
+
+	data := make([]byte, 10<<10+123)
+	rand.Read(data)
+	blobId, err := s.PutStream(logger, bytes.NewReader(data), []byte("video"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	blob, err := s.Get(logger, blobId)
+	if assert.Nil(t, err) {
+		assert.Equal(t, data, blob)
+	}
+
+	for _, r := range [][2]int64{{0, 10}, {1000, 100}, {1020, 2000}, {10 << 10, 1000}, {int64(len(data)), 10}} {
+		blob, err := s.GetRange(logger, blobId, r[0], r[1])
+		if !assert.Nil(t, err, "range %v", r) {
+			continue
+		}
+		end := r[0] + r[1]
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		assert.Equal(t, data[r[0]:end], blob, "range %v", r)
+	}
+	_, err = s.GetRange(logger, blobId, int64(len(data))+1, 1)
+	assert.Equal(t, ErrInvalidRange, errors.Cause(err))
+
+	reader, err := s.NewReader(logger, blobId)
+	if assert.Nil(t, err) {
+		size, err := reader.Seek(0, io.SeekEnd)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(data)), size)
+		reader.Seek(3000, io.SeekStart)
+		blob, err := ioutil.ReadAll(reader)
+		if assert.Nil(t, err) {
+			assert.Equal(t, data[3000:], blob)
+		}
+	}
+
+	// the plain blobs are read the same way
+	reqs := putBlobs(t, logger, s, 1)
+	if assert.Len(t, reqs, 1) {
+		blob, err := s.GetRange(logger, reqs[0].BlobId, 1, 3)
+		if assert.Nil(t, err) {
+			assert.Equal(t, reqs[0].Blob[1:4], blob)
+		}
+	}
+
+	// the chunks are deleted with the manifest
+	_, manifestBlob, err := s.readBlob(blobId)
+	if !assert.Nil(t, err) {
+		return
+	}
+	m, err := decodeManifest(manifestBlob)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Len(t, m.Chunks, 11)
+
+	// the chunks are internal
+	_, err = s.Get(logger, m.Chunks[0])
+	assert.Equal(t, ErrInternalBlob, errors.Cause(err))
+	_, err = s.NewReader(logger, m.Chunks[0])
+	assert.Equal(t, ErrInternalBlob, errors.Cause(err))
+	_, err = s.Delete(logger, m.Chunks[0])
+	assert.Equal(t, ErrInternalBlob, errors.Cause(err))
+
+	dr, err := s.Delete(logger, blobId)
+	if !assert.Nil(t, err) || !assert.Nil(t, <-dr.ErrCh) {
+		return
+	}
+	for _, chunk := range append(m.Chunks, blobId) {
+		_, err := s.ms.Get(chunk)
+		assert.Equal(t, ErrMetaNotFound, err)
+	}
+}
+
+func TestStorePutStreamReplicated(t *testing.T) {
+	logger := testLogger()
+	network := newMemoryNetwork()
+	peers := []uint64{1, 2, 3}
+	opts := DefaultOpts
+	opts.ChunkSize = 1 << 10
+	defer stopReplicas(network)
+	if !startReplicas(t, logger, network, peers, opts) {
+		return
+	}
+	leaderId, leader := network.leader(0)
+	if !assert.NotNil(t, leader) {
+		return
+	}
+
+	data := make([]byte, 5<<10)
+	rand.Read(data)
+	blobId, err := leader.PutStream(logger, bytes.NewReader(data), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	// the chunks travel outside the raft entries
+	raftRg := leader.rg.(*raftReplicaGroup)
+	first, _ := raftRg.storage.FirstIndex()
+	last, _ := raftRg.storage.LastIndex()
+	ents, err := raftRg.storage.Entries(first, last+1, 1<<30)
+	if assert.Nil(t, err) {
+		for _, ent := range ents {
+			assert.True(t, int64(len(ent.Data)) < opts.ChunkSize, "entry %d of %d bytes", ent.Index, len(ent.Data))
+		}
+	}
+	for id, s := range network.stores {
+		if id == leaderId {
+			continue
+		}
+		assert.True(t, eventually(func() bool {
+			blob, err := s.GetRange(logger, blobId, 1000, 2000)
+			return err == nil && bytes.Equal(data[1000:3000], blob)
+		}), "replica %d", id)
+	}
+}
+
+func TestStorePutStreamChunkMissing(t *testing.T) {
+	logger := testLogger()
+	network := newMemoryNetwork()
+	peers := []uint64{1, 2, 3}
+	opts := DefaultOpts
+	opts.ChunkSize = 1 << 10
+	defer stopReplicas(network)
+	if !startReplicas(t, logger, network, peers, opts) {
+		return
+	}
+	leaderId, leader := network.leader(0)
+	if !assert.NotNil(t, leader) {
+		return
+	}
+	followerId := peers[0]
+	if followerId == leaderId {
+		followerId = peers[1]
+	}
+	follower := network.stores[followerId]
+
+	// the follower behind finds the chunks lost when committing them
+	network.isolate(followerId, true)
+	data := make([]byte, 2<<10)
+	rand.Read(data)
+	blobId, err := leader.PutStream(logger, bytes.NewReader(data), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	reqs := putBlobs(t, logger, leader, 1)
+	if !assert.Len(t, reqs, 1) {
+		return
+	}
+	network.lock.Lock()
+	network.lostFetches = true
+	network.lock.Unlock()
+	network.isolate(followerId, false)
+
+	// it goes on with the chunks missing
+	assert.True(t, eventually(func() bool {
+		_, err := follower.Get(logger, reqs[0].BlobId)
+		return err == nil
+	}))
+	_, err = follower.Get(logger, blobId)
+	assert.Equal(t, ErrDanglingBlobMetas, errors.Cause(err))
+
+	// repaired from the peers once reachable
+	network.lock.Lock()
+	network.lostFetches = false
+	network.lock.Unlock()
+	assert.True(t, eventually(func() bool {
+		blob, err := follower.Get(logger, blobId)
+		return err == nil && bytes.Equal(data, blob)
+	}))
+}
+
+func TestStoreCollectChunks(t *testing.T) {
+	root := "./test_stream_collect"
+	os.MkdirAll(root+"/"+blobStoreDir, 0755)
+	defer os.RemoveAll(root)
+	logger := testLogger()
+	opts := DefaultOpts
+	opts.ChunkSize = 1 << 10
+
+	s := NewStore(logger, root, opts)
+	if !assert.Nil(t, s.Load()) || !assert.True(t, waitLeader(s)) {
+		return
+	}
+	defer s.Close()
+
+	data := make([]byte, 2<<10)
+	rand.Read(data)
+	blobId, err := s.PutStream(logger, bytes.NewReader(data), nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	// a chunk of a stream in flight, left until the stream failed
+	start := s.startStream()
+	chunk := []byte("#orphan#")
+	req, err := s.put(&Request{Blob: chunk, Crc: blobCrc(chunk), chunk: true})
+	if !assert.Nil(t, err) || !assert.Nil(t, <-req.ErrCh) {
+		return
+	}
+	n, err := s.collectChunks()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	s.endStream(start)
+
+	n, err = s.collectChunks()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	_, err = s.ms.Get(req.BlobId)
+	assert.Equal(t, ErrMetaNotFound, err)
+	blob, err := s.Get(logger, blobId)
+	if assert.Nil(t, err) {
+		assert.Equal(t, data, blob)
+	}
+}
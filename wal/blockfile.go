@@ -126,3 +126,19 @@ func (bf *BlockFile) Write(val []byte) (int64, error) {
 	bf.size += int64(len(val))
 	return off, nil
 }
+
+// Truncate drops the data from size, the writing goes on from there.
+func (bf *BlockFile) Truncate(size int64) error {
+	if bf.w == nil {
+		return ErrReadonly
+	}
+
+	bf.Lock()
+	defer bf.Unlock()
+
+	if err := bf.w.Truncate(size); err != nil {
+		return errors.Wrap(err, "unable to truncate file")
+	}
+	bf.size = size
+	return nil
+}
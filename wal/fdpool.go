@@ -1,13 +1,17 @@
 package wal
 
 import (
+	"container/list"
 	"os"
+	"sync"
 
 	"github.com/pkg/errors"
 )
 
 type FDPool interface {
 	Do(p string, fn func(*os.File) error) error
+	// Evict drops the fd of the file removed, the readers using it go on.
+	Evict(p string)
 }
 
 type createFDPool struct {
@@ -24,3 +28,144 @@ func (c *createFDPool) Do(f string, fn func(*os.File) error) error {
 	}
 	return nil
 }
+
+func (c *createFDPool) Evict(f string) {}
+
+// FDCacheStats is the counters of a fd cache since created.
+type FDCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// the fds open, including the ones evicted but still in use
+	Open int
+}
+
+// FDCache keeps at most capacity fds open, the least recently used ones
+// evicted. An fd evicted is closed once the last reader of it done.
+type FDCache struct {
+	lock sync.Mutex
+
+	capacity int
+	// of *cachedFD, the most recently used in the front
+	lru *list.List
+	fds map[string]*list.Element
+
+	stats FDCacheStats
+}
+
+type cachedFD struct {
+	path    string
+	fd      *os.File
+	refs    int
+	evicted bool
+}
+
+func NewFDCache(capacity int) *FDCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &FDCache{
+		capacity: capacity,
+		lru:      list.New(),
+		fds:      make(map[string]*list.Element),
+	}
+}
+
+func (c *FDCache) Do(f string, fn func(*os.File) error) error {
+	cfd, err := c.acquire(f)
+	if err != nil {
+		return err
+	}
+	defer c.release(cfd)
+	return fn(cfd.fd)
+}
+
+func (c *FDCache) acquire(f string) (*cachedFD, error) {
+	c.lock.Lock()
+	if e, found := c.fds[f]; found {
+		cfd := e.Value.(*cachedFD)
+		cfd.refs++
+		c.lru.MoveToFront(e)
+		c.stats.Hits++
+		c.lock.Unlock()
+		return cfd, nil
+	}
+	c.stats.Misses++
+	c.lock.Unlock()
+
+	// not opening under the lock, the hits go on meanwhile
+	fd, err := os.OpenFile(f, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open file")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, found := c.fds[f]; found {
+		// opened by another reader meanwhile
+		fd.Close()
+		cfd := e.Value.(*cachedFD)
+		cfd.refs++
+		c.lru.MoveToFront(e)
+		return cfd, nil
+	}
+	cfd := &cachedFD{path: f, fd: fd, refs: 1}
+	c.fds[f] = c.lru.PushFront(cfd)
+	c.stats.Open++
+	for c.lru.Len() > c.capacity {
+		c.evict(c.lru.Back())
+		c.stats.Evictions++
+	}
+	return cfd, nil
+}
+
+func (c *FDCache) release(cfd *cachedFD) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cfd.refs--
+	if cfd.evicted && cfd.refs == 0 {
+		c.close(cfd)
+	}
+}
+
+// evict drops the fd from the cache, the caller holds the lock.
+func (c *FDCache) evict(e *list.Element) {
+	cfd := e.Value.(*cachedFD)
+	c.lru.Remove(e)
+	delete(c.fds, cfd.path)
+	cfd.evicted = true
+	if cfd.refs == 0 {
+		c.close(cfd)
+	}
+}
+
+func (c *FDCache) close(cfd *cachedFD) {
+	// FIXME: the error of closing a readonly fd is ignored
+	cfd.fd.Close()
+	c.stats.Open--
+}
+
+func (c *FDCache) Evict(f string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, found := c.fds[f]; found {
+		c.evict(e)
+	}
+}
+
+func (c *FDCache) Stats() FDCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// Close evicts all the fds, the ones in use closed once their readers
+// done.
+func (c *FDCache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+	return nil
+}
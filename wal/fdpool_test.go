@@ -0,0 +1,124 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func createFiles(t *testing.T, dir string, n int) []string {
+	var files []string
+	for i := 0; i < n; i++ {
+		f := filepath.Join(dir, fmt.Sprintf("%05d.data", i))
+		ensure(t, assert.Nil(t, ioutil.WriteFile(f, []byte(f), 0640)))
+		files = append(files, f)
+	}
+	return files
+}
+
+func readFile(c *FDCache, f string) ([]byte, error) {
+	buf := make([]byte, len(f))
+	err := c.Do(f, func(fd *os.File) error {
+		_, err := fd.ReadAt(buf, 0)
+		return err
+	})
+	return buf, err
+}
+
+func TestFDCacheLRU(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_fd_cache_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	files := createFiles(t, tmpdir, 4)
+	c := NewFDCache(2)
+	defer c.Close()
+
+	for _, f := range files[:2] {
+		buf, err := readFile(c, f)
+		ensure(t, assert.Nil(t, err))
+		ensure(t, assert.Equal(t, f, string(buf)))
+	}
+	_, err = readFile(c, files[0])
+	ensure(t, assert.Nil(t, err))
+	ensure(t, assert.Equal(t, FDCacheStats{Hits: 1, Misses: 2, Open: 2}, c.Stats()))
+
+	// files[1] is the least recently used
+	_, err = readFile(c, files[2])
+	ensure(t, assert.Nil(t, err))
+	_, err = readFile(c, files[0])
+	ensure(t, assert.Nil(t, err))
+	_, err = readFile(c, files[1])
+	ensure(t, assert.Nil(t, err))
+	ensure(t, assert.Equal(t, FDCacheStats{Hits: 2, Misses: 4, Evictions: 2, Open: 2}, c.Stats()))
+
+	_, err = readFile(c, filepath.Join(tmpdir, "nop"))
+	ensure(t, assert.NotNil(t, err))
+}
+
+func TestFDCacheEvictInUse(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_fd_cache_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	files := createFiles(t, tmpdir, 3)
+	c := NewFDCache(1)
+
+	err = c.Do(files[0], func(fd *os.File) error {
+		// evicted by the others, and removed
+		_, err := readFile(c, files[1])
+		ensure(t, assert.Nil(t, err))
+		c.Evict(files[0])
+		ensure(t, assert.Nil(t, os.Remove(files[0])))
+		ensure(t, assert.Equal(t, 2, c.Stats().Open))
+
+		buf := make([]byte, len(files[0]))
+		_, err = fd.ReadAt(buf, 0)
+		ensure(t, assert.Nil(t, err))
+		ensure(t, assert.Equal(t, files[0], string(buf)))
+		return nil
+	})
+	ensure(t, assert.Nil(t, err))
+	ensure(t, assert.Equal(t, 1, c.Stats().Open))
+
+	_, err = readFile(c, files[0])
+	ensure(t, assert.True(t, os.IsNotExist(errors.Cause(err))))
+
+	ensure(t, assert.Nil(t, c.Close()))
+	ensure(t, assert.Equal(t, 0, c.Stats().Open))
+}
+
+func TestFDCacheConcurrent(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_fd_cache_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	files := createFiles(t, tmpdir, 16)
+	c := NewFDCache(4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				f := files[(i*7+j)%len(files)]
+				buf, err := readFile(c, f)
+				assert.Nil(t, err)
+				assert.Equal(t, f, string(buf))
+			}
+		}(i)
+	}
+	wg.Wait()
+	stats := c.Stats()
+	ensure(t, assert.Equal(t, uint64(8*200), stats.Hits+stats.Misses))
+	ensure(t, assert.Equal(t, 4, stats.Open))
+	ensure(t, assert.Nil(t, c.Close()))
+	ensure(t, assert.Equal(t, 0, c.Stats().Open))
+}
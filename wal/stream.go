@@ -29,7 +29,21 @@ type Encoder struct {
 	w *bufio.Writer
 }
 
+// Encode encodes the value and flushes it to the writer.
 func (e *Encoder) Encode(val []byte) (int, error) {
+	n, err := e.EncodeBuffered(val)
+	if err != nil {
+		return 0, err
+	}
+	if err := e.Flush(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// EncodeBuffered encodes the value without flushing, a batch of them
+// goes to the writer by Flush.
+func (e *Encoder) EncodeBuffered(val []byte) (int, error) {
 	hash := crc32.New(CastagnoliCrcTable)
 	mw := io.MultiWriter(e.w, hash)
 
@@ -50,11 +64,14 @@ func (e *Encoder) Encode(val []byte) (int, error) {
 		return 0, errors.Wrap(err, "failed to write crc32")
 	}
 
+	return len(val) + prefixSize + crc32.Size, nil
+}
+
+func (e *Encoder) Flush() error {
 	if err := e.w.Flush(); err != nil {
-		return 0, errors.Wrap(err, "failed to flush data")
+		return errors.Wrap(err, "failed to flush data")
 	}
-
-	return len(val) + prefixSize + crc32.Size, nil
+	return nil
 }
 
 func NewDecoder(r io.Reader) *Decoder {
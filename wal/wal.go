@@ -1 +1,699 @@
 package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrCorrupted error = errors.New("wal corrupted")
+	ErrCompacted error = errors.New("wal entry compacted")
+	ErrClosed    error = errors.New("wal closed")
+
+	// the record cut off by a crash, only allowed at the tail
+	errTornRecord error = errors.New("torn record")
+)
+
+const (
+	segmentSuffix = ".wal"
+
+	// a record is the value encoded, the seq of it first
+	seqSize = 8
+
+	// the most entries written in a batch
+	maxBatch = 1024
+)
+
+// SyncPolicy is when the entries appended synced to the disk.
+type SyncPolicy int
+
+const (
+	// an Append returns after the batch of it synced
+	SyncAlways SyncPolicy = iota
+	// synced every SyncInterval
+	SyncPeriodic
+	// synced once SyncBytes written since the last sync
+	SyncBatchBytes
+	// synced only by Sync, or rolling the segment
+	SyncNever
+)
+
+type Opts struct {
+	// a new segment rolled once the current one reaches it, the batch
+	// written last may go over it.
+	SegmentSize int64
+	// reads the segments sealed, a FDCache of FDCacheSize fds owned by
+	// the wal if nil
+	FDPool      FDPool
+	FDCacheSize int
+
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+	SyncBytes    int64
+}
+
+var DefaultOpts = Opts{
+	SegmentSize:  64 << 20,
+	FDCacheSize:  256,
+	SyncPolicy:   SyncAlways,
+	SyncInterval: 10 * time.Millisecond,
+	SyncBytes:    1 << 20,
+}
+
+// WAL is a log of the segments, each a block file named by its id and the
+// seq of its first entry. The entries get the seqs increasing one by one,
+// only the last segment written and the others sealed readonly.
+//
+// The appenders are committed in groups, the ones coming while a batch is
+// written and synced are written in the next batch, a write and a sync at
+// most for all of them.
+type WAL struct {
+	lock sync.RWMutex
+
+	dir  string
+	opts Opts
+
+	segments []*segment
+	// the seq of the next entry appended
+	next uint64
+	// the bytes written not synced yet
+	unsynced int64
+	// the segment left unknown on the disk, no more appended once set
+	failed error
+
+	buf *bytes.Buffer
+	enc *Encoder
+	// the fd cache created by the wal, closed with it
+	fdCache *FDCache
+
+	reqCh     chan *appendRequest
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+	committed sync.WaitGroup
+}
+
+type appendRequest struct {
+	val  []byte
+	seq  uint64
+	done chan error
+}
+
+type segment struct {
+	bf    *BlockFile
+	first uint64
+	// the offsets of the entries, from first on
+	offsets []int64
+}
+
+func (seg *segment) last() uint64 {
+	return seg.first + uint64(len(seg.offsets)) - 1
+}
+
+func segmentName(id int32, first uint64) string {
+	return fmt.Sprintf("%08x-%016x%s", id, first, segmentSuffix)
+}
+
+func parseSegmentName(name string) (id int32, first uint64, err error) {
+	_, err = fmt.Sscanf(name, "%08x-%016x"+segmentSuffix, &id, &first)
+	return
+}
+
+// Open opens the wal in dir, creates it if not exist. The entries cut off
+// by a crash at the tail of the last segment are dropped.
+func Open(dir string, opts Opts) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, errors.Wrap(err, "unable to create wal directory")
+	}
+	w := &WAL{
+		dir:    dir,
+		opts:   opts,
+		buf:    &bytes.Buffer{},
+		reqCh:  make(chan *appendRequest),
+		stopCh: make(chan struct{}),
+	}
+	if w.opts.FDPool == nil {
+		w.fdCache = NewFDCache(opts.FDCacheSize)
+		w.opts.FDPool = w.fdCache
+	}
+	w.enc = NewEncoder(w.buf, 64<<10)
+
+	if err := w.load(); err != nil {
+		w.closeSegments()
+		return nil, err
+	}
+
+	w.committed.Add(1)
+	go w.committer()
+	return w, nil
+}
+
+func (w *WAL) load() error {
+	infos, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		return errors.Wrap(err, "unable to read wal directory")
+	}
+	var names []string
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), segmentSuffix) {
+			names = append(names, info.Name())
+		}
+	}
+	// named by the ids in hex of fixed width
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		w.next = 1
+		return w.createSegment(0, 1)
+	}
+
+	for i, name := range names {
+		id, first, err := parseSegmentName(name)
+		if err != nil {
+			return errors.Wrapf(ErrCorrupted, "segment name %s", name)
+		}
+		if i > 0 && first != w.next {
+			return errors.Wrapf(ErrCorrupted, "segment %s not following seq %d", name, w.next-1)
+		}
+		tail := i == len(names)-1
+		bf, err := NewBlockFile(filepath.Join(w.dir, name), id, !tail, w.opts.FDPool)
+		if err != nil {
+			return err
+		}
+		seg := &segment{bf: bf, first: first}
+		w.segments = append(w.segments, seg)
+		if err := w.scanSegment(seg, tail); err != nil {
+			return err
+		}
+		w.next = seg.first + uint64(len(seg.offsets))
+	}
+	return nil
+}
+
+// scanSegment indexes the entries of the segment, the torn ones at the
+// tail of the last segment truncated. A bad record followed by a valid one
+// is corrupted, not torn.
+func (w *WAL) scanSegment(seg *segment, tail bool) error {
+	size := seg.bf.Size()
+	var off int64
+	for off < size {
+		seq, _, n, err := readRecord(seg.bf, off, size)
+		if err == nil && seq != seg.first+uint64(len(seg.offsets)) {
+			return errors.Wrapf(ErrCorrupted, "segment %s at %d seq %d out of order", seg.bf.fn, off, seq)
+		}
+		if err != nil {
+			if !tail || !badRecord(err) {
+				return errors.Wrapf(err, "segment %s at %d", seg.bf.fn, off)
+			}
+			follows, ferr := recordFollows(seg.bf, off, size)
+			if ferr != nil {
+				return ferr
+			}
+			if follows {
+				return errors.Wrapf(ErrCorrupted, "segment %s at %d, %v", seg.bf.fn, off, err)
+			}
+			if err := seg.bf.Truncate(off); err != nil {
+				return err
+			}
+			if err := seg.bf.Sync(); err != nil {
+				return errors.Wrap(err, "unable to sync segment")
+			}
+			return nil
+		}
+		seg.offsets = append(seg.offsets, off)
+		off += n
+	}
+	return nil
+}
+
+func badRecord(err error) bool {
+	switch errors.Cause(err) {
+	case errTornRecord, ErrCorrupted, ErrCrcMismatch:
+		return true
+	}
+	return false
+}
+
+// recordFollows reports whether a valid record is found after the bad one
+// at off, there is none after a torn one.
+func recordFollows(bf *BlockFile, off, size int64) (bool, error) {
+	rest, err := bf.ReadAt(off, int(size-off))
+	if err != nil {
+		return false, errors.Wrap(err, "unable to read segment tail")
+	}
+	for p := 1; p+prefixSize+seqSize+crc32.Size <= len(rest); p++ {
+		l := binary.BigEndian.Uint64(rest[p:])
+		if l < seqSize || l > uint64(len(rest)-p-prefixSize-crc32.Size) {
+			continue
+		}
+		end := p + prefixSize + int(l)
+		if crc32.Checksum(rest[p:end], CastagnoliCrcTable) == binary.BigEndian.Uint32(rest[end:]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readRecord reads the record at off of the block file of size bytes,
+// returns the entry with the bytes of the record.
+func readRecord(bf *BlockFile, off, size int64) (seq uint64, val []byte, n int64, err error) {
+	if size-off < prefixSize+crc32.Size {
+		return 0, nil, 0, errTornRecord
+	}
+	prefix, err := bf.ReadAt(off, prefixSize)
+	if err != nil {
+		return 0, nil, 0, errors.Wrap(err, "unable to read record prefix")
+	}
+	// not trusted before the crc checked
+	l := binary.BigEndian.Uint64(prefix)
+	if l > uint64(size-off-prefixSize-crc32.Size) {
+		return 0, nil, 0, errTornRecord
+	}
+	if l < seqSize {
+		return 0, nil, 0, errors.Wrapf(ErrCorrupted, "record of %d bytes", l)
+	}
+	n = prefixSize + int64(l) + crc32.Size
+	record, err := bf.ReadAt(off, int(n))
+	if err != nil {
+		return 0, nil, 0, errors.Wrap(err, "unable to read record")
+	}
+	payload, err := NewDecoder(bytes.NewReader(record)).Decode()
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	return binary.BigEndian.Uint64(payload), payload[seqSize:], n, nil
+}
+
+func (w *WAL) createSegment(id int32, first uint64) error {
+	bf, err := NewBlockFile(filepath.Join(w.dir, segmentName(id, first)), id, false, w.opts.FDPool)
+	if err != nil {
+		return err
+	}
+	// or the entries synced into it lost with it by a crash
+	if err := syncDir(w.dir); err != nil {
+		bf.Close()
+		return err
+	}
+	w.segments = append(w.segments, &segment{bf: bf, first: first})
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "unable to open wal directory")
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, "unable to sync wal directory")
+	}
+	return nil
+}
+
+func (w *WAL) tail() *segment {
+	return w.segments[len(w.segments)-1]
+}
+
+// roll seals the last segment and creates a new one after it.
+func (w *WAL) roll() error {
+	seg := w.tail()
+	// synced by the close
+	if err := seg.bf.Close(); err != nil {
+		w.failed = errors.Wrap(err, "unable to close segment")
+		return w.failed
+	}
+	w.unsynced = 0
+	bf, err := NewBlockFile(seg.bf.fn, seg.bf.id, true, w.opts.FDPool)
+	if err != nil {
+		// the segment closed is the last one still
+		w.failed = errors.Wrap(err, "unable to reopen segment sealed")
+		return w.failed
+	}
+	seg.bf = bf
+	return w.createSegment(seg.bf.id+1, w.next)
+}
+
+// Append appends the entry, returns the seq of it once written, and
+// synced if SyncAlways.
+func (w *WAL) Append(val []byte) (uint64, error) {
+	req := &appendRequest{val: val, done: make(chan error, 1)}
+	select {
+	case w.reqCh <- req:
+	case <-w.stopCh:
+		return 0, ErrClosed
+	}
+	if err := <-req.done; err != nil {
+		return 0, err
+	}
+	return req.seq, nil
+}
+
+func (w *WAL) committer() {
+	defer w.committed.Done()
+
+	var tickC <-chan time.Time
+	if w.opts.SyncPolicy == SyncPeriodic {
+		ticker := time.NewTicker(w.opts.SyncInterval)
+		defer ticker.Stop()
+		tickC = ticker.C
+	}
+
+	reqs := make([]*appendRequest, 0, maxBatch)
+	for {
+		select {
+		case req := <-w.reqCh:
+			reqs = append(reqs[:0], req)
+			// the ones waiting meanwhile
+		gather:
+			for len(reqs) < maxBatch {
+				select {
+				case req := <-w.reqCh:
+					reqs = append(reqs, req)
+				default:
+					break gather
+				}
+			}
+			err := w.commit(reqs)
+			for _, req := range reqs {
+				req.done <- err
+			}
+		case <-tickC:
+			// the wal failed by the error, the next Append or Sync gets it
+			w.Sync()
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+// commit writes the batch into the last segment in one write.
+func (w *WAL) commit(reqs []*appendRequest) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.segments == nil {
+		return ErrClosed
+	}
+	if w.failed != nil {
+		return w.failed
+	}
+	if w.tail().bf.Size() >= w.opts.SegmentSize {
+		if err := w.roll(); err != nil {
+			return err
+		}
+	}
+
+	seg := w.tail()
+	base := seg.bf.Size()
+	offsets := make([]int64, len(reqs))
+	var n int64
+	w.buf.Reset()
+	for i, req := range reqs {
+		req.seq = w.next + uint64(i)
+		payload := make([]byte, seqSize+len(req.val))
+		binary.BigEndian.PutUint64(payload, req.seq)
+		copy(payload[seqSize:], req.val)
+		m, err := w.enc.EncodeBuffered(payload)
+		if err != nil {
+			return err
+		}
+		offsets[i] = base + n
+		n += int64(m)
+	}
+	if err := w.enc.Flush(); err != nil {
+		return err
+	}
+	if _, err := seg.bf.Write(w.buf.Bytes()); err != nil {
+		// the part written dropped, or the batches after it written behind
+		// the garbage
+		if terr := seg.bf.Truncate(base); terr != nil {
+			w.failed = errors.Wrapf(terr, "unable to drop the entries written partly, %v", err)
+			return w.failed
+		}
+		return errors.Wrap(err, "unable to write entries")
+	}
+	w.unsynced += n
+	if w.syncDue() {
+		if err := w.sync(); err != nil {
+			// not seen by the readers as the appenders failed, dropped if
+			// the file still writable
+			seg.bf.Truncate(base)
+			return err
+		}
+	}
+	seg.offsets = append(seg.offsets, offsets...)
+	w.next += uint64(len(reqs))
+	return nil
+}
+
+func (w *WAL) syncDue() bool {
+	switch w.opts.SyncPolicy {
+	case SyncAlways:
+		return true
+	case SyncBatchBytes:
+		return w.unsynced >= w.opts.SyncBytes
+	default:
+		return false
+	}
+}
+
+// sync syncs the last segment, the caller holds the lock. The wal failed
+// by a failed sync, the pages not written may be dropped and a later sync
+// succeeding tells nothing of them.
+func (w *WAL) sync() error {
+	if w.failed != nil {
+		return w.failed
+	}
+	if w.unsynced == 0 {
+		return nil
+	}
+	if err := w.tail().bf.Sync(); err != nil {
+		w.failed = errors.Wrap(err, "unable to sync segment")
+		return w.failed
+	}
+	w.unsynced = 0
+	return nil
+}
+
+// Sync syncs the entries appended to the disk.
+func (w *WAL) Sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.segments == nil {
+		return ErrClosed
+	}
+	return w.sync()
+}
+
+// FirstSeq returns the seq of the first entry kept.
+func (w *WAL) FirstSeq() uint64 {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.segments == nil {
+		return 0
+	}
+	return w.segments[0].first
+}
+
+// LastSeq returns the seq of the last entry, FirstSeq()-1 if empty.
+func (w *WAL) LastSeq() uint64 {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.next - 1
+}
+
+// find returns the index of the segment the seq in, the caller makes sure
+// the seq not before the first segment.
+func (w *WAL) find(seq uint64) int {
+	return sort.Search(len(w.segments), func(i int) bool { return w.segments[i].first > seq }) - 1
+}
+
+// TruncateBefore removes the segments of the entries all before seq, the
+// ones in the same segment as seq are kept.
+func (w *WAL) TruncateBefore(seq uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.segments == nil {
+		return ErrClosed
+	}
+	var removed int
+	// the last segment is kept for the appending
+	for removed < len(w.segments)-1 && w.segments[removed+1].first <= seq {
+		if err := w.removeSegment(w.segments[removed]); err != nil {
+			w.segments = w.segments[removed:]
+			return err
+		}
+		removed++
+	}
+	w.segments = w.segments[removed:]
+	return nil
+}
+
+// TruncateAfter drops the entries after seq, the next one appended gets
+// seq+1.
+func (w *WAL) TruncateAfter(seq uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.segments == nil {
+		return ErrClosed
+	}
+	if w.failed != nil {
+		return w.failed
+	}
+	if seq >= w.next-1 {
+		return nil
+	}
+	if seq+1 < w.segments[0].first {
+		return errors.Wrapf(ErrCompacted, "truncate after %d", seq)
+	}
+
+	i := w.find(seq + 1)
+	for len(w.segments) > i+1 {
+		if err := w.removeSegment(w.tail()); err != nil {
+			return err
+		}
+		w.segments = w.segments[:len(w.segments)-1]
+		w.next = w.tail().last() + 1
+	}
+	seg := w.tail()
+	if seg.bf.w == nil {
+		// sealed, it's the last one now
+		bf, err := NewBlockFile(seg.bf.fn, seg.bf.id, false, w.opts.FDPool)
+		if err != nil {
+			return err
+		}
+		seg.bf = bf
+	}
+	k := seq + 1 - seg.first
+	if err := seg.bf.Truncate(seg.offsets[k]); err != nil {
+		return err
+	}
+	seg.offsets = seg.offsets[:k]
+	w.next = seq + 1
+	w.unsynced = 0
+	if err := seg.bf.Sync(); err != nil {
+		w.failed = errors.Wrap(err, "unable to sync segment")
+		return w.failed
+	}
+	return nil
+}
+
+func (w *WAL) removeSegment(seg *segment) error {
+	if err := seg.bf.Close(); err != nil {
+		return errors.Wrap(err, "unable to close segment")
+	}
+	// a segment created later may get the name
+	w.opts.FDPool.Evict(seg.bf.fn)
+	if err := os.Remove(seg.bf.fn); err != nil {
+		return errors.Wrap(err, "unable to remove segment")
+	}
+	return syncDir(w.dir)
+}
+
+// read returns the entry of seq, false if not appended yet.
+func (w *WAL) read(seq uint64) ([]byte, bool, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if w.segments == nil {
+		return nil, false, ErrClosed
+	}
+	if seq >= w.next {
+		return nil, false, nil
+	}
+	if seq < w.segments[0].first {
+		return nil, false, errors.Wrapf(ErrCompacted, "entry %d", seq)
+	}
+	seg := w.segments[w.find(seq)]
+	off := seg.offsets[seq-seg.first]
+	got, val, _, err := readRecord(seg.bf, off, seg.bf.Size())
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "entry %d", seq)
+	}
+	if got != seq {
+		return nil, false, errors.Wrapf(ErrCorrupted, "entry %d read as %d", seq, got)
+	}
+	return val, true, nil
+}
+
+// ReadFrom iterates the entries from seq on, including the ones appended
+// while iterating.
+func (w *WAL) ReadFrom(seq uint64) *Iterator {
+	return &Iterator{w: w, next: seq}
+}
+
+type Iterator struct {
+	w    *WAL
+	next uint64
+
+	seq uint64
+	val []byte
+	err error
+}
+
+// Next moves to the next entry, false if no more or failed.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	val, ok, err := it.w.read(it.next)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if !ok {
+		return false
+	}
+	it.seq, it.val = it.next, val
+	it.next++
+	return true
+}
+
+func (it *Iterator) Seq() uint64 {
+	return it.seq
+}
+
+func (it *Iterator) Value() []byte {
+	return it.val
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (w *WAL) closeSegments() error {
+	var err error
+	for _, seg := range w.segments {
+		if e := seg.bf.Close(); e != nil && err == nil {
+			err = errors.Wrap(e, "unable to close segment")
+		}
+	}
+	w.segments = nil
+	if w.fdCache != nil {
+		w.fdCache.Close()
+	}
+	return err
+}
+
+// Close syncs and closes the wal, the appenders not committed yet get
+// ErrClosed.
+func (w *WAL) Close() error {
+	w.stopOnce.Do(func() { close(w.stopCh) })
+	w.committed.Wait()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.closeSegments()
+}
@@ -0,0 +1,395 @@
+package wal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func walOpts() Opts {
+	opts := DefaultOpts
+	opts.SegmentSize = 256
+	return opts
+}
+
+func entry(seq uint64) []byte {
+	return []byte(fmt.Sprintf("entry-%d", seq))
+}
+
+func appendEntries(t *testing.T, w *WAL, from, to uint64) {
+	for seq := from; seq <= to; seq++ {
+		got, err := w.Append(entry(seq))
+		ensure(t, assert.Nil(t, err))
+		ensure(t, assert.Equal(t, seq, got))
+	}
+}
+
+func checkEntries(t *testing.T, w *WAL, from, to uint64) {
+	it := w.ReadFrom(from)
+	seq := from
+	for it.Next() {
+		ensure(t, assert.Equal(t, seq, it.Seq()))
+		ensure(t, assert.Equal(t, entry(seq), it.Value()))
+		seq++
+	}
+	ensure(t, assert.Nil(t, it.Err()))
+	ensure(t, assert.Equal(t, to+1, seq))
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	ensure(t, assert.Nil(t, err))
+	return files
+}
+
+func TestWALAppendRead(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_wal_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	w, err := Open(tmpdir, walOpts())
+	ensure(t, assert.Nil(t, err))
+	ensure(t, assert.Equal(t, uint64(1), w.FirstSeq()))
+	ensure(t, assert.Equal(t, uint64(0), w.LastSeq()))
+
+	appendEntries(t, w, 1, 100)
+	ensure(t, assert.True(t, len(segmentFiles(t, tmpdir)) > 1))
+	checkEntries(t, w, 1, 100)
+	checkEntries(t, w, 42, 100)
+	ensure(t, assert.False(t, w.ReadFrom(101).Next()))
+	ensure(t, assert.Nil(t, w.Close()))
+
+	// reopen
+	w, err = Open(tmpdir, walOpts())
+	ensure(t, assert.Nil(t, err))
+	defer w.Close()
+	ensure(t, assert.Equal(t, uint64(100), w.LastSeq()))
+	checkEntries(t, w, 1, 100)
+	appendEntries(t, w, 101, 120)
+	checkEntries(t, w, 1, 120)
+}
+
+func TestWALTruncateBefore(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_wal_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	w, err := Open(tmpdir, walOpts())
+	ensure(t, assert.Nil(t, err))
+	defer w.Close()
+	appendEntries(t, w, 1, 100)
+	segments := len(segmentFiles(t, tmpdir))
+
+	ensure(t, assert.Nil(t, w.TruncateBefore(50)))
+	first := w.FirstSeq()
+	ensure(t, assert.True(t, first > 1 && first <= 50))
+	ensure(t, assert.True(t, len(segmentFiles(t, tmpdir)) < segments))
+	checkEntries(t, w, first, 100)
+
+	it := w.ReadFrom(1)
+	ensure(t, assert.False(t, it.Next()))
+	ensure(t, assert.Equal(t, ErrCompacted, errors.Cause(it.Err())))
+
+	// the last segment kept
+	ensure(t, assert.Nil(t, w.TruncateBefore(1000)))
+	ensure(t, assert.Equal(t, 1, len(segmentFiles(t, tmpdir))))
+	ensure(t, assert.Equal(t, uint64(100), w.LastSeq()))
+	appendEntries(t, w, 101, 110)
+	checkEntries(t, w, w.FirstSeq(), 110)
+}
+
+func TestWALTruncateAfter(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_wal_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	w, err := Open(tmpdir, walOpts())
+	ensure(t, assert.Nil(t, err))
+	appendEntries(t, w, 1, 100)
+
+	ensure(t, assert.Nil(t, w.TruncateAfter(30)))
+	ensure(t, assert.Equal(t, uint64(30), w.LastSeq()))
+	checkEntries(t, w, 1, 30)
+	appendEntries(t, w, 31, 60)
+	checkEntries(t, w, 1, 60)
+
+	ensure(t, assert.Nil(t, w.TruncateAfter(0)))
+	ensure(t, assert.Equal(t, uint64(0), w.LastSeq()))
+	ensure(t, assert.False(t, w.ReadFrom(1).Next()))
+	appendEntries(t, w, 1, 10)
+	ensure(t, assert.Nil(t, w.Close()))
+
+	w, err = Open(tmpdir, walOpts())
+	ensure(t, assert.Nil(t, err))
+	defer w.Close()
+	checkEntries(t, w, 1, 10)
+}
+
+func TestWALRepairTornTail(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_wal_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	w, err := Open(tmpdir, walOpts())
+	ensure(t, assert.Nil(t, err))
+	appendEntries(t, w, 1, 50)
+	ensure(t, assert.Nil(t, w.Close()))
+
+	// cut the last record in half, then some garbage
+	files := segmentFiles(t, tmpdir)
+	last := files[len(files)-1]
+	stat, err := os.Stat(last)
+	ensure(t, assert.Nil(t, err))
+	ensure(t, assert.Nil(t, os.Truncate(last, stat.Size()-5)))
+	f, err := os.OpenFile(last, os.O_APPEND|os.O_WRONLY, 0)
+	ensure(t, assert.Nil(t, err))
+	_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5})
+	ensure(t, assert.Nil(t, err))
+	ensure(t, assert.Nil(t, f.Close()))
+
+	w, err = Open(tmpdir, walOpts())
+	ensure(t, assert.Nil(t, err))
+	defer w.Close()
+	ensure(t, assert.Equal(t, uint64(49), w.LastSeq()))
+	checkEntries(t, w, 1, 49)
+	appendEntries(t, w, 50, 60)
+	checkEntries(t, w, 1, 60)
+}
+
+func TestWALCorruptedSealedSegment(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_wal_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	w, err := Open(tmpdir, walOpts())
+	ensure(t, assert.Nil(t, err))
+	appendEntries(t, w, 1, 50)
+	ensure(t, assert.Nil(t, w.Close()))
+
+	files := segmentFiles(t, tmpdir)
+	f, err := os.OpenFile(files[0], os.O_WRONLY, 0)
+	ensure(t, assert.Nil(t, err))
+	_, err = f.WriteAt([]byte("x"), prefixSize+seqSize)
+	ensure(t, assert.Nil(t, err))
+	ensure(t, assert.Nil(t, f.Close()))
+
+	_, err = Open(tmpdir, walOpts())
+	ensure(t, assert.Equal(t, ErrCrcMismatch, errors.Cause(err)))
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_wal_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	w, err := Open(tmpdir, walOpts())
+	ensure(t, assert.Nil(t, err))
+
+	const appenders, entries = 8, 200
+	var wg sync.WaitGroup
+	seqs := make([][]uint64, appenders)
+	for i := 0; i < appenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < entries; j++ {
+				seq, err := w.Append([]byte(fmt.Sprintf("appender-%d-%d", i, j)))
+				if !assert.Nil(t, err) {
+					return
+				}
+				seqs[i] = append(seqs[i], seq)
+			}
+		}(i)
+	}
+	wg.Wait()
+	ensure(t, assert.Equal(t, uint64(appenders*entries), w.LastSeq()))
+
+	seen := make(map[uint64]bool)
+	for i := range seqs {
+		ensure(t, assert.Equal(t, entries, len(seqs[i])))
+		for j, seq := range seqs[i] {
+			ensure(t, assert.False(t, seen[seq]))
+			seen[seq] = true
+			if j > 0 {
+				ensure(t, assert.True(t, seq > seqs[i][j-1]))
+			}
+		}
+	}
+	ensure(t, assert.Nil(t, w.Close()))
+
+	w, err = Open(tmpdir, walOpts())
+	ensure(t, assert.Nil(t, err))
+	defer w.Close()
+	for i := range seqs {
+		for j, seq := range seqs[i] {
+			it := w.ReadFrom(seq)
+			ensure(t, assert.True(t, it.Next()))
+			ensure(t, assert.Equal(t, fmt.Sprintf("appender-%d-%d", i, j), string(it.Value())))
+		}
+	}
+
+	_, err = w.Append([]byte("x"))
+	ensure(t, assert.Nil(t, err))
+	ensure(t, assert.Nil(t, w.Close()))
+	_, err = w.Append([]byte("x"))
+	ensure(t, assert.Equal(t, ErrClosed, err))
+}
+
+func unsyncedBytes(w *WAL) int64 {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.unsynced
+}
+
+func TestWALSyncPolicy(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_wal_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	opts := DefaultOpts
+	opts.SyncPolicy = SyncAlways
+	w, err := Open(filepath.Join(tmpdir, "always"), opts)
+	ensure(t, assert.Nil(t, err))
+	appendEntries(t, w, 1, 10)
+	ensure(t, assert.Equal(t, int64(0), unsyncedBytes(w)))
+	ensure(t, assert.Nil(t, w.Close()))
+
+	opts.SyncPolicy = SyncNever
+	w, err = Open(filepath.Join(tmpdir, "never"), opts)
+	ensure(t, assert.Nil(t, err))
+	appendEntries(t, w, 1, 10)
+	ensure(t, assert.True(t, unsyncedBytes(w) > 0))
+	ensure(t, assert.Nil(t, w.Sync()))
+	ensure(t, assert.Equal(t, int64(0), unsyncedBytes(w)))
+	ensure(t, assert.Nil(t, w.Close()))
+
+	opts.SyncPolicy = SyncBatchBytes
+	opts.SyncBytes = 100
+	w, err = Open(filepath.Join(tmpdir, "bytes"), opts)
+	ensure(t, assert.Nil(t, err))
+	appendEntries(t, w, 1, 1)
+	ensure(t, assert.True(t, unsyncedBytes(w) > 0))
+	appendEntries(t, w, 2, 10)
+	ensure(t, assert.True(t, unsyncedBytes(w) < opts.SyncBytes))
+	ensure(t, assert.Nil(t, w.Close()))
+
+	opts.SyncPolicy = SyncPeriodic
+	opts.SyncInterval = 5 * time.Millisecond
+	w, err = Open(filepath.Join(tmpdir, "periodic"), opts)
+	ensure(t, assert.Nil(t, err))
+	defer w.Close()
+	appendEntries(t, w, 1, 10)
+	ensure(t, assert.Eventually(t, func() bool { return unsyncedBytes(w) == 0 }, time.Second, opts.SyncInterval))
+}
+
+func TestWALWriteFailed(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_wal_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	w, err := Open(tmpdir, DefaultOpts)
+	ensure(t, assert.Nil(t, err))
+	defer w.Close()
+	appendEntries(t, w, 1, 10)
+
+	// neither written nor truncated by a readonly fd
+	seg := w.tail()
+	fd, err := os.Open(seg.bf.fn)
+	ensure(t, assert.Nil(t, err))
+	ensure(t, assert.Nil(t, seg.bf.w.Close()))
+	seg.bf.w = fd
+
+	_, err = w.Append([]byte("x"))
+	ensure(t, assert.NotNil(t, err))
+	// failed for good
+	_, err2 := w.Append([]byte("x"))
+	ensure(t, assert.Equal(t, err, err2))
+	ensure(t, assert.Equal(t, uint64(10), w.LastSeq()))
+	checkEntries(t, w, 1, 10)
+}
+
+func TestWALRollFailed(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_wal_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	w, err := Open(tmpdir, walOpts())
+	ensure(t, assert.Nil(t, err))
+	defer w.Close()
+	seq := uint64(1)
+	for ; w.tail().bf.Size() < w.opts.SegmentSize; seq++ {
+		appendEntries(t, w, seq, seq)
+	}
+
+	// the segment sealed can't be reopened
+	ensure(t, assert.Nil(t, os.Remove(w.tail().bf.fn)))
+	_, err = w.Append(entry(seq))
+	ensure(t, assert.NotNil(t, err))
+	// failed for good, never written into the segment closed
+	_, err2 := w.Append(entry(seq))
+	ensure(t, assert.Equal(t, err, err2))
+	ensure(t, assert.Equal(t, seq-1, w.LastSeq()))
+}
+
+func TestWALCorruptedTailSegment(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_wal_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	w, err := Open(tmpdir, DefaultOpts)
+	ensure(t, assert.Nil(t, err))
+	appendEntries(t, w, 1, 50)
+	ensure(t, assert.Nil(t, w.Close()))
+
+	// the entries after the one corrupted not taken as torn
+	files := segmentFiles(t, tmpdir)
+	ensure(t, assert.Equal(t, 1, len(files)))
+	stat, err := os.Stat(files[0])
+	ensure(t, assert.Nil(t, err))
+	f, err := os.OpenFile(files[0], os.O_WRONLY, 0)
+	ensure(t, assert.Nil(t, err))
+	_, err = f.WriteAt([]byte("x"), prefixSize+seqSize)
+	ensure(t, assert.Nil(t, err))
+	ensure(t, assert.Nil(t, f.Close()))
+
+	_, err = Open(tmpdir, DefaultOpts)
+	ensure(t, assert.Equal(t, ErrCorrupted, errors.Cause(err)))
+	stat2, err := os.Stat(files[0])
+	ensure(t, assert.Nil(t, err))
+	ensure(t, assert.Equal(t, stat.Size(), stat2.Size()))
+}
+
+func TestWALSyncFailed(t *testing.T) {
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test_wal_")
+	ensure(t, assert.Nil(t, err))
+	defer os.RemoveAll(tmpdir)
+
+	opts := DefaultOpts
+	opts.SyncPolicy = SyncNever
+	w, err := Open(tmpdir, opts)
+	ensure(t, assert.Nil(t, err))
+	defer w.Close()
+	appendEntries(t, w, 1, 10)
+
+	// the fsync fails on the fd closed
+	ensure(t, assert.Nil(t, w.tail().bf.w.Close()))
+	err = w.Sync()
+	ensure(t, assert.NotNil(t, err))
+
+	// failed for good, though the fd reopened
+	fd, err2 := os.OpenFile(w.tail().bf.fn, os.O_APPEND|os.O_RDWR, 0)
+	ensure(t, assert.Nil(t, err2))
+	w.tail().bf.w = fd
+	ensure(t, assert.Equal(t, err, w.Sync()))
+	_, err2 = w.Append([]byte("x"))
+	ensure(t, assert.Equal(t, err, err2))
+	ensure(t, assert.Equal(t, err, w.TruncateAfter(5)))
+	ensure(t, assert.Equal(t, uint64(10), w.LastSeq()))
+}